@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AssignmentStrategy decides which client consumes each shard, given the shards and clients
+// both sorted by ID. Every client of an application must use the same strategy.
+type AssignmentStrategy int
+
+const (
+	// AssignmentModulo gives shard i to client i % clients. This is the default.
+	AssignmentModulo AssignmentStrategy = iota
+	// AssignmentContiguous gives each client a contiguous range of shards, so that shards created
+	// around the same time, such as the children of a reshard, are mostly consumed by the same client.
+	AssignmentContiguous
+	// AssignmentZoneSpread interleaves the clients of each availability zone, so that every client
+	// consumes as many shards as with the modulo strategy while the shards are spread evenly across
+	// zones. Clients register their zone with Config.WithAvailabilityZone.
+	AssignmentZoneSpread
+	// AssignmentZoneAffinity divides the shards evenly between the availability zones first, then
+	// between the clients of each zone, so the shards of a client that stopped stay in its zone as
+	// long as the zone has other clients. Clients of small zones may consume more shards than others.
+	AssignmentZoneAffinity
+)
+
+// String returns the name of the strategy
+func (s AssignmentStrategy) String() string {
+	switch s {
+	case AssignmentModulo:
+		return "modulo"
+	case AssignmentContiguous:
+		return "contiguous"
+	case AssignmentZoneSpread:
+		return "zone-spread"
+	case AssignmentZoneAffinity:
+		return "zone-affinity"
+	}
+	return fmt.Sprintf("AssignmentStrategy(%d)", int(s))
+}
+
+// zoned returns whether the strategy takes the availability zones of the clients into account
+func (s AssignmentStrategy) zoned() bool {
+	return s == AssignmentZoneSpread || s == AssignmentZoneAffinity
+}
+
+// shardOwner returns the index of the client that should consume the shard at the given index,
+// or -1 if there are no clients. The zoned strategies assume all the clients are in the same zone.
+func (s AssignmentStrategy) shardOwner(shard, totalShards, totalClients int) int {
+	if totalClients <= 0 {
+		return -1
+	}
+	switch s {
+	case AssignmentContiguous:
+		// Clients past the number of shards get nothing, like with the modulo strategy
+		if totalClients > totalShards {
+			totalClients = totalShards
+		}
+		// Client c owns the shards in [c*totalShards/totalClients, (c+1)*totalShards/totalClients)
+		return ((shard+1)*totalClients - 1) / totalShards
+	default:
+		return shard % totalClients
+	}
+}
+
+// zonedShardOwner returns the index of the client that should consume the shard at the given index,
+// given the availability zone of each client, or -1 if there are no clients.
+func (s AssignmentStrategy) zonedShardOwner(shard, totalShards int, zones []string) int {
+	if !s.zoned() || len(zones) == 0 {
+		return s.shardOwner(shard, totalShards, len(zones))
+	}
+
+	// The clients of each zone, zones sorted by name
+	byZone := make(map[string][]int)
+	var names []string
+	for i, zone := range zones {
+		if _, ok := byZone[zone]; !ok {
+			names = append(names, zone)
+		}
+		byZone[zone] = append(byZone[zone], i)
+	}
+	sort.Strings(names)
+
+	if s == AssignmentZoneAffinity {
+		clients := byZone[names[shard%len(names)]]
+		return clients[(shard/len(names))%len(clients)]
+	}
+	var interleaved []int
+	for round := 0; len(interleaved) < len(zones); round++ {
+		for _, name := range names {
+			if clients := byZone[name]; round < len(clients) {
+				interleaved = append(interleaved, clients[round])
+			}
+		}
+	}
+	return interleaved[shard%len(interleaved)]
+}
+
+// AssignmentSimulation is the outcome of SimulateAssignment
+type AssignmentSimulation struct {
+	// Strategy that was simulated
+	Strategy AssignmentStrategy
+	// Number of clients and shards currently in dynamo, that the simulation is compared to
+	CurrentClients int
+	CurrentShards  int
+	// Number of shards each client would consume, indexed by the client's position in the
+	// sorted list of clients
+	ShardsPerClient []int
+	// Fewest and most shards consumed by a single client
+	MinShards int
+	MaxShards int
+	// Number of current shards that would be consumed by a different client than today,
+	// and have to be released by their owner and captured again
+	MovedShards int
+}
+
+// simulateAssignment computes the assignment of shards to clients with the given strategy, and how
+// many shards move compared to the current assignment. Existing shards and clients are assumed to keep
+// their position in the sorted lists, with new ones added at the end.
+func simulateAssignment(strategy AssignmentStrategy, currentStrategy AssignmentStrategy,
+	currentClients, currentShards, clients, shards int) *AssignmentSimulation {
+	sim := &AssignmentSimulation{
+		Strategy:        strategy,
+		CurrentClients:  currentClients,
+		CurrentShards:   currentShards,
+		ShardsPerClient: make([]int, clients),
+	}
+
+	for i := 0; i < shards; i++ {
+		owner := strategy.shardOwner(i, shards, clients)
+		sim.ShardsPerClient[owner]++
+		if i < currentShards && currentClients > 0 && owner != currentStrategy.shardOwner(i, currentShards, currentClients) {
+			sim.MovedShards++
+		}
+	}
+
+	sim.MinShards = shards
+	for _, n := range sim.ShardsPerClient {
+		if n < sim.MinShards {
+			sim.MinShards = n
+		}
+		if n > sim.MaxShards {
+			sim.MaxShards = n
+		}
+	}
+	return sim
+}
+
+// SimulateAssignment previews how shards would be distributed by the given strategy if the
+// application ran with the given number of clients on a stream with the given number of shards, and
+// how many shards would change owner compared to the current clients and shards, assigned with the
+// configured strategy. It doesn't change anything, so it can be used to plan scaling the fleet or the
+// stream. The simulation assumes existing clients and shards keep their place in the ordering, while
+// new client IDs are random and can be sorted anywhere, so the actual movement may be larger.
+func (k *Kinsumer) SimulateAssignment(clients int, shards int, strategy AssignmentStrategy) (*AssignmentSimulation, error) {
+	if clients <= 0 || shards < 0 {
+		return nil, ErrInvalidAssignmentSimulation
+	}
+
+	current, err := getClients(k.dynamodb, k.clientID(), k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	shardCache, err := loadShardCacheFromDynamo(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return nil, err
+	}
+	var currentShards int
+	if shardCache != nil && len(shardCache.ShardIDs) > 0 {
+		currentShards = len(shardCache.ShardIDs)
+	} else {
+		list, err := k.listShards()
+		if err != nil {
+			return nil, err
+		}
+		currentShards = len(list)
+	}
+
+	return simulateAssignment(strategy, k.config.assignmentStrategy, len(current), currentShards, clients, shards), nil
+}
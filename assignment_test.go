@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateAssignment(t *testing.T) {
+	sim := simulateAssignment(AssignmentModulo, AssignmentModulo, 2, 10, 3, 10)
+	require.Equal(t, []int{4, 3, 3}, sim.ShardsPerClient)
+	require.Equal(t, 3, sim.MinShards)
+	require.Equal(t, 4, sim.MaxShards)
+	require.Equal(t, 6, sim.MovedShards)
+
+	sim = simulateAssignment(AssignmentContiguous, AssignmentContiguous, 2, 10, 3, 10)
+	require.Equal(t, []int{3, 3, 4}, sim.ShardsPerClient)
+	require.Equal(t, 6, sim.MovedShards)
+
+	// Clients past the number of shards get nothing
+	sim = simulateAssignment(AssignmentContiguous, AssignmentModulo, 0, 0, 5, 3)
+	require.Equal(t, []int{1, 1, 1, 0, 0}, sim.ShardsPerClient)
+	require.Equal(t, 0, sim.MinShards)
+	require.Equal(t, 0, sim.MovedShards)
+
+	// New shards don't count as moved
+	sim = simulateAssignment(AssignmentModulo, AssignmentModulo, 2, 4, 2, 8)
+	require.Equal(t, []int{4, 4}, sim.ShardsPerClient)
+	require.Equal(t, 0, sim.MovedShards)
+}
+
+func TestZonedShardOwner(t *testing.T) {
+	owners := func(strategy AssignmentStrategy, shards int, zones []string) []int {
+		var result []int
+		for i := 0; i < shards; i++ {
+			result = append(result, strategy.zonedShardOwner(i, shards, zones))
+		}
+		return result
+	}
+	zones := []string{"b", "a", "a", "b", "c"}
+
+	// Clients interleaved by zone: a1, b0, c4, a2, b3
+	require.Equal(t, []int{1, 0, 4, 2, 3, 1, 0}, owners(AssignmentZoneSpread, 7, zones))
+	// Zones take turns, then their clients: a1, b0, c4, a2, b3, c4
+	require.Equal(t, []int{1, 0, 4, 2, 3, 4}, owners(AssignmentZoneAffinity, 6, zones))
+
+	// After a client of zone b stopped, its shards went to the other client of the zone
+	require.Equal(t, []int{1, 0, 3, 2, 0, 3}, owners(AssignmentZoneAffinity, 6, []string{"b", "a", "a", "c"}))
+
+	// Without zones the strategies are the same as modulo
+	require.Equal(t, []int{0, 1, 2, 0}, owners(AssignmentZoneSpread, 4, make([]string, 3)))
+	require.Equal(t, []int{0, 1, 2, 0}, owners(AssignmentZoneAffinity, 4, make([]string, 3)))
+	require.Equal(t, []int{0, 0, 1, 1}, owners(AssignmentContiguous, 4, zones[:2]))
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// A BackoffPolicy decides how long kinsumer waits before retrying a request that was throttled
+// by kinesis or dynamo. Its methods are called from multiple go routines.
+type BackoffPolicy interface {
+	// Delay returns how long to wait after the given number of consecutive throttled requests,
+	// starting at 1
+	Delay(throttles int) time.Duration
+}
+
+// ExponentialBackoff is a BackoffPolicy that doubles the delay after every consecutive throttled
+// request, from Base up to Max, and waits a random time between half the delay and the full delay
+// so that clients throttled at the same time don't retry at the same time.
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+var (
+	jitterMutex sync.Mutex
+	jitter      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay implementation with exponential growth and jitter
+func (b ExponentialBackoff) Delay(throttles int) time.Duration {
+	delay := b.Max
+	if throttles < 1 {
+		throttles = 1
+	}
+	// Stop shifting before overflowing, the delay is capped by Max anyway
+	if throttles < 32 && b.Base<<uint(throttles-1) < b.Max {
+		delay = b.Base << uint(throttles-1)
+	}
+	if delay <= 1 {
+		return delay
+	}
+
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// backoff tracks the consecutive throttled requests of a single kind of operation
+type backoff struct {
+	policy    BackoffPolicy
+	throttles int
+	until     time.Time
+}
+
+// throttled records a throttled request and returns how long to wait before the next one
+func (b *backoff) throttled(now time.Time) time.Duration {
+	b.throttles++
+	delay := b.policy.Delay(b.throttles)
+	b.until = now.Add(delay)
+	return delay
+}
+
+// ready returns whether we are done waiting after the last throttled request
+func (b *backoff) ready(now time.Time) bool {
+	return !now.Before(b.until)
+}
+
+// reset is called after a request succeeded
+func (b *backoff) reset() {
+	b.throttles = 0
+	b.until = time.Time{}
+}
+
+// isThrottle returns whether the error means the request was throttled by AWS
+func isThrottle(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	return request.IsErrorThrottle(awsErr) || awsErr.Code() == kinesis.ErrCodeLimitExceededException
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+	for i := 0; i < 100; i++ {
+		delay := b.Delay(1)
+		require.True(t, delay >= 50*time.Millisecond && delay <= 100*time.Millisecond, delay)
+		delay = b.Delay(3)
+		require.True(t, delay >= 200*time.Millisecond && delay <= 400*time.Millisecond, delay)
+		delay = b.Delay(64)
+		require.True(t, delay >= 500*time.Millisecond && delay <= time.Second, delay)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{policy: ExponentialBackoff{Base: time.Second, Max: time.Minute}}
+	now := time.Now()
+	require.True(t, b.ready(now))
+
+	delay := b.throttled(now)
+	require.False(t, b.ready(now))
+	require.True(t, b.ready(now.Add(delay)))
+	require.Equal(t, 1, b.throttles)
+
+	b.reset()
+	require.True(t, b.ready(now))
+	require.Equal(t, 0, b.throttles)
+}
+
+func TestIsThrottle(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	require.True(t, isThrottle(throttled))
+	require.True(t, isThrottle(fmt.Errorf("error committing checkpoint: %w", throttled)))
+	require.False(t, isThrottle(awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "nope", nil)))
+	require.False(t, isThrottle(errors.New("some error")))
+	require.False(t, isThrottle(nil))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const bookmarkKeyPrefix = "Bookmark:"
+
+type bookmarkRecord struct {
+	Key             string            // "Bookmark:" followed by the name of the bookmark
+	SequenceNumbers map[string]string // last checkpointed sequence number by shard ID
+	LastUpdate      int64             // timestamp of when the bookmark was saved
+
+	// Debug versions of LastUpdate
+	LastUpdateRFC string
+}
+
+// SaveBookmark stores the current checkpoint of every shard in the metadata table under the
+// given name, overwriting any bookmark previously saved with that name.
+func (k *Kinsumer) SaveBookmark(name string) error {
+	checkpoints, err := loadCheckpoints(k.dynamodb, k.checkpointTableName)
+	if err != nil {
+		return fmt.Errorf("error loading checkpoints: %v", err)
+	}
+	checkpoints = k.streamCheckpoints(checkpoints)
+
+	sequenceNumbers := make(map[string]string, len(checkpoints))
+	for shardID, checkpoint := range checkpoints {
+		if checkpoint.SequenceNumber != nil && *checkpoint.SequenceNumber != "" {
+			sequenceNumbers[shardID] = *checkpoint.SequenceNumber
+		}
+	}
+
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(&bookmarkRecord{
+		Key:             bookmarkKeyPrefix + name,
+		SequenceNumbers: sequenceNumbers,
+		LastUpdate:      now.UnixNano(),
+		LastUpdateRFC:   now.UTC().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling bookmark: %v", err)
+	}
+
+	if _, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(k.metadataTableName),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("error saving bookmark: %v", err)
+	}
+	return nil
+}
+
+// ResumeFromBookmark makes the next Run() start every shard from the position saved in the given
+// bookmark, replacing any checkpoint written before the run started, as with WithIgnoreCheckpoints.
+// Shards created after the bookmark was saved are consumed from the configured shard iterator type,
+// and shards that have been finished since are not consumed again.
+func (k *Kinsumer) ResumeFromBookmark(name string) error {
+	if atomic.LoadInt32(&k.numberOfRuns) != 0 {
+		return ErrResumeAfterRun
+	}
+
+	resp, err := k.dynamodb.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(k.metadataTableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(bookmarkKeyPrefix + name)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error loading bookmark: %v", err)
+	}
+	if len(resp.Item) == 0 {
+		return ErrNoSuchBookmark
+	}
+
+	var record bookmarkRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return err
+	}
+	k.bookmark = record.SequenceNumbers
+	if k.bookmark == nil {
+		k.bookmark = make(map[string]string)
+	}
+	return nil
+}
+
+// DeleteBookmark removes the bookmark with the given name from the metadata table.
+func (k *Kinsumer) DeleteBookmark(name string) error {
+	if _, err := k.dynamodb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(k.metadataTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(bookmarkKeyPrefix + name)},
+		},
+	}); err != nil {
+		return fmt.Errorf("error deleting bookmark: %v", err)
+	}
+	return nil
+}
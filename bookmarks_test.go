@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// newBookmarkKinsumer returns a Kinsumer using the given mock dynamo, which has the checkpoints of
+// the given shards
+func newBookmarkKinsumer(t *testing.T, db dynamodbiface.DynamoDBAPI, checkpoints map[string]string) *Kinsumer {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	for shardID, sequenceNumber := range checkpoints {
+		record := checkpointRecord{Shard: shardID}
+		if sequenceNumber != "" {
+			record.SequenceNumber = aws.String(sequenceNumber)
+		}
+		item, err := dynamodbattribute.MarshalMap(&record)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(k.checkpointTableName), Item: item})
+		require.NoError(t, err)
+	}
+	return k
+}
+
+func newBookmarkDynamo() dynamodbiface.DynamoDBAPI {
+	return mocks.NewMockDynamo([]string{"app_checkpoints", "app_metadata"})
+}
+
+func TestBookmarkRoundTrip(t *testing.T) {
+	db := newBookmarkDynamo()
+	k := newBookmarkKinsumer(t, db, map[string]string{"shard-1": "10", "shard-2": "20", "unread": ""})
+	require.NoError(t, k.SaveBookmark("before-deploy"))
+
+	// Another client resumes from it, the shards never read are left out
+	resumed := newBookmarkKinsumer(t, db, nil)
+	require.NoError(t, resumed.ResumeFromBookmark("before-deploy"))
+	require.Equal(t, map[string]string{"shard-1": "10", "shard-2": "20"}, resumed.bookmark)
+	require.True(t, resumed.replacesCheckpoints())
+}
+
+func TestResumeFromMissingBookmark(t *testing.T) {
+	k := newBookmarkKinsumer(t, newBookmarkDynamo(), map[string]string{"shard-1": "10"})
+	require.True(t, errors.Is(k.ResumeFromBookmark("missing"), ErrNoSuchBookmark))
+	require.Nil(t, k.bookmark)
+}
+
+func TestResumeFromBookmarkOfGoneShards(t *testing.T) {
+	db := newBookmarkDynamo()
+	k := newBookmarkKinsumer(t, db, map[string]string{"gone": "10", "kept": "20"})
+	require.NoError(t, k.SaveBookmark("old"))
+
+	// The stream was resharded since, the shards of the bookmark that are gone are never captured
+	resumed := newBookmarkKinsumer(t, db, nil)
+	require.NoError(t, resumed.ResumeFromBookmark("old"))
+	startedAt := time.Now()
+	resumed.runStartedAt = startedAt
+	checkpoint := func(shardID string) *checkpointer {
+		return &checkpointer{
+			shardID:            shardID,
+			tableName:          resumed.checkpointTableName,
+			dynamodb:           db,
+			stats:              &NoopStatReceiver{},
+			sequenceNumber:     "30",
+			capturedLastUpdate: startedAt.Add(-time.Hour).UnixNano(),
+		}
+	}
+
+	cp := checkpoint("kept")
+	require.NoError(t, resumed.replaceStaleCheckpoint(cp))
+	require.Equal(t, "20", cp.sequenceNumber)
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("20"), resumed.startingPosition("kept", cp.sequenceNumber))
+
+	// A shard created after the bookmark starts from the configured position
+	cp = checkpoint("new")
+	require.NoError(t, resumed.replaceStaleCheckpoint(cp))
+	require.Equal(t, "", cp.sequenceNumber)
+}
+
+func TestDeleteBookmark(t *testing.T) {
+	db := newBookmarkDynamo()
+	k := newBookmarkKinsumer(t, db, map[string]string{"shard-1": "10"})
+	require.NoError(t, k.SaveBookmark("kept"))
+	require.NoError(t, k.SaveBookmark("deleted"))
+
+	require.NoError(t, k.DeleteBookmark("deleted"))
+	require.True(t, errors.Is(k.ResumeFromBookmark("deleted"), ErrNoSuchBookmark))
+	require.NoError(t, k.ResumeFromBookmark("kept"))
+	require.Equal(t, map[string]string{"shard-1": "10"}, k.bookmark)
+
+	// Deleting a bookmark that doesn't exist is not an error
+	require.NoError(t, k.DeleteBookmark("deleted"))
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// bufferOverflowPolicy is what the shard consumers do when the combined records buffer is full
+type bufferOverflowPolicy int
+
+const (
+	// bufferOverflowBlock makes the shard consumers wait until there is room in the buffer
+	bufferOverflowBlock bufferOverflowPolicy = iota
+	// bufferOverflowDropOldest drops the oldest record in the buffer to make room for the new one
+	bufferOverflowDropOldest
+	// bufferOverflowSpill writes the records that don't fit in the buffer to a file on disk
+	bufferOverflowSpill
+)
+
+// bufferRecord puts the record on the combined records buffer, or the buffer of its shard with shard
+// buffers, according to the configured overflow policy, committing the checkpoint while it waits.
+// Returns false if the consumer should stop.
+func (k *Kinsumer) bufferRecord(cr *consumedRecord, commitTicker *time.Ticker, commitBackoff *backoff) bool {
+	shardID := cr.checkpointer.shardID
+	// The combined buffer is locked while we put the record on it, as UpdateConfig can replace it.
+	// The shard buffers are not replaced.
+	lock := k.lockBuffer
+	if k.shardBuffers != nil {
+		buffer := k.shardBuffers.get(shardID)
+		lock = func() (chan *consumedRecord, <-chan struct{}, func()) { return buffer, nil, func() {} }
+		defer k.shardBuffers.notify()
+	}
+	if k.config.bufferOverflowPolicy == bufferOverflowBlock {
+		buffer, _, unlock := lock()
+		select {
+		case buffer <- cr:
+			unlock()
+			return true
+		default:
+		}
+		unlock()
+		if stats, ok := k.config.stats.(BufferStatReceiver); ok {
+			blockedAt := time.Now()
+			defer func() { stats.BufferBlocked(shardID, time.Since(blockedAt)) }()
+		}
+	}
+	for {
+		// buffer is nil while it is being replaced, replacing is closed once it was
+		buffer, replacing, unlock := lock()
+		switch k.config.bufferOverflowPolicy {
+		case bufferOverflowDropOldest:
+			if buffer != nil {
+				k.bufferDropOldest(buffer, cr)
+				unlock()
+				return true
+			}
+		case bufferOverflowSpill:
+			ok, err := k.spill.put(cr, buffer)
+			if err != nil {
+				unlock()
+				k.shardErrors <- shardConsumerError{shardID: shardID, action: "spill.put", err: err}
+				return false
+			}
+			if ok {
+				unlock()
+				return true
+			}
+		}
+
+		// Wait until the record is buffered, or there may be room in the spill file
+		var wait <-chan time.Time
+		var records chan *consumedRecord
+		if k.config.bufferOverflowPolicy == bufferOverflowSpill {
+			wait = time.After(k.live.getThrottleDelay())
+		} else {
+			records = buffer
+		}
+
+		select {
+		case <-commitTicker.C:
+			unlock()
+			finishCommitted, err := k.commitCheckpoint(cr.checkpointer, commitBackoff)
+			if err != nil {
+				k.shardErrors <- shardConsumerError{shardID: shardID, action: "checkpointer.commit", err: err}
+				return false
+			}
+			if finishCommitted {
+				return false
+			}
+		case <-k.stop:
+			unlock()
+			return false
+		case records <- cr:
+			unlock()
+			return true
+		case <-wait:
+			unlock()
+		case <-replacing:
+			unlock()
+		}
+	}
+}
+
+// bufferDropOldest puts the record on the buffer, dropping the oldest records until there is room for it
+func (k *Kinsumer) bufferDropOldest(buffer chan *consumedRecord, cr *consumedRecord) {
+	for {
+		select {
+		case buffer <- cr:
+			return
+		default:
+		}
+
+		select {
+		case dropped := <-buffer:
+			atomic.AddUint64(&k.droppedRecords, 1)
+			k.unbuffered(dropped)
+			if stats, ok := k.config.stats.(OverflowStatReceiver); ok {
+				stats.EventsDropped(1, dropped.checkpointer.shardID)
+			}
+			dropped.trace.log(k.config.logger, "dropped from the full buffer", time.Now())
+		default:
+		}
+	}
+}
+
+// DroppedRecords returns the number of records dropped because the buffer was full, which only
+// happens with Config.WithBufferOverflowDropOldest.
+func (k *Kinsumer) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&k.droppedRecords)
+}
+
+// spillEntry is the location in the spill file of a record that didn't fit in the buffer
+type spillEntry struct {
+	checkpointer *checkpointer
+	retrievedAt  time.Time
+	trace        *deliveryTrace
+	offset       int64
+	length       int
+	dataLength   int // bytes of record data, accounted for by the delivery pacing
+}
+
+// spillBuffer is a FIFO queue of records on disk sitting in front of the combined records buffer.
+// As long as it isn't empty every new record goes through it, so records of a shard stay in order.
+type spillBuffer struct {
+	dir      string
+	maxBytes int64
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64        // bytes written to the file, including entries already read back
+	pending  int64        // bytes of the entries not handed to the buffer yet
+	entries  []spillEntry // entries not handed to the buffer yet, oldest first
+	notEmpty chan struct{}
+}
+
+func newSpillBuffer(dir string, maxBytes int64) *spillBuffer {
+	return &spillBuffer{
+		dir:      dir,
+		maxBytes: maxBytes,
+		notEmpty: make(chan struct{}, 1),
+	}
+}
+
+// put hands the record straight to the records buffer if nothing is spilled and there's room, or
+// appends it to the spill file otherwise, as it does while the buffer is nil. Returns false if the
+// records not read back fill maxBytes.
+func (s *spillBuffer) put(cr *consumedRecord, records chan *consumedRecord) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.entries) == 0 {
+		select {
+		case records <- cr:
+			return true, nil
+		default:
+		}
+	}
+
+	data, err := json.Marshal(cr.record)
+	if err != nil {
+		return false, err
+	}
+	if s.pending+int64(len(data)) > s.maxBytes {
+		return false, nil
+	}
+
+	if s.file == nil {
+		if s.file, err = ioutil.TempFile(s.dir, "kinsumer-spill-"); err != nil {
+			return false, fmt.Errorf("error creating spill file: %v", err)
+		}
+	}
+	if _, err = s.file.WriteAt(data, s.size); err != nil {
+		return false, fmt.Errorf("error writing to spill file: %v", err)
+	}
+
+	s.entries = append(s.entries, spillEntry{
+		checkpointer: cr.checkpointer,
+		retrievedAt:  cr.retrievedAt,
+		trace:        cr.trace,
+		offset:       s.size,
+		length:       len(data),
+		dataLength:   len(cr.record.Data),
+	})
+	s.size += int64(len(data))
+	s.pending += int64(len(data))
+
+	select {
+	case s.notEmpty <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// peek reads back the oldest spilled record, or returns nil if nothing is spilled
+func (s *spillBuffer) peek() (*consumedRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+	entry := s.entries[0]
+	data := make([]byte, entry.length)
+	if _, err := s.file.ReadAt(data, entry.offset); err != nil {
+		return nil, fmt.Errorf("error reading from spill file: %v", err)
+	}
+	var record kinesis.Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &consumedRecord{
+		record:       &record,
+		checkpointer: entry.checkpointer,
+		retrievedAt:  entry.retrievedAt,
+		trace:        entry.trace,
+	}, nil
+}
+
+// pop forgets the oldest spilled record once it has been handed to the buffer, or couldn't be read
+// back, and returns its entry
+func (s *spillBuffer) pop() spillEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.entries[0]
+	s.entries = s.entries[1:]
+	s.pending -= int64(entry.length)
+	if len(s.entries) == 0 {
+		s.truncate()
+	}
+	return entry
+}
+
+// reset drops every spilled record, it must only be called when no consumer is running
+func (s *spillBuffer) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries = nil
+	s.truncate()
+}
+
+// truncate empties the spill file, the mutex must be held
+func (s *spillBuffer) truncate() {
+	s.size = 0
+	s.pending = 0
+	if s.file != nil {
+		_ = s.file.Truncate(0)
+	}
+}
+
+// close removes the spill file
+func (s *spillBuffer) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+// feedSpilledRecords moves spilled records to the combined records buffer as room frees up,
+// until we are told to stop consuming. A record that can't be read back is reported and dropped, so
+// the records spilled after it are still fed.
+func (k *Kinsumer) feedSpilledRecords() {
+	defer k.waitGroup.Done()
+	defer k.recoverPanic("feedSpilledRecords", "")
+
+	for {
+		cr, err := k.spill.peek()
+		if err != nil {
+			k.dropSpilled(err)
+			continue
+		}
+		if cr == nil {
+			select {
+			case <-k.spill.notEmpty:
+				continue
+			case <-k.stop:
+				return
+			}
+		}
+
+		buffer, replacing, unlock := k.lockBuffer()
+		select {
+		case buffer <- cr:
+			unlock()
+			k.spill.pop()
+		case <-replacing:
+			unlock()
+		case <-k.stop:
+			unlock()
+			return
+		}
+	}
+}
+
+// dropSpilled drops the oldest spilled record, which couldn't be read back, like the records dropped
+// from a full buffer
+func (k *Kinsumer) dropSpilled(err error) {
+	entry := k.spill.pop()
+	shardID := entry.checkpointer.shardID
+	atomic.AddUint64(&k.droppedRecords, 1)
+	if k.config.pacingBytesPerSecond > 0 {
+		atomic.AddInt64(&k.bufferedBytes, -int64(entry.dataLength))
+	}
+	if stats, ok := k.config.stats.(OverflowStatReceiver); ok {
+		stats.EventsDropped(1, shardID)
+	}
+	entry.trace.log(k.config.logger, "dropped from the unreadable spill file", time.Now())
+	k.reportError("feedSpilledRecords", shardID, fmt.Errorf("error reading spilled record of shard %s, dropping it: %v", shardID, err))
+}
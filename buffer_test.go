@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func testConsumedRecord(sequenceNumber string) *consumedRecord {
+	return &consumedRecord{
+		record: &kinesis.Record{
+			SequenceNumber: aws.String(sequenceNumber),
+			Data:           []byte(sequenceNumber),
+		},
+		checkpointer: &checkpointer{shardID: "shard"},
+	}
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	k := &Kinsumer{
+		records: make(chan *consumedRecord, 2),
+		config:  NewConfig().WithBufferOverflowDropOldest(),
+	}
+
+	for _, sn := range []string{"1", "2", "3"} {
+		k.bufferDropOldest(k.records, testConsumedRecord(sn))
+	}
+
+	require.Equal(t, uint64(1), k.DroppedRecords())
+	require.Equal(t, "2", aws.StringValue((<-k.records).record.SequenceNumber))
+	require.Equal(t, "3", aws.StringValue((<-k.records).record.SequenceNumber))
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinsumer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records := make(chan *consumedRecord, 1)
+	s := newSpillBuffer(dir, 1024)
+	defer s.close()
+
+	// The first record fits in the buffer, the others are spilled
+	for _, sn := range []string{"1", "2", "3"} {
+		ok, err := s.put(testConsumedRecord(sn), records)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	require.Equal(t, "1", aws.StringValue((<-records).record.SequenceNumber))
+
+	// Even though there's room in the buffer now, new records must queue behind the spilled ones
+	ok, err := s.put(testConsumedRecord("4"), records)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, records, 0)
+
+	for _, sn := range []string{"2", "3", "4"} {
+		cr, err := s.peek()
+		require.NoError(t, err)
+		require.Equal(t, sn, aws.StringValue(cr.record.SequenceNumber))
+		require.Equal(t, []byte(sn), cr.record.Data)
+		s.pop()
+	}
+	cr, err := s.peek()
+	require.NoError(t, err)
+	require.Nil(t, cr)
+
+	// Once the spill file is full, put refuses new records
+	s = newSpillBuffer(dir, 1)
+	defer s.close()
+	ok, err = s.put(testConsumedRecord("5"), make(chan *consumedRecord))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestFeedSpilledRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinsumer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records := make(chan *consumedRecord)
+	k := &Kinsumer{
+		records: records,
+		config:  NewConfig(),
+		errors:  make(chan error, 1),
+		stop:    make(chan struct{}),
+		spill:   newSpillBuffer(dir, 1024),
+	}
+	defer k.spill.close()
+	for _, sn := range []string{"1", "2", "3"} {
+		ok, err := k.spill.put(testConsumedRecord(sn), records)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	// The second record can't be read back
+	_, err = k.spill.file.WriteAt([]byte("garbage"), k.spill.entries[1].offset)
+	require.NoError(t, err)
+
+	k.waitGroup.Add(1)
+	go k.feedSpilledRecords()
+	require.Equal(t, "1", aws.StringValue((<-records).record.SequenceNumber))
+	require.Equal(t, "3", aws.StringValue((<-records).record.SequenceNumber), "the records after it are still fed")
+	require.Error(t, <-k.errors)
+	require.Equal(t, uint64(1), k.DroppedRecords())
+	close(k.stop)
+	k.waitGroup.Wait()
+
+	// The records read back leave room for new ones, even if the spill file never emptied
+	s := newSpillBuffer(dir, 300)
+	defer s.close()
+	ok, err := s.put(testConsumedRecord("1"), make(chan *consumedRecord))
+	require.NoError(t, err)
+	require.True(t, ok)
+	for i := 0; i < 10; i++ {
+		ok, err = s.put(testConsumedRecord("2"), make(chan *consumedRecord))
+		require.NoError(t, err)
+		require.True(t, ok)
+		s.pop()
+	}
+}
@@ -3,6 +3,7 @@
 package kinsumer
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 	"time"
@@ -14,6 +15,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
+// maxCheckpointMetadataSize is the largest metadata blob that can be attached to a checkpoint
+const maxCheckpointMetadataSize = 16 * 1024
+
 // Note: Not thread safe!
 
 type checkpointer struct {
@@ -30,14 +34,59 @@ type checkpointer struct {
 	mutex                 sync.Mutex
 	finished              bool
 	finalSequenceNumber   string
+	capturedLastUpdate    int64 // LastUpdate of the checkpoint record before we captured it
+	metadata              []byte
+	onCheckpoint          CheckpointHook   // optional hook called after every checkpoint written
+	onCommit              CommitHook       // optional hook called after every checkpoint written, with when
+	traces                []*deliveryTrace // sampled records acked since the last checkpoint written
+	logger                Logger           // logger for the delivery traces
+
+	// previous sequence number of each nacked record waiting for redelivery, by sequence number
+	holds map[string]string
+	// sequence number of a record skipped by the record filter, to checkpoint once skipAfter is acked
+	skipTo    string
+	skipAfter string
+	// last throughput measured, nil if the shard isn't measured
+	throughput *shardThroughput
+	// last time the checkpoint was written to dynamo, and number of writes that failed
+	written      time.Time
+	commitErrors int
+	// how long after it was written the checkpoint is rewritten if it didn't change, 0 to never
+	touchFrequency time.Duration
+	// epoch of the home region we captured the shard in with global tables, 0 without them
+	homeEpoch int64
+	// number of failovers of the stream the checkpoint was written after, with stream failover
+	failovers int64
+	// fencing token of our ownership, the writes of the checkpoint fail once the shard was captured again
+	leaseToken int64
+	// last successful GetRecords call of the shard worker, and how far behind the stream it was
+	polledAt time.Time
+	lag      time.Duration
 }
 
+// CheckpointHook is called with the shard and sequence number of every checkpoint written to dynamo
+type CheckpointHook func(shardID string, sequenceNumber string)
+
+// CommitHook is called with the shard and sequence number of every checkpoint written to dynamo, and
+// the time it was written at, which is its LastUpdate in the checkpoints table
+type CommitHook func(shardID string, sequenceNumber string, at time.Time)
+
 type checkpointRecord struct {
 	Shard          string
 	SequenceNumber *string // last read sequence number, null if the shard has never been consumed
 	LastUpdate     int64   // timestamp of last commit/ownership change
 	OwnerName      *string // uuid of owning client, null if the shard is unowned
 	Finished       *int64  // timestamp of when the shard was fully consumed, null if it's active
+	Metadata       []byte  // opaque blob attached to the checkpoint by the library user
+	// throughput of the shard measured by its owner, for the ScalingAdvisor
+	Throughput *shardThroughput `dynamodbav:",omitempty"`
+	// epoch of the home region the checkpoint was written in, with global tables
+	HomeEpoch int64 `dynamodbav:",omitempty"`
+	// number of failovers of the stream the sequence number was read after, with stream failover
+	Failovers int64 `dynamodbav:",omitempty"`
+	// fencing token of the ownership, incremented by every capture so that the writes of a previous
+	// owner fail even if it has the same ID, such as a client paused for longer than the client expiry
+	LeaseToken int64 `dynamodbav:",omitempty"`
 
 	// Columns added to the table that are never used for decision making in the
 	// library, rather they are useful for manual troubleshooting
@@ -47,7 +96,9 @@ type checkpointRecord struct {
 }
 
 // capture is a non-blocking call that attempts to capture the given shard/checkpoint.
-// It returns a checkpointer on success, or nil if it fails to capture the checkpoint
+// It returns a checkpointer on success, or nil if it fails to capture the checkpoint.
+// With global tables, homeEpoch is the epoch of the home region, and the shards owned by the
+// clients of a previous home are captured without waiting for their records to expire.
 func capture(
 	shardID string,
 	tableName string,
@@ -55,6 +106,7 @@ func capture(
 	ownerName string,
 	ownerID string,
 	maxAgeForClientRecord time.Duration,
+	homeEpoch int64,
 	stats StatReceiver) (*checkpointer, error) {
 
 	cutoff := time.Now().Add(-maxAgeForClientRecord).UnixNano()
@@ -69,7 +121,7 @@ func capture(
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("error calling GetItem on shard checkpoint: %v", err)
+		return nil, fmt.Errorf("error calling GetItem on shard checkpoint: %w", err)
 	}
 
 	// Convert to struct so we can work with the values
@@ -79,7 +131,8 @@ func capture(
 	}
 
 	// If the record is marked as owned by someone else, and has not expired
-	if record.OwnerID != nil && record.LastUpdate > cutoff {
+	previousHome := homeEpoch > 0 && record.HomeEpoch < homeEpoch
+	if record.OwnerID != nil && record.LastUpdate > cutoff && !previousHome {
 		// We fail to capture it
 		return nil, nil
 	}
@@ -90,8 +143,12 @@ func capture(
 	// Mark us as the owners
 	record.OwnerID = &ownerID
 	record.OwnerName = &ownerName
+	record.HomeEpoch = homeEpoch
+	previousToken := record.LeaseToken
+	record.LeaseToken++
 
 	// Update timestamp
+	previousUpdate := record.LastUpdate
 	now := time.Now()
 	record.LastUpdate = now.UnixNano()
 	record.LastUpdateRFC = now.UTC().Format(time.RFC1123Z)
@@ -101,20 +158,32 @@ func capture(
 		return nil, err
 	}
 
-	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+	values := map[string]interface{}{
 		":cutoff":   aws.Int64(cutoff),
 		":nullType": aws.String("NULL"),
-	})
+	}
+	// The OwnerID doesn't exist if the entry doesn't exist, but PutItem with a marshaled
+	// checkpointRecord sets a nil OwnerID to the NULL type.
+	condition := "attribute_not_exists(OwnerID) OR attribute_type(OwnerID, :nullType) OR LastUpdate <= :cutoff"
+	if homeEpoch > 0 {
+		condition += " OR attribute_not_exists(HomeEpoch) OR HomeEpoch < :epoch"
+		values[":epoch"] = aws.Int64(homeEpoch)
+	}
+	// Nobody captured it since we read it, so the token we write is only ours
+	if previousToken == 0 {
+		condition = "(" + condition + ") AND attribute_not_exists(LeaseToken)"
+	} else {
+		condition = "(" + condition + ") AND LeaseToken = :previousToken"
+		values[":previousToken"] = aws.Int64(previousToken)
+	}
+	attrVals, err := dynamodbattribute.MarshalMap(values)
 	if err != nil {
 		return nil, err
 	}
 	if _, err = dynamodbiface.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
-		// The OwnerID doesn't exist if the entry doesn't exist, but PutItem with a marshaled
-		// checkpointRecord sets a nil OwnerID to the NULL type.
-		ConditionExpression: aws.String(
-			"attribute_not_exists(OwnerID) OR attribute_type(OwnerID, :nullType) OR LastUpdate <= :cutoff"),
+		TableName:                 aws.String(tableName),
+		Item:                      item,
+		ConditionExpression:       aws.String(condition),
 		ExpressionAttributeValues: attrVals,
 	}); err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ConditionalCheckFailedException" {
@@ -134,6 +203,12 @@ func capture(
 		sequenceNumber:        aws.StringValue(record.SequenceNumber),
 		maxAgeForClientRecord: maxAgeForClientRecord,
 		captured:              true,
+		capturedLastUpdate:    previousUpdate,
+		metadata:              record.Metadata,
+		written:               now,
+		homeEpoch:             homeEpoch,
+		failovers:             record.Failovers,
+		leaseToken:            record.LeaseToken,
 	}
 
 	return checkpointer, nil
@@ -145,13 +220,23 @@ func capture(
 func (cp *checkpointer) commit() (bool, error) {
 	cp.mutex.Lock()
 	defer cp.mutex.Unlock()
-	if !cp.dirty && !cp.finished {
+	if !cp.dirty && !cp.finished && !cp.touchDue(time.Now()) {
 		return false, nil
 	}
+	return cp.write(func(put *dynamodb.PutItemInput) error {
+		_, err := cp.dynamodb.PutItem(put)
+		return err
+	})
+}
+
+// write writes the checkpoint with the given function, given the conditional put of the checkpoint
+// record, so the checkpoint can be written as part of a larger request. The mutex must be held.
+func (cp *checkpointer) write(put func(*dynamodb.PutItemInput) error) (bool, error) {
 	now := time.Now()
 
-	sn := &cp.sequenceNumber
-	if cp.sequenceNumber == "" {
+	sequenceNumber := cp.checkpointedSequenceNumber()
+	sn := &sequenceNumber
+	if sequenceNumber == "" {
 		// We are not allowed to pass empty strings to dynamo, so instead pass a nil *string
 		// to 'unset' it
 		sn = nil
@@ -162,38 +247,60 @@ func (cp *checkpointer) commit() (bool, error) {
 		SequenceNumber: sn,
 		LastUpdate:     now.UnixNano(),
 		LastUpdateRFC:  now.UTC().Format(time.RFC1123Z),
+		Metadata:       cp.metadata,
+		Throughput:     cp.throughput,
 	}
 	finished := false
-	if cp.finished && (cp.sequenceNumber == cp.finalSequenceNumber || cp.finalSequenceNumber == "") {
+	if cp.finished && len(cp.holds) == 0 && (cp.sequenceNumber == cp.finalSequenceNumber || cp.finalSequenceNumber == "") {
 		record.Finished = aws.Int64(now.UnixNano())
 		record.FinishedRFC = aws.String(now.UTC().Format(time.RFC1123Z))
 		finished = true
 	}
 	record.OwnerID = &cp.ownerID
 	record.OwnerName = &cp.ownerName
+	record.HomeEpoch = cp.homeEpoch
+	record.Failovers = cp.failovers
+	record.LeaseToken = cp.leaseToken
 
 	item, err := dynamodbattribute.MarshalMap(&record)
 	if err != nil {
 		return false, err
 	}
 
-	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
-		":ownerID": aws.String(cp.ownerID),
-	})
+	values := map[string]interface{}{
+		":ownerID":    aws.String(cp.ownerID),
+		":leaseToken": aws.Int64(cp.leaseToken),
+	}
+	condition := "OwnerID = :ownerID AND LeaseToken = :leaseToken"
+	if cp.homeEpoch > 0 {
+		// A client of the previous home can overwrite our capture when its write replicates after
+		// ours with a later timestamp, global tables keeping the last writer. The row is still ours
+		// then, the clients of the previous home stop writing once they see the new home.
+		condition = "(OwnerID = :ownerID AND LeaseToken = :leaseToken) OR HomeEpoch < :epoch"
+		values[":epoch"] = aws.Int64(cp.homeEpoch)
+	}
+	attrVals, err := dynamodbattribute.MarshalMap(values)
 	if err != nil {
 		return false, err
 	}
-	if _, err = cp.dynamodb.PutItem(&dynamodb.PutItemInput{
+	if err = put(&dynamodb.PutItemInput{
 		TableName:                 aws.String(cp.tableName),
 		Item:                      item,
-		ConditionExpression:       aws.String("OwnerID = :ownerID"),
+		ConditionExpression:       aws.String(condition),
 		ExpressionAttributeValues: attrVals,
 	}); err != nil {
-		return false, fmt.Errorf("error committing checkpoint: %s", err)
+		cp.commitErrors++
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			// Someone else owns the shard now
+			return false, ErrCheckpointOwnershipLost
+		}
+		return false, fmt.Errorf("error committing checkpoint: %w", err)
 	}
+	cp.tracesCovered(now)
+	cp.written = now
 
 	if sn != nil {
-		cp.stats.Checkpoint()
+		cp.checkpointed(sequenceNumber, now)
 	}
 	cp.dirty = false
 	return finished, nil
@@ -202,10 +309,14 @@ func (cp *checkpointer) commit() (bool, error) {
 // release releases our ownership of the checkpoint in dynamo so another client can take it
 func (cp *checkpointer) release() error {
 	now := time.Now()
+	cp.mutex.Lock()
+	sequenceNumber := cp.checkpointedSequenceNumber()
+	cp.mutex.Unlock()
 
 	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
 		":ownerID":        aws.String(cp.ownerID),
-		":sequenceNumber": aws.String(cp.sequenceNumber),
+		":leaseToken":     aws.Int64(cp.leaseToken),
+		":sequenceNumber": aws.String(sequenceNumber),
 		":lastUpdate":     aws.Int64(now.UnixNano()),
 		":lastUpdateRFC":  aws.String(now.UTC().Format(time.RFC1123Z)),
 	})
@@ -220,29 +331,198 @@ func (cp *checkpointer) release() error {
 		UpdateExpression: aws.String("REMOVE OwnerID, OwnerName " +
 			"SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC, " +
 			"SequenceNumber = :sequenceNumber"),
-		ConditionExpression:       aws.String("OwnerID = :ownerID"),
+		ConditionExpression:       aws.String("OwnerID = :ownerID AND LeaseToken = :leaseToken"),
 		ExpressionAttributeValues: attrVals,
 	}); err != nil {
-		return fmt.Errorf("error releasing checkpoint: %s", err)
+		return fmt.Errorf("error releasing checkpoint: %w", err)
 	}
+	cp.mutex.Lock()
+	cp.tracesCovered(now)
+	cp.written = now
+	cp.captured = false
+	cp.mutex.Unlock()
 
-	if cp.sequenceNumber != "" {
-		cp.stats.Checkpoint()
+	if sequenceNumber != "" {
+		cp.checkpointed(sequenceNumber, now)
 	}
 
-	cp.captured = false
-
 	return nil
 }
 
+// checkpointed reports a sequence number written to dynamo at the given time to the stats and hooks
+func (cp *checkpointer) checkpointed(sequenceNumber string, at time.Time) {
+	cp.stats.Checkpoint()
+	if cp.onCheckpoint != nil {
+		cp.onCheckpoint(cp.shardID, sequenceNumber)
+	}
+	if cp.onCommit != nil {
+		cp.onCommit(cp.shardID, sequenceNumber, at)
+	}
+}
+
+// reset forgets the captured sequence number. If rewrite is true the checkpoint is marked dirty
+// so the next commit clears it in dynamo, otherwise it is left alone until the next update.
+func (cp *checkpointer) reset(rewrite bool) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.dirty = cp.dirty || (rewrite && cp.sequenceNumber != "")
+	cp.sequenceNumber = ""
+}
+
+// reseed clears a checkpoint read from another copy of the stream, whose sequence number means
+// nothing for the stream failed over to, and rewrites it for the given number of failovers
+func (cp *checkpointer) reseed(failovers int64) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.sequenceNumber = ""
+	cp.failovers = failovers
+	cp.dirty = true
+}
+
 // update updates the current sequenceNumber of the checkpoint, marking it dirty if necessary
 func (cp *checkpointer) update(sequenceNumber string) {
 	cp.mutex.Lock()
 	defer cp.mutex.Unlock()
+	cp.setSequenceNumber(sequenceNumber)
+}
+
+// setSequenceNumber moves the checkpoint to the given acked record, or past the records skipped
+// after it, the mutex must be held
+func (cp *checkpointer) setSequenceNumber(sequenceNumber string) {
+	if cp.skipAfter != "" && !sequenceNumberLess(sequenceNumber, cp.skipAfter) {
+		if sequenceNumberLess(sequenceNumber, cp.skipTo) {
+			sequenceNumber = cp.skipTo
+		}
+		cp.skipAfter = ""
+		cp.skipTo = ""
+	}
 	cp.dirty = cp.dirty || cp.sequenceNumber != sequenceNumber
 	cp.sequenceNumber = sequenceNumber
 }
 
+// skip moves the checkpoint past a record skipped by the record filter or validator once lastBuffered, the
+// record buffered just before it, is acked. Empty if no record was buffered since we captured the shard.
+func (cp *checkpointer) skip(lastBuffered, sequenceNumber string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if lastBuffered == "" || !sequenceNumberLess(cp.sequenceNumber, lastBuffered) {
+		cp.skipAfter = ""
+		cp.skipTo = ""
+		cp.setSequenceNumber(sequenceNumber)
+		return
+	}
+	cp.skipAfter = lastBuffered
+	cp.skipTo = sequenceNumber
+}
+
+// updateTraced is like update, for a record sampled for delivery tracing. The trace is logged once
+// the checkpoint covering the record has been written.
+func (cp *checkpointer) updateTraced(sequenceNumber string, trace *deliveryTrace) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.setSequenceNumber(sequenceNumber)
+	cp.traces = append(cp.traces, trace)
+}
+
+// tracesCovered logs the traces of the records covered by the checkpoint just written, the mutex
+// must be held
+func (cp *checkpointer) tracesCovered(at time.Time) {
+	for _, t := range cp.traces {
+		t.log(cp.logger, "checkpoint-covered", at)
+	}
+	cp.traces = nil
+}
+
+// currentSequenceNumber returns the sequence number of the last record delivered from the shard
+func (cp *checkpointer) currentSequenceNumber() string {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.sequenceNumber
+}
+
+// isCaptured returns whether we still own the shard
+func (cp *checkpointer) isCaptured() bool {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.captured
+}
+
+// hold keeps the checkpoint from moving past a nacked record until it is redelivered, previous is
+// the sequence number that was checkpointed before the record was delivered the first time
+func (cp *checkpointer) hold(sequenceNumber, previous string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.holds == nil {
+		cp.holds = make(map[string]string)
+	}
+	cp.holds[sequenceNumber] = previous
+	cp.dirty = true
+}
+
+// updateHeld is like update for a record being processed, the checkpoint doesn't move past previous,
+// the sequence number delivered before it, until the record is unheld
+func (cp *checkpointer) updateHeld(sequenceNumber, previous string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.holds == nil {
+		cp.holds = make(map[string]string)
+	}
+	cp.holds[sequenceNumber] = previous
+	cp.setSequenceNumber(sequenceNumber)
+}
+
+// unhold lets the checkpoint move past a nacked record again once it has been redelivered, or past
+// a record handled by Dispatch
+func (cp *checkpointer) unhold(sequenceNumber string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if _, ok := cp.holds[sequenceNumber]; ok {
+		delete(cp.holds, sequenceNumber)
+		cp.dirty = true
+	}
+}
+
+// checkpointedSequenceNumber returns the sequence number to write to dynamo: the last one delivered,
+// or the earliest one before a nacked record still waiting for redelivery. The mutex must be held.
+func (cp *checkpointer) checkpointedSequenceNumber() string {
+	sequenceNumber := cp.sequenceNumber
+	for _, previous := range cp.holds {
+		if sequenceNumberLess(previous, sequenceNumber) {
+			sequenceNumber = previous
+		}
+	}
+	return sequenceNumber
+}
+
+// touchDue returns whether the unchanged checkpoint should be rewritten. The mutex must be held.
+func (cp *checkpointer) touchDue(now time.Time) bool {
+	return cp.touchFrequency > 0 && now.Sub(cp.written) >= cp.touchFrequency
+}
+
+// setMetadata replaces the metadata attached to the checkpoint, marking it dirty if it changed
+func (cp *checkpointer) setMetadata(metadata []byte) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.dirty = cp.dirty || !bytes.Equal(cp.metadata, metadata)
+	cp.metadata = metadata
+}
+
+// setThroughput replaces the throughput measured for the shard, written with the next commit of
+// the checkpoint or when it is touched
+func (cp *checkpointer) setThroughput(t shardThroughput) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.throughput = &t
+}
+
+// polled records a successful GetRecords call of the shard worker
+func (cp *checkpointer) polled(at time.Time, lag time.Duration) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.polledAt = at
+	cp.lag = lag
+}
+
 // finish marks the given sequence number as the final one for the shard.
 // sequenceNumber is the empty string if we never read anything from the shard.
 func (cp *checkpointer) finish(sequenceNumber string) {
@@ -252,6 +532,26 @@ func (cp *checkpointer) finish(sequenceNumber string) {
 	cp.finished = true
 }
 
+// shardFinished returns whether the checkpoint of the given shard says it was fully consumed
+func shardFinished(db dynamodbiface.DynamoDBAPI, tableName, shardID string) (bool, error) {
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Shard": {S: aws.String(shardID)},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error calling GetItem on shard checkpoint: %v", err)
+	}
+
+	var record checkpointRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return false, err
+	}
+	return record.Finished != nil, nil
+}
+
 // loadCheckpoints returns checkpoint records from dynamo mapped by shard id.
 func loadCheckpoints(db dynamodbiface.DynamoDBAPI, tableName string) (map[string]*checkpointRecord, error) {
 	params := &dynamodb.ScanInput{
@@ -3,9 +3,17 @@
 package kinsumer
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/brenol/kinsumer/mocks"
 )
 
@@ -14,7 +22,7 @@ func TestCheckpointer(t *testing.T) {
 	mock := mocks.NewMockDynamo([]string{table})
 	stats := &NoopStatReceiver{}
 
-	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, stats)
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
 
 	// Initially, we expect that there is no record, so our new record should have no sequence number
 	if err != nil {
@@ -71,7 +79,7 @@ func TestCheckpointer(t *testing.T) {
 	})
 
 	// Try to get another checkpointer for this shard, should not succeed but not error
-	cp2, err := capture("shard", table, mock, "differentOwner", "differentOwnerId", 3*time.Minute, stats)
+	cp2, err := capture("shard", table, mock, "differentOwner", "differentOwnerId", 3*time.Minute, 0, stats)
 	if err != nil {
 		t.Errorf("cp2 first attempt err=%q", err)
 	}
@@ -104,3 +112,424 @@ func TestCheckpointer(t *testing.T) {
 		}
 	*/
 }
+
+func TestCheckpointerReset(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+	cp.update("seq1")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq1 err=%q", err)
+	}
+
+	// Resetting without rewriting shouldn't make the checkpoint dirty
+	cp.reset(false)
+	if cp.sequenceNumber != "" {
+		t.Errorf("sequence number should be empty after reset")
+	}
+	mocks.AssertNoRequestsMade(t, mock.(*mocks.MockDynamo), "commit after reset(false)", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit after reset(false) err=%q", err)
+		}
+	})
+
+	// Resetting with rewrite should clear the checkpoint on the next commit
+	cp.update("seq2")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq2 err=%q", err)
+	}
+	cp.reset(true)
+	mocks.AssertRequestMade(t, mock.(*mocks.MockDynamo), "commit after reset(true)", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit after reset(true) err=%q", err)
+		}
+	})
+}
+
+func TestCheckpointerMetadata(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+	if cp.metadata != nil {
+		t.Errorf("metadata should initially be nil")
+	}
+
+	// Setting metadata should be committed even if the sequence number didn't change
+	cp.setMetadata([]byte("state"))
+	mocks.AssertRequestMade(t, mock.(*mocks.MockDynamo), "commit metadata", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit metadata err=%q", err)
+		}
+	})
+
+	// The same metadata again doesn't make the checkpoint dirty
+	cp.setMetadata([]byte("state"))
+	mocks.AssertNoRequestsMade(t, mock.(*mocks.MockDynamo), "commit unchanged metadata", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit unchanged metadata err=%q", err)
+		}
+	})
+}
+
+func TestCheckpointerTouch(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+
+	// A new throughput alone isn't worth a write
+	cp.setThroughput(shardThroughput{RecordsPerSecond: 1})
+	mocks.AssertNoRequestsMade(t, mock.(*mocks.MockDynamo), "commit throughput", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit throughput err=%q", err)
+		}
+	})
+
+	// Unless the checkpoint is due for a touch
+	cp.touchFrequency = time.Minute
+	mocks.AssertNoRequestsMade(t, mock.(*mocks.MockDynamo), "commit before touch", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit before touch err=%q", err)
+		}
+	})
+	cp.written = cp.written.Add(-time.Minute)
+	mocks.AssertRequestMade(t, mock.(*mocks.MockDynamo), "commit touch", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit touch err=%q", err)
+		}
+	})
+	mocks.AssertNoRequestsMade(t, mock.(*mocks.MockDynamo), "commit after touch", func() {
+		if _, err = cp.commit(); err != nil {
+			t.Errorf("commit after touch err=%q", err)
+		}
+	})
+}
+
+func TestCheckpointerOnCheckpoint(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+
+	var committed []string
+	cp.onCheckpoint = func(shardID, sequenceNumber string) {
+		if shardID != "shard" {
+			t.Errorf("unexpected shard %q", shardID)
+		}
+		committed = append(committed, sequenceNumber)
+	}
+
+	cp.update("seq1")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq1 err=%q", err)
+	}
+	// Nothing changed, so the hook shouldn't be called again
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit unchanged err=%q", err)
+	}
+	cp.update("seq2")
+	if err = cp.release(); err != nil {
+		t.Fatalf("release err=%q", err)
+	}
+
+	if len(committed) != 2 || committed[0] != "seq1" || committed[1] != "seq2" {
+		t.Errorf("unexpected checkpoints %v", committed)
+	}
+}
+
+func TestCheckpointerCommitHook(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+
+	var committed []string
+	var times []time.Time
+	cp.onCommit = func(shardID, sequenceNumber string, at time.Time) {
+		committed = append(committed, sequenceNumber)
+		times = append(times, at)
+	}
+
+	before := time.Now()
+	cp.update("seq1")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq1 err=%q", err)
+	}
+	cp.update("seq2")
+	if err = cp.release(); err != nil {
+		t.Fatalf("release err=%q", err)
+	}
+
+	if len(committed) != 2 || committed[0] != "seq1" || committed[1] != "seq2" {
+		t.Fatalf("unexpected checkpoints %v", committed)
+	}
+	if times[0].Before(before) || times[1].Before(times[0]) {
+		t.Errorf("unexpected commit times %v", times)
+	}
+	if !times[1].Equal(cp.written) {
+		t.Errorf("release time %v doesn't match the last write %v", times[1], cp.written)
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Log(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestCheckpointerTraces(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+	logger := &recordingLogger{}
+	cp.logger = logger
+
+	cp.updateTraced("seq1", &deliveryTrace{id: 7, shardID: "shard", sequenceNumber: "seq1", fetchedAt: time.Now()})
+	if len(logger.lines) != 0 {
+		t.Errorf("trace logged before the checkpoint was written: %v", logger.lines)
+	}
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq1 err=%q", err)
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "Delivery 7 (shard shard, sequence number seq1) checkpoint-covered") {
+		t.Errorf("unexpected trace logs %v", logger.lines)
+	}
+
+	// Traces are only logged once
+	cp.update("seq2")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit seq2 err=%q", err)
+	}
+	if len(logger.lines) != 1 {
+		t.Errorf("unexpected trace logs %v", logger.lines)
+	}
+}
+
+func TestCheckpointerHold(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+	var committed []string
+	cp.onCheckpoint = func(shardID, sequenceNumber string) {
+		committed = append(committed, sequenceNumber)
+	}
+
+	// Records 2 and 4 are nacked after 4 was delivered
+	cp.update("4")
+	cp.hold("4", "3")
+	cp.hold("2", "1")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit err=%q", err)
+	}
+	cp.update("5")
+	cp.unhold("2")
+	if _, err = cp.commit(); err != nil {
+		t.Fatalf("commit err=%q", err)
+	}
+	// The shard can't be finished while a record waits for redelivery
+	cp.finish("5")
+	if finished, err := cp.commit(); err != nil || finished {
+		t.Fatalf("commit finished=%v err=%q", finished, err)
+	}
+	cp.unhold("4")
+	if finished, err := cp.commit(); err != nil || !finished {
+		t.Fatalf("commit finished=%v err=%q", finished, err)
+	}
+
+	if len(committed) != 4 || committed[0] != "1" || committed[1] != "3" || committed[2] != "3" || committed[3] != "5" {
+		t.Errorf("unexpected checkpoints %v", committed)
+	}
+}
+
+func TestCheckpointerSkip(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	stats := &NoopStatReceiver{}
+
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, stats)
+	if err != nil || cp == nil {
+		t.Fatalf("capture err=%q cp=%v", err, cp)
+	}
+
+	// Nothing was buffered, the skipped record is checkpointed right away
+	cp.skip("", "1")
+	if seq := cp.currentSequenceNumber(); seq != "1" {
+		t.Errorf("unexpected sequence number %q after skipping 1", seq)
+	}
+
+	// Records 3 and 4 are skipped while 2 is in the buffer
+	cp.skip("2", "3")
+	cp.skip("2", "4")
+	if seq := cp.currentSequenceNumber(); seq != "1" {
+		t.Errorf("unexpected sequence number %q while 2 is buffered", seq)
+	}
+	cp.update("2")
+	if seq := cp.currentSequenceNumber(); seq != "4" {
+		t.Errorf("unexpected sequence number %q after acking 2", seq)
+	}
+
+	// Everything buffered was acked
+	cp.update("5")
+	cp.skip("5", "6")
+	if seq := cp.currentSequenceNumber(); seq != "6" {
+		t.Errorf("unexpected sequence number %q after skipping 6", seq)
+	}
+}
+
+func TestCommitNow(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mock, "stream", "app", "client", NewConfig())
+	if err != nil {
+		t.Fatalf("NewWithInterfaces err=%q", err)
+	}
+
+	var mutex sync.Mutex
+	committed := make(map[string]string)
+	for _, shardID := range []string{"shard0", "shard1"} {
+		cp, err := capture(shardID, table, mock, "ownerName", "ownerId", 3*time.Minute, 0, &NoopStatReceiver{})
+		if err != nil || cp == nil {
+			t.Fatalf("capture err=%q cp=%v", err, cp)
+		}
+		cp.onCommit = func(shardID, sequenceNumber string, at time.Time) {
+			mutex.Lock()
+			committed[shardID] = sequenceNumber
+			mutex.Unlock()
+		}
+		k.setOwnedCheckpointer(shardID, cp)
+	}
+
+	// Only the checkpoint that changed is written
+	k.ownedCheckpointer("shard1").update("seq")
+	if err = k.CommitNow(); err != nil {
+		t.Fatalf("CommitNow err=%q", err)
+	}
+	if len(committed) != 1 || committed["shard1"] != "seq" {
+		t.Errorf("unexpected checkpoints %v", committed)
+	}
+	if k.ownedCheckpointer("shard1").dirty {
+		t.Errorf("checkpoint still dirty after CommitNow")
+	}
+}
+
+// fencedDynamo is a checkpoint table of a single shard checking the ownership conditions of the puts
+type fencedDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	item map[string]*dynamodb.AttributeValue
+}
+
+func (d *fencedDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: d.item}, nil
+}
+
+func (d *fencedDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	var current checkpointRecord
+	if err := dynamodbattribute.UnmarshalMap(d.item, &current); err != nil {
+		return nil, err
+	}
+	var cutoff, token int64
+	values := in.ExpressionAttributeValues
+	var allowed bool
+	if values[":cutoff"] != nil {
+		// A capture, of an expired shard read with the given token
+		if err := dynamodbattribute.Unmarshal(values[":cutoff"], &cutoff); err != nil {
+			return nil, err
+		}
+		if values[":previousToken"] != nil {
+			if err := dynamodbattribute.Unmarshal(values[":previousToken"], &token); err != nil {
+				return nil, err
+			}
+		}
+		allowed = (current.OwnerID == nil || current.LastUpdate <= cutoff) && current.LeaseToken == token
+	} else {
+		if err := dynamodbattribute.Unmarshal(values[":leaseToken"], &token); err != nil {
+			return nil, err
+		}
+		allowed = aws.StringValue(current.OwnerID) == aws.StringValue(values[":ownerID"].S) && current.LeaseToken == token
+	}
+	if !allowed {
+		return nil, awserr.New(conditionalFail, "the conditional request failed", nil)
+	}
+	d.item = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestCheckpointerFencing(t *testing.T) {
+	db := &fencedDynamo{}
+	stats := &NoopStatReceiver{}
+	paused, err := capture("shard", "checkpoints", db, "a", "clientA", time.Minute, 0, stats)
+	if err != nil || paused == nil {
+		t.Fatalf("capture err=%q cp=%v", err, paused)
+	}
+	if paused.leaseToken != 1 {
+		t.Errorf("first lease token %d, expected 1", paused.leaseToken)
+	}
+
+	// The client is presumed dead and another one captures the shard
+	time.Sleep(time.Millisecond)
+	other, err := capture("shard", "checkpoints", db, "b", "clientB", time.Nanosecond, 0, stats)
+	if err != nil || other == nil || other.leaseToken != 2 {
+		t.Fatalf("capture of the expired shard err=%q cp=%v", err, other)
+	}
+	paused.update("seq1")
+	if _, err = paused.commit(); err != ErrCheckpointOwnershipLost {
+		t.Errorf("commit of the previous owner err=%q, expected ErrCheckpointOwnershipLost", err)
+	}
+
+	// Even once the same client captured the shard again, its previous capture can't write
+	time.Sleep(time.Millisecond)
+	recaptured, err := capture("shard", "checkpoints", db, "a", "clientA", time.Nanosecond, 0, stats)
+	if err != nil || recaptured == nil || recaptured.leaseToken != 3 {
+		t.Fatalf("recapture err=%q cp=%v", err, recaptured)
+	}
+	paused.update("seq2")
+	if _, err = paused.commit(); err != ErrCheckpointOwnershipLost {
+		t.Errorf("commit of the previous capture err=%q, expected ErrCheckpointOwnershipLost", err)
+	}
+	recaptured.update("seq3")
+	if _, err = recaptured.commit(); err != nil {
+		t.Errorf("commit of the current capture err=%q", err)
+	}
+
+	var record checkpointRecord
+	if err = dynamodbattribute.UnmarshalMap(db.item, &record); err != nil {
+		t.Fatalf("unmarshal err=%q", err)
+	}
+	if aws.StringValue(record.SequenceNumber) != "seq3" || record.LeaseToken != 3 {
+		t.Errorf("checkpoint %s with lease token %d, expected seq3 with 3", aws.StringValue(record.SequenceNumber), record.LeaseToken)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// ClaimCheckResolver fetches from S3 the payloads of the records that were too large for kinesis, whose
+// data only points to the S3 object holding them
+type ClaimCheckResolver struct {
+	S3 s3iface.S3API
+	// Detect returns the S3 object holding the payload of a record, ok is false for the records
+	// carrying their own payload. Called from multiple go routines.
+	Detect func(data []byte) (bucket, key string, ok bool)
+	// Max number of objects fetched at once by all the shard workers, 0 for no limit
+	Concurrency int
+	// How failed fetches are retried, the Config's Retryer if nil
+	Retryer Retryer
+}
+
+// DetectS3URL is a ClaimCheckResolver Detect function for the records whose data is an s3://bucket/key URL
+func DetectS3URL(data []byte) (bucket, key string, ok bool) {
+	const scheme = "s3://"
+	if !bytes.HasPrefix(data, []byte(scheme)) {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(bytes.TrimSpace(data[len(scheme):])), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// errClaimCheckStopped is returned by resolveClaimCheck when the consumers stopped before the
+// payload was fetched
+var errClaimCheckStopped = errors.New("the consumers stopped while fetching the payload")
+
+// resolveClaimCheck replaces the data of a record pointing to an S3 object with the object, giving up
+// with errClaimCheckStopped if the consumers stop while it waits for a fetch slot or to retry
+func (k *Kinsumer) resolveClaimCheck(record *kinesis.Record) error {
+	resolver := k.config.claimCheck
+	if resolver == nil {
+		return nil
+	}
+	bucket, key, ok := resolver.Detect(record.Data)
+	if !ok {
+		return nil
+	}
+
+	stop := k.stopping()
+	if k.claimCheckSlots != nil {
+		select {
+		case k.claimCheckSlots <- struct{}{}:
+		case <-stop:
+			return errClaimCheckStopped
+		}
+		defer func() { <-k.claimCheckSlots }()
+	}
+	retryer := resolver.Retryer
+	if retryer == nil {
+		retryer = k.config.retryer
+	}
+
+	var data []byte
+	err := retrier{retryer: retryer, logger: k.config.logger, stop: k.stopping}.do("GetObject", func() error {
+		out, err := resolver.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		data, err = ioutil.ReadAll(out.Body)
+		return err
+	})
+	if err != nil {
+		select {
+		case <-stop:
+			return errClaimCheckStopped
+		default:
+		}
+		return fmt.Errorf("error fetching the payload of record %s from s3://%s/%s: %w",
+			aws.StringValue(record.SequenceNumber), bucket, key, err)
+	}
+	record.Data = data
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// mockS3 serves objects from memory, failing the first failures requests
+type mockS3 struct {
+	s3iface.S3API
+	objects  map[string][]byte
+	failures int
+	requests int
+}
+
+func (m *mockS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.requests++
+	if m.requests <= m.failures {
+		return nil, awserr.New("InternalError", "try again", nil)
+	}
+	data, ok := m.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func TestDetectS3URL(t *testing.T) {
+	bucket, key, ok := DetectS3URL([]byte("s3://bucket/path/to/key\n"))
+	require.True(t, ok)
+	require.Equal(t, "bucket", bucket)
+	require.Equal(t, "path/to/key", key)
+
+	for _, data := range []string{"payload", "s3://bucket", "s3:///key", ""} {
+		_, _, ok = DetectS3URL([]byte(data))
+		require.False(t, ok, data)
+	}
+}
+
+func TestResolveClaimCheck(t *testing.T) {
+	store := &mockS3{objects: map[string][]byte{"bucket/key": []byte("large payload")}, failures: 1}
+	resolver := ClaimCheckResolver{
+		S3:          store,
+		Detect:      DetectS3URL,
+		Concurrency: 1,
+		Retryer:     RetryPolicy{MaxAttempts: 2, Backoff: ExponentialBackoff{}},
+	}
+	config := NewConfig().WithLogger(&recordingLogger{}).WithClaimCheckResolver(resolver)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	// Records carrying their own payload are left alone
+	record := &kinesis.Record{SequenceNumber: aws.String("1"), Data: []byte("small payload")}
+	require.NoError(t, k.resolveClaimCheck(record))
+	require.Equal(t, "small payload", string(record.Data))
+	require.Equal(t, 0, store.requests)
+
+	// The failed fetch is retried
+	record = &kinesis.Record{SequenceNumber: aws.String("2"), Data: []byte("s3://bucket/key")}
+	require.NoError(t, k.resolveClaimCheck(record))
+	require.Equal(t, "large payload", string(record.Data))
+	require.Equal(t, 2, store.requests)
+
+	record = &kinesis.Record{SequenceNumber: aws.String("3"), Data: []byte("s3://bucket/missing")}
+	require.Error(t, k.resolveClaimCheck(record))
+	require.Equal(t, "s3://bucket/missing", string(record.Data))
+
+	// Stopping the consumers ends the wait for a fetch slot
+	k.stop = make(chan struct{})
+	k.claimCheckSlots <- struct{}{}
+	close(k.stop)
+	require.Equal(t, errClaimCheckStopped, k.resolveClaimCheck(&kinesis.Record{Data: []byte("s3://bucket/key")}))
+	<-k.claimCheckSlots
+
+	// And the wait to retry a fetch
+	store.failures = store.requests + 1
+	k.config.claimCheck.Retryer = RetryPolicy{MaxAttempts: 2, Backoff: ExponentialBackoff{Base: time.Hour, Max: time.Hour}}
+	require.Equal(t, errClaimCheckStopped, k.resolveClaimCheck(&kinesis.Record{Data: []byte("s3://bucket/key")}))
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// clientsGenerationKey is the key of the metadata table item counting the changes of the clients,
+// incremented whenever a client joins or leaves so the clients caching the clients table know
+// when to scan it again
+const clientsGenerationKey = "ClientsGeneration"
+
+type clientsGenerationRecord struct {
+	Key        string
+	Generation int64
+}
+
+// clientsCache is the last scan of the clients table, and the generation it was made at
+type clientsCache struct {
+	mutex      sync.Mutex
+	clients    []clientRecord
+	generation int64
+	scannedAt  time.Time
+	// IDs of the clients the leader saw last time it checked for expired clients
+	leaderSeen []string
+}
+
+// loadClientsGeneration returns the generation of the clients, 0 if it was never incremented
+func loadClientsGeneration(db dynamodbiface.DynamoDBAPI, tableName string) (int64, error) {
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(clientsGenerationKey)},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var record clientsGenerationRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return 0, err
+	}
+	return record.Generation, nil
+}
+
+// incrementClientsGeneration records that the clients changed
+func incrementClientsGeneration(db dynamodbiface.DynamoDBAPI, tableName string) error {
+	_, err := db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(clientsGenerationKey)},
+		},
+		UpdateExpression: aws.String("ADD Generation :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+	})
+	return err
+}
+
+// clientsChanged increments the generation of the clients after one joined or left. Clients
+// caching the clients table notice the change at their next scan of it otherwise.
+func (k *Kinsumer) clientsChanged() {
+	if err := incrementClientsGeneration(k.dynamodb, k.metadataTableName); err != nil {
+		k.logf(LevelWarn, "clientsGeneration", "", "Error incrementing the generation of the clients: %s", err)
+	}
+}
+
+// loadClients returns the clients that were updated recently. With Config.WithClientsCache it only
+// scans the clients table when their generation changed or the last scan is too old.
+func (k *Kinsumer) loadClients() ([]clientRecord, error) {
+	maxAge := k.config.clientsCacheAge
+	if maxAge == 0 {
+		clients, err := getClients(k.dynamodb, k.clientID(), k.clientsTableName, k.maxAgeForClientRecord)
+		return k.homeClients(clients), err
+	}
+
+	generation, err := loadClientsGeneration(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the generation of the clients: %w", err)
+	}
+	cache := k.clientsCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if cache.clients != nil && cache.generation == generation && now.Sub(cache.scannedAt) < maxAge &&
+		containsClient(cache.clients, k.clientID()) {
+		return k.homeClients(append([]clientRecord(nil), cache.clients...)), nil
+	}
+
+	clients, err := getClients(k.dynamodb, k.clientID(), k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return nil, err
+	}
+	cache.clients, cache.generation, cache.scannedAt = clients, generation, now
+	return k.homeClients(append([]clientRecord(nil), clients...)), nil
+}
+
+// checkExpiredClients is a leader action scanning the clients table, and incrementing the
+// generation of the clients if they changed since the previous check, so the clients that
+// expired without leaving are noticed by the clients caching the clients table
+func (k *Kinsumer) checkExpiredClients() error {
+	clients, err := getClients(k.dynamodb, k.clientID(), k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(clients))
+	for i, c := range clients {
+		ids[i] = c.ID
+	}
+
+	cache := k.clientsCache
+	cache.mutex.Lock()
+	changed := cache.leaderSeen == nil || !stringSlicesEqual(cache.leaderSeen, ids)
+	cache.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+	if err = incrementClientsGeneration(k.dynamodb, k.metadataTableName); err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	cache.leaderSeen = ids
+	cache.mutex.Unlock()
+	return nil
+}
+
+func containsClient(clients []clientRecord, id string) bool {
+	for _, c := range clients {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// generationDynamo keeps the generation of the clients, and counts the scans of the clients table
+type generationDynamo struct {
+	*clientsDynamo
+	generation int64
+	scans      int
+}
+
+func (d *generationDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"Key":        {S: aws.String(clientsGenerationKey)},
+		"Generation": {N: aws.String(strconv.FormatInt(d.generation, 10))},
+	}}, nil
+}
+
+func (d *generationDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	d.generation++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (d *generationDynamo) ScanPages(in *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool) error {
+	d.scans++
+	return d.clientsDynamo.ScanPages(in, pager)
+}
+
+func TestClientsCache(t *testing.T) {
+	db := &generationDynamo{clientsDynamo: &clientsDynamo{
+		DynamoDBAPI: mocks.NewMockDynamo(nil),
+		clients:     make(map[string]map[string]*dynamodb.AttributeValue),
+	}}
+	config := NewConfig().WithHeartbeatFrequency(time.Second).WithClientsCache(time.Hour)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	// Joining increments the generation, so the table is scanned
+	clients := k.beat(nil, &backoff{})
+	require.Equal(t, []string{k.clientID()}, clients)
+	require.Equal(t, int64(1), db.generation)
+	require.Equal(t, 1, db.scans)
+
+	// Heartbeats alone reuse the cache
+	clients = k.beat(clients, &backoff{})
+	clients = k.beat(clients, &backoff{})
+	require.Equal(t, int64(1), db.generation)
+	require.Equal(t, 1, db.scans)
+
+	// Another client joining invalidates it
+	_, err = registerWithClientsTable(db, clientRecord{ID: "other", Name: "other"}, k.clientsTableName, k.maxAgeForClientRecord)
+	require.NoError(t, err)
+	db.generation++
+	clients = k.beat(clients, &backoff{})
+	require.Len(t, clients, 2)
+	require.Equal(t, 2, db.scans)
+
+	// The leader notices the clients that expired without leaving
+	require.NoError(t, k.checkExpiredClients())
+	require.Equal(t, int64(3), db.generation, "first check")
+	require.NoError(t, k.checkExpiredClients())
+	require.Equal(t, int64(3), db.generation, "nothing changed")
+	// Filtered out by the scan once expired
+	delete(db.clients, "other")
+	require.NoError(t, k.checkExpiredClients())
+	require.Equal(t, int64(4), db.generation, "a client expired")
+	require.Len(t, k.beat(clients, &backoff{}), 1)
+}
@@ -5,8 +5,10 @@ package kinsumer
 //TODO: The filename is bad
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -25,6 +27,15 @@ type clientRecord struct {
 	// library, rather they are useful for manual troubleshooting
 	Name          string
 	LastUpdateRFC string
+
+	// Availability zone of the client, for the zoned assignment strategies
+	Zone string `dynamodbav:",omitempty"`
+	// Epoch of the home region the client registered in, with global tables
+	HomeEpoch int64 `dynamodbav:",omitempty"`
+	// Metadata published by the client, see WithClientMetadata
+	Hostname string            `dynamodbav:",omitempty"`
+	Version  string            `dynamodbav:",omitempty"`
+	Labels   map[string]string `dynamodbav:",omitempty"`
 }
 
 type sortableClients []clientRecord
@@ -41,28 +52,32 @@ func (sc sortableClients) Swap(left, right int) {
 	sc[left], sc[right] = sc[right], sc[left]
 }
 
-// registerWithClientsTable adds or updates our client with a current LastUpdate in dynamo
-func registerWithClientsTable(db dynamodbiface.DynamoDBAPI, id, name, tableName string) error {
+// registerWithClientsTable adds or updates the client with a current LastUpdate in dynamo, returning
+// whether the client joined, having no record updated within maxAgeForClientRecord before
+func registerWithClientsTable(db dynamodbiface.DynamoDBAPI, client clientRecord, tableName string, maxAgeForClientRecord time.Duration) (bool, error) {
 	now := time.Now()
-	item, err := dynamodbattribute.MarshalMap(clientRecord{
-		ID:            id,
-		Name:          name,
-		LastUpdate:    now.UnixNano(),
-		LastUpdateRFC: now.UTC().Format(time.RFC1123Z),
-	})
+	client.LastUpdate = now.UnixNano()
+	client.LastUpdateRFC = now.UTC().Format(time.RFC1123Z)
+	item, err := dynamodbattribute.MarshalMap(client)
 
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if _, err = db.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
-	}); err != nil {
-		return err
+	out, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName:    aws.String(tableName),
+		Item:         item,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	var previous clientRecord
+	if err = dynamodbattribute.UnmarshalMap(out.Attributes, &previous); err != nil {
+		return false, err
+	}
+	return previous.LastUpdate <= now.Add(-maxAgeForClientRecord).UnixNano(), nil
 }
 
 // deregisterWithClientsTable deletes our client from dynamo
@@ -180,3 +195,114 @@ func reapClients(db dynamodbiface.DynamoDBAPI, tableName string) error {
 	}
 	return nil
 }
+
+// heartbeat updates our client record every heartbeat period until stop is closed, and requests a
+// refresh of the shards whenever clients came or went since the previous heartbeat.
+func (k *Kinsumer) heartbeat(stop <-chan struct{}) {
+	defer k.recoverPanic("heartbeat", "")
+	ticker := time.NewTicker(k.config.heartbeatFrequency)
+	defer ticker.Stop()
+
+	beatBackoff := &backoff{policy: k.config.throttleBackoff}
+	var clients []string
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		clients = k.beat(clients, beatBackoff)
+	}
+}
+
+// beat updates our client record and requests a refresh if the clients changed since previous, nil
+// before the first beat. It returns the IDs of the current clients. The beats are skipped until we
+// are done backing off after a throttled one.
+func (k *Kinsumer) beat(previous []string, beatBackoff *backoff) []string {
+	if k.standingBy() {
+		k.health.heartbeat(time.Now())
+		return previous
+	}
+	now := time.Now()
+	if !beatBackoff.ready(now) {
+		return previous
+	}
+	joined, err := registerWithClientsTable(k.dynamodb, k.clientRecord(), k.clientsTableName, k.maxAgeForClientRecord)
+	if isThrottle(err) {
+		k.throttled("heartbeat", "", beatBackoff.throttled(now))
+		return previous
+	}
+	if err != nil {
+		k.reportError("heartbeat", "", fmt.Errorf("error updating client: %v", err))
+		return previous
+	}
+	beatBackoff.reset()
+	if joined {
+		k.clientsChanged()
+	}
+	k.health.heartbeat(time.Now())
+	clients, err := k.loadClients()
+	if err != nil {
+		k.reportError("heartbeat", "", fmt.Errorf("error loading clients: %v", err))
+		return previous
+	}
+	current := make([]string, len(clients))
+	for i, c := range clients {
+		current[i] = c.ID
+	}
+	if previous != nil && !stringSlicesEqual(previous, current) {
+		k.requestRefresh()
+	}
+	return current
+}
+
+// clientRecord returns the record of our client, without its LastUpdate
+func (k *Kinsumer) clientRecord() clientRecord {
+	return clientRecord{
+		ID:        k.clientID(),
+		Name:      k.clientName,
+		Zone:      k.config.availabilityZone,
+		HomeEpoch: atomic.LoadInt64(&k.homeEpoch),
+		Hostname:  k.config.clientMetadata.Hostname,
+		Version:   k.config.clientMetadata.Version,
+		Labels:    k.config.clientMetadata.Labels,
+	}
+}
+
+// homeClients keeps the clients registered in the current home region, with global tables
+func (k *Kinsumer) homeClients(clients []clientRecord) []clientRecord {
+	epoch := atomic.LoadInt64(&k.homeEpoch)
+	if k.config.region == "" || epoch == 0 {
+		return clients
+	}
+	home := clients[:0]
+	for _, c := range clients {
+		if c.HomeEpoch == epoch {
+			home = append(home, c)
+		}
+	}
+	return home
+}
+
+// startHeartbeat starts updating our client record every heartbeat period, if there is one
+func (k *Kinsumer) startHeartbeat() {
+	if k.config.heartbeatFrequency <= 0 {
+		return
+	}
+	k.heartbeatStop = make(chan struct{})
+	k.heartbeatWG.Add(1)
+	go func(stop <-chan struct{}) {
+		defer k.heartbeatWG.Done()
+		k.heartbeat(stop)
+	}(k.heartbeatStop)
+}
+
+// stopHeartbeat stops the heartbeat and waits until it returned
+func (k *Kinsumer) stopHeartbeat() {
+	if k.heartbeatStop == nil {
+		return
+	}
+	close(k.heartbeatStop)
+	k.heartbeatWG.Wait()
+	k.heartbeatStop = nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientExpiry(t *testing.T) {
+	config := NewConfig().WithShardCheckFrequency(time.Minute)
+	require.Equal(t, 5*time.Minute, config.clientExpiry(), "five shard checks by default")
+	config = config.WithHeartbeatFrequency(time.Second)
+	require.Equal(t, 5*time.Second, config.clientExpiry(), "five heartbeats")
+	config = config.WithClientExpiryAge(3 * time.Second)
+	require.Equal(t, 3*time.Second, config.clientExpiry())
+
+	config = config.WithClientExpiryAge(time.Second)
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidClientExpiryAge))
+}
+
+// clientsDynamo keeps one item per client, where the dynamo mock appends every put
+type clientsDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	clients map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (d *clientsDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	id := aws.StringValue(in.Item["ID"].S)
+	previous := d.clients[id]
+	d.clients[id] = in.Item
+	return &dynamodb.PutItemOutput{Attributes: previous}, nil
+}
+
+func (d *clientsDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	delete(d.clients, aws.StringValue(in.Key["ID"].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (d *clientsDynamo) ScanPages(in *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool) error {
+	var ids []string
+	for id := range d.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &dynamodb.ScanOutput{}
+	for _, id := range ids {
+		out.Items = append(out.Items, d.clients[id])
+	}
+	pager(out, true)
+	return nil
+}
+
+func TestHeartbeat(t *testing.T) {
+	db := &clientsDynamo{
+		DynamoDBAPI: mocks.NewMockDynamo(nil),
+		clients:     make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+	config := NewConfig().WithHeartbeatFrequency(time.Second)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+	refreshRequested := func() bool {
+		select {
+		case <-k.refreshRequested:
+			return true
+		default:
+			return false
+		}
+	}
+
+	clients := k.beat(nil, &backoff{})
+	require.Equal(t, []string{k.clientID()}, clients, "our client is registered")
+	clients = k.beat(clients, &backoff{})
+	require.False(t, refreshRequested(), "the clients didn't change")
+
+	_, err = registerWithClientsTable(db, clientRecord{ID: "other", Name: "other"}, k.clientsTableName, time.Minute)
+	require.NoError(t, err)
+	clients = k.beat(clients, &backoff{})
+	require.Len(t, clients, 2)
+	require.True(t, refreshRequested(), "a client joined")
+}
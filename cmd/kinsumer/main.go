@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/brenol/kinsumer"
+)
+
+// command is a subcommand of kinsumer, run with the arguments following its name
+type command struct {
+	summary string
+	run     func(args []string)
+}
+
+// commands are the subcommands of kinsumer by name
+var commands = map[string]command{
+	"export": {summary: "write the checkpoints and metadata of an application as JSON", run: exportState},
+	"import": {summary: "restore the checkpoints and metadata exported from an application", run: importState},
+	"replay": {summary: "print the records of a stream between two times", run: replay},
+	"status": {summary: "print the clients of an application and the shards they own", run: status},
+	"tail":   {summary: "print the records of a stream as they arrive", run: tail},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nRun %s <command> -h for the flags of a command\n", os.Args[0])
+}
+
+// newKinsumer returns a Kinsumer of the given stream and application, which is not run
+func newKinsumer(streamName, applicationName string) *kinsumer.Kinsumer {
+	if len(streamName) == 0 {
+		log.Fatalln("stream commandline parameter is required")
+	}
+	session := session.Must(session.NewSession(aws.NewConfig()))
+	k, err := kinsumer.NewWithSession(session, streamName, applicationName, "kinsumer", kinsumer.NewConfig())
+	if err != nil {
+		log.Fatalf("Error creating kinsumer: %v", err)
+	}
+	return k
+}
+
+// parseTime parses a RFC 3339 time, or a duration before now such as 5m
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a RFC 3339 time nor a duration", value)
+	}
+	return t, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(flag.Args()[1:])
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brenol/kinsumer"
+)
+
+// replayedRecord is a record printed by replay, one JSON object per line
+type replayedRecord struct {
+	ShardID        string    `json:"shard"`
+	SequenceNumber string    `json:"sequenceNumber"`
+	PartitionKey   string    `json:"partitionKey"`
+	Arrival        time.Time `json:"arrival"`
+	Data           []byte    `json:"data"`
+}
+
+// replay prints the records of a stream between two times as JSON lines, without touching the
+// checkpoints of the applications consuming it
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	streamName := flags.String("stream", "", "name of kinesis stream")
+	from := flags.String("from", "", "RFC 3339 time or duration ago the replay starts at")
+	to := flags.String("to", "0s", "RFC 3339 time or duration ago the replay ends at")
+	shards := flags.Int("shards", 4, "number of shards replayed at once")
+	_ = flags.Parse(args)
+
+	if len(*from) == 0 {
+		log.Fatalln("from commandline parameter is required")
+	}
+	now := time.Now()
+	start, err := parseTime(*from, now)
+	if err != nil {
+		log.Fatalf("Invalid from: %v", err)
+	}
+	end, err := parseTime(*to, now)
+	if err != nil {
+		log.Fatalf("Invalid to: %v", err)
+	}
+	// The replay doesn't use the tables, the application name doesn't matter
+	k := newKinsumer(*streamName, "kinsumer-replay")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	var mutex sync.Mutex
+	encoder := json.NewEncoder(os.Stdout)
+	err = k.Replay(ctx, start, end, *shards, func(record *kinsumer.Record) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return encoder.Encode(replayedRecord{
+			ShardID:        record.ShardID,
+			SequenceNumber: record.SequenceNumber,
+			PartitionKey:   record.PartitionKey,
+			Arrival:        record.ApproximateArrivalTimestamp,
+			Data:           record.Data,
+		})
+	})
+	if err != nil {
+		log.Fatalf("Error replaying stream %s: %v", *streamName, err)
+	}
+}
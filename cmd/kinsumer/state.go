@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+// exportState writes the checkpoints and metadata of an application as JSON, to a file or stdout
+func exportState(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	streamName := flags.String("stream", "", "name of kinesis stream")
+	applicationName := flags.String("application", "", "name of the application consuming the stream")
+	output := flags.String("output", "", "file the state is written to, stdout by default")
+	_ = flags.Parse(args)
+
+	if len(*applicationName) == 0 {
+		log.Fatalln("application commandline parameter is required")
+	}
+	k := newKinsumer(*streamName, *applicationName)
+
+	var w io.Writer = os.Stdout
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating %s: %v", *output, err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Fatalf("Error writing %s: %v", *output, err)
+			}
+		}()
+		w = f
+	}
+	if err := k.ExportState(w); err != nil {
+		log.Fatalf("Error exporting the state of %s: %v", *applicationName, err)
+	}
+}
+
+// importState restores the checkpoints and metadata exported from an application, possibly
+// another one, into the tables of an application whose clients are stopped
+func importState(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	streamName := flags.String("stream", "", "name of kinesis stream")
+	applicationName := flags.String("application", "", "name of the application the state is imported into")
+	input := flags.String("input", "", "file the state is read from, stdin by default")
+	create := flags.Bool("create", false, "create the tables of the application if they don't exist")
+	_ = flags.Parse(args)
+
+	if len(*applicationName) == 0 {
+		log.Fatalln("application commandline parameter is required")
+	}
+	k := newKinsumer(*streamName, *applicationName)
+	if *create {
+		if err := k.CreateRequiredTables(); err != nil {
+			log.Fatalf("Error creating the tables of %s: %v", *applicationName, err)
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	if len(*input) > 0 {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", *input, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := k.ImportState(r); err != nil {
+		log.Fatalf("Error importing the state into %s: %v", *applicationName, err)
+	}
+	log.Printf("Imported the state into %s", *applicationName)
+}
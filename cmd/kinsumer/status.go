@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// status prints the clients of an application with their metadata and the shards they own
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	streamName := flags.String("stream", "", "name of kinesis stream")
+	applicationName := flags.String("application", "", "name of the application consuming the stream")
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	_ = flags.Parse(args)
+
+	if len(*applicationName) == 0 {
+		log.Fatalln("application commandline parameter is required")
+	}
+	k := newKinsumer(*streamName, *applicationName)
+	s, err := k.Status()
+	if err != nil {
+		log.Fatalf("Error loading the status of %s: %v", *applicationName, err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(s); err != nil {
+			log.Fatalf("Error encoding the status: %v", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tHOSTNAME\tVERSION\tZONE\tHEARTBEAT\tSHARDS\tLABELS")
+	now := time.Now()
+	for _, c := range s.Clients {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s ago\t%d\t%s\n", c.ID, c.Name, c.Hostname, c.Version, c.Zone,
+			now.Sub(c.LastUpdate).Round(time.Second), len(c.Shards), labels(c.Labels))
+	}
+	_ = w.Flush()
+	if len(s.UnownedShards) > 0 {
+		fmt.Printf("\nUnowned shards: %s\n", strings.Join(s.UnownedShards, ", "))
+	}
+}
+
+// labels formats the labels of a client as name=value pairs sorted by name
+func labels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer"
+)
+
+// tailer prints the records of the shards it follows as they arrive
+type tailer struct {
+	ctx        context.Context
+	k          *kinsumer.Kinsumer
+	kinesis    kinesisiface.KinesisAPI
+	streamName string
+	formatJSON bool
+	out        io.Writer
+
+	mutex   sync.Mutex // protects out and started
+	started map[string]bool
+	wg      sync.WaitGroup
+}
+
+// tail prints the records of a stream as they arrive, without registering in the clients table
+func tail(args []string) {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	streamName := flags.String("stream", "", "name of kinesis stream")
+	shardID := flags.String("shard", "", "ID of the only shard to tail, all the shards by default")
+	since := flags.String("since", "", "RFC 3339 time or duration ago to start at, the latest records by default")
+	formatJSON := flags.Bool("json", false, "indent the data of the records that are JSON")
+	_ = flags.Parse(args)
+
+	position := kinsumer.ShardReaderFromLatest()
+	if len(*since) > 0 {
+		start, err := parseTime(*since, time.Now())
+		if err != nil {
+			log.Fatalf("Invalid since: %v", err)
+		}
+		position = kinsumer.ShardReaderFromAtTimestamp(start)
+	}
+	// Reading shards doesn't use the tables, the application name doesn't matter
+	k := newKinsumer(*streamName, "kinsumer-tail")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	t := &tailer{
+		ctx:        ctx,
+		k:          k,
+		kinesis:    kinesis.New(session.Must(session.NewSession(aws.NewConfig()))),
+		streamName: *streamName,
+		formatJSON: *formatJSON,
+		out:        os.Stdout,
+		started:    make(map[string]bool),
+	}
+	if len(*shardID) > 0 {
+		t.follow(*shardID, position)
+	} else {
+		shards, err := t.listShards()
+		if err != nil {
+			log.Fatalf("Error listing the shards of stream %s: %v", *streamName, err)
+		}
+		for _, shard := range shards {
+			// Closed shards have no latest records
+			open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+			if open || position.IteratorType != kinesis.ShardIteratorTypeLatest {
+				t.follow(aws.StringValue(shard.ShardId), position)
+			}
+		}
+	}
+	t.wg.Wait()
+}
+
+// listShards returns the shards of the stream
+func (t *tailer) listShards() ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	in := &kinesis.ListShardsInput{StreamName: aws.String(t.streamName)}
+	for {
+		out, err := t.kinesis.ListShardsWithContext(t.ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		// The stream name must not be set along with a NextToken
+		in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// follow prints the records of the shard from the given position, and then the records of its
+// children once it is closed
+func (t *tailer) follow(shardID string, position kinsumer.ShardPosition) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.started[shardID] {
+		return
+	}
+	t.started[shardID] = true
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ended, err := t.print(shardID, position)
+		if err != nil {
+			if t.ctx.Err() == nil {
+				log.Printf("Error reading shard %s: %v", shardID, err)
+			}
+			return
+		}
+		if ended {
+			t.followChildren(shardID)
+		}
+	}()
+}
+
+// print prints the records of the shard, and returns whether the end of the shard was reached
+func (t *tailer) print(shardID string, position kinsumer.ShardPosition) (bool, error) {
+	reader, err := t.k.OpenShard(t.ctx, shardID, position)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return false, err
+		}
+		if record == nil {
+			return true, nil
+		}
+		t.mutex.Lock()
+		fmt.Fprintf(t.out, "%s %s %s key=%s (%d bytes)\n%s\n", record.ApproximateArrivalTimestamp.Format(time.RFC3339Nano),
+			record.ShardID, record.SequenceNumber, record.PartitionKey, len(record.Data), t.format(record.Data))
+		t.mutex.Unlock()
+	}
+}
+
+// followChildren follows the children of a closed shard from their start
+func (t *tailer) followChildren(shardID string) {
+	shards, err := t.listShards()
+	if err != nil {
+		if t.ctx.Err() == nil {
+			log.Printf("Error listing the children of shard %s: %v", shardID, err)
+		}
+		return
+	}
+	for _, shard := range shards {
+		if aws.StringValue(shard.ParentShardId) == shardID || aws.StringValue(shard.AdjacentParentShardId) == shardID {
+			t.follow(aws.StringValue(shard.ShardId), kinsumer.ShardReaderFromTrimHorizon())
+		}
+	}
+}
+
+// format returns the data of a record as printed: indented if it is JSON and formatJSON is set, as
+// is if it is text, quoted otherwise
+func (t *tailer) format(data []byte) string {
+	if t.formatJSON && json.Valid(data) {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err == nil {
+			return indented.String()
+		}
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return fmt.Sprintf("%q", data)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/brenol/kinsumer"
+)
+
+var (
+	kinesisStreamName  string
+	fromApplication    string
+	toApplication      string
+	createDynamoTables bool
+	statusOnly         bool
+	wait               bool
+)
+
+func init() {
+	flag.StringVar(&kinesisStreamName, "stream", "", "name of kinesis stream")
+	flag.StringVar(&fromApplication, "from", "", "application name the tables are migrated from")
+	flag.StringVar(&toApplication, "to", "", "application name the tables are migrated to")
+	flag.BoolVar(&createDynamoTables, "createTables", false, "create the dynamo db tables of the new application name")
+	flag.BoolVar(&statusOnly, "status", false, "only print the status of the migration")
+	flag.BoolVar(&wait, "wait", false, "wait for the migration to be done")
+}
+
+func newKinsumer(session *session.Session, applicationName string) *kinsumer.Kinsumer {
+	k, err := kinsumer.NewWithSession(session, kinesisStreamName, applicationName, "migratetables", kinsumer.NewConfig())
+	if err != nil {
+		log.Fatalf("Error creating kinsumer: %v", err)
+	}
+	return k
+}
+
+func printStatus(k *kinsumer.Kinsumer) *kinsumer.Migration {
+	migration, err := k.MigrationStatus()
+	if err != nil {
+		log.Fatalf("Error loading migration status: %v", err)
+	}
+	if migration == nil {
+		fmt.Printf("The tables of %s are not being migrated\n", fromApplication)
+		return nil
+	}
+	fmt.Printf("Migrating the tables of %s to %s: %s since %s\n", fromApplication, migration.Application,
+		migration.Phase, migration.PhaseChangedAt.Format(time.RFC3339))
+	return migration
+}
+
+func main() {
+	flag.Parse()
+
+	if len(kinesisStreamName) == 0 || len(fromApplication) == 0 {
+		log.Fatalln("stream and from commandline parameters are required")
+	}
+
+	session := session.Must(session.NewSession(aws.NewConfig()))
+	k := newKinsumer(session, fromApplication)
+
+	if !statusOnly {
+		if len(toApplication) == 0 {
+			log.Fatalln("to commandline parameter is required to start a migration")
+		}
+		if createDynamoTables {
+			if err := newKinsumer(session, toApplication).CreateRequiredTables(); err != nil {
+				log.Fatalf("Error creating kinsumer dynamo db tables: %v", err)
+			}
+		}
+		if err := k.MigrateTables(toApplication); err != nil {
+			log.Fatalf("Error starting migration: %v", err)
+		}
+	}
+
+	// The running clients move the migration along, we only watch it
+	for {
+		migration := printStatus(k)
+		if !wait || migration == nil || migration.Phase == kinsumer.MigrationDone {
+			return
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// compactCheckpoints deletes the checkpoints of the shards gone from the stream that weren't written
+// for the checkpoint retention period, and removes the owners gone from the clients table from the
+// checkpoints they still hold. Checkpoints written since they were loaded are left alone.
+func (k *Kinsumer) compactCheckpoints(shards []*kinesis.Shard, checkpoints map[string]*checkpointRecord) error {
+	clients, err := getClients(k.dynamodb, k.clientID(), k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(clients))
+	for _, c := range clients {
+		current[c.ID] = true
+	}
+	exists := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		exists[aws.StringValue(s.ShardId)] = true
+	}
+
+	now := time.Now()
+	retentionCutoff := now.Add(-k.config.checkpointRetention).UnixNano()
+	ownerCutoff := now.Add(-k.maxAgeForClientRecord).UnixNano()
+	var deleted, freed int
+	for shardID, cp := range checkpoints {
+		var err error
+		switch {
+		case !exists[shardID] && cp.LastUpdate < retentionCutoff:
+			err = k.deleteCheckpoint(cp)
+			deleted++
+		case cp.OwnerID != nil && !current[*cp.OwnerID] && cp.LastUpdate < ownerCutoff:
+			err = k.removeCheckpointOwner(cp)
+			freed++
+		default:
+			continue
+		}
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			// Written since we loaded it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if deleted > 0 || freed > 0 {
+		k.logf(LevelInfo, "compactCheckpoints", "", "Compacted checkpoints: deleted %d of shards gone from the stream, removed %d owners gone", deleted, freed)
+	}
+	return nil
+}
+
+// checkpointUnchanged is the condition of a write to a checkpoint that wasn't written since it was loaded
+func checkpointUnchanged(cp *checkpointRecord) (*string, map[string]*dynamodb.AttributeValue) {
+	return aws.String("LastUpdate = :lastUpdate"), map[string]*dynamodb.AttributeValue{
+		":lastUpdate": {N: aws.String(strconv.FormatInt(cp.LastUpdate, 10))},
+	}
+}
+
+func (k *Kinsumer) deleteCheckpoint(cp *checkpointRecord) error {
+	condition, attrVals := checkpointUnchanged(cp)
+	_, err := k.dynamodb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(k.checkpointTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Shard": {S: aws.String(cp.Shard)},
+		},
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: attrVals,
+	})
+	return err
+}
+
+func (k *Kinsumer) removeCheckpointOwner(cp *checkpointRecord) error {
+	condition, attrVals := checkpointUnchanged(cp)
+	_, err := k.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(k.checkpointTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Shard": {S: aws.String(cp.Shard)},
+		},
+		UpdateExpression:          aws.String("REMOVE OwnerID, OwnerName"),
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: attrVals,
+	})
+	return err
+}
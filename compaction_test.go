@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// compactionDynamo records the checkpoints deleted and freed, failing the writes to the raced shard
+type compactionDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	raced   string
+	deleted []string
+	freed   []string
+}
+
+func (d *compactionDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	shard := aws.StringValue(in.Key["Shard"].S)
+	if shard == d.raced {
+		return nil, awserr.New(conditionalFail, "condition failed", nil)
+	}
+	d.deleted = append(d.deleted, shard)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (d *compactionDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	shard := aws.StringValue(in.Key["Shard"].S)
+	if shard == d.raced {
+		return nil, awserr.New(conditionalFail, "condition failed", nil)
+	}
+	d.freed = append(d.freed, shard)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestCompactCheckpoints(t *testing.T) {
+	db := &compactionDynamo{DynamoDBAPI: mocks.NewMockDynamo([]string{"app_clients"}), raced: "raced"}
+	config := NewConfig().WithCheckpointRetention(24 * time.Hour)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	item, err := dynamodbattribute.MarshalMap(clientRecord{ID: "alive", LastUpdate: time.Now().UnixNano()})
+	require.NoError(t, err)
+	_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("app_clients"), Item: item})
+	require.NoError(t, err)
+
+	old := time.Now().Add(-48 * time.Hour).UnixNano()
+	recent := time.Now().Add(-time.Hour).UnixNano()
+	checkpoints := map[string]*checkpointRecord{
+		"gone":        {Shard: "gone", LastUpdate: old},
+		"gone-recent": {Shard: "gone-recent", LastUpdate: recent},
+		"raced":       {Shard: "raced", LastUpdate: old},
+		"orphaned":    {Shard: "orphaned", LastUpdate: recent, OwnerID: aws.String("left")},
+		"owned":       {Shard: "owned", LastUpdate: recent, OwnerID: aws.String("alive")},
+		"fresh":       {Shard: "fresh", LastUpdate: time.Now().UnixNano(), OwnerID: aws.String("starting")},
+	}
+	shards := []*kinesis.Shard{
+		{ShardId: aws.String("orphaned")},
+		{ShardId: aws.String("owned")},
+		{ShardId: aws.String("fresh")},
+	}
+
+	require.NoError(t, k.compactCheckpoints(shards, checkpoints))
+	require.Equal(t, []string{"gone"}, db.deleted, "only the old checkpoints of the shards gone are deleted")
+	require.Equal(t, []string{"orphaned"}, db.freed, "only the stale checkpoints of the clients gone are freed")
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the format the producers compressed the data of the records with
+type Compression int
+
+const (
+	// CompressionNone delivers the data of the records as read from kinesis
+	CompressionNone Compression = iota
+	// CompressionAuto detects the format of each record by its magic bytes, delivering the data of
+	// the records that don't start with any as read from kinesis. Snappy is only detected with the
+	// framing format, as raw snappy blocks have no magic bytes.
+	CompressionAuto
+	// CompressionGzip decompresses gzip data
+	CompressionGzip
+	// CompressionSnappy decompresses snappy data, in the framing format or as a raw block
+	CompressionSnappy
+	// CompressionZstd decompresses zstd frames
+	CompressionZstd
+)
+
+// String returns the name of the format
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionAuto:
+		return "auto"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	errUnknownCompression = errors.New("unknown compression")
+	errDecompressionLimit = errors.New("data decompresses to more than the decompression limit")
+)
+
+// zstd decoders run go routines, so a single one by decompression limit is shared by all the shards
+var (
+	zstdDecoders     = make(map[int64]*zstd.Decoder)
+	zstdDecodersLock sync.Mutex
+)
+
+// zstdDecoder returns the decoder failing to decode frames to more than limit bytes, or with a
+// window larger than limit
+func zstdDecoder(limit int64) (*zstd.Decoder, error) {
+	zstdDecodersLock.Lock()
+	defer zstdDecodersLock.Unlock()
+	if d, ok := zstdDecoders[limit]; ok {
+		return d, nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[limit] = d
+	return d, nil
+}
+
+// readLimited reads r to the end, failing once more than limit bytes were read
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errDecompressionLimit
+	}
+	return data, nil
+}
+
+// detectCompression returns the format of data according to its magic bytes
+func detectCompression(data []byte) Compression {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(data, snappyMagic):
+		return CompressionSnappy
+	case bytes.HasPrefix(data, zstdMagic):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// decompress returns data decompressed from the given format, failing if it decompresses to more
+// than limit bytes
+func decompress(compression Compression, data []byte, limit int64) ([]byte, error) {
+	if compression == CompressionAuto {
+		compression = detectCompression(data)
+	}
+
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, limit)
+	case CompressionSnappy:
+		if bytes.HasPrefix(data, snappyMagic) {
+			return readLimited(snappy.NewReader(bytes.NewReader(data)), limit)
+		}
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > limit {
+			return nil, errDecompressionLimit
+		}
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		d, err := zstdDecoder(limit)
+		if err != nil {
+			return nil, err
+		}
+		return d.DecodeAll(data, nil)
+	}
+	return nil, errUnknownCompression
+}
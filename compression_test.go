@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 200)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, err = sw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstded := zw.EncodeAll(data, nil)
+	require.NoError(t, zw.Close())
+
+	tests := []struct {
+		compression Compression
+		data        []byte
+	}{
+		{CompressionNone, data},
+		{CompressionGzip, gzipped.Bytes()},
+		{CompressionSnappy, framed.Bytes()},
+		{CompressionSnappy, snappy.Encode(nil, data)},
+		{CompressionZstd, zstded},
+		{CompressionAuto, data},
+		{CompressionAuto, gzipped.Bytes()},
+		{CompressionAuto, framed.Bytes()},
+		{CompressionAuto, zstded},
+	}
+	for _, test := range tests {
+		decompressed, err := decompress(test.compression, test.data, int64(len(data)))
+		require.NoError(t, err, test.compression.String())
+		require.Equal(t, data, decompressed, test.compression.String())
+
+		// Data decompressing to more than the limit fails rather than being read in memory
+		if test.compression != CompressionNone && !bytes.Equal(test.data, data) {
+			_, err = decompress(test.compression, test.data, int64(len(data))-1)
+			require.Error(t, err, test.compression.String())
+		}
+	}
+
+	_, err = decompress(CompressionGzip, data, 1<<20)
+	require.Error(t, err)
+	_, err = decompress(CompressionZstd, data, 1<<20)
+	require.Error(t, err)
+
+	config := NewConfig().WithDecompressionLimit(0)
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidDecompressionLimit))
+}
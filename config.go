@@ -3,8 +3,12 @@
 package kinsumer
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
@@ -15,17 +19,114 @@ import (
 type Config struct {
 	stats  StatReceiver
 	logger Logger
+	// Optional handler of the typed events, such as shards captured and leadership changes
+	eventHandler EventHandler
+
+	// Optional function used to track throughput per logical key
+	keyExtractor KeyExtractor
+	// Optional function called with the checkpoint metadata every time a shard is captured
+	shardCaptureHook ShardCaptureHook
+	// Optional function called after every successful checkpoint commit
+	onCheckpoint CheckpointHook
+	// Optional function called after every successful checkpoint commit, with the time of the commit
+	onCommit CommitHook
+	// Optional function called by the leader when the shards of the stream change
+	reshardHook ReshardHook
+	// Only move the checkpoints with CommitTransaction, rather than when records are returned
+	transactionalCheckpoints bool
+	// Optional function called with the position the shards were resumed at after Run was called
+	recoveryHook RecoveryHook
+	// Optional reporter of the errors and panics happening inside kinsumer
+	errorReporter ErrorReporter
+	// Optional function processing every record before it is returned, records it fails are tried
+	// again after recordHookRetryDelay
+	recordHook           RecordHook
+	recordHookRetryDelay time.Duration
+	// Optional function run by the shard workers, records it returns false for are skipped
+	recordFilter func(Record) bool
+	// Optional function run by the shard workers, records it returns an error for are corrupt and
+	// halt their shard, are skipped or are sent to the dead-letter sink by corruptRecordPolicy
+	recordValidator     RecordValidator
+	corruptRecordPolicy corruptRecordPolicy
+	// How long the records returned are remembered in the deduplication table so they aren't
+	// returned again, by deduplicationKey if set, 0 to disable
+	deduplicationWindow time.Duration
+	deduplicationKey    DeduplicationKey
+	// Optional function removing sensitive record data from the errors kinsumer logs or reports
+	redactor Redactor
+	// Optional sink of the records that were nacked or failed the record hook deadLetterAttempts times
+	deadLetterSink     DeadLetterSink
+	deadLetterAttempts int
+	// Log the path of one of every deliveryTracing records through kinsumer, 0 to disable
+	deliveryTracing int
 
 	// ---------- [ Per Shard Worker ] ----------
 	// Time to sleep if no records are found
 	throttleDelay time.Duration
 
+	// How long to wait before retrying requests throttled by kinesis or dynamo
+	throttleBackoff BackoffPolicy
+
+	// Optional resolver of the records whose payload was stored in S3, before they are decompressed
+	claimCheck *ClaimCheckResolver
+	// How the data of the records is decompressed before they are buffered, and the most bytes
+	// the data of a record decompresses to
+	decompression      Compression
+	decompressionLimit int64
+
+	// How failed requests to kinesis or dynamo are retried
+	retryer Retryer
+
+	// Max number of records returned by a single GetRecords call
+	getRecordsLimit int64
+	// Approximate number of bytes we want a single GetRecords call to return, 0 for no target
+	getRecordsMaxBytes int
+	// How far behind the tip of the stream a shard must be for its worker to fetch more records,
+	// more often, until it catches up. 0 to never do it.
+	catchUpLag time.Duration
+	// Number of times in a row a GetRecords call returning no records while behind the tip of the
+	// stream is made again right away, rather than after the throttle delay
+	emptyPollRetries int
+
 	// Delay between commits to the checkpoint database
 	commitFrequency time.Duration
+	// Delay between rewrites of the checkpoints that didn't change, refreshing their LastUpdate and
+	// throughput, 0 to only write the checkpoints that changed
+	checkpointTouchFrequency time.Duration
 
 	// Delay between tests for the client or shard numbers changing
 	shardCheckFrequency time.Duration
-	// ---------- [ For the leader (first client alphabetically) ] ----------
+	// Delay between updates of our client record, 0 to update it at every shard check. When set, the
+	// clients table is also checked for clients coming and going at this frequency.
+	heartbeatFrequency time.Duration
+	// How long after its last update a client is considered gone, 0 for five heartbeats
+	clientExpiryAge time.Duration
+	// How long a scan of the clients table is reused while the generation of the clients doesn't
+	// change, 0 to scan it every time
+	clientsCacheAge time.Duration
+	// How long a list of shards loaded from kinesis is reused before calling ListShards again
+	shardListCacheTTL time.Duration
+	// Number of checkpoint commits lost to another owner within quarantineWindow after which
+	// this client drops all its shards and re-registers with a new identity, 0 to never do it
+	quarantineThreshold int
+	quarantineWindow    time.Duration
+	// How shards are divided between the clients
+	assignmentStrategy AssignmentStrategy
+	// Availability zone registered with our client, for the zoned assignment strategies
+	availabilityZone string
+	// Metadata registered with our client, for operators
+	clientMetadata ClientMetadata
+	// ---------- [ For the leader (the client holding a lease by default) ] ----------
+	// Elects the leader, nil for a lease in the metadata table every client runs for
+	leaderElector LeaderElector
+	// Whether only the first client by ID runs for the default lease
+	firstClientLeader bool
+	// How long the checkpoints of the shards gone from the stream are kept, 0 to keep them forever
+	checkpointRetention time.Duration
+	// Recommends splitting and merging shards, nil for no recommendations
+	scalingAdvisor *ScalingAdvisor
+	// Name of the enhanced fan-out consumer registered by the leader, empty for none
+	fanOutConsumer string
 	// Time between leader actions
 	leaderActionFrequency time.Duration
 
@@ -34,6 +135,32 @@ type Config struct {
 	// the workers will stop adding new elements to the queue, so a slow client will
 	// potentially fall behind the kinesis stream.
 	bufferSize int
+	// Size of the buffer of each shard the workers put their records on, and a fair merger moves to
+	// the combined records channel, 0 to put them straight on the combined records channel
+	shardBufferSize int
+	// What the workers do when the buffer is full: wait for room, drop the oldest record in
+	// the buffer, or spill the records to a file of at most spillMaxBytes in spillDirectory
+	bufferOverflowPolicy bufferOverflowPolicy
+	spillDirectory       string
+	spillMaxBytes        int64
+	// How long the application can go without draining buffered records before it is considered
+	// stalled, and the optional function called when it is, 0 to not detect stalls
+	stallThreshold time.Duration
+	stallHook      StallHook
+	// How long after their arrival in kinesis records are held so records of all the shards are
+	// returned in approximate arrival order, 0 to return them as soon as possible
+	arrivalOrderingWindow time.Duration
+	// Max records and bytes per second returned to the application overall, and per shard, 0 for no limit
+	recordsPerSecond      float64
+	bytesPerSecond        float64
+	shardRecordsPerSecond float64
+	shardBytesPerSecond   float64
+	// Bytes of record data per second delivery is paced at, 0 to not pace it, and max bytes of
+	// record data buffered while pacing, 0 for no limit besides the buffer size
+	pacingBytesPerSecond float64
+	pacingMaxBytes       int64
+	// AWS prices used by EstimateCosts
+	costRates CostRates
 
 	// ---------- [ For the Dynamo DB tables ] ----------
 	// Read and write capacity for the Dynamo DB tables when created
@@ -43,11 +170,71 @@ type Config struct {
 	dynamoWriteCapacity int64
 	// Time to wait between attempts to verify tables were created/deleted completely
 	dynamoWaiterDelay time.Duration
+	// Names of the tables, the empty ones are named after the application
+	tableNames TableNames
+	// Region of our dynamo endpoint when the tables are global tables, and the region consuming the
+	// stream until another one takes over, empty if the tables aren't global tables
+	region     string
+	homeRegion string
+	// Copies of the stream in other regions to fail over to in order, how long the stream consumed
+	// fails before the clients fail over, and how far before the failures the shards are resumed at
+	failoverEndpoints []StreamEndpoint
+	failoverAfter     time.Duration
+	failoverRewind    time.Duration
+	// Time between polls of the clients and metadata table streams, 0 if we shouldn't follow them.
+	// Following the streams lets clients react to membership and shard changes within seconds
+	// without having to lower the shardCheckFrequency.
+	tableStreamsPollFrequency time.Duration
+	dynamoStreams             dynamodbstreamsiface.DynamoDBStreamsAPI
+	// Time between the lookups of the leader for shards created since the last one and the checks of
+	// the shard cache by the clients, 0 to only find new shards on shard checks and leader actions
+	shardDiscoveryFrequency time.Duration
 
 	// ---------- [ For the Stream Starting Point ] ----------
 	shardIteratorType string
 	atTimestamp       *time.Time
 	sequenceNumber    string
+	// How long before Run() to start from with AT_TIMESTAMP, when set atTimestamp is resolved from it by Run()
+	atAge time.Duration
+	// Whether checkpoints written before the run started should be ignored so that every shard starts
+	// from the configured iterator, and whether the ignored checkpoints should be cleared
+	// in dynamo as soon as the shard is captured
+	ignoreCheckpoints  bool
+	rewriteCheckpoints bool
+	// Optional position of specific shards, replacing their checkpoints written before the run started and the
+	// configured starting point. startingPositions are the positions given as a map, for validation.
+	startingPositionFor StartingPositionFunc
+	startingPositions   map[string]ShardPosition
+	// Position of the shards without a checkpoint, nil to start them at the configured starting point
+	missingCheckpointFallback *ShardPosition
+	// Position of the shards whose checkpointed sequence number is no longer in the stream, nil to
+	// fail them with ErrCheckpointExpired
+	expiredCheckpointFallback *ShardPosition
+}
+
+// TableNames are the names of the dynamo tables of a Kinsumer
+type TableNames struct {
+	Checkpoints   string // <applicationName>_checkpoints by default
+	Clients       string // <applicationName>_clients by default
+	Metadata      string // <applicationName>_metadata by default
+	Deduplication string // <applicationName>_deduplication by default
+}
+
+// withDefaults returns the names with the empty ones named after the application
+func (n TableNames) withDefaults(applicationName string) TableNames {
+	if n.Checkpoints == "" {
+		n.Checkpoints = applicationName + "_checkpoints"
+	}
+	if n.Clients == "" {
+		n.Clients = applicationName + "_clients"
+	}
+	if n.Metadata == "" {
+		n.Metadata = applicationName + "_metadata"
+	}
+	if n.Deduplication == "" {
+		n.Deduplication = applicationName + "_deduplication"
+	}
+	return n
 }
 
 // NewConfig returns a default Config struct
@@ -55,15 +242,23 @@ func NewConfig() Config {
 	return Config{
 		shardIteratorType:     kinesis.ShardIteratorTypeAfterSequenceNumber,
 		throttleDelay:         250 * time.Millisecond,
+		throttleBackoff:       ExponentialBackoff{Base: 500 * time.Millisecond, Max: 30 * time.Second},
+		retryer:               RetryPolicy{MaxAttempts: 4, Backoff: ExponentialBackoff{Base: time.Second, Max: 4 * time.Second}},
+		getRecordsLimit:       getRecordsLimit,
 		commitFrequency:       1000 * time.Millisecond,
 		shardCheckFrequency:   1 * time.Minute,
+		shardListCacheTTL:     10 * time.Second,
+		quarantineThreshold:   3,
+		quarantineWindow:      5 * time.Minute,
 		leaderActionFrequency: 1 * time.Minute,
+		decompressionLimit:    32 << 20,
 		bufferSize:            100,
 		stats:                 &NoopStatReceiver{},
 		dynamoReadCapacity:    10,
 		dynamoWriteCapacity:   10,
 		dynamoWaiterDelay:     3 * time.Second,
 		logger:                &DefaultLogger{},
+		costRates:             DefaultCostRates(),
 	}
 }
 
@@ -73,18 +268,161 @@ func (c Config) WithThrottleDelay(delay time.Duration) Config {
 	return c
 }
 
+// WithThrottleBackoff returns a Config with a modified policy for backing off after a request to
+// kinesis or dynamo was throttled. Throttled requests are retried until they succeed, so when sharing a
+// stream with other consumers a slower policy leaves them more of the read throughput.
+func (c Config) WithThrottleBackoff(policy BackoffPolicy) Config {
+	c.throttleBackoff = policy
+	return c
+}
+
+// WithRetryer returns a Config with a modified policy for retrying the requests to kinesis or dynamo
+// that failed. By default a request is made up to 4 times, with exponential backoff from 1 second.
+// A request that is still failing is reported as an error. The writes that can't be made twice,
+// adding to an attribute or capturing a shard, aren't retried as a failed one may have gone
+// through, and the retries stop waiting when the consumers stop. The dynamo writes, which include the
+// final commits, the release of the shards and the deregistration of the client, keep being retried
+// while shutting down until the client record would expire. The retries of the AWS SDK clients given
+// to kinsumer are disabled, as they would multiply the attempts, throttled requests are retried a few
+// times as told by the throttle BackoffPolicy instead.
+func (c Config) WithRetryer(retryer Retryer) Config {
+	c.retryer = retryer
+	return c
+}
+
+// WithGetRecordsLimit returns a Config with a modified max number of records per GetRecords call,
+// between 1 and 10000 (the default)
+func (c Config) WithGetRecordsLimit(limit int64) Config {
+	c.getRecordsLimit = limit
+	return c
+}
+
+// WithGetRecordsMaxBytes returns a Config that adjusts the number of records asked for in every
+// GetRecords call to the size of the records of the previous call, so that a call returns about
+// maxBytes of data, until the GetRecords limit. 0 (the default) always asks for the limit.
+func (c Config) WithGetRecordsMaxBytes(maxBytes int) Config {
+	c.getRecordsMaxBytes = maxBytes
+	return c
+}
+
+// WithAdaptiveFetch returns a Config that makes the workers of shards at least catchUpLag behind
+// the tip of the stream double their GetRecords limit after every call, up to 10000 records, and poll
+// as often as kinesis allows, until they have caught up. They then go back to the configured GetRecords
+// limit and throttle delay. The GetRecords max bytes still applies while catching up.
+func (c Config) WithAdaptiveFetch(catchUpLag time.Duration) Config {
+	c.catchUpLag = catchUpLag
+	return c
+}
+
+// WithEmptyPollRetries returns a Config that makes the shard workers call GetRecords again right
+// away, up to retries times in a row, when a call returns no records but kinesis says the shard is
+// behind the tip of the stream, so sparse parts of the stream don't add a throttle delay each
+func (c Config) WithEmptyPollRetries(retries int) Config {
+	c.emptyPollRetries = retries
+	return c
+}
+
 // WithCommitFrequency returns a Config with a modified commit frequency
 func (c Config) WithCommitFrequency(commitFrequency time.Duration) Config {
 	c.commitFrequency = commitFrequency
 	return c
 }
 
+// WithCheckpointTouchFrequency returns a Config that rewrites the checkpoints of the shards that
+// didn't advance at the given frequency, rather than only writing the checkpoints that changed. It
+// refreshes the LastUpdate of idle shards, and their throughput for the ScalingAdvisor. 0 (the default)
+// only writes the checkpoints that changed, or touches them every leader action with a ScalingAdvisor.
+func (c Config) WithCheckpointTouchFrequency(frequency time.Duration) Config {
+	c.checkpointTouchFrequency = frequency
+	return c
+}
+
 // WithShardCheckFrequency returns a Config with a modified shard check frequency
 func (c Config) WithShardCheckFrequency(shardCheckFrequency time.Duration) Config {
 	c.shardCheckFrequency = shardCheckFrequency
 	return c
 }
 
+// WithHeartbeatFrequency returns a Config with a modified heartbeat frequency, the delay between
+// updates of our client record. It lets clients that stopped be detected quickly while checking
+// the shards rarely, as changes of the clients trigger a shard check right away.
+func (c Config) WithHeartbeatFrequency(heartbeatFrequency time.Duration) Config {
+	c.heartbeatFrequency = heartbeatFrequency
+	return c
+}
+
+// WithClientExpiryAge returns a Config with a modified client expiry age, how long after their last
+// heartbeat clients are considered gone and their shards reassigned. It must be longer than the
+// heartbeat frequency.
+func (c Config) WithClientExpiryAge(clientExpiryAge time.Duration) Config {
+	c.clientExpiryAge = clientExpiryAge
+	return c
+}
+
+// WithClientsCache returns a Config that only scans the clients table when clients joined or left,
+// according to a generation counter in the metadata table, or when the previous scan is older than
+// maxAge. Clients that stop without leaving are noticed by the leader, which scans the clients table
+// every leader action. All the clients of an application should use it, as clients without a cache
+// don't check for expired clients when they are the leader.
+func (c Config) WithClientsCache(maxAge time.Duration) Config {
+	c.clientsCacheAge = maxAge
+	return c
+}
+
+// WithShardListCacheTTL returns a Config with a modified shard list cache TTL
+func (c Config) WithShardListCacheTTL(ttl time.Duration) Config {
+	c.shardListCacheTTL = ttl
+	return c
+}
+
+// WithQuarantine returns a Config that quarantines this client once threshold checkpoint commits
+// failed within window because another client owned the shard, which means this client no longer
+// truly owns its shards. A quarantined client releases all its shards and re-registers with a new
+// identity. A threshold of 0 disables quarantining.
+func (c Config) WithQuarantine(threshold int, window time.Duration) Config {
+	c.quarantineThreshold = threshold
+	c.quarantineWindow = window
+	return c
+}
+
+// WithAssignmentStrategy returns a Config with a modified assignment strategy. All the clients of
+// an application must use the same strategy, or some shards will be consumed twice or not at all.
+func (c Config) WithAssignmentStrategy(strategy AssignmentStrategy) Config {
+	c.assignmentStrategy = strategy
+	return c
+}
+
+// WithAvailabilityZone returns a Config that registers the client in the given availability zone,
+// which the AssignmentZoneSpread and AssignmentZoneAffinity strategies use to spread the shards
+// across zones. Clients without a zone are treated as being in a zone of their own.
+func (c Config) WithAvailabilityZone(zone string) Config {
+	c.availabilityZone = zone
+	return c
+}
+
+// ClientMetadata describes a client to the operators looking at the clients table or at the Status of
+// the application. It isn't used to assign the shards, see WithAvailabilityZone for that.
+type ClientMetadata struct {
+	// Host the client runs on, the hostname of the machine by default
+	Hostname string
+	// Version of the application
+	Version string
+	// Labels of the client, such as its deployment or cluster
+	Labels map[string]string
+}
+
+// WithClientMetadata returns a Config with the metadata registered with our client in the clients
+// table, which is kept small as it is written on every heartbeat
+func (c Config) WithClientMetadata(metadata ClientMetadata) Config {
+	labels := make(map[string]string, len(metadata.Labels))
+	for name, value := range metadata.Labels {
+		labels[name] = value
+	}
+	metadata.Labels = labels
+	c.clientMetadata = metadata
+	return c
+}
+
 // WithLeaderActionFrequency returns a Config with a modified leader action frequency
 func (c Config) WithLeaderActionFrequency(leaderActionFrequency time.Duration) Config {
 	c.leaderActionFrequency = leaderActionFrequency
@@ -97,6 +435,290 @@ func (c Config) WithBufferSize(bufferSize int) Config {
 	return c
 }
 
+// WithShardBuffers returns a Config that gives every shard a buffer of the given size. The shard
+// workers put their records on the buffer of their shard, and a merger moves them to the combined
+// buffer taking one record from each shard in turn. A shard whose records are slow to process, or
+// that delivers a large burst, then only holds back its own worker rather than the GetRecords calls
+// of every shard, and the combined buffer can be kept small. The buffer overflow policy applies to
+// the buffers of the shards, and can't be to spill.
+func (c Config) WithShardBuffers(size int) Config {
+	c.shardBufferSize = size
+	return c
+}
+
+// WithStallDetection returns a Config that logs a warning and calls the hook, if not nil, once
+// records have been waiting in the buffer for longer than threshold without the application taking
+// one with Next() or finishing one with Dispatch, so a slow consumer is noticed before it falls far
+// behind the stream. The hook is called again for the next stall, once a record was drained.
+func (c Config) WithStallDetection(threshold time.Duration, hook StallHook) Config {
+	c.stallThreshold = threshold
+	c.stallHook = hook
+	return c
+}
+
+// WithBufferOverflowBlock returns a Config that makes the workers wait for room when the buffer is
+// full, so a slow client falls behind the stream. This is the default.
+func (c Config) WithBufferOverflowBlock() Config {
+	c.bufferOverflowPolicy = bufferOverflowBlock
+	return c
+}
+
+// WithBufferOverflowDropOldest returns a Config that drops the oldest record in the buffer when it
+// is full, for clients that would rather lose old data than fall behind the stream. Dropped records
+// are never returned by Next(), but are checkpointed past like any other record.
+func (c Config) WithBufferOverflowDropOldest() Config {
+	c.bufferOverflowPolicy = bufferOverflowDropOldest
+	return c
+}
+
+// WithBufferOverflowSpill returns a Config that writes the records that don't fit in the buffer to
+// a temporary file in dir (the default temporary directory if empty), blocking the workers once the
+// records spilled and not read back yet reach maxBytes. Spilled records are dropped, and read again
+// from kinesis, when the shards are rebalanced. A spilled record that can't be read back is reported
+// by Next() and dropped like with WithBufferOverflowDropOldest.
+func (c Config) WithBufferOverflowSpill(dir string, maxBytes int64) Config {
+	c.bufferOverflowPolicy = bufferOverflowSpill
+	c.spillDirectory = dir
+	c.spillMaxBytes = maxBytes
+	return c
+}
+
+// WithArrivalOrdering returns a Config that returns the records of all the shards in approximate
+// arrival time order, on a best effort basis. Records are held until window has passed since their arrival
+// in kinesis, or until another BufferSize records are held, and the earliest one is returned first. The
+// records of a shard are always returned in order. This adds up to window of latency.
+func (c Config) WithArrivalOrdering(window time.Duration) Config {
+	c.arrivalOrderingWindow = window
+	return c
+}
+
+// WithRateLimit returns a Config that limits the records, and the bytes of record data, returned
+// to the application per second across all shards. 0 means no limit. When the limit is reached the
+// records wait in the buffer, and the shard workers slow down once it is full.
+func (c Config) WithRateLimit(recordsPerSecond, bytesPerSecond float64) Config {
+	c.recordsPerSecond = recordsPerSecond
+	c.bytesPerSecond = bytesPerSecond
+	return c
+}
+
+// WithShardRateLimit returns a Config that limits the records, and the bytes of record data, read
+// from any single shard per second. 0 means no limit. The worker of a shard that reached its limit
+// waits before buffering more records, without holding back the other shards.
+func (c Config) WithShardRateLimit(recordsPerSecond, bytesPerSecond float64) Config {
+	c.shardRecordsPerSecond = recordsPerSecond
+	c.shardBytesPerSecond = bytesPerSecond
+	return c
+}
+
+// WithDeliveryPacing returns a Config that spaces out the records returned to the application so
+// their data flows at bytesPerSecond, even when the stream delivers a large burst after a quiet
+// period, where WithRateLimit lets a full second worth of records through at once. The records wait
+// in the buffer, and the shard workers stop reading from kinesis while maxBufferedBytes of record
+// data are buffered. 0 for maxBufferedBytes only bounds the buffer by its size in records.
+func (c Config) WithDeliveryPacing(bytesPerSecond float64, maxBufferedBytes int64) Config {
+	c.pacingBytesPerSecond = bytesPerSecond
+	c.pacingMaxBytes = maxBufferedBytes
+	return c
+}
+
+// WithCostRates returns a Config with modified AWS prices for EstimateCosts, for regions priced
+// differently than the defaults
+func (c Config) WithCostRates(rates CostRates) Config {
+	c.costRates = rates
+	return c
+}
+
+// WithRecordHook returns a Config that calls the given hook with every record before NextRecord
+// returns it. Records the hook fails are not returned, and are tried again after retryDelay without
+// holding back the other records of their shard, until they are sent to the dead-letter sink.
+func (c Config) WithRecordHook(hook RecordHook, retryDelay time.Duration) Config {
+	c.recordHook = hook
+	c.recordHookRetryDelay = retryDelay
+	return c
+}
+
+// WithClaimCheckResolver returns a Config that fetches from S3 the payloads of the records pointing
+// to them, in the shard workers before the records are decompressed and buffered. A shard whose
+// payload could not be fetched is released, and consumed again from its checkpoint later.
+func (c Config) WithClaimCheckResolver(resolver ClaimCheckResolver) Config {
+	c.claimCheck = &resolver
+	return c
+}
+
+// WithDecompression returns a Config that decompresses the data of the records in the shard workers,
+// before they are filtered and buffered. Records whose data fails to decompress, or decompresses to
+// more than the decompression limit, are counted and go through the corrupt record policy like the
+// records failing the record validator.
+func (c Config) WithDecompression(compression Compression) Config {
+	c.decompression = compression
+	return c
+}
+
+// WithDecompressionLimit returns a Config that fails to decompress the data of the records that
+// would decompress to more than maxBytes, so a small record can't exhaust the memory of the shard
+// workers. The default is 32MiB.
+func (c Config) WithDecompressionLimit(maxBytes int64) Config {
+	c.decompressionLimit = maxBytes
+	return c
+}
+
+// WithDeduplication returns a Config that records every record marked processed, by Dispatch or
+// Kinsumer.MarkProcessed, in the <applicationName>_deduplication dynamo table for the given window,
+// and doesn't return the records already in it, so the records processed again after a crash or a
+// shard changing owners are skipped. Records are identified by their shard and sequence number, or
+// by the given key if it isn't nil. The table is created by CreateRequiredTables with a TTL removing
+// the expired records. A record returned but not marked processed before a crash is returned again.
+func (c Config) WithDeduplication(window time.Duration, key DeduplicationKey) Config {
+	c.deduplicationWindow = window
+	c.deduplicationKey = key
+	return c
+}
+
+// WithRedactor returns a Config that runs the errors of the records kinsumer logs or reports through
+// the given redactor first, including the causes given to the dead-letter sink and the errors and
+// panics given to the ErrorReporter, so record payloads they quote never reach the logs. The
+// redacted errors still unwrap to the original ones.
+func (c Config) WithRedactor(redactor Redactor) Config {
+	c.redactor = redactor
+	return c
+}
+
+// WithRecordFilter returns a Config that only buffers the records the given filter returns true
+// for. The filter runs in the shard workers before the records take room in the buffer, the records
+// it skips are never returned by NextRecord but are still checkpointed. It is called from multiple go
+// routines.
+func (c Config) WithRecordFilter(filter func(Record) bool) Config {
+	c.recordFilter = filter
+	return c
+}
+
+// WithRecordValidator returns a Config that runs the validator on every record in the shard workers,
+// after it is decompressed and before the record filter. By default a corrupt record, one the
+// validator returns an error or panics for, halts its shard: the records before it are returned and
+// checkpointed, and the shard stays captured without being read further until the client stops.
+func (c Config) WithRecordValidator(validator RecordValidator) Config {
+	c.recordValidator = validator
+	return c
+}
+
+// WithCorruptRecordHalt returns a Config that halts the shard of a record failing the record
+// validator, reporting ErrCorruptRecord. This is the default.
+func (c Config) WithCorruptRecordHalt() Config {
+	c.corruptRecordPolicy = corruptRecordHalt
+	return c
+}
+
+// WithCorruptRecordSkip returns a Config that skips the records failing the record validator. They
+// are never returned by NextRecord, but are checkpointed past like any other record.
+func (c Config) WithCorruptRecordSkip() Config {
+	c.corruptRecordPolicy = corruptRecordSkip
+	return c
+}
+
+// WithCorruptRecordDeadLetter returns a Config that sends the records failing the record validator
+// to the dead-letter sink, which must be set, with the error of the validator. They are skipped once
+// the sink accepted them, and tried again until it does.
+func (c Config) WithCorruptRecordDeadLetter() Config {
+	c.corruptRecordPolicy = corruptRecordDeadLetter
+	return c
+}
+
+// WithDeadLetterSink returns a Config that sends the records that were nacked or failed the record
+// hook the given number of times to the sink, rather than trying them again, so a single malformed
+// record can't hold back the checkpoint of its shard forever.
+func (c Config) WithDeadLetterSink(sink DeadLetterSink, attempts int) Config {
+	c.deadLetterSink = sink
+	c.deadLetterAttempts = attempts
+	return c
+}
+
+// WithTransactionalCheckpoints returns a Config that doesn't checkpoint the records as they are
+// returned by NextRecord. The checkpoint of a shard only moves when the application calls
+// CommitTransaction with one of its records, after it processed it.
+func (c Config) WithTransactionalCheckpoints() Config {
+	c.transactionalCheckpoints = true
+	return c
+}
+
+// WithCheckpointRetention returns a Config that makes the leader delete the checkpoints of the shards
+// gone from the stream once they weren't written for the given retention, and remove the owners
+// that left the clients table from the checkpoints they still hold. 0 keeps them forever.
+func (c Config) WithCheckpointRetention(retention time.Duration) Config {
+	c.checkpointRetention = retention
+	return c
+}
+
+// WithStreamFailover returns a Config failing the clients over to the next of the given copies of the
+// stream once the requests to the stream they consume have been failing for the after duration, for
+// producers mirroring the stream to other regions. The stream given to New comes first, and the
+// clients fail back to it after the last endpoint. The sequence numbers of the checkpoints don't
+// carry over from one copy of the stream to another, so the shards of the endpoint failed over to
+// start at rewind before the failures started, and the records written in that time are returned
+// again: rewind should be longer than how far behind the stream the clients can be.
+func (c Config) WithStreamFailover(endpoints []StreamEndpoint, after, rewind time.Duration) Config {
+	c.failoverEndpoints = endpoints
+	c.failoverAfter = after
+	c.failoverRewind = rewind
+	return c
+}
+
+// WithEnhancedFanOut returns a Config that makes the leader register an enhanced fan-out consumer
+// with the given name on the stream, and store its ARN in the metadata table once it is ACTIVE for
+// Kinsumer.FanOutConsumerARN. The shard consumers then read the shards with SubscribeToShard through
+// it, subscribing again from the continuation sequence number as the subscriptions expire, and poll
+// them with GetRecords until it is active. A consumer registered under a previous name is
+// deregistered once the new one is active, the shard consumers move to it on their next refresh.
+// DeleteTables leaves the consumer registered, as other readers may still subscribe with it.
+func (c Config) WithEnhancedFanOut(consumerName string) Config {
+	c.fanOutConsumer = consumerName
+	return c
+}
+
+// WithScalingAdvisor returns a Config that makes the leader recommend splitting or merging the
+// shards of the stream with the given advisor. All the clients should use it, as the throughput of
+// a shard is only measured by an owner that has it.
+func (c Config) WithScalingAdvisor(advisor *ScalingAdvisor) Config {
+	c.scalingAdvisor = advisor
+	return c
+}
+
+// WithLeaderElector returns a Config that elects the leader with the given LeaderElector instead of
+// the client holding a lease in the metadata table
+func (c Config) WithLeaderElector(elector LeaderElector) Config {
+	c.leaderElector = elector
+	return c
+}
+
+// WithFirstClientLeader returns a Config where only the first client by ID runs for the leader
+// lease, as before every client did. Leadership then moves to the new first client as clients come
+// and go, once the lease of the previous leader expired. It has no effect with WithLeaderElector.
+func (c Config) WithFirstClientLeader() Config {
+	c.firstClientLeader = true
+	return c
+}
+
+// WithRecoveryHook returns a Config that calls the given hook with the RecoveryReport once all the
+// shards assigned when Run was called were read once, telling how far behind their checkpoints were
+func (c Config) WithRecoveryHook(hook RecoveryHook) Config {
+	c.recoveryHook = hook
+	return c
+}
+
+// WithReshardHook returns a Config that calls the given hook when the leader detects that the shards
+// of the stream changed, with the shards before and after the change and the parents of the new shards,
+// so applications can maintain resources tied to each shard
+func (c Config) WithReshardHook(hook ReshardHook) Config {
+	c.reshardHook = hook
+	return c
+}
+
+// WithErrorReporter returns a Config that hands the errors returned by Next and NextRecord, and the
+// panics of the kinsumer go routines, to the given reporter along with where they happened
+func (c Config) WithErrorReporter(reporter ErrorReporter) Config {
+	c.errorReporter = reporter
+	return c
+}
+
 // WithStats returns a Config with a modified stats
 func (c Config) WithStats(stats StatReceiver) Config {
 	c.stats = stats
@@ -121,16 +743,128 @@ func (c Config) WithDynamoWaiterDelay(delay time.Duration) Config {
 	return c
 }
 
-// WithLogger returns a Config with a modified logger
+// WithTableNames returns a Config with modified names of the dynamo tables, for tables that don't
+// follow the <applicationName>_<table> naming. The tables left empty keep the default name.
+func (c Config) WithTableNames(names TableNames) Config {
+	c.tableNames = names
+	return c
+}
+
+// WithGlobalTables returns a Config for tables that are DynamoDB global tables replicated to the
+// clients of several regions, region being the region of the dynamo endpoint of this client. Only the
+// clients of the home region of the tables consume the stream, the others stand by without taking
+// part in the shard assignment. The home region is homeRegion until Kinsumer.TakeHomeRegion is
+// called from another region, every client of an application must use the same homeRegion.
+func (c Config) WithGlobalTables(region, homeRegion string) Config {
+	c.region = region
+	c.homeRegion = homeRegion
+	return c
+}
+
+// WithTableStreams returns a Config that follows the dynamodb streams of the clients and metadata
+// tables, polling them at the given frequency, and refreshes the shards as soon as a client joins or
+// leaves or the leader updates the shard cache. Tables created with CreateRequiredTables() have
+// streams enabled, existing tables need a KEYS_ONLY (or more) stream enabled manually.
+func (c Config) WithTableStreams(pollFrequency time.Duration) Config {
+	c.tableStreamsPollFrequency = pollFrequency
+	return c
+}
+
+// WithShardDiscovery returns a Config where the leader lists the shards created since its last
+// lookup at the given frequency, with a ListShards filter so only the new shards are listed, and adds
+// them to the shard cache, which the clients check at the same frequency. New shards are then
+// consumed within seconds instead of after the next leader action and shard check, the children of
+// the shards we consume being added as soon as their parent closes either way.
+func (c Config) WithShardDiscovery(frequency time.Duration) Config {
+	c.shardDiscoveryFrequency = frequency
+	return c
+}
+
+// WithOnDemandStream returns a Config suited to on-demand streams, which reshard automatically and
+// often: new shards are discovered every few seconds, see WithShardDiscovery
+func (c Config) WithOnDemandStream() Config {
+	return c.WithShardDiscovery(onDemandShardDiscoveryFrequency)
+}
+
+// WithDynamoStreamsInterface returns a Config with a modified dynamodb streams interface, used to
+// follow the table streams. It only needs to be set when using NewWithInterfaces.
+func (c Config) WithDynamoStreamsInterface(streams dynamodbstreamsiface.DynamoDBStreamsAPI) Config {
+	c.dynamoStreams = streams
+	return c
+}
+
+// WithLogger returns a Config with a modified logger, which gets leveled lines with fields if it is
+// a StructuredLogger
 func (c Config) WithLogger(logger Logger) Config {
 	c.logger = logger
 	return c
 }
 
+// WithEventHandler returns a Config that sends the typed events of the consumer, such as shards
+// captured and released, leadership changes, checkpoint failures, throttles and reshards, to the
+// handler, so they can be routed to alerting by type and fields rather than parsed from the logs.
+// The events are sent in addition to the log lines.
+func (c Config) WithEventHandler(handler EventHandler) Config {
+	c.eventHandler = handler
+	return c
+}
+
+// WithKeyExtractor returns a Config that tracks throughput per key, as returned by the given
+// extractor. The extractor is called from the shard consumers for every record retrieved, and
+// should return keys of a bounded cardinality.
+func (c Config) WithKeyExtractor(extractor KeyExtractor) Config {
+	c.keyExtractor = extractor
+	return c
+}
+
+// WithShardCaptureHook returns a Config that calls the given hook every time this client captures
+// a shard, with the metadata last attached to the shard's checkpoint with SetCheckpointMetadata.
+// No records from the shard are returned before the hook returns.
+func (c Config) WithShardCaptureHook(hook ShardCaptureHook) Config {
+	c.shardCaptureHook = hook
+	return c
+}
+
+// WithOnCheckpoint returns a Config that calls the given hook after every checkpoint successfully
+// written to dynamo, so applications can mirror their position into other systems. The hook is called
+// from the shard consumers and blocks them until it returns, so it should be fast.
+func (c Config) WithOnCheckpoint(hook CheckpointHook) Config {
+	c.onCheckpoint = hook
+	return c
+}
+
+// WithCommitHook returns a Config that calls the given hook after every checkpoint successfully
+// written to dynamo, with the time it was written at, so applications can audit what was committed
+// and when. Like WithOnCheckpoint the hook is called from the shard consumers and blocks them until it
+// returns, so it should be fast.
+func (c Config) WithCommitHook(hook CommitHook) Config {
+	c.onCommit = hook
+	return c
+}
+
+// WithDeliveryTracing returns a Config that samples one of every oneIn records fetched from kinesis,
+// and logs when it is fetched, buffered, delivered by Next(), acked and covered by a checkpoint written to
+// dynamo, or when it is dropped or discarded along the way. Sampled records have a DeliveryID that
+// identifies them in the logs. 0 disables tracing.
+func (c Config) WithDeliveryTracing(oneIn int) Config {
+	c.deliveryTracing = oneIn
+	return c
+}
+
 // WithShardIteratorAtTimestamp returns a Config with a modified at timestamp and sets shardIteratorType to AT_TIMESTAMP
 func (c Config) WithShardIteratorAtTimestamp(t time.Time) Config {
 	c.shardIteratorType = kinesis.ShardIteratorTypeAtTimestamp
 	c.atTimestamp = &t
+	c.atAge = 0
+	return c
+}
+
+// WithShardIteratorAtAge returns a Config that sets shardIteratorType to AT_TIMESTAMP, starting from
+// the given duration before Run() is called rather than from a timestamp computed up front
+func (c Config) WithShardIteratorAtAge(d time.Duration) Config {
+	c.shardIteratorType = kinesis.ShardIteratorTypeAtTimestamp
+	c.atTimestamp = nil
+	c.atAge = d
 	return c
 }
 
@@ -140,9 +874,9 @@ func (c Config) WithShardIteratorLatest() Config {
 	return c
 }
 
-// WithShardIteratorLatest returns a Config that sets shardIteratorType to AT_SEQUENCE_NUMBER
+// WithShardIteratorAtSequenceNumber returns a Config that sets shardIteratorType to AT_SEQUENCE_NUMBER
 func (c Config) WithShardIteratorAtSequenceNumber(sequenceNumber string) Config {
-	c.shardIteratorType = kinesis.ShardIteratorTypeLatest
+	c.shardIteratorType = kinesis.ShardIteratorTypeAtSequenceNumber
 	c.sequenceNumber = sequenceNumber
 	return c
 }
@@ -160,43 +894,383 @@ func (c Config) WithShardIteratorTrimHorizon() Config {
 	return c
 }
 
+// WithIgnoreCheckpoints returns a Config that starts every shard from the configured shard iterator
+// type, ignoring any checkpoints that were written before the run started. The run starts when the
+// first client calls Run() while no other client is alive, and is recorded in the metadata table so
+// the clients joining later, as in a rolling deploy, don't ignore the checkpoints of their peers. It
+// ends when a client calls Run() without ignoring checkpoints. If rewrite is true the ignored
+// checkpoints are cleared as soon as the shard is captured, otherwise they are only overwritten by
+// the first commit.
+func (c Config) WithIgnoreCheckpoints(rewrite bool) Config {
+	c.ignoreCheckpoints = true
+	c.rewriteCheckpoints = rewrite
+	return c
+}
+
+// WithMissingCheckpointFallback returns a Config that starts the shards without a checkpoint at
+// the given position, while the others keep resuming from their checkpoint. By default they start at
+// TRIM_HORIZON. It has no effect with the WithShardIterator methods other than the default
+// AFTER_SEQUENCE_NUMBER without a sequence number, as their position takes precedence anyway.
+func (c Config) WithMissingCheckpointFallback(position ShardPosition) Config {
+	c.missingCheckpointFallback = &position
+	return c
+}
+
+// WithExpiredCheckpointFallback returns a Config that starts the shards whose checkpointed sequence
+// number is no longer in the stream, having aged out of its retention, at the given TRIM_HORIZON,
+// LATEST or AT_TIMESTAMP position rather than failing them with ErrCheckpointExpired. It also applies
+// when the last record read aged out before its expired shard iterator was replaced. A sequence
+// number is only considered aged out if it is older than the oldest record of its shard, the other
+// sequence numbers kinesis rejects still fail the shard. The records between the checkpoint and the
+// position are lost.
+func (c Config) WithExpiredCheckpointFallback(position ShardPosition) Config {
+	c.expiredCheckpointFallback = &position
+	return c
+}
+
+// WithStartingPositionFor returns a Config that starts the shards the given function returns a
+// position for at that position, rather than at their checkpoint or the configured starting point,
+// for replaying some shards after a partial data loss. Like with WithIgnoreCheckpoints, only the
+// checkpoints written before the run started are replaced, so the shards resume from their new checkpoints
+// when they change owners afterwards. Remove the positions once the shards were replayed, or they
+// are replayed again the next time Run() is called.
+func (c Config) WithStartingPositionFor(positionFor StartingPositionFunc) Config {
+	c.startingPositionFor = positionFor
+	c.startingPositions = nil
+	return c
+}
+
+// WithStartingPositions returns a Config that starts the shards of the map at their position, like
+// WithStartingPositionFor
+func (c Config) WithStartingPositions(positions map[string]ShardPosition) Config {
+	c.startingPositionFor = func(shardID string) (ShardPosition, bool) {
+		position, ok := positions[shardID]
+		return position, ok
+	}
+	c.startingPositions = positions
+	return c
+}
+
+// ConfigFieldError is an invalid setting of a Config
+type ConfigFieldError struct {
+	// Name of the setting, as in its With method
+	Field   string
+	Value   interface{}
+	Allowed string
+	// The ErrConfigInvalid error of the setting
+	Err error
+}
+
+// Error returns the setting, its value and what it allows
+func (e *ConfigFieldError) Error() string {
+	return fmt.Sprintf("%s is %v, must be %s", e.Field, e.Value, e.Allowed)
+}
+
+// Unwrap returns the ErrConfigInvalid error of the setting
+func (e *ConfigFieldError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all the invalid settings of a Config. errors.Is matches the ErrConfigInvalid
+// error of any of them.
+type ConfigErrors []*ConfigFieldError
+
+// Error lists the invalid settings
+func (e ConfigErrors) Error() string {
+	descriptions := make([]string, len(e))
+	for i, err := range e {
+		descriptions[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(descriptions, "; ")
+}
+
+// Is returns whether target is the error of one of the settings
+func (e ConfigErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns the ConfigErrors of the invalid settings of the Config, or nil if it is valid,
+// so services can check their configuration before creating a Kinsumer
+func (c Config) Validate() error {
+	return validateConfig(&c)
+}
+
 // Verify that a config struct has sane and valid values
 func validateConfig(c *Config) error {
-	if c.throttleDelay < 200*time.Millisecond {
-		return ErrConfigInvalidThrottleDelay
+	var errs ConfigErrors
+	invalid := func(err error, field string, value interface{}, allowed string) {
+		errs = append(errs, &ConfigFieldError{Field: field, Value: value, Allowed: allowed, Err: err})
+	}
+
+	if c.throttleDelay < minThrottleDelay {
+		invalid(ErrConfigInvalidThrottleDelay, "ThrottleDelay", c.throttleDelay, "at least "+minThrottleDelay.String())
+	}
+
+	if c.throttleBackoff == nil {
+		invalid(ErrConfigInvalidThrottleBackoff, "ThrottleBackoff", nil, "set")
+	}
+
+	if c.retryer == nil {
+		invalid(ErrConfigInvalidRetryer, "Retryer", nil, "set")
+	}
+
+	if c.deadLetterSink != nil && c.deadLetterAttempts < 1 {
+		invalid(ErrConfigInvalidDeadLetter, "DeadLetterSink attempts", c.deadLetterAttempts, "at least 1")
+	}
+	if c.recordHookRetryDelay < 0 {
+		invalid(ErrConfigInvalidRecordHook, "RecordHook retry delay", c.recordHookRetryDelay, "at least 0")
+	}
+	if c.corruptRecordPolicy == corruptRecordDeadLetter && c.deadLetterSink == nil {
+		invalid(ErrConfigInvalidCorruptRecordPolicy, "CorruptRecordDeadLetter sink", nil, "set")
+	}
+
+	if c.getRecordsLimit < 1 || c.getRecordsLimit > getRecordsLimit {
+		invalid(ErrConfigInvalidGetRecordsLimit, "GetRecordsLimit", c.getRecordsLimit, fmt.Sprintf("between 1 and %d", getRecordsLimit))
+	}
+	if c.getRecordsMaxBytes < 0 {
+		invalid(ErrConfigInvalidGetRecordsLimit, "GetRecordsMaxBytes", c.getRecordsMaxBytes, "at least 0")
+	}
+
+	if c.catchUpLag < 0 {
+		invalid(ErrConfigInvalidCatchUpLag, "CatchUpLag", c.catchUpLag, "at least 0")
+	}
+
+	if c.emptyPollRetries < 0 {
+		invalid(ErrConfigInvalidEmptyPollRetries, "EmptyPollRetries", c.emptyPollRetries, "at least 0")
 	}
 
 	if c.commitFrequency == 0 {
-		return ErrConfigInvalidCommitFrequency
+		invalid(ErrConfigInvalidCommitFrequency, "CommitFrequency", c.commitFrequency, "set")
+	}
+
+	if c.checkpointTouchFrequency < 0 {
+		invalid(ErrConfigInvalidCheckpointTouchFrequency, "CheckpointTouchFrequency", c.checkpointTouchFrequency, "at least 0")
 	}
 
 	if c.shardCheckFrequency == 0 {
-		return ErrConfigInvalidShardCheckFrequency
+		invalid(ErrConfigInvalidShardCheckFrequency, "ShardCheckFrequency", c.shardCheckFrequency, "set")
+	}
+
+	if c.heartbeatFrequency < 0 {
+		invalid(ErrConfigInvalidHeartbeatFrequency, "HeartbeatFrequency", c.heartbeatFrequency, "at least 0")
+	}
+
+	if c.clientExpiryAge < 0 || (c.clientExpiryAge > 0 && c.clientExpiryAge <= c.heartbeatInterval()) {
+		invalid(ErrConfigInvalidClientExpiryAge, "ClientExpiryAge", c.clientExpiryAge,
+			"0 or longer than the heartbeat frequency "+c.heartbeatInterval().String())
+	}
+
+	if c.clientsCacheAge < 0 {
+		invalid(ErrConfigInvalidClientsCache, "ClientsCache", c.clientsCacheAge, "a max age of at least 0")
+	}
+
+	if c.shardListCacheTTL < 0 {
+		invalid(ErrConfigInvalidShardListCacheTTL, "ShardListCacheTTL", c.shardListCacheTTL, "at least 0")
+	}
+
+	if c.leaderActionFrequency == 0 || c.shardCheckFrequency > c.leaderActionFrequency {
+		invalid(ErrConfigInvalidLeaderActionFrequency, "LeaderActionFrequency", c.leaderActionFrequency,
+			"at least the shard check frequency "+c.shardCheckFrequency.String())
+	}
+
+	if c.bufferSize < 1 {
+		invalid(ErrConfigInvalidBufferSize, "BufferSize", c.bufferSize, "at least 1")
+	}
+
+	if c.stallThreshold < 0 {
+		invalid(ErrConfigInvalidStallDetection, "StallDetection", c.stallThreshold, "at least 0")
+	}
+
+	if c.quarantineThreshold < 0 || c.quarantineWindow < 0 {
+		invalid(ErrConfigInvalidQuarantine, "Quarantine", fmt.Sprintf("%d in %s", c.quarantineThreshold, c.quarantineWindow),
+			"a threshold and window of at least 0")
+	}
+
+	if c.shardBufferSize < 0 {
+		invalid(ErrConfigInvalidShardBuffers, "ShardBuffers", c.shardBufferSize, "at least 0")
+	}
+	if c.shardBufferSize > 0 && c.bufferOverflowPolicy == bufferOverflowSpill {
+		invalid(ErrConfigInvalidShardBuffers, "ShardBuffers overflow policy", "spill", "block or drop-oldest")
+	}
+
+	if c.bufferOverflowPolicy == bufferOverflowSpill && c.spillMaxBytes <= 0 {
+		invalid(ErrConfigInvalidSpillMaxBytes, "BufferOverflowSpill max bytes", c.spillMaxBytes, "at least 1")
 	}
 
-	if c.leaderActionFrequency == 0 {
-		return ErrConfigInvalidLeaderActionFrequency
+	if c.arrivalOrderingWindow < 0 {
+		invalid(ErrConfigInvalidArrivalOrdering, "ArrivalOrdering", c.arrivalOrderingWindow, "at least 0")
 	}
 
-	if c.shardCheckFrequency > c.leaderActionFrequency {
-		return ErrConfigInvalidLeaderActionFrequency
+	if c.recordsPerSecond < 0 || c.bytesPerSecond < 0 {
+		invalid(ErrConfigInvalidRateLimit, "RateLimit", fmt.Sprintf("%g records/s, %g bytes/s", c.recordsPerSecond, c.bytesPerSecond),
+			"at least 0")
+	}
+	if c.shardRecordsPerSecond < 0 || c.shardBytesPerSecond < 0 {
+		invalid(ErrConfigInvalidRateLimit, "ShardRateLimit",
+			fmt.Sprintf("%g records/s, %g bytes/s", c.shardRecordsPerSecond, c.shardBytesPerSecond), "at least 0")
 	}
 
-	if c.bufferSize == 0 {
-		return ErrConfigInvalidBufferSize
+	if c.pacingBytesPerSecond < 0 || c.pacingMaxBytes < 0 {
+		invalid(ErrConfigInvalidDeliveryPacing, "DeliveryPacing",
+			fmt.Sprintf("%g bytes/s, %d max bytes", c.pacingBytesPerSecond, c.pacingMaxBytes), "at least 0")
+	}
+	if c.pacingMaxBytes > 0 && c.pacingBytesPerSecond == 0 {
+		invalid(ErrConfigInvalidDeliveryPacing, "DeliveryPacing bytes/s", c.pacingBytesPerSecond, "set with a max bytes")
+	}
+
+	r := c.costRates
+	if r.DynamoReadRequestUnit < 0 || r.DynamoWriteRequestUnit < 0 || r.DynamoReadCapacityHour < 0 ||
+		r.DynamoWriteCapacityHour < 0 || r.FanOutShardHour < 0 || r.FanOutGigabyte < 0 {
+		invalid(ErrConfigInvalidCostRates, "CostRates", fmt.Sprintf("%+v", r), "at least 0")
 	}
 
 	if c.stats == nil {
-		return ErrConfigInvalidStats
+		invalid(ErrConfigInvalidStats, "Stats", nil, "set")
 	}
 
-	if c.dynamoReadCapacity == 0 || c.dynamoWriteCapacity == 0 {
-		return ErrConfigInvalidDynamoCapacity
+	if c.dynamoReadCapacity == 0 {
+		invalid(ErrConfigInvalidDynamoCapacity, "DynamoReadCapacity", c.dynamoReadCapacity, "set")
+	}
+	if c.dynamoWriteCapacity == 0 {
+		invalid(ErrConfigInvalidDynamoCapacity, "DynamoWriteCapacity", c.dynamoWriteCapacity, "set")
 	}
 
 	if c.logger == nil {
-		return ErrConfigInvalidLogger
+		invalid(ErrConfigInvalidLogger, "Logger", nil, "set")
 	}
 
-	return nil
+	if c.atAge < 0 {
+		invalid(ErrConfigInvalidShardIteratorAtAge, "ShardIteratorAtAge", c.atAge, "at least 0")
+	}
+
+	switch c.shardIteratorType {
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber,
+		kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest, kinesis.ShardIteratorTypeAtTimestamp:
+	default:
+		invalid(ErrConfigInvalidShardIteratorType, "ShardIteratorType", fmt.Sprintf("%q", c.shardIteratorType),
+			"one of the kinesis shard iterator types")
+	}
+
+	for shardID, position := range c.startingPositions {
+		if !position.valid() {
+			invalid(ErrConfigInvalidStartingPosition, "StartingPositions["+shardID+"]", fmt.Sprintf("%+v", position),
+				"a shard iterator type with its sequence number or timestamp")
+		}
+	}
+
+	if p := c.missingCheckpointFallback; p != nil && !p.valid() {
+		invalid(ErrConfigInvalidStartingPosition, "MissingCheckpointFallback", fmt.Sprintf("%+v", *p),
+			"a shard iterator type with its sequence number or timestamp")
+	}
+
+	if p := c.expiredCheckpointFallback; p != nil && (!p.valid() ||
+		p.IteratorType == kinesis.ShardIteratorTypeAtSequenceNumber || p.IteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber) {
+		invalid(ErrConfigInvalidCheckpointFallback, "ExpiredCheckpointFallback", fmt.Sprintf("%+v", *p),
+			"TRIM_HORIZON, LATEST or AT_TIMESTAMP with a timestamp")
+	}
+
+	if len(c.failoverEndpoints) > 0 {
+		for i, e := range c.failoverEndpoints {
+			if e.Kinesis == nil || e.StreamName == "" {
+				invalid(ErrConfigInvalidStreamFailover, fmt.Sprintf("StreamFailover.Endpoints[%d]", i),
+					fmt.Sprintf("stream %q in %q", e.StreamName, e.Region), "a stream name and a kinesis interface")
+			}
+		}
+		if c.failoverAfter <= 0 {
+			invalid(ErrConfigInvalidStreamFailover, "StreamFailover.After", c.failoverAfter, "greater than 0")
+		}
+		if c.failoverRewind < 0 {
+			invalid(ErrConfigInvalidStreamFailover, "StreamFailover.Rewind", c.failoverRewind, "at least 0")
+		}
+		if c.fanOutConsumer != "" {
+			invalid(ErrConfigInvalidStreamFailover, "StreamFailover", fmt.Sprintf("enhanced fan-out %q", c.fanOutConsumer),
+				"not used with enhanced fan-out")
+		}
+	}
+
+	if c.fanOutConsumer != "" && !validConsumerName.MatchString(c.fanOutConsumer) {
+		invalid(ErrConfigInvalidFanOutConsumer, "EnhancedFanOut", fmt.Sprintf("%q", c.fanOutConsumer),
+			"1 to 128 letters, digits, '_', '.' or '-'")
+	}
+
+	if a := c.scalingAdvisor; a != nil && (a.SplitAbove < 0 || a.MergeBelow < 0 || a.MaxLag < 0) {
+		invalid(ErrConfigInvalidScalingAdvisor, "ScalingAdvisor",
+			fmt.Sprintf("split above %g, merge below %g, max lag %s", a.SplitAbove, a.MergeBelow, a.MaxLag), "at least 0")
+	}
+
+	if c.checkpointRetention < 0 {
+		invalid(ErrConfigInvalidCheckpointRetention, "CheckpointRetention", c.checkpointRetention, "at least 0")
+	}
+
+	if c.deduplicationWindow < 0 {
+		invalid(ErrConfigInvalidDeduplication, "Deduplication", c.deduplicationWindow, "a window of at least 0")
+	}
+
+	if r := c.claimCheck; r != nil && (r.S3 == nil || r.Detect == nil || r.Concurrency < 0) {
+		invalid(ErrConfigInvalidClaimCheck, "ClaimCheckResolver",
+			fmt.Sprintf("S3 set: %t, Detect set: %t, Concurrency %d", r.S3 != nil, r.Detect != nil, r.Concurrency),
+			"S3 and Detect set, Concurrency at least 0")
+	}
+
+	if c.decompression < CompressionNone || c.decompression > CompressionZstd {
+		invalid(ErrConfigInvalidDecompression, "Decompression", c.decompression, "one of the Compression constants")
+	}
+
+	if c.decompressionLimit <= 0 {
+		invalid(ErrConfigInvalidDecompressionLimit, "DecompressionLimit", c.decompressionLimit, "greater than 0")
+	}
+
+	if c.deliveryTracing < 0 {
+		invalid(ErrConfigInvalidDeliveryTracing, "DeliveryTracing", c.deliveryTracing, "at least 0")
+	}
+
+	if (c.region == "") != (c.homeRegion == "") {
+		invalid(ErrConfigInvalidGlobalTables, "GlobalTables", fmt.Sprintf("region %q, home region %q", c.region, c.homeRegion),
+			"both set or both empty")
+	}
+
+	if c.tableStreamsPollFrequency < 0 {
+		invalid(ErrConfigInvalidTableStreams, "TableStreams", c.tableStreamsPollFrequency, "at least 0")
+	} else if c.tableStreamsPollFrequency > 0 && c.dynamoStreams == nil {
+		invalid(ErrConfigInvalidTableStreams, "DynamoStreamsInterface", nil, "set to follow the table streams")
+	}
+
+	if c.shardDiscoveryFrequency < 0 || (c.shardDiscoveryFrequency > 0 && c.shardDiscoveryFrequency < minShardDiscoveryFrequency) {
+		invalid(ErrConfigInvalidShardDiscovery, "ShardDiscovery", c.shardDiscoveryFrequency, "0 or at least "+minShardDiscoveryFrequency.String())
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkpointTouchInterval returns the delay between rewrites of the checkpoints that didn't change,
+// 0 to never rewrite them
+func (c Config) checkpointTouchInterval() time.Duration {
+	if c.checkpointTouchFrequency == 0 && c.scalingAdvisor != nil {
+		return c.leaderActionFrequency
+	}
+	return c.checkpointTouchFrequency
+}
+
+// heartbeatInterval returns the delay between updates of our client record
+func (c Config) heartbeatInterval() time.Duration {
+	if c.heartbeatFrequency > 0 {
+		return c.heartbeatFrequency
+	}
+	return c.shardCheckFrequency
+}
+
+// clientExpiry returns how long after their last update clients are considered gone
+func (c Config) clientExpiry() time.Duration {
+	if c.clientExpiryAge > 0 {
+		return c.clientExpiryAge
+	}
+	return c.heartbeatInterval() * 5
 }
@@ -3,6 +3,7 @@
 package kinsumer
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -22,35 +23,88 @@ func TestConfigErrors(t *testing.T) {
 	)
 	config = NewConfig().WithBufferSize(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidBufferSize.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidBufferSize))
 
 	config = NewConfig().WithThrottleDelay(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidThrottleDelay.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidThrottleDelay))
+
+	config = NewConfig().WithThrottleBackoff(nil)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidThrottleBackoff))
+
+	config = NewConfig().WithRetryer(nil)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidRetryer))
+
+	config = NewConfig().WithDeadLetterSink(DeadLetterFunc(func(*Record, error) error { return nil }), 0)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidDeadLetter))
+
+	config = NewConfig().WithRecordHook(func(*Record) error { return nil }, -time.Second)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidRecordHook))
+	require.False(t, errors.Is(err, ErrConfigInvalidDeadLetter))
+
+	config = NewConfig().WithGetRecordsLimit(10001)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidGetRecordsLimit))
+
+	config = NewConfig().WithGetRecordsMaxBytes(-1)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidGetRecordsLimit))
+
+	config = NewConfig().WithAdaptiveFetch(-time.Second)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidCatchUpLag))
+
+	config = NewConfig().WithEmptyPollRetries(-1)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidEmptyPollRetries))
 
 	config = NewConfig().WithCommitFrequency(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidCommitFrequency.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidCommitFrequency))
 
 	config = NewConfig().WithShardCheckFrequency(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidShardCheckFrequency.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidShardCheckFrequency))
 
 	config = NewConfig().WithLeaderActionFrequency(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidLeaderActionFrequency.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidLeaderActionFrequency))
 
 	config = NewConfig().WithLeaderActionFrequency(time.Second).WithShardCheckFrequency(time.Minute)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidLeaderActionFrequency.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidLeaderActionFrequency))
 
 	config = NewConfig().WithBufferSize(0)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidBufferSize.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidBufferSize))
 
 	config = NewConfig().WithStats(nil)
 	err = validateConfig(&config)
-	require.EqualError(t, err, ErrConfigInvalidStats.Error())
+	require.True(t, errors.Is(err, ErrConfigInvalidStats))
+
+	config = NewConfig().WithTableStreams(time.Second)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidTableStreams))
+
+	config = NewConfig().WithShardRateLimit(-1, 0)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidRateLimit))
+
+	config = NewConfig().WithShardIteratorAtAge(-time.Hour)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidShardIteratorAtAge))
+
+	config = NewConfig().WithEnhancedFanOut("my consumer")
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidFanOutConsumer))
+
+	config = NewConfig().WithCheckpointRetention(-time.Hour)
+	err = validateConfig(&config)
+	require.True(t, errors.Is(err, ErrConfigInvalidCheckpointRetention))
 }
 
 func TestConfigWithMethods(t *testing.T) {
@@ -61,7 +115,8 @@ func TestConfigWithMethods(t *testing.T) {
 		WithShardCheckFrequency(1 * time.Second).
 		WithLeaderActionFrequency(1 * time.Second).
 		WithThrottleDelay(1 * time.Second).
-		WithStats(stats)
+		WithStats(stats).
+		WithIgnoreCheckpoints(true)
 
 	err := validateConfig(&config)
 	require.NoError(t, err)
@@ -72,4 +127,62 @@ func TestConfigWithMethods(t *testing.T) {
 	require.Equal(t, 1*time.Second, config.shardCheckFrequency)
 	require.Equal(t, 1*time.Second, config.leaderActionFrequency)
 	require.Equal(t, stats, config.stats)
+	require.True(t, config.ignoreCheckpoints)
+	require.True(t, config.rewriteCheckpoints)
+}
+
+func TestConfigShardIteratorAtAge(t *testing.T) {
+	config := NewConfig().WithShardIteratorAtAge(2 * time.Hour)
+	require.NoError(t, validateConfig(&config))
+	require.Equal(t, "AT_TIMESTAMP", config.shardIteratorType)
+	require.Nil(t, config.atTimestamp)
+	require.Equal(t, 2*time.Hour, config.atAge)
+
+	// An absolute timestamp replaces the age
+	ts := time.Now()
+	config = config.WithShardIteratorAtTimestamp(ts)
+	require.Equal(t, &ts, config.atTimestamp)
+	require.Equal(t, time.Duration(0), config.atAge)
+}
+
+func TestConfigShardIteratorAtSequenceNumber(t *testing.T) {
+	config := NewConfig().WithShardIteratorAtSequenceNumber("5")
+	require.NoError(t, validateConfig(&config))
+	require.Equal(t, "AT_SEQUENCE_NUMBER", config.shardIteratorType)
+	require.Equal(t, "5", config.sequenceNumber)
+}
+
+func TestConfigValidateAggregates(t *testing.T) {
+	config := NewConfig().
+		WithBufferSize(0).
+		WithGetRecordsLimit(20000).
+		WithCheckpointRetention(-time.Hour)
+	err := config.Validate()
+	require.True(t, errors.Is(err, ErrConfigInvalidBufferSize))
+	require.True(t, errors.Is(err, ErrConfigInvalidGetRecordsLimit))
+	require.True(t, errors.Is(err, ErrConfigInvalidCheckpointRetention))
+	require.False(t, errors.Is(err, ErrConfigInvalidLogger))
+
+	var errs ConfigErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 3)
+	require.Equal(t, "GetRecordsLimit", errs[0].Field)
+	require.Equal(t, int64(20000), errs[0].Value)
+	require.EqualError(t, err, "invalid config: GetRecordsLimit is 20000, must be between 1 and 10000; "+
+		"BufferSize is 0, must be at least 1; CheckpointRetention is -1h0m0s, must be at least 0")
+
+	require.NoError(t, NewConfig().Validate())
+}
+
+func TestConfigCheckpointTouchInterval(t *testing.T) {
+	config := NewConfig()
+	require.Equal(t, time.Duration(0), config.checkpointTouchInterval())
+	// The advisor needs the throughput of the idle shards
+	config = config.WithScalingAdvisor(&ScalingAdvisor{})
+	require.Equal(t, config.leaderActionFrequency, config.checkpointTouchInterval())
+	config = config.WithCheckpointTouchFrequency(10 * time.Minute)
+	require.Equal(t, 10*time.Minute, config.checkpointTouchInterval())
+
+	config = NewConfig().WithCheckpointTouchFrequency(-time.Second)
+	require.True(t, errors.Is(config.Validate(), ErrConfigInvalidCheckpointTouchFrequency))
 }
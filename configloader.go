@@ -0,0 +1,277 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables read by ConfigFromEnv, followed by the
+// name of the setting in upper case, such as KINSUMER_BUFFER_SIZE
+const ConfigEnvPrefix = "KINSUMER_"
+
+// configSetting is a tunable of the Config that can be loaded from text
+type configSetting struct {
+	allowed string // what the value must be, for the errors
+	set     func(c *Config, value string) error
+}
+
+func durationSetting(field func(c *Config) *time.Duration) configSetting {
+	return configSetting{allowed: "a duration such as 250ms or 1m", set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		*field(c) = d
+		return err
+	}}
+}
+
+func intSetting(field func(c *Config) *int) configSetting {
+	return configSetting{allowed: "an integer", set: func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		*field(c) = i
+		return err
+	}}
+}
+
+func int64Setting(field func(c *Config) *int64) configSetting {
+	return configSetting{allowed: "an integer", set: func(c *Config, value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		*field(c) = i
+		return err
+	}}
+}
+
+func floatSetting(field func(c *Config) *float64) configSetting {
+	return configSetting{allowed: "a number", set: func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		*field(c) = f
+		return err
+	}}
+}
+
+func boolSetting(field func(c *Config) *bool) configSetting {
+	return configSetting{allowed: "true or false", set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		*field(c) = b
+		return err
+	}}
+}
+
+func stringSetting(field func(c *Config) *string) configSetting {
+	return configSetting{allowed: "a string", set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+// choiceSetting is a setting whose value is one of the given names
+func choiceSetting(set func(c *Config, choice string), choices ...string) configSetting {
+	return configSetting{allowed: "one of " + strings.Join(choices, ", "), set: func(c *Config, value string) error {
+		for _, choice := range choices {
+			if strings.EqualFold(value, choice) {
+				set(c, choice)
+				return nil
+			}
+		}
+		return ErrConfigInvalidSetting
+	}}
+}
+
+// configSettings are the settings loaded by ConfigFromEnv and ConfigFromFile, by name. The hooks and
+// interfaces can only be set in code.
+var configSettings = map[string]configSetting{
+	"throttle_delay":             durationSetting(func(c *Config) *time.Duration { return &c.throttleDelay }),
+	"get_records_limit":          int64Setting(func(c *Config) *int64 { return &c.getRecordsLimit }),
+	"get_records_max_bytes":      intSetting(func(c *Config) *int { return &c.getRecordsMaxBytes }),
+	"catch_up_lag":               durationSetting(func(c *Config) *time.Duration { return &c.catchUpLag }),
+	"empty_poll_retries":         intSetting(func(c *Config) *int { return &c.emptyPollRetries }),
+	"commit_frequency":           durationSetting(func(c *Config) *time.Duration { return &c.commitFrequency }),
+	"checkpoint_touch_frequency": durationSetting(func(c *Config) *time.Duration { return &c.checkpointTouchFrequency }),
+	"shard_check_frequency":      durationSetting(func(c *Config) *time.Duration { return &c.shardCheckFrequency }),
+	"heartbeat_frequency":        durationSetting(func(c *Config) *time.Duration { return &c.heartbeatFrequency }),
+	"client_expiry_age":          durationSetting(func(c *Config) *time.Duration { return &c.clientExpiryAge }),
+	"clients_cache_age":          durationSetting(func(c *Config) *time.Duration { return &c.clientsCacheAge }),
+	"shard_list_cache_ttl":       durationSetting(func(c *Config) *time.Duration { return &c.shardListCacheTTL }),
+	"quarantine_threshold":       intSetting(func(c *Config) *int { return &c.quarantineThreshold }),
+	"quarantine_window":          durationSetting(func(c *Config) *time.Duration { return &c.quarantineWindow }),
+	"assignment_strategy": choiceSetting(func(c *Config, choice string) {
+		for s := AssignmentModulo; s <= AssignmentZoneAffinity; s++ {
+			if s.String() == choice {
+				c.assignmentStrategy = s
+			}
+		}
+	}, AssignmentModulo.String(), AssignmentContiguous.String(), AssignmentZoneSpread.String(), AssignmentZoneAffinity.String()),
+	"availability_zone":       stringSetting(func(c *Config) *string { return &c.availabilityZone }),
+	"client_hostname":         stringSetting(func(c *Config) *string { return &c.clientMetadata.Hostname }),
+	"client_version":          stringSetting(func(c *Config) *string { return &c.clientMetadata.Version }),
+	"leader_action_frequency": durationSetting(func(c *Config) *time.Duration { return &c.leaderActionFrequency }),
+	"checkpoint_retention":    durationSetting(func(c *Config) *time.Duration { return &c.checkpointRetention }),
+	"enhanced_fan_out":        stringSetting(func(c *Config) *string { return &c.fanOutConsumer }),
+
+	"buffer_size":       intSetting(func(c *Config) *int { return &c.bufferSize }),
+	"shard_buffer_size": intSetting(func(c *Config) *int { return &c.shardBufferSize }),
+	"stall_threshold":   durationSetting(func(c *Config) *time.Duration { return &c.stallThreshold }),
+	"buffer_overflow": choiceSetting(func(c *Config, choice string) {
+		c.bufferOverflowPolicy = map[string]bufferOverflowPolicy{
+			"block":       bufferOverflowBlock,
+			"drop-oldest": bufferOverflowDropOldest,
+			"spill":       bufferOverflowSpill,
+		}[choice]
+	}, "block", "drop-oldest", "spill"),
+	"corrupt_record_policy": choiceSetting(func(c *Config, choice string) {
+		c.corruptRecordPolicy = map[string]corruptRecordPolicy{
+			"halt":        corruptRecordHalt,
+			"skip":        corruptRecordSkip,
+			"dead-letter": corruptRecordDeadLetter,
+		}[choice]
+	}, "halt", "skip", "dead-letter"),
+	"spill_directory":          stringSetting(func(c *Config) *string { return &c.spillDirectory }),
+	"spill_max_bytes":          int64Setting(func(c *Config) *int64 { return &c.spillMaxBytes }),
+	"arrival_ordering_window":  durationSetting(func(c *Config) *time.Duration { return &c.arrivalOrderingWindow }),
+	"records_per_second":       floatSetting(func(c *Config) *float64 { return &c.recordsPerSecond }),
+	"bytes_per_second":         floatSetting(func(c *Config) *float64 { return &c.bytesPerSecond }),
+	"delivery_pacing":          floatSetting(func(c *Config) *float64 { return &c.pacingBytesPerSecond }),
+	"pacing_max_bytes":         int64Setting(func(c *Config) *int64 { return &c.pacingMaxBytes }),
+	"shard_records_per_second": floatSetting(func(c *Config) *float64 { return &c.shardRecordsPerSecond }),
+	"shard_bytes_per_second":   floatSetting(func(c *Config) *float64 { return &c.shardBytesPerSecond }),
+	"decompression": choiceSetting(func(c *Config, choice string) {
+		for compression := CompressionNone; compression <= CompressionZstd; compression++ {
+			if compression.String() == choice {
+				c.decompression = compression
+			}
+		}
+	}, CompressionNone.String(), CompressionAuto.String(), CompressionGzip.String(), CompressionSnappy.String(),
+		CompressionZstd.String()),
+	"decompression_limit":       int64Setting(func(c *Config) *int64 { return &c.decompressionLimit }),
+	"deduplication_window":      durationSetting(func(c *Config) *time.Duration { return &c.deduplicationWindow }),
+	"transactional_checkpoints": boolSetting(func(c *Config) *bool { return &c.transactionalCheckpoints }),
+	"delivery_tracing":          intSetting(func(c *Config) *int { return &c.deliveryTracing }),
+
+	"dynamo_read_capacity":         int64Setting(func(c *Config) *int64 { return &c.dynamoReadCapacity }),
+	"dynamo_write_capacity":        int64Setting(func(c *Config) *int64 { return &c.dynamoWriteCapacity }),
+	"dynamo_waiter_delay":          durationSetting(func(c *Config) *time.Duration { return &c.dynamoWaiterDelay }),
+	"table_streams_poll_frequency": durationSetting(func(c *Config) *time.Duration { return &c.tableStreamsPollFrequency }),
+	"shard_discovery_frequency":    durationSetting(func(c *Config) *time.Duration { return &c.shardDiscoveryFrequency }),
+	"checkpoints_table":            stringSetting(func(c *Config) *string { return &c.tableNames.Checkpoints }),
+	"clients_table":                stringSetting(func(c *Config) *string { return &c.tableNames.Clients }),
+	"metadata_table":               stringSetting(func(c *Config) *string { return &c.tableNames.Metadata }),
+	"deduplication_table":          stringSetting(func(c *Config) *string { return &c.tableNames.Deduplication }),
+	"region":                       stringSetting(func(c *Config) *string { return &c.region }),
+	"home_region":                  stringSetting(func(c *Config) *string { return &c.homeRegion }),
+	"stream_failover_after":        durationSetting(func(c *Config) *time.Duration { return &c.failoverAfter }),
+	"stream_failover_rewind":       durationSetting(func(c *Config) *time.Duration { return &c.failoverRewind }),
+
+	"shard_iterator_type": choiceSetting(func(c *Config, choice string) { c.shardIteratorType = choice },
+		kinesis.ShardIteratorTypeAfterSequenceNumber, kinesis.ShardIteratorTypeAtSequenceNumber,
+		kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest, kinesis.ShardIteratorTypeAtTimestamp),
+	"shard_iterator_timestamp": {allowed: "an RFC 3339 timestamp", set: func(c *Config, value string) error {
+		t, err := time.Parse(time.RFC3339, value)
+		c.atTimestamp = &t
+		return err
+	}},
+	"shard_iterator_age":             durationSetting(func(c *Config) *time.Duration { return &c.atAge }),
+	"shard_iterator_sequence_number": stringSetting(func(c *Config) *string { return &c.sequenceNumber }),
+	"expired_checkpoint_fallback": choiceSetting(func(c *Config, choice string) {
+		c.expiredCheckpointFallback = &ShardPosition{IteratorType: choice}
+	}, kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest),
+	"ignore_checkpoints":  boolSetting(func(c *Config) *bool { return &c.ignoreCheckpoints }),
+	"rewrite_checkpoints": boolSetting(func(c *Config) *bool { return &c.rewriteCheckpoints }),
+}
+
+// ConfigFromEnv returns the default Config with the settings found in the environment variables
+// named after them, such as KINSUMER_BUFFER_SIZE=500 or KINSUMER_COMMIT_FREQUENCY=5s. Durations are
+// written like 250ms or 1m, timestamps in RFC 3339, and the strategies and formats by name, such as
+// KINSUMER_ASSIGNMENT_STRATEGY=zone-spread or KINSUMER_SHARD_ITERATOR_TYPE=TRIM_HORIZON. It returns
+// the ConfigErrors of the settings that can't be parsed, and ignores the variables that aren't
+// settings. The Config can be modified further with the With methods, and is validated by New or
+// Config.Validate.
+func ConfigFromEnv() (Config, error) {
+	values := make(map[string]interface{})
+	for name := range configSettings {
+		if value, ok := os.LookupEnv(ConfigEnvPrefix + strings.ToUpper(name)); ok {
+			values[name] = value
+		}
+	}
+	return loadConfig(NewConfig(), values, func(name string) string {
+		return ConfigEnvPrefix + strings.ToUpper(name)
+	})
+}
+
+// ConfigFromFile returns the default Config with the settings of the given JSON or YAML file, told
+// apart by the .json, .yaml or .yml extension of path. The file holds an object of the settings, named
+// like the ConfigFromEnv variables without their prefix and in lower case, such as buffer_size: 500.
+// It returns the ConfigErrors of the settings that are unknown or can't be parsed.
+func ConfigFromFile(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var settings map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		// Keeps large integers from being written as floats
+		decoder.UseNumber()
+		err = decoder.Decode(&settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	default:
+		return Config{}, fmt.Errorf("config file %s must have a .json, .yaml or .yml extension", path)
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	return loadConfig(NewConfig(), settings, func(name string) string { return name })
+}
+
+// loadConfig applies the settings of values to c, field names the settings in the errors
+func loadConfig(c Config, values map[string]interface{}, field func(name string) string) (Config, error) {
+	// Sorted so the errors are always in the same order
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ConfigErrors
+	for _, name := range names {
+		setting, ok := configSettings[name]
+		if !ok {
+			errs = append(errs, &ConfigFieldError{Field: field(name), Value: fmt.Sprintf("%v", values[name]),
+				Allowed: "a known setting", Err: ErrConfigInvalidSetting})
+			continue
+		}
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = strings.TrimSpace(v)
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}, nil:
+			errs = append(errs, &ConfigFieldError{Field: field(name), Value: fmt.Sprintf("%v", v),
+				Allowed: setting.allowed, Err: ErrConfigInvalidSetting})
+			continue
+		default:
+			value = fmt.Sprint(v)
+		}
+		if err := setting.set(&c, value); err != nil {
+			errs = append(errs, &ConfigFieldError{Field: field(name), Value: fmt.Sprintf("%q", value),
+				Allowed: setting.allowed, Err: ErrConfigInvalidSetting})
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		"KINSUMER_BUFFER_SIZE":         "500",
+		"KINSUMER_COMMIT_FREQUENCY":    "5s",
+		"KINSUMER_ASSIGNMENT_STRATEGY": "Zone-Spread",
+		"KINSUMER_SHARD_ITERATOR_TYPE": "trim_horizon",
+		"KINSUMER_RECORDS_PER_SECOND":  "12.5",
+		"KINSUMER_CLIENTS_TABLE":       "shared_clients",
+		"KINSUMER_NOT_A_SETTING":       "ignored",
+	}
+	for name, value := range env {
+		require.NoError(t, os.Setenv(name, value))
+		defer os.Unsetenv(name)
+	}
+
+	config, err := ConfigFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, 500, config.bufferSize)
+	require.Equal(t, 5*time.Second, config.commitFrequency)
+	require.Equal(t, AssignmentZoneSpread, config.assignmentStrategy)
+	require.Equal(t, kinesis.ShardIteratorTypeTrimHorizon, config.shardIteratorType)
+	require.Equal(t, 12.5, config.recordsPerSecond)
+	require.Equal(t, "shared_clients", config.tableNames.Clients)
+	// Merged onto the defaults
+	require.Equal(t, NewConfig().throttleDelay, config.throttleDelay)
+	require.NoError(t, config.Validate())
+
+	require.NoError(t, os.Setenv("KINSUMER_BUFFER_SIZE", "lots"))
+	require.NoError(t, os.Setenv("KINSUMER_LEADER_ACTION_FREQUENCY", "1"))
+	defer os.Unsetenv("KINSUMER_LEADER_ACTION_FREQUENCY")
+	_, err = ConfigFromEnv()
+	require.True(t, errors.Is(err, ErrConfigInvalidSetting))
+	require.EqualError(t, err, `invalid config: KINSUMER_BUFFER_SIZE is "lots", must be an integer; `+
+		`KINSUMER_LEADER_ACTION_FREQUENCY is "1", must be a duration such as 250ms or 1m`)
+}
+
+func TestConfigFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinsumer-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		return path
+	}
+
+	config, err := ConfigFromFile(write("config.json", `{
+		"buffer_size": 250,
+		"spill_max_bytes": 10000000000,
+		"buffer_overflow": "spill",
+		"shard_iterator_timestamp": "2020-11-01T10:00:00Z",
+		"shard_iterator_type": "AT_TIMESTAMP",
+		"ignore_checkpoints": true
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, 250, config.bufferSize)
+	require.Equal(t, int64(10000000000), config.spillMaxBytes)
+	require.Equal(t, bufferOverflowSpill, config.bufferOverflowPolicy)
+	require.Equal(t, time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC), *config.atTimestamp)
+	require.Equal(t, kinesis.ShardIteratorTypeAtTimestamp, config.shardIteratorType)
+	require.True(t, config.ignoreCheckpoints)
+
+	config, err = ConfigFromFile(write("config.yaml", `
+shard_check_frequency: 30s
+leader_action_frequency: 2m
+dynamo_read_capacity: 25
+decompression: gzip
+metadata_table: shared_metadata
+`))
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, config.shardCheckFrequency)
+	require.Equal(t, 2*time.Minute, config.leaderActionFrequency)
+	require.Equal(t, int64(25), config.dynamoReadCapacity)
+	require.Equal(t, CompressionGzip, config.decompression)
+	require.Equal(t, "shared_metadata", config.tableNames.Metadata)
+
+	_, err = ConfigFromFile(write("typo.yml", "bufer_size: 10\nbuffer_overflow: [block]\n"))
+	require.True(t, errors.Is(err, ErrConfigInvalidSetting))
+	require.EqualError(t, err, `invalid config: bufer_size is 10, must be a known setting; `+
+		`buffer_overflow is [block], must be one of block, drop-oldest, spill`)
+
+	_, err = ConfigFromFile(write("config.toml", ""))
+	require.Error(t, err)
+}
+
+func TestTableNames(t *testing.T) {
+	names := TableNames{Clients: "shared_clients"}.withDefaults("app")
+	require.Equal(t, TableNames{
+		Checkpoints:   "app_checkpoints",
+		Clients:       "shared_clients",
+		Metadata:      "app_metadata",
+		Deduplication: "app_deduplication",
+	}, names)
+}
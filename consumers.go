@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// maxStreamConsumers is the number of enhanced fan-out consumers kinesis allows on a stream
+const maxStreamConsumers = 20
+
+// StreamConsumer is an enhanced fan-out consumer registered on the stream, by kinsumer or not
+type StreamConsumer struct {
+	Name      string
+	ARN       string
+	Status    string // CREATING, ACTIVE or DELETING
+	CreatedAt time.Time
+}
+
+// StreamConsumers are the enhanced fan-out consumers registered on the stream
+type StreamConsumers struct {
+	StreamARN string
+	Consumers []StreamConsumer
+	Limit     int // number of consumers kinesis allows on the stream
+}
+
+// Remaining returns how many more consumers can be registered on the stream before kinesis
+// rejects the registrations
+func (c *StreamConsumers) Remaining() int {
+	if remaining := c.Limit - len(c.Consumers); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// StreamConsumers lists the enhanced fan-out consumers registered on the stream, including the
+// ones of other applications, so operators can see how close the stream is to the consumer limit
+func (k *Kinsumer) StreamConsumers(ctx context.Context) (*StreamConsumers, error) {
+	summary, err := k.kinesis.DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(k.streamName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	consumers := &StreamConsumers{
+		StreamARN: aws.StringValue(summary.StreamDescriptionSummary.StreamARN),
+		Limit:     maxStreamConsumers,
+	}
+	err = k.kinesis.ListStreamConsumersPagesWithContext(ctx, &kinesis.ListStreamConsumersInput{
+		StreamARN: summary.StreamDescriptionSummary.StreamARN,
+	}, func(page *kinesis.ListStreamConsumersOutput, _ bool) bool {
+		for _, c := range page.Consumers {
+			consumers.Consumers = append(consumers.Consumers, StreamConsumer{
+				Name:      aws.StringValue(c.ConsumerName),
+				ARN:       aws.StringValue(c.ConsumerARN),
+				Status:    aws.StringValue(c.ConsumerStatus),
+				CreatedAt: aws.TimeValue(c.ConsumerCreationTimestamp),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return consumers, nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// consumersKinesis adds the enhanced fan-out consumers of the stream to the kinesis mock, one per page
+type consumersKinesis struct {
+	kinesisiface.KinesisAPI
+	consumers []string
+}
+
+func (k *consumersKinesis) DescribeStreamSummaryWithContext(ctx aws.Context, in *kinesis.DescribeStreamSummaryInput, opts ...request.Option) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+		StreamName: in.StreamName,
+		StreamARN:  aws.String("arn:aws:kinesis:us-west-2:123456789012:stream/" + aws.StringValue(in.StreamName)),
+	}}, nil
+}
+
+func (k *consumersKinesis) ListStreamConsumersPagesWithContext(ctx aws.Context, in *kinesis.ListStreamConsumersInput, fn func(*kinesis.ListStreamConsumersOutput, bool) bool, opts ...request.Option) error {
+	for i, name := range k.consumers {
+		page := &kinesis.ListStreamConsumersOutput{Consumers: []*kinesis.Consumer{{
+			ConsumerName:   aws.String(name),
+			ConsumerARN:    aws.String(aws.StringValue(in.StreamARN) + "/consumer/" + name),
+			ConsumerStatus: aws.String(kinesis.ConsumerStatusActive),
+		}}}
+		if !fn(page, i == len(k.consumers)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestStreamConsumers(t *testing.T) {
+	kin := &consumersKinesis{KinesisAPI: mocks.NewMockKinesis("stream", nil), consumers: []string{"app", "other"}}
+	k, err := NewWithInterfaces(kin, mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+
+	consumers, err := k.StreamConsumers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "arn:aws:kinesis:us-west-2:123456789012:stream/stream", consumers.StreamARN)
+	require.Len(t, consumers.Consumers, 2)
+	require.Equal(t, "other", consumers.Consumers[1].Name)
+	require.Equal(t, kinesis.ConsumerStatusActive, consumers.Consumers[1].Status)
+	require.Equal(t, 18, consumers.Remaining())
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// hoursPerMonth is the number of hours AWS bills for an average month
+const hoursPerMonth = 730
+
+// CostRates are the AWS prices, in dollars, used by EstimateCosts. They vary by region, see
+// DefaultCostRates for the ones used unless Config.WithCostRates is called.
+type CostRates struct {
+	DynamoReadRequestUnit   float64 // per on-demand read request unit
+	DynamoWriteRequestUnit  float64 // per on-demand write request unit
+	DynamoReadCapacityHour  float64 // per provisioned read capacity unit per hour
+	DynamoWriteCapacityHour float64 // per provisioned write capacity unit per hour
+	FanOutShardHour         float64 // per enhanced fan-out consumer per shard per hour
+	FanOutGigabyte          float64 // per GB of data retrieved with enhanced fan-out
+}
+
+// DefaultCostRates returns the us-east-1 prices at the time of writing
+func DefaultCostRates() CostRates {
+	return CostRates{
+		DynamoReadRequestUnit:   0.25 / 1e6,
+		DynamoWriteRequestUnit:  1.25 / 1e6,
+		DynamoReadCapacityHour:  0.00013,
+		DynamoWriteCapacityHour: 0.00065,
+		FanOutShardHour:         0.015,
+		FanOutGigabyte:          0.013,
+	}
+}
+
+// CostEstimate is the approximate monthly cost of running a client, extrapolated from its usage so far
+type CostEstimate struct {
+	Observed                 time.Duration // how long the usage was observed for
+	Shards                   int           // number of shards the client consumes
+	GetRecordsCallsPerSecond float64       // GetRecords calls made by the client
+	BytesPerSecond           float64       // data read from kinesis by the client
+	ReadUnitsPerSecond       float64       // dynamo read capacity consumed by the client in the kinsumer tables
+	WriteUnitsPerSecond      float64       // dynamo write capacity consumed by the client in the kinsumer tables, mostly by checkpoint commits
+
+	// Whether all the kinsumer tables are billed per request rather than for their provisioned capacity
+	OnDemand bool
+	// Cost of the kinsumer tables, summed by table. An on-demand table costs the capacity consumed in
+	// it by this client, a provisioned one costs its provisioned capacity, which is shared by all the
+	// clients of the application.
+	DynamoMonthly float64
+	// Cost of the client reading with GetRecords, which is only charged for dynamo as polling is
+	// covered by the stream's shard hours
+	PollingMonthly float64
+	// Cost of the client if it read the same data from the same shards with enhanced fan-out
+	FanOutMonthly float64
+}
+
+// usage counts the calls made to kinesis and dynamo, it is safe for concurrent use
+type usage struct {
+	since           time.Time
+	getRecordsCalls uint64
+	bytesRead       uint64
+
+	mutex  sync.Mutex
+	tables map[string]*tableUsage // dynamo capacity consumed by table name
+}
+
+// tableUsage is the dynamo capacity consumed in a table
+type tableUsage struct {
+	readMilliUnits  uint64 // read capacity units consumed, in thousandths
+	writeMilliUnits uint64 // write capacity units consumed, in thousandths
+}
+
+func newUsage() *usage {
+	return &usage{since: time.Now(), tables: make(map[string]*tableUsage)}
+}
+
+// getRecords accounts for a GetRecords call that returned the given records
+func (u *usage) getRecords(records []*kinesis.Record) {
+	var size int
+	for _, r := range records {
+		size += len(r.Data)
+	}
+	atomic.AddUint64(&u.getRecordsCalls, 1)
+	atomic.AddUint64(&u.bytesRead, uint64(size))
+}
+
+// consumed accounts for the capacity consumed by a dynamo request in a table. Kinsumer items are
+// small, so requests that don't report their capacity are counted as one unit.
+func (u *usage) consumed(table *string, capacity *dynamodb.ConsumedCapacity, write bool) {
+	units := 1.0
+	if capacity != nil && capacity.CapacityUnits != nil {
+		units = aws.Float64Value(capacity.CapacityUnits)
+	}
+	u.add(aws.StringValue(table), units, write)
+}
+
+// add accounts for capacity units consumed in a table
+func (u *usage) add(table string, units float64, write bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	t := u.tables[table]
+	if t == nil {
+		t = &tableUsage{}
+		u.tables[table] = t
+	}
+	if write {
+		t.writeMilliUnits += uint64(units * 1000)
+	} else {
+		t.readMilliUnits += uint64(units * 1000)
+	}
+}
+
+// table returns the capacity consumed in a table
+func (u *usage) table(table string) tableUsage {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if t := u.tables[table]; t != nil {
+		return *t
+	}
+	return tableUsage{}
+}
+
+// meteredDynamo is a dynamo interface that counts the capacity consumed by the item, scan and
+// transaction requests made through it
+type meteredDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	usage *usage
+}
+
+func (m *meteredDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	out, err := m.DynamoDBAPI.GetItem(in)
+	if err == nil {
+		m.usage.consumed(in.TableName, out.ConsumedCapacity, false)
+	}
+	return out, err
+}
+
+func (m *meteredDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	out, err := m.DynamoDBAPI.PutItem(in)
+	if err == nil {
+		m.usage.consumed(in.TableName, out.ConsumedCapacity, true)
+	}
+	return out, err
+}
+
+func (m *meteredDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	out, err := m.DynamoDBAPI.UpdateItem(in)
+	if err == nil {
+		m.usage.consumed(in.TableName, out.ConsumedCapacity, true)
+	}
+	return out, err
+}
+
+func (m *meteredDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	out, err := m.DynamoDBAPI.DeleteItem(in)
+	if err == nil {
+		m.usage.consumed(in.TableName, out.ConsumedCapacity, true)
+	}
+	return out, err
+}
+
+// TransactWriteItems counts the capacity consumed in each table of the transaction. Transactional
+// writes take two units per item when the capacity isn't reported.
+func (m *meteredDynamo) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	out, err := m.DynamoDBAPI.TransactWriteItems(in)
+	if err != nil {
+		return out, err
+	}
+	if len(out.ConsumedCapacity) > 0 {
+		for _, capacity := range out.ConsumedCapacity {
+			m.usage.consumed(capacity.TableName, capacity, true)
+		}
+		return out, nil
+	}
+	for _, item := range in.TransactItems {
+		var table *string
+		switch {
+		case item.Put != nil:
+			table = item.Put.TableName
+		case item.Update != nil:
+			table = item.Update.TableName
+		case item.Delete != nil:
+			table = item.Delete.TableName
+		case item.ConditionCheck != nil:
+			table = item.ConditionCheck.TableName
+		}
+		m.usage.add(aws.StringValue(table), 2, true)
+	}
+	return out, nil
+}
+
+func (m *meteredDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	in.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+	return m.DynamoDBAPI.ScanPages(in, func(page *dynamodb.ScanOutput, last bool) bool {
+		m.usage.consumed(in.TableName, page.ConsumedCapacity, false)
+		return fn(page, last)
+	})
+}
+
+// EstimateCosts returns the approximate monthly cost of this client, extrapolated from the GetRecords
+// calls it made and the dynamo capacity it consumed since it was created, along with what enhanced
+// fan-out would cost it for the same shards and data. It describes the kinsumer tables to find how
+// they are billed. Lowering the commit frequency lowers the write units consumed.
+func (k *Kinsumer) EstimateCosts(ctx context.Context) (*CostEstimate, error) {
+	rates := k.config.costRates
+	estimate := &CostEstimate{
+		Observed: time.Since(k.usage.since),
+		OnDemand: true,
+	}
+
+	k.checkpointersMutex.Lock()
+	estimate.Shards = len(k.checkpointers)
+	k.checkpointersMutex.Unlock()
+
+	seconds := estimate.Observed.Seconds()
+	if seconds > 0 {
+		estimate.GetRecordsCallsPerSecond = float64(atomic.LoadUint64(&k.usage.getRecordsCalls)) / seconds
+		estimate.BytesPerSecond = float64(atomic.LoadUint64(&k.usage.bytesRead)) / seconds
+	}
+
+	tables := []string{k.clientsTableName, k.checkpointTableName, k.metadataTableName}
+	if k.config.deduplicationWindow > 0 {
+		tables = append(tables, k.dedupTableName)
+	}
+	secondsPerMonth := float64(hoursPerMonth * 60 * 60)
+	for _, name := range tables {
+		// The tables the requests go to while migrating them
+		table, _ := k.migrating.route(aws.String(name))
+		var readUnits, writeUnits float64
+		if seconds > 0 {
+			consumed := k.usage.table(aws.StringValue(table))
+			readUnits = float64(consumed.readMilliUnits) / 1000 / seconds
+			writeUnits = float64(consumed.writeMilliUnits) / 1000 / seconds
+		}
+		estimate.ReadUnitsPerSecond += readUnits
+		estimate.WriteUnitsPerSecond += writeUnits
+
+		out, err := k.dynamodb.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: table,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if summary := out.Table.BillingModeSummary; summary != nil && aws.StringValue(summary.BillingMode) == dynamodb.BillingModePayPerRequest {
+			estimate.DynamoMonthly += (readUnits*rates.DynamoReadRequestUnit + writeUnits*rates.DynamoWriteRequestUnit) * secondsPerMonth
+			continue
+		}
+		estimate.OnDemand = false
+		if throughput := out.Table.ProvisionedThroughput; throughput != nil {
+			estimate.DynamoMonthly += (float64(aws.Int64Value(throughput.ReadCapacityUnits))*rates.DynamoReadCapacityHour +
+				float64(aws.Int64Value(throughput.WriteCapacityUnits))*rates.DynamoWriteCapacityHour) * hoursPerMonth
+		}
+	}
+
+	estimate.PollingMonthly = estimate.DynamoMonthly
+	estimate.FanOutMonthly = estimate.DynamoMonthly +
+		float64(estimate.Shards)*rates.FanOutShardHour*hoursPerMonth +
+		estimate.BytesPerSecond*secondsPerMonth/1e9*rates.FanOutGigabyte
+	return estimate, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// describedDynamo adds DescribeTable and TransactWriteItems to the dynamo mock, every table having the
+// given billing mode unless it has its own
+type describedDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	billingMode  string
+	billingModes map[string]string
+}
+
+func (d *describedDynamo) DescribeTableWithContext(ctx aws.Context, in *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	mode := d.billingMode
+	if m, ok := d.billingModes[aws.StringValue(in.TableName)]; ok {
+		mode = m
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:          in.TableName,
+		BillingModeSummary: &dynamodb.BillingModeSummary{BillingMode: aws.String(mode)},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  aws.Int64(10),
+			WriteCapacityUnits: aws.Int64(10),
+		},
+	}}, nil
+}
+
+func (d *describedDynamo) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestEstimateCosts(t *testing.T) {
+	db := &describedDynamo{DynamoDBAPI: mocks.NewMockDynamo([]string{"app_checkpoints"}), billingMode: dynamodb.BillingModePayPerRequest}
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+
+	// The mock doesn't report consumed capacity, so each request counts as one unit
+	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("app_checkpoints"),
+		Item:      map[string]*dynamodb.AttributeValue{"Shard": {S: aws.String("shard")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), k.usage.table("app_checkpoints").writeMilliUnits)
+
+	// Transactions count in each of their tables
+	_, err = k.dynamodb.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{
+		{Put: &dynamodb.Put{TableName: aws.String("orders")}},
+		{Put: &dynamodb.Put{TableName: aws.String("app_checkpoints")}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3000), k.usage.table("app_checkpoints").writeMilliUnits)
+	require.Equal(t, uint64(2000), k.usage.table("orders").writeMilliUnits)
+
+	// An hour at 2 write units, 1 read unit and 1MB per second
+	k.usage = &usage{
+		since:           time.Now().Add(-time.Hour),
+		getRecordsCalls: 3600,
+		bytesRead:       3600 * 1e6,
+		tables: map[string]*tableUsage{
+			"app_checkpoints": {readMilliUnits: 3600 * 1000, writeMilliUnits: 2 * 3600 * 1000},
+			"orders":          {writeMilliUnits: 3600 * 1000},
+		},
+	}
+	k.checkpointers["shard"] = &checkpointer{shardID: "shard"}
+
+	estimate, err := k.EstimateCosts(context.Background())
+	require.NoError(t, err)
+	require.True(t, estimate.OnDemand)
+	require.Equal(t, 1, estimate.Shards)
+	require.InDelta(t, 1, estimate.GetRecordsCallsPerSecond, 0.01)
+	require.InDelta(t, 2, estimate.WriteUnitsPerSecond, 0.01)
+
+	secondsPerMonth := float64(hoursPerMonth * 60 * 60)
+	dynamo := (0.25 + 2*1.25) / 1e6 * secondsPerMonth
+	require.InDelta(t, dynamo, estimate.DynamoMonthly, 0.1)
+	require.Equal(t, estimate.DynamoMonthly, estimate.PollingMonthly)
+	require.InDelta(t, dynamo+0.015*hoursPerMonth+secondsPerMonth/1e3*0.013, estimate.FanOutMonthly, 0.5)
+
+	// Provisioned tables cost their capacity whatever is consumed
+	db.billingMode = dynamodb.BillingModeProvisioned
+	estimate, err = k.EstimateCosts(context.Background())
+	require.NoError(t, err)
+	require.False(t, estimate.OnDemand)
+	require.InDelta(t, 3*10*(0.00013+0.00065)*hoursPerMonth, estimate.DynamoMonthly, 0.01)
+
+	// With mixed billing modes the on-demand tables still cost what was consumed in them
+	db.billingModes = map[string]string{"app_checkpoints": dynamodb.BillingModePayPerRequest}
+	estimate, err = k.EstimateCosts(context.Background())
+	require.NoError(t, err)
+	require.False(t, estimate.OnDemand)
+	require.InDelta(t, 2*10*(0.00013+0.00065)*hoursPerMonth+dynamo, estimate.DynamoMonthly, 0.1)
+}
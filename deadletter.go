@@ -0,0 +1,130 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// A RecordHook processes or decodes a record before NextRecord returns it. A record the hook returns
+// an error for isn't returned, it is tried again later like a nacked record, and sent to the
+// dead-letter sink once it failed too many times.
+type RecordHook func(record *Record) error
+
+// A DeadLetterSink receives the records that failed too many times, along with the error of their
+// last failure. A record the sink returns an error for is tried again later. Its methods are called
+// from multiple go routines.
+type DeadLetterSink interface {
+	SendDeadLetter(record *Record, cause error) error
+}
+
+// DeadLetterFunc is a DeadLetterSink calling a function
+type DeadLetterFunc func(record *Record, cause error) error
+
+// SendDeadLetter implementation calling the function
+func (f DeadLetterFunc) SendDeadLetter(record *Record, cause error) error {
+	return f(record, cause)
+}
+
+type kinesisDeadLetterSink struct {
+	kinesis    kinesisiface.KinesisAPI
+	streamName string
+}
+
+// NewKinesisDeadLetterSink returns a DeadLetterSink that puts the records, with their original
+// partition key, on another kinesis stream
+func NewKinesisDeadLetterSink(kinesis kinesisiface.KinesisAPI, streamName string) DeadLetterSink {
+	return &kinesisDeadLetterSink{kinesis: kinesis, streamName: streamName}
+}
+
+func (s *kinesisDeadLetterSink) SendDeadLetter(record *Record, cause error) error {
+	_, err := s.kinesis.PutRecord(&kinesis.PutRecordInput{
+		StreamName:   aws.String(s.streamName),
+		PartitionKey: aws.String(record.PartitionKey),
+		Data:         record.Data,
+	})
+	return err
+}
+
+type sqsDeadLetterSink struct {
+	sqs      sqsiface.SQSAPI
+	queueURL string
+}
+
+// NewSQSDeadLetterSink returns a DeadLetterSink that sends the records to an SQS queue. The body of
+// the messages is the base64 encoded data of the record, and the shard, sequence number, partition
+// key and error are set as message attributes.
+func NewSQSDeadLetterSink(sqs sqsiface.SQSAPI, queueURL string) DeadLetterSink {
+	return &sqsDeadLetterSink{sqs: sqs, queueURL: queueURL}
+}
+
+func (s *sqsDeadLetterSink) SendDeadLetter(record *Record, cause error) error {
+	attribute := func(value string) *sqs.MessageAttributeValue {
+		return &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"ShardID":        attribute(record.ShardID),
+		"SequenceNumber": attribute(record.SequenceNumber),
+		"Error":          attribute(cause.Error()),
+	}
+	// SQS rejects empty attribute values
+	if record.PartitionKey != "" {
+		attributes["PartitionKey"] = attribute(record.PartitionKey)
+	}
+	_, err := s.sqs.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          aws.String(s.queueURL),
+		MessageBody:       aws.String(base64.StdEncoding.EncodeToString(record.Data)),
+		MessageAttributes: attributes,
+	})
+	return err
+}
+
+// failRecord is called when a record returned by NextRecord failed for the given cause, either
+// the record hook or the application nacking it. It sends the record to the dead-letter sink if it
+// failed too many times, and tries it again after delay otherwise.
+func (k *Kinsumer) failRecord(record *Record, delay time.Duration, cause error) error {
+	cr := record.consumed
+	if !cr.checkpointer.isCaptured() {
+		return ErrShardNotOwned
+	}
+
+	cause = k.redactError(cause)
+	attempts := cr.attempts + 1
+	if sink := k.config.deadLetterSink; sink != nil && attempts >= k.config.deadLetterAttempts {
+		err := sink.SendDeadLetter(record, cause)
+		if err == nil {
+			// The record was already acked when it was returned, so we are done with it
+			if stats, ok := k.config.stats.(DeadLetterStatReceiver); ok {
+				stats.DeadLettered(record.ShardID)
+			}
+			k.logf(LevelWarn, "deadLetter", record.ShardID, "Sent record %s of shard %s to the dead-letter sink after %d attempts: %s",
+				record.SequenceNumber, record.ShardID, attempts, cause)
+			// Held when dispatching
+			cr.checkpointer.unhold(record.SequenceNumber)
+			cr.trace.log(k.config.logger, "dead-lettered", time.Now())
+			return nil
+		}
+		k.logf(LevelError, "deadLetter", record.ShardID, "Error sending record %s of shard %s to the dead-letter sink, trying it again: %s",
+			record.SequenceNumber, record.ShardID, err)
+	}
+
+	cr.checkpointer.hold(record.SequenceNumber, cr.previous)
+	k.redeliveries.push(&consumedRecord{
+		record:       cr.record,
+		checkpointer: cr.checkpointer,
+		retrievedAt:  cr.retrievedAt,
+		trace:        cr.trace,
+		previous:     cr.previous,
+		redelivered:  true,
+		attempts:     attempts,
+	}, time.Now().Add(delay))
+	cr.trace.log(k.config.logger, "nacked", time.Now())
+	return nil
+}
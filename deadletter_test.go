@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetter(t *testing.T) {
+	var dead []*Record
+	var causes []error
+	sink := DeadLetterFunc(func(record *Record, cause error) error {
+		dead = append(dead, record)
+		causes = append(causes, cause)
+		return nil
+	})
+	config := NewConfig().WithLogger(&recordingLogger{}).WithDeadLetterSink(sink, 2)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	cp := &checkpointer{shardID: "shard", captured: true}
+	record := &Record{
+		ShardID:        "shard",
+		SequenceNumber: "1",
+		consumed: &consumedRecord{
+			record:       &kinesis.Record{SequenceNumber: aws.String("1")},
+			checkpointer: cp,
+		},
+	}
+
+	// The first failure is tried again
+	bad := errors.New("bad record")
+	require.NoError(t, k.failRecord(record, 0, bad))
+	require.Empty(t, dead)
+	redelivered, _ := k.redeliveries.pop(time.Now())
+	require.NotNil(t, redelivered)
+	require.Equal(t, 1, redelivered.attempts)
+	require.Equal(t, "", cp.checkpointedSequenceNumber(), "the checkpoint is held back")
+
+	// The second one goes to the sink
+	cp.unhold("1")
+	record.consumed = redelivered
+	require.NoError(t, k.Nack(record, time.Minute))
+	require.Equal(t, []*Record{record}, dead)
+	require.Equal(t, []error{ErrTooManyNacks}, causes)
+	redelivered, _ = k.redeliveries.pop(time.Now().Add(time.Hour))
+	require.Nil(t, redelivered)
+
+	// A record that can't be sent to the sink is tried again
+	failing := config.WithDeadLetterSink(DeadLetterFunc(func(*Record, error) error { return errors.New("sink down") }), 1)
+	k.config = failing
+	require.NoError(t, k.failRecord(record, 0, bad))
+	redelivered, _ = k.redeliveries.pop(time.Now())
+	require.NotNil(t, redelivered)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DebugState is a snapshot of the internal state of the consumer, for diagnosing stalls
+type DebugState struct {
+	ClientID   string
+	ClientName string
+	Running    bool
+	// Whether we are the leader, and the token of our leadership
+	Leader      bool
+	LeaderToken int64
+	// Last time our client record was updated
+	LastHeartbeat time.Time
+	// Number of shards assigned to us, and the state of the ones we captured
+	AssignedShards int
+	Shards         []ShardDebugState
+	// Records waiting in the buffer for the application, out of its capacity
+	BufferedRecords int
+	BufferCapacity  int
+	// Last time a record was returned to the application
+	LastDelivery time.Time
+}
+
+// ShardDebugState is the state of a shard we consume
+type ShardDebugState struct {
+	ShardID string
+	// Last sequence number acked by the application, and the one the next checkpoint writes, which
+	// is earlier while nacked records wait for redelivery
+	SequenceNumber             string
+	CheckpointedSequenceNumber string
+	// How far behind the tip of the stream the last GetRecords call was, in milliseconds
+	IteratorAgeMillis int64
+	LastGetRecords    time.Time
+	LastCheckpoint    time.Time
+	// Whether records were acked since the last checkpoint written
+	Dirty bool
+	// Number of checkpoint writes that failed since the shard was captured
+	CommitErrors int
+	// Fencing token of our ownership of the shard
+	LeaseToken int64
+	// Records waiting in the buffer of the shard with shard buffers
+	BufferedRecords int
+}
+
+// DebugState returns a snapshot of the internal state of the consumer
+func (k *Kinsumer) DebugState() *DebugState {
+	state := &DebugState{ClientID: k.clientID(), ClientName: k.clientName}
+	state.Leader, state.LeaderToken = k.Leadership()
+
+	k.health.mutex.Lock()
+	state.Running = k.health.running
+	state.LastHeartbeat = k.health.lastHeartbeat
+	state.AssignedShards = k.health.assigned
+	state.LastDelivery = k.health.lastDelivery
+	records := k.health.records
+	k.health.mutex.Unlock()
+	state.BufferedRecords, state.BufferCapacity = len(records), cap(records)
+
+	var shardBuffered map[string]int
+	if k.shardBuffers != nil {
+		shardBuffered = k.shardBuffers.occupancy()
+	}
+	k.checkpointersMutex.Lock()
+	for _, cp := range k.checkpointers {
+		cp.mutex.Lock()
+		state.Shards = append(state.Shards, ShardDebugState{
+			ShardID:                    cp.shardID,
+			SequenceNumber:             cp.sequenceNumber,
+			CheckpointedSequenceNumber: cp.checkpointedSequenceNumber(),
+			IteratorAgeMillis:          int64(cp.lag / time.Millisecond),
+			LastGetRecords:             cp.polledAt,
+			LastCheckpoint:             cp.written,
+			Dirty:                      cp.dirty,
+			CommitErrors:               cp.commitErrors,
+			LeaseToken:                 cp.leaseToken,
+			BufferedRecords:            shardBuffered[cp.shardID],
+		})
+		cp.mutex.Unlock()
+	}
+	k.checkpointersMutex.Unlock()
+	sort.Slice(state.Shards, func(i, j int) bool { return state.Shards[i].ShardID < state.Shards[j].ShardID })
+	return state
+}
+
+// DebugHandler returns an http.Handler serving the DebugState as JSON. It exposes the client and
+// shard IDs and sequence numbers, so it should only be served to operators.
+func (k *Kinsumer) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(k.DebugState()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandler(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	k.health.setBuffer(make(chan *consumedRecord, 5))
+	k.health.assign(2, time.Now())
+	polledAt := time.Now()
+	for _, shardID := range []string{"shard2", "shard1"} {
+		cp := &checkpointer{shardID: shardID, sequenceNumber: "3", holds: map[string]string{"2": "1"}, commitErrors: 1}
+		cp.polled(polledAt, 1500*time.Millisecond)
+		k.setOwnedCheckpointer(shardID, cp)
+	}
+
+	rec := httptest.NewRecorder()
+	k.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/kinsumer", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var state DebugState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+
+	require.Equal(t, k.clientID(), state.ClientID)
+	require.False(t, state.Leader)
+	require.Equal(t, 2, state.AssignedShards)
+	require.Equal(t, 5, state.BufferCapacity)
+	require.Len(t, state.Shards, 2)
+	shard := state.Shards[0]
+	require.Equal(t, "shard1", shard.ShardID)
+	require.Equal(t, "3", shard.SequenceNumber)
+	require.Equal(t, "1", shard.CheckpointedSequenceNumber, "a nacked record waits for redelivery")
+	require.Equal(t, int64(1500), shard.IteratorAgeMillis)
+	require.True(t, shard.LastGetRecords.Equal(polledAt))
+	require.Equal(t, 1, shard.CommitErrors)
+}
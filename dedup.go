@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// A DeduplicationKey returns the key identifying a record for deduplication, such as an idempotency
+// key the producer put in its data. Records with the same key are only returned once within the
+// deduplication window. It is called from multiple go routines.
+type DeduplicationKey func(record *Record) string
+
+// deduplicationRecord is an item of the deduplication table, recording that a record was processed
+type deduplicationRecord struct {
+	Key            string
+	ShardID        string
+	SequenceNumber string
+	ExpiresAt      int64 // unix timestamp after which the record may be returned again, the table's TTL attribute
+}
+
+// deduplicationKey returns the key of a record in the deduplication table
+func (k *Kinsumer) deduplicationKey(record *Record) string {
+	if k.config.deduplicationKey != nil {
+		return k.config.deduplicationKey(record)
+	}
+	return record.ShardID + "/" + record.SequenceNumber
+}
+
+// processedBefore returns whether a record was marked processed in the deduplication table within
+// the deduplication window. Records are returned when the table can't be read, as it is better to
+// return a record twice than never.
+func (k *Kinsumer) processedBefore(record *Record) bool {
+	out, err := k.dynamodb.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(k.dedupTableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(k.deduplicationKey(record))},
+		},
+	})
+	if err != nil {
+		k.logf(LevelWarn, "deduplicate", record.ShardID, "Error reading the deliveries of record %s of shard %s, returning it: %s",
+			record.SequenceNumber, record.ShardID, err)
+		return false
+	}
+	var processed deduplicationRecord
+	if err = dynamodbattribute.UnmarshalMap(out.Item, &processed); err != nil {
+		k.logf(LevelWarn, "deduplicate", record.ShardID, "Error unmarshaling the delivery of record %s of shard %s, returning it: %s",
+			record.SequenceNumber, record.ShardID, err)
+		return false
+	}
+	// Expired items linger until dynamo gets around to deleting them
+	if out.Item == nil || processed.ExpiresAt < time.Now().Unix() {
+		return false
+	}
+	if stats, ok := k.config.stats.(DeduplicationStatReceiver); ok {
+		stats.Deduplicated(record.ShardID)
+	}
+	return true
+}
+
+// MarkProcessed records in the deduplication table that a record returned by NextRecord was
+// processed, so it isn't returned again within the deduplication window. Dispatch marks the records
+// its handler processed. It does nothing when deduplication is disabled.
+func (k *Kinsumer) MarkProcessed(record *Record) error {
+	if k.config.deduplicationWindow <= 0 {
+		return nil
+	}
+	item, err := dynamodbattribute.MarshalMap(deduplicationRecord{
+		Key:            k.deduplicationKey(record),
+		ShardID:        record.ShardID,
+		SequenceNumber: record.SequenceNumber,
+		ExpiresAt:      time.Now().Add(k.config.deduplicationWindow).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling the delivery of record %s of shard %s: %w", record.SequenceNumber, record.ShardID, err)
+	}
+	if _, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(k.dedupTableName),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("error marking record %s of shard %s processed: %w", record.SequenceNumber, record.ShardID, err)
+	}
+	return nil
+}
+
+// createDeduplicationTable creates the deduplication table and enables its TTL, so expired
+// deliveries are deleted by dynamo
+func (k *Kinsumer) createDeduplicationTable() error {
+	if err := k.dynamoCreateTableIfNotExists(k.dedupTableName, "Key", false); err != nil {
+		return err
+	}
+	out, err := k.dynamodb.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(k.dedupTableName),
+	})
+	if err != nil {
+		return err
+	}
+	switch aws.StringValue(out.TimeToLiveDescription.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return nil
+	}
+	_, err = k.dynamodb.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(k.dedupTableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
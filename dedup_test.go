@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// dedupDynamo keeps the items of the deduplication table, which the dynamo mock doesn't read back
+type dedupDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	expiresAt map[string]int64
+}
+
+func (d *dedupDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	expiresAt, ok := d.expiresAt[aws.StringValue(in.Key["Key"].S)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"ExpiresAt": {N: aws.String(strconv.FormatInt(expiresAt, 10))},
+	}}, nil
+}
+
+func (d *dedupDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	d.expiresAt[aws.StringValue(in.Item["Key"].S)], _ = strconv.ParseInt(aws.StringValue(in.Item["ExpiresAt"].N), 10, 64)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestMarkProcessed(t *testing.T) {
+	db := &dedupDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil), expiresAt: make(map[string]int64)}
+	config := NewConfig().WithDeduplication(time.Hour, nil)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	record := func(shardID, sequenceNumber, data string) *Record {
+		return &Record{ShardID: shardID, SequenceNumber: sequenceNumber, Data: []byte(data)}
+	}
+	// Returning a record doesn't mark it, so it isn't lost if it wasn't processed
+	require.False(t, k.processedBefore(record("shard1", "1", "a")))
+	require.False(t, k.processedBefore(record("shard1", "1", "a")))
+	require.NoError(t, k.MarkProcessed(record("shard1", "1", "a")))
+	require.True(t, k.processedBefore(record("shard1", "1", "a")), "returned again after a handoff")
+	require.False(t, k.processedBefore(record("shard2", "1", "a")))
+
+	// Once the window is over the record can be returned again
+	db.expiresAt["shard1/1"] = time.Now().Add(-time.Minute).Unix()
+	require.False(t, k.processedBefore(record("shard1", "1", "a")))
+
+	// With an idempotency key the shard and sequence number don't matter
+	k.config = config.WithDeduplication(time.Hour, func(r *Record) string { return string(r.Data) })
+	require.NoError(t, k.MarkProcessed(record("shard1", "2", "b")))
+	require.True(t, k.processedBefore(record("shard2", "5", "b")))
+
+	// Dispatch marks the records its handler processed
+	db.expiresAt = make(map[string]int64)
+	cp := &checkpointer{shardID: "shard"}
+	processed := &Record{ShardID: "shard", SequenceNumber: "3", Data: []byte("c"), consumed: &consumedRecord{checkpointer: cp}}
+	require.NoError(t, k.handle(processed, func(*Record) error { return nil }))
+	require.True(t, k.processedBefore(record("shard3", "7", "c")))
+	failed := &Record{ShardID: "shard", SequenceNumber: "4", Data: []byte("d"), consumed: &consumedRecord{checkpointer: cp}}
+	require.Error(t, k.handle(failed, func(*Record) error { return errors.New("boom") }))
+	require.False(t, k.processedBefore(record("shard3", "8", "d")))
+}
+
+func TestDeduplicationSkipsRedeliveries(t *testing.T) {
+	db := &dedupDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil), expiresAt: make(map[string]int64)}
+	config := NewConfig().WithDeduplication(time.Hour, nil)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	cp := &checkpointer{shardID: "shard"}
+	arrived := time.Now()
+	k.output = make(chan *consumedRecord, 2)
+	require.NoError(t, k.MarkProcessed(&Record{ShardID: "shard", SequenceNumber: "1"}))
+	k.output <- &consumedRecord{record: &kinesis.Record{SequenceNumber: aws.String("2"), ApproximateArrivalTimestamp: &arrived}, checkpointer: cp}
+	k.output <- &consumedRecord{record: &kinesis.Record{SequenceNumber: aws.String("1"), ApproximateArrivalTimestamp: &arrived}, checkpointer: cp, redelivered: true}
+	for _, sequenceNumber := range []string{"2", "1"} {
+		record, err := k.NextRecord()
+		require.NoError(t, err)
+		require.Equal(t, sequenceNumber, record.SequenceNumber)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// minShardDiscoveryFrequency is the shortest time between shard discoveries, which list the shards
+	// of the stream with a ListShards call limited to 100 per second
+	minShardDiscoveryFrequency = time.Second
+	// onDemandShardDiscoveryFrequency is the time between shard discoveries for on-demand streams
+	onDemandShardDiscoveryFrequency = 5 * time.Second
+)
+
+// shardDiscovery is what a client knows of the shards between two discoveries
+type shardDiscovery struct {
+	// highest shard ID cached or listed, the shards are listed after it as shard IDs only increase
+	after string
+	// shard IDs of the cache at the last discovery
+	cached []string
+}
+
+// discoverShards looks for new shards at the shard discovery frequency until stop is closed
+func (k *Kinsumer) discoverShards(stop <-chan struct{}) {
+	defer k.recoverPanic("discoverShards", "")
+	ticker := time.NewTicker(k.config.shardDiscoveryFrequency)
+	defer ticker.Stop()
+
+	discovery := &shardDiscovery{}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := k.discover(discovery); err != nil {
+			k.reportError("discoverShards", "", err)
+		}
+	}
+}
+
+// discover refreshes our shards if the shard cache changed since the last discovery, and if we are
+// the leader adds the shards created since then to the cache
+func (k *Kinsumer) discover(discovery *shardDiscovery) error {
+	shardCache, err := loadShardCacheFromDynamo(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return fmt.Errorf("error loading shard cache from dynamo: %v", err)
+	}
+	if shardCache == nil || len(shardCache.ShardIDs) == 0 || shardCache.Failovers != k.streamFailovers() {
+		// The shard checks and leader actions list all the shards until there is a cache
+		return nil
+	}
+	if discovery.cached != nil && !stringSlicesEqual(discovery.cached, shardCache.ShardIDs) {
+		k.requestRefresh()
+	}
+	discovery.cached = shardCache.ShardIDs
+	if last := shardCache.ShardIDs[len(shardCache.ShardIDs)-1]; last > discovery.after {
+		discovery.after = last
+	}
+
+	if leader, _ := k.Leadership(); !leader {
+		return nil
+	}
+	shards, err := listShardPages(k.kinesis, &kinesis.ListShardsInput{
+		StreamName: aws.String(k.streamName),
+		ShardFilter: &kinesis.ShardFilter{
+			Type:    aws.String(kinesis.ShardFilterTypeAfterShardId),
+			ShardId: aws.String(discovery.after),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error listing the shards after %s: %v", discovery.after, err)
+	}
+	if len(shards) == 0 {
+		return nil
+	}
+
+	// The parents that aren't cached nor new are finished
+	known := make(map[string]bool, len(shardCache.ShardIDs)+len(shards))
+	for _, shardID := range shardCache.ShardIDs {
+		known[shardID] = true
+	}
+	for _, shard := range shards {
+		known[aws.StringValue(shard.ShardId)] = true
+	}
+	created := make(map[string][]string, len(shards))
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		var parents []string
+		for _, parentID := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+			if parentID != nil && known[*parentID] {
+				parents = append(parents, *parentID)
+			}
+		}
+		created[shardID] = parents
+		if shardID > discovery.after {
+			discovery.after = shardID
+		}
+	}
+
+	added, err := k.addShards(created)
+	if err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		k.logf(LevelInfo, "discoverShards", "", "Discovered %d new shards: %s", len(added), strings.Join(added, ", "))
+		// We refreshed already
+		discovery.cached = nil
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// shardCacheDynamo keeps the shard cache, applying the updates of shardCacheUpdate
+type shardCacheDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	cache shardCacheRecord
+}
+
+func (d *shardCacheDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	item, err := dynamodbattribute.MarshalMap(&d.cache)
+	return &dynamodb.GetItemOutput{Item: item}, err
+}
+
+func (d *shardCacheDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	var values map[string]interface{}
+	if err := dynamodbattribute.UnmarshalMap(in.ExpressionAttributeValues, &values); err != nil {
+		return nil, err
+	}
+	if shardIDs, ok := values[":shardIDs"]; ok {
+		d.cache.ShardIDs = nil
+		for _, shardID := range shardIDs.([]interface{}) {
+			d.cache.ShardIDs = append(d.cache.ShardIDs, shardID.(string))
+		}
+	}
+	if err := dynamodbattribute.Unmarshal(in.ExpressionAttributeValues[":shardParents"], &d.cache.ShardParents); err != nil {
+		return nil, err
+	}
+	for name, child := range in.ExpressionAttributeNames {
+		var parents []string
+		for _, parent := range values[":parents"+strings.TrimPrefix(name, "#child")].([]interface{}) {
+			parents = append(parents, parent.(string))
+		}
+		if d.cache.ShardParents == nil {
+			d.cache.ShardParents = make(map[string][]string)
+		}
+		d.cache.ShardParents[*child] = parents
+	}
+	d.cache.LastUpdate = int64(values[":lastUpdate"].(float64))
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestShardDiscovery(t *testing.T) {
+	var shards []*kinesis.Shard
+	for _, shard := range []struct{ id, parent, adjacent string }{
+		{id: "shardId-000000000000"},
+		{id: "shardId-000000000001"},
+		{id: "shardId-000000000002", parent: "shardId-000000000001"},
+		{id: "shardId-000000000003", parent: "shardId-000000000001"},
+		{id: "shardId-000000000004", parent: "shardId-000000000000", adjacent: "shardId-000000000003"},
+		// Its parent expired from the stream
+		{id: "shardId-000000000005", parent: "shardId-000000000000-gone"},
+	} {
+		s := &kinesis.Shard{ShardId: aws.String(shard.id)}
+		if shard.parent != "" {
+			s.ParentShardId = aws.String(shard.parent)
+		}
+		if shard.adjacent != "" {
+			s.AdjacentParentShardId = aws.String(shard.adjacent)
+		}
+		shards = append(shards, s)
+	}
+	kin := mocks.NewMockKinesis("stream", shards)
+	db := &shardCacheDynamo{cache: shardCacheRecord{
+		Key:        shardCacheKey,
+		ShardIDs:   []string{"shardId-000000000000", "shardId-000000000001"},
+		LastUpdate: 1,
+	}}
+	config := NewConfig().WithOnDemandStream()
+	leader, err := NewWithInterfaces(kin, db, "stream", "app", "leader", config)
+	require.NoError(t, err)
+	follower, err := NewWithInterfaces(kin, db, "stream", "app", "follower", config)
+	require.NoError(t, err)
+	atomic.StoreInt64(&leader.leaderToken, 1)
+
+	// The follower knows the cache before the new shards
+	followerDiscovery := &shardDiscovery{}
+	require.NoError(t, follower.discover(followerDiscovery))
+	require.Equal(t, 0, kin.ListShardsCalls, "only the leader lists the shards")
+	require.Len(t, follower.refreshRequested, 0)
+
+	// Only the shards after the last cached one are listed
+	leaderDiscovery := &shardDiscovery{}
+	require.NoError(t, leader.discover(leaderDiscovery))
+	require.Equal(t, 2, kin.ListShardsCalls, "two pages of the four new shards")
+	require.Equal(t, []string{
+		"shardId-000000000000", "shardId-000000000001", "shardId-000000000002",
+		"shardId-000000000003", "shardId-000000000004", "shardId-000000000005",
+	}, db.cache.ShardIDs)
+	require.Equal(t, map[string][]string{
+		"shardId-000000000002": {"shardId-000000000001"},
+		"shardId-000000000003": {"shardId-000000000001"},
+		"shardId-000000000004": {"shardId-000000000000", "shardId-000000000003"},
+	}, db.cache.ShardParents)
+	require.Len(t, leader.refreshRequested, 1)
+	require.Equal(t, "shardId-000000000005", leaderDiscovery.after)
+
+	// The follower refreshes its shards on its next discovery rather than the next shard check
+	require.NoError(t, follower.discover(followerDiscovery))
+	require.Len(t, follower.refreshRequested, 1)
+
+	// Without new shards the cache is left alone
+	lastUpdate := db.cache.LastUpdate
+	require.NoError(t, leader.discover(leaderDiscovery))
+	require.Equal(t, lastUpdate, db.cache.LastUpdate)
+	require.Equal(t, 3, kin.ListShardsCalls)
+
+	config = NewConfig().WithShardDiscovery(100 * time.Millisecond)
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidShardDiscovery))
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dispatchQueueSize is the number of records that can wait for each Dispatch worker, Dispatch stops
+// taking records while the queue of the worker of the next record is full
+const dispatchQueueSize = 64
+
+// RecordHandler processes a record handed out by Dispatch
+type RecordHandler func(record *Record) error
+
+// Dispatch calls the handler with every record from the given number of worker go routines until the
+// Kinsumer is stopped. The records with the same partition key always go to the same worker, so they
+// are processed in order while the other keys proceed in parallel, and the checkpoint of a shard only
+// moves past a record once it and all the records before it in its shard were processed. The records
+// processed are marked processed for Config.WithDeduplication.
+//
+// A record the handler fails is sent to the dead-letter sink if there is one. Otherwise, or if the
+// sink fails too, Dispatch stops taking records and returns the error once the records already handed
+// to the other workers were processed, and the checkpoint of the shard stays before the failed
+// record so it is read again once the shard changes owner. Dispatch also returns the errors returned
+// by NextRecord, and nil once the Kinsumer was stopped. It must be the only caller of NextRecord
+// while it runs, and can't be used with Config.WithTransactionalCheckpoints. Once it returned, the
+// failed record and the others it took but didn't handle are returned again first by NextRecord or
+// the next Dispatch.
+func (k *Kinsumer) Dispatch(workers int, handler RecordHandler) error {
+	if k.config.transactionalCheckpoints {
+		return ErrDispatchTransactional
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	atomic.StoreInt32(&k.dispatching, 1)
+	// Only once the records taken were put back, so they stay held until they are returned again
+	defer atomic.StoreInt32(&k.dispatching, 0)
+
+	var wg sync.WaitGroup
+	queues := make([]chan *Record, workers)
+	// each worker fails at most once, as it stops processing its keys so they stay in order
+	failed := make(chan error, workers)
+	// record each worker failed, before the ones left in its queue
+	unhandled := make([]*Record, workers)
+	for i := range queues {
+		queues[i] = make(chan *Record, dispatchQueueSize)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer k.recoverPanic("dispatch", "")
+			for record := range queues[i] {
+				if err := k.handle(record, handler); err != nil {
+					unhandled[i] = record
+					failed <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	// NextRecord is called from its own go routine, so a failure is noticed while waiting for records
+	type next struct {
+		record *Record
+		err    error
+	}
+	records := make(chan next)
+	done := make(chan struct{})
+	// records taken from NextRecord but not dispatched to a worker, in the order they were read
+	var held []*Record
+	var pending *Record
+	var reader sync.WaitGroup
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		for {
+			record, err := k.nextRecord(done)
+			select {
+			case records <- next{record, err}:
+			case <-done:
+				pending = record
+				return
+			}
+			if err != nil || record == nil {
+				return
+			}
+		}
+	}()
+
+	var err error
+dispatchLoop:
+	for {
+		var n next
+		select {
+		case n = <-records:
+		case err = <-failed:
+			break dispatchLoop
+		}
+		record := n.record
+		if err = n.err; err != nil || record == nil {
+			break
+		}
+		select {
+		case queues[dispatchWorker(record.PartitionKey, workers)] <- record:
+		case err = <-failed:
+			held = append(held, record)
+			break dispatchLoop
+		}
+	}
+
+	close(done)
+	reader.Wait()
+	if pending != nil {
+		held = append(held, pending)
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	// Put the records back in the order they were read, so the records of a key stay in order: the
+	// failed records and the queues of their workers, then the records that didn't reach a worker
+	for i, queue := range queues {
+		if unhandled[i] != nil {
+			k.requeue(unhandled[i])
+		}
+		for record := range queue {
+			k.requeue(record)
+		}
+	}
+	for _, record := range held {
+		k.requeue(record)
+	}
+	if err == nil {
+		select {
+		case err = <-failed:
+		default:
+		}
+	}
+	return err
+}
+
+// handle calls the handler with a dispatched record, and acks it once it was processed or sent to
+// the dead-letter sink
+func (k *Kinsumer) handle(record *Record, handler RecordHandler) error {
+	cp := record.consumed.checkpointer
+	err := handler(record)
+	if err == nil {
+		k.health.handled(time.Now())
+		k.markProcessed(record)
+		cp.unhold(record.SequenceNumber)
+		record.consumed.trace.log(k.config.logger, "acked", time.Now())
+		return nil
+	}
+
+	err = k.redactError(err)
+	if sink := k.config.deadLetterSink; sink != nil {
+		sinkErr := sink.SendDeadLetter(record, err)
+		if sinkErr == nil {
+			k.health.handled(time.Now())
+			k.markProcessed(record)
+			if stats, ok := k.config.stats.(DeadLetterStatReceiver); ok {
+				stats.DeadLettered(record.ShardID)
+			}
+			k.logf(LevelWarn, "deadLetter", record.ShardID, "Sent record %s of shard %s to the dead-letter sink after the handler failed: %s",
+				record.SequenceNumber, record.ShardID, err)
+			cp.unhold(record.SequenceNumber)
+			record.consumed.trace.log(k.config.logger, "dead-lettered", time.Now())
+			return nil
+		}
+		k.logf(LevelError, "deadLetter", record.ShardID, "Error sending record %s of shard %s to the dead-letter sink: %s",
+			record.SequenceNumber, record.ShardID, sinkErr)
+	}
+	return fmt.Errorf("error handling record %s of shard %s: %w", record.SequenceNumber, record.ShardID, err)
+}
+
+// requeue puts a record Dispatch took but didn't handle on the redelivery queue, it stays held until
+// it is returned again
+func (k *Kinsumer) requeue(record *Record) {
+	cr := record.consumed
+	k.redeliveries.push(&consumedRecord{
+		record:       cr.record,
+		checkpointer: cr.checkpointer,
+		retrievedAt:  cr.retrievedAt,
+		trace:        cr.trace,
+		previous:     cr.previous,
+		redelivered:  true,
+		attempts:     cr.attempts,
+	}, time.Now())
+}
+
+// markProcessed marks a record handled by Dispatch processed, it is only processed again if the
+// mark couldn't be written
+func (k *Kinsumer) markProcessed(record *Record) {
+	if err := k.MarkProcessed(record); err != nil {
+		k.logf(LevelWarn, "deduplicate", record.ShardID, "%s", err)
+	}
+}
+
+// dispatchWorker returns the worker the records with the given partition key are dispatched to
+func dispatchWorker(partitionKey string, workers int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(partitionKey))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// isDispatching returns whether the records are handed out by Dispatch, and only acked once they
+// were processed
+func (k *Kinsumer) isDispatching() bool {
+	return atomic.LoadInt32(&k.dispatching) == 1
+}
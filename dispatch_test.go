@@ -0,0 +1,182 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// dispatchRecords puts records with the given partition keys on the output, delivering them as the main
+// loop does when dispatching
+func dispatchRecords(k *Kinsumer, cp *checkpointer, keys ...string) {
+	k.output = make(chan *consumedRecord, len(keys))
+	arrived := time.Now()
+	for i, key := range keys {
+		sequenceNumber := strconv.Itoa(i + 1)
+		previous := cp.currentSequenceNumber()
+		cp.updateHeld(sequenceNumber, previous)
+		k.output <- &consumedRecord{
+			record: &kinesis.Record{
+				SequenceNumber:              aws.String(sequenceNumber),
+				PartitionKey:                aws.String(key),
+				ApproximateArrivalTimestamp: &arrived,
+			},
+			checkpointer: cp,
+			previous:     previous,
+		}
+	}
+}
+
+// heldCheckpoint returns the sequence number the checkpointer would write while records are dispatched
+func heldCheckpoint(cp *checkpointer) string {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.checkpointedSequenceNumber()
+}
+
+func TestDispatch(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	cp := &checkpointer{shardID: "shard"}
+	dispatchRecords(k, cp, "a", "b", "a", "b", "c", "a")
+
+	var mutex sync.Mutex
+	byKey := make(map[string][]string)
+	handled := make(chan string, 6)
+	release := make(chan struct{})
+	dispatched := make(chan error)
+	go func() {
+		dispatched <- k.Dispatch(4, func(record *Record) error {
+			if record.SequenceNumber == "2" {
+				<-release
+			}
+			mutex.Lock()
+			byKey[record.PartitionKey] = append(byKey[record.PartitionKey], record.SequenceNumber)
+			mutex.Unlock()
+			handled <- record.SequenceNumber
+			return nil
+		})
+	}()
+
+	// The other keys go on while record 2 is processed, and so does record 4 of the same key, but the
+	// checkpoint stays before record 2
+	for i := 0; i < 4; i++ {
+		<-handled
+	}
+	require.Equal(t, "1", heldCheckpoint(cp))
+
+	close(release)
+	<-handled
+	<-handled
+	close(k.output)
+	require.NoError(t, <-dispatched)
+	require.Equal(t, "6", heldCheckpoint(cp))
+	require.Equal(t, map[string][]string{"a": {"1", "3", "6"}, "b": {"2", "4"}, "c": {"5"}}, byKey)
+}
+
+func TestDispatchFailure(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	cp := &checkpointer{shardID: "shard"}
+	dispatchRecords(k, cp, "a", "a", "a")
+
+	failure := errors.New("downstream is down")
+	err = k.Dispatch(2, func(record *Record) error {
+		if record.SequenceNumber == "2" {
+			return failure
+		}
+		return nil
+	})
+	require.True(t, errors.Is(err, failure))
+	// Record 3 of the same key isn't handled before record 2
+	require.Equal(t, "1", heldCheckpoint(cp))
+
+	k, err = NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client",
+		NewConfig().WithTransactionalCheckpoints())
+	require.NoError(t, err)
+	require.Equal(t, ErrDispatchTransactional, k.Dispatch(2, func(record *Record) error { return nil }))
+}
+
+func TestDispatchReturns(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	cp := &checkpointer{shardID: "shard", captured: true}
+	dispatchRecords(k, cp, "a", "a", "a")
+
+	failure := errors.New("downstream is down")
+	err = k.Dispatch(1, func(record *Record) error {
+		if record.SequenceNumber == "2" {
+			// Fail once Dispatch took record 3 too
+			for len(k.output) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return failure
+		}
+		return nil
+	})
+	require.True(t, errors.Is(err, failure))
+	require.False(t, k.isDispatching())
+	require.Equal(t, "1", heldCheckpoint(cp))
+
+	// The records Dispatch didn't handle are returned again, and the checkpoint moves past them
+	var redelivered []string
+	for {
+		cr, _ := k.redeliveries.pop(time.Now())
+		if cr == nil {
+			break
+		}
+		redelivered = append(redelivered, aws.StringValue(cr.record.SequenceNumber))
+		k.returned(cr)
+	}
+	require.ElementsMatch(t, []string{"2", "3"}, redelivered)
+	require.Equal(t, "3", heldCheckpoint(cp))
+
+	// As do the records returned by NextRecord after it
+	k.returned(&consumedRecord{record: &kinesis.Record{SequenceNumber: aws.String("4")}, checkpointer: cp, previous: "3"})
+	require.Equal(t, "4", heldCheckpoint(cp))
+}
+
+func TestDispatchFailureOrder(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	cp := &checkpointer{shardID: "shard", captured: true}
+	// One more record of the key than the queue of its worker takes, so the last one is still held
+	// by Dispatch when the handler fails
+	keys := make([]string, dispatchQueueSize+2)
+	for i := range keys {
+		keys[i] = "a"
+	}
+	dispatchRecords(k, cp, keys...)
+
+	failure := errors.New("downstream is down")
+	err = k.Dispatch(2, func(record *Record) error {
+		for len(k.output) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return failure
+	})
+	require.True(t, errors.Is(err, failure))
+
+	// The records of the key are returned again in order
+	var redelivered []string
+	for {
+		cr, _ := k.redeliveries.pop(time.Now())
+		if cr == nil {
+			break
+		}
+		redelivered = append(redelivered, aws.StringValue(cr.record.SequenceNumber))
+	}
+	require.Len(t, redelivered, len(keys))
+	for i, sequenceNumber := range redelivered {
+		require.Equal(t, strconv.Itoa(i+1), sequenceNumber)
+	}
+}
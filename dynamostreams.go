@@ -0,0 +1,257 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const (
+	// maxDynamoStreamsShards is the most shards DescribeStream returns at once
+	maxDynamoStreamsShards = 100
+	// maxDynamoStreamsRecords is the most records GetRecords returns at once from a dynamodb stream
+	maxDynamoStreamsRecords = 1000
+)
+
+// dynamoStreamsKinesis is a kinesis interface reading the dynamodb stream of a table, so the
+// changes of the table are consumed like the records of a kinesis stream. Only the requests
+// kinsumer makes to read a stream are supported, the stream name of the requests is ignored.
+// Like the SDK, the requests return an empty output along with their errors.
+type dynamoStreamsKinesis struct {
+	kinesisiface.KinesisAPI // nil, the other requests have no dynamodb streams equivalent
+	streams                 dynamodbstreamsiface.DynamoDBStreamsAPI
+	streamArn               string
+}
+
+// NewDynamoStreamsKinesis returns a kinesis interface reading the dynamodb stream of the given
+// table, which must have streams enabled, to be given to NewWithInterfaces along with the table
+// name as the stream name. The shards, checkpoints and clients are then handled as for a kinesis
+// stream. The stream is the one enabled when this is called, a stream enabled again later has
+// another ARN and needs a new Kinsumer.
+//
+// The Data of the records is the dynamodb stream record, see DecodeTableStreamRecord, and their
+// partition key is made of the keys of the item changed so Dispatch keeps the changes of an item in
+// order. The shards can't be read from a timestamp, which rules out ShardReaderFromAtTimestamp
+// positions and stream failover, and there is no enhanced fan-out nor shard discovery:
+// StreamConsumers fails with ErrTableStreamFanOut.
+func NewDynamoStreamsKinesis(db dynamodbiface.DynamoDBAPI, streams dynamodbstreamsiface.DynamoDBStreamsAPI, tableName string) (kinesisiface.KinesisAPI, error) {
+	out, err := db.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing table %s: %v", tableName, err)
+	}
+	streamArn := aws.StringValue(out.Table.LatestStreamArn)
+	if streamArn == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoTableStream, tableName)
+	}
+	return &dynamoStreamsKinesis{streams: streams, streamArn: streamArn}, nil
+}
+
+// NewWithTableStream returns a Kinsumer consuming the dynamodb stream of the given table, with the
+// kinesis interface returned by NewDynamoStreamsKinesis
+func NewWithTableStream(session *session.Session, tableName, applicationName, clientName string, config Config) (*Kinsumer, error) {
+	d := dynamodb.New(session)
+	k, err := NewDynamoStreamsKinesis(d, dynamodbstreams.New(session), tableName)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithInterfaces(k, d, tableName, applicationName, clientName, config)
+}
+
+// DecodeTableStreamRecord returns the dynamodb stream record of a record read through
+// NewDynamoStreamsKinesis
+func DecodeTableStreamRecord(record *Record) (*dynamodbstreams.Record, error) {
+	var streamRecord dynamodbstreams.Record
+	if err := json.Unmarshal(record.Data, &streamRecord); err != nil {
+		return nil, fmt.Errorf("error decoding record %s of shard %s: %v", record.SequenceNumber, record.ShardID, err)
+	}
+	return &streamRecord, nil
+}
+
+func (d *dynamoStreamsKinesis) DescribeStreamSummary(in *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return d.DescribeStreamSummaryWithContext(aws.BackgroundContext(), in)
+}
+
+func (d *dynamoStreamsKinesis) DescribeStreamSummaryWithContext(ctx aws.Context, in *kinesis.DescribeStreamSummaryInput, _ ...request.Option) (*kinesis.DescribeStreamSummaryOutput, error) {
+	out, err := d.streams.DescribeStreamWithContext(ctx, &dynamodbstreams.DescribeStreamInput{
+		StreamArn: aws.String(d.streamArn),
+		Limit:     aws.Int64(1),
+	})
+	if err != nil {
+		return &kinesis.DescribeStreamSummaryOutput{}, kinesisError(err)
+	}
+	// A disabled stream can still be read until its records expire
+	status := kinesis.StreamStatusActive
+	if aws.StringValue(out.StreamDescription.StreamStatus) == dynamodbstreams.StreamStatusEnabling {
+		status = kinesis.StreamStatusCreating
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamARN:               aws.String(d.streamArn),
+			StreamName:              out.StreamDescription.TableName,
+			StreamStatus:            aws.String(status),
+			StreamCreationTimestamp: out.StreamDescription.CreationRequestDateTime,
+		},
+	}, nil
+}
+
+// ListStreamConsumersPagesWithContext fails, as there are no stream consumers to list
+func (d *dynamoStreamsKinesis) ListStreamConsumersPagesWithContext(aws.Context, *kinesis.ListStreamConsumersInput, func(*kinesis.ListStreamConsumersOutput, bool) bool, ...request.Option) error {
+	return ErrTableStreamFanOut
+}
+
+func (d *dynamoStreamsKinesis) ListShards(in *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	limit := aws.Int64Value(in.MaxResults)
+	if limit <= 0 || limit > maxDynamoStreamsShards {
+		limit = maxDynamoStreamsShards
+	}
+	// The next token is the last shard returned
+	start := in.ExclusiveStartShardId
+	if in.NextToken != nil {
+		start = in.NextToken
+	}
+	out, err := d.streams.DescribeStream(&dynamodbstreams.DescribeStreamInput{
+		StreamArn:             aws.String(d.streamArn),
+		ExclusiveStartShardId: start,
+		Limit:                 aws.Int64(limit),
+	})
+	if err != nil {
+		return &kinesis.ListShardsOutput{}, kinesisError(err)
+	}
+
+	shards := make([]*kinesis.Shard, len(out.StreamDescription.Shards))
+	for i, shard := range out.StreamDescription.Shards {
+		shards[i] = &kinesis.Shard{
+			ShardId:       shard.ShardId,
+			ParentShardId: shard.ParentShardId,
+		}
+		if r := shard.SequenceNumberRange; r != nil {
+			shards[i].SequenceNumberRange = &kinesis.SequenceNumberRange{
+				StartingSequenceNumber: r.StartingSequenceNumber,
+				EndingSequenceNumber:   r.EndingSequenceNumber,
+			}
+		}
+	}
+	return &kinesis.ListShardsOutput{
+		Shards:    shards,
+		NextToken: out.StreamDescription.LastEvaluatedShardId,
+	}, nil
+}
+
+func (d *dynamoStreamsKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	if aws.StringValue(in.ShardIteratorType) == kinesis.ShardIteratorTypeAtTimestamp {
+		return &kinesis.GetShardIteratorOutput{}, ErrTableStreamAtTimestamp
+	}
+	// The iterator types are the same
+	out, err := d.streams.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(d.streamArn),
+		ShardId:           in.ShardId,
+		ShardIteratorType: in.ShardIteratorType,
+		SequenceNumber:    in.StartingSequenceNumber,
+	})
+	if err != nil {
+		return &kinesis.GetShardIteratorOutput{}, kinesisError(err)
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: out.ShardIterator}, nil
+}
+
+func (d *dynamoStreamsKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	limit := aws.Int64Value(in.Limit)
+	if limit <= 0 || limit > maxDynamoStreamsRecords {
+		limit = maxDynamoStreamsRecords
+	}
+	out, err := d.streams.GetRecords(&dynamodbstreams.GetRecordsInput{
+		ShardIterator: in.ShardIterator,
+		Limit:         aws.Int64(limit),
+	})
+	if err != nil {
+		return &kinesis.GetRecordsOutput{}, kinesisError(err)
+	}
+
+	records := make([]*kinesis.Record, len(out.Records))
+	for i, record := range out.Records {
+		if records[i], err = kinesisRecord(record); err != nil {
+			return &kinesis.GetRecordsOutput{}, err
+		}
+	}
+	// dynamodb streams don't tell how far behind we are, nor the children of a closed shard, which
+	// are found by listing the shards
+	return &kinesis.GetRecordsOutput{
+		Records:           records,
+		NextShardIterator: out.NextShardIterator,
+	}, nil
+}
+
+// kinesisRecord returns the kinesis record carrying a dynamodb stream record
+func kinesisRecord(record *dynamodbstreams.Record) (*kinesis.Record, error) {
+	change := record.Dynamodb
+	if change == nil {
+		change = &dynamodbstreams.StreamRecord{}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding dynamodb stream record %s: %v", aws.StringValue(change.SequenceNumber), err)
+	}
+	arrival := aws.TimeValue(change.ApproximateCreationDateTime)
+	if arrival.IsZero() {
+		arrival = time.Now()
+	}
+	return &kinesis.Record{
+		SequenceNumber:              change.SequenceNumber,
+		PartitionKey:                aws.String(itemKey(change.Keys)),
+		ApproximateArrivalTimestamp: &arrival,
+		Data:                        data,
+	}, nil
+}
+
+// itemKey returns a string identifying the item with the given keys, which are strings, numbers
+// or binaries
+func itemKey(keys map[string]*dynamodb.AttributeValue) string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := keys[name]
+		switch {
+		case value.S != nil:
+			parts[i] = name + "=" + aws.StringValue(value.S)
+		case value.N != nil:
+			parts[i] = name + "=" + aws.StringValue(value.N)
+		default:
+			parts[i] = name + "=" + base64.StdEncoding.EncodeToString(value.B)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// kinesisError returns the kinesis error kinsumer expects for a dynamodb streams error. The codes
+// are the same, except for the records trimmed from the stream.
+func kinesisError(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodbstreams.ErrCodeTrimmedDataAccessException {
+		return awserr.New(kinesis.ErrCodeInvalidArgumentException, awsErr.Message(), err)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// streamTableDynamo describes a table with streams enabled
+type streamTableDynamo struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (*streamTableDynamo) DescribeTable(in *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:       in.TableName,
+		LatestStreamArn: aws.String("arn:stream"),
+	}}, nil
+}
+
+// fakeStreams is a dynamodb stream with two shards, returning one shard per DescribeStream page
+type fakeStreams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+	records []*dynamodbstreams.Record
+}
+
+func (*fakeStreams) DescribeStream(in *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+	if aws.StringValue(in.StreamArn) != "arn:stream" {
+		return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException, "no such stream", nil)
+	}
+	description := &dynamodbstreams.StreamDescription{
+		TableName:    aws.String("table"),
+		StreamStatus: aws.String(dynamodbstreams.StreamStatusEnabled),
+	}
+	if in.ExclusiveStartShardId == nil {
+		description.Shards = []*dynamodbstreams.Shard{{
+			ShardId: aws.String("shard0"),
+			SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+				StartingSequenceNumber: aws.String("100"),
+				EndingSequenceNumber:   aws.String("200"),
+			},
+		}}
+		description.LastEvaluatedShardId = aws.String("shard0")
+	} else {
+		description.Shards = []*dynamodbstreams.Shard{{ShardId: aws.String("shard1"), ParentShardId: aws.String("shard0")}}
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: description}, nil
+}
+
+func (s *fakeStreams) DescribeStreamWithContext(_ aws.Context, in *dynamodbstreams.DescribeStreamInput, _ ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return s.DescribeStream(in)
+}
+
+func (*fakeStreams) GetShardIterator(in *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	if aws.StringValue(in.SequenceNumber) == "1" {
+		return nil, awserr.New(dynamodbstreams.ErrCodeTrimmedDataAccessException, "trimmed", nil)
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(aws.StringValue(in.ShardId) + "/" + aws.StringValue(in.ShardIteratorType))}, nil
+}
+
+func (s *fakeStreams) GetRecords(in *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+	return &dynamodbstreams.GetRecordsOutput{Records: s.records}, nil
+}
+
+func TestDynamoStreamsKinesis(t *testing.T) {
+	created := time.Unix(1600000000, 0).UTC()
+	streams := &fakeStreams{records: []*dynamodbstreams.Record{{
+		EventName: aws.String(dynamodbstreams.OperationTypeModify),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			SequenceNumber:              aws.String("150"),
+			ApproximateCreationDateTime: &created,
+			Keys: map[string]*dynamodb.AttributeValue{
+				"user":  {S: aws.String("u1")},
+				"order": {N: aws.String("7")},
+			},
+			NewImage: map[string]*dynamodb.AttributeValue{
+				"status": {S: aws.String("shipped")},
+			},
+		},
+	}}}
+	adapter, err := NewDynamoStreamsKinesis(&streamTableDynamo{}, streams, "table")
+	require.NoError(t, err)
+
+	k, err := NewWithInterfaces(adapter, mocks.NewMockDynamo(nil), "table", "app", "client", NewConfig())
+	require.NoError(t, err)
+	require.NoError(t, k.kinesisStreamReady())
+
+	// The shards of every page are listed
+	shards, err := loadShardsFromKinesis(adapter, "table")
+	require.NoError(t, err)
+	require.Equal(t, []string{"shard0", "shard1"}, sortedShardIDs(shards))
+	require.Equal(t, "200", aws.StringValue(shards[0].SequenceNumberRange.EndingSequenceNumber))
+	require.Equal(t, "shard0", aws.StringValue(shards[1].ParentShardId))
+
+	iterator, err := getShardIterator(adapter, "table", "shard0", kinesis.ShardIteratorTypeAfterSequenceNumber, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "shard0/"+kinesis.ShardIteratorTypeTrimHorizon, iterator)
+	_, err = getShardIterator(adapter, "table", "shard0", kinesis.ShardIteratorTypeAfterSequenceNumber, "1", nil)
+	require.True(t, isInvalidArgument(err))
+	_, err = getShardIterator(adapter, "table", "shard0", kinesis.ShardIteratorTypeAtTimestamp, "", &created)
+	require.Equal(t, ErrTableStreamAtTimestamp, err)
+
+	records, next, _, _, err := getRecords(adapter, iterator, 10000)
+	require.NoError(t, err)
+	require.Equal(t, "", next)
+	require.Len(t, records, 1)
+	record := newRecord("shard0", records[0])
+	require.Equal(t, "150", record.SequenceNumber)
+	require.Equal(t, "order=7&user=u1", record.PartitionKey)
+	require.True(t, created.Equal(record.ApproximateArrivalTimestamp))
+	decoded, err := DecodeTableStreamRecord(record)
+	require.NoError(t, err)
+	require.Equal(t, streams.records[0], decoded)
+
+	_, err = NewWithInterfaces(adapter, mocks.NewMockDynamo(nil), "table", "app", "client", NewConfig().WithEnhancedFanOut("consumer"))
+	require.Equal(t, ErrTableStreamFanOut, err)
+
+	// The stream consumers can be looked at through the retries, there are none
+	consumer, err := NewWithInterfaces(adapter, mocks.NewMockDynamo(nil), "table", "app", "client", NewConfig())
+	require.NoError(t, err)
+	summary, err := consumer.kinesis.DescribeStreamSummaryWithContext(context.Background(), &kinesis.DescribeStreamSummaryInput{})
+	require.NoError(t, err)
+	require.Equal(t, "table", aws.StringValue(summary.StreamDescriptionSummary.StreamName))
+	_, err = consumer.StreamConsumers(context.Background())
+	require.Equal(t, ErrTableStreamFanOut, err)
+}
+
+func TestDynamoStreamsKinesisWithoutStream(t *testing.T) {
+	_, err := NewDynamoStreamsKinesis(&tableDescriptionDynamo{}, &fakeStreams{}, "table")
+	require.True(t, errors.Is(err, ErrNoTableStream))
+}
+
+// tableDescriptionDynamo describes a table without streams
+type tableDescriptionDynamo struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (*tableDescriptionDynamo) DescribeTable(in *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableName: in.TableName}}, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import "runtime/debug"
+
+// ErrorContext describes where in kinsumer an error or a panic happened
+type ErrorContext struct {
+	ClientID   string // ID of the client, changes if the client is quarantined
+	ClientName string // name the client was created with
+	ShardID    string // shard the error is about, empty if it isn't about a single shard
+	Operation  string // what kinsumer was doing, e.g. "getRecords" or "leaderActions"
+}
+
+// An ErrorReporter is told about the errors kinsumer returns from Next and NextRecord, which were not
+// fixed by retrying, and about the panics of its go routines, so they reach an error tracking system.
+//
+// The methods will get called from multiple go routines and it is
+// the implementors responsibility to handle thread synchronization
+type ErrorReporter interface {
+	// ReportError is called with every error kinsumer hands to the application
+	ReportError(err error, context ErrorContext)
+
+	// ReportPanic is called when a kinsumer go routine panics, with the value it panicked with and
+	// its stack. The go routine panics again once ReportPanic returns, which usually ends the program,
+	// so the report must be sent before returning.
+	ReportPanic(value interface{}, stack []byte, context ErrorContext)
+}
+
+func (k *Kinsumer) errorContext(operation, shardID string) ErrorContext {
+	return ErrorContext{
+		ClientID:   k.clientID(),
+		ClientName: k.clientName,
+		ShardID:    shardID,
+		Operation:  operation,
+	}
+}
+
+// reportError hands an error to the application, and to the ErrorReporter if there is one
+func (k *Kinsumer) reportError(operation, shardID string, err error) {
+	if r := k.config.errorReporter; r != nil {
+		r.ReportError(k.redactError(err), k.errorContext(operation, shardID))
+	}
+	k.errors <- err
+}
+
+// recoverPanic reports a panic of the go routine it is deferred in to the ErrorReporter, and panics
+// again. It must be deferred directly.
+func (k *Kinsumer) recoverPanic(operation, shardID string) {
+	r := k.config.errorReporter
+	if r == nil {
+		return
+	}
+	if v := recover(); v != nil {
+		r.ReportPanic(k.redactPanic(v), debug.Stack(), k.errorContext(operation, shardID))
+		panic(v)
+	}
+}
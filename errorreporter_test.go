@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingReporter struct {
+	errors   []error
+	panics   []interface{}
+	contexts []ErrorContext
+}
+
+func (r *recordingReporter) ReportError(err error, context ErrorContext) {
+	r.errors = append(r.errors, err)
+	r.contexts = append(r.contexts, context)
+}
+
+func (r *recordingReporter) ReportPanic(value interface{}, stack []byte, context ErrorContext) {
+	r.panics = append(r.panics, value)
+	r.contexts = append(r.contexts, context)
+}
+
+func TestErrorReporter(t *testing.T) {
+	reporter := &recordingReporter{}
+	config := NewConfig().WithErrorReporter(reporter)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	failure := errors.New("failure")
+	k.reportError("getRecords", "shard-1", failure)
+	require.Equal(t, failure, <-k.errors)
+	require.Equal(t, []error{failure}, reporter.errors)
+	require.Equal(t, ErrorContext{ClientID: k.clientID(), ClientName: "client", ShardID: "shard-1", Operation: "getRecords"}, reporter.contexts[0])
+
+	require.PanicsWithValue(t, "boom", func() {
+		defer k.recoverPanic("leader", "")
+		panic("boom")
+	})
+	require.Equal(t, []interface{}{"boom"}, reporter.panics)
+	require.Equal(t, "leader", reporter.contexts[1].Operation)
+}
@@ -22,20 +22,150 @@ var (
 
 	// ErrConfigInvalidThrottleDelay - ThrottleDelay config value must be at least 200ms
 	ErrConfigInvalidThrottleDelay = errors.New("throttleDelay config value must be at least 200ms (preferably 250ms)")
+	// ErrConfigInvalidThrottleBackoff - ThrottleBackoff cannot be nil
+	ErrConfigInvalidThrottleBackoff = errors.New("throttleBackoff cannot be nil")
+	// ErrConfigInvalidDeadLetter - Dead-letter attempts must be positive
+	ErrConfigInvalidDeadLetter = errors.New("dead-letter attempts must be positive")
+	// ErrConfigInvalidRecordHook - RecordHook retry delay cannot be negative
+	ErrConfigInvalidRecordHook = errors.New("recordHook retry delay cannot be negative")
+	// ErrConfigInvalidCorruptRecordPolicy - Sending corrupt records to the dead-letter sink needs a sink
+	ErrConfigInvalidCorruptRecordPolicy = errors.New("sending corrupt records to the dead-letter sink needs a sink")
+	// ErrConfigInvalidRetryer - Retryer cannot be nil
+	ErrConfigInvalidRetryer = errors.New("retryer cannot be nil")
+	// ErrConfigInvalidGetRecordsLimit - GetRecords limit must be between 1 and 10000, and max bytes cannot be negative
+	ErrConfigInvalidGetRecordsLimit = errors.New("getRecords limit must be between 1 and 10000, and max bytes cannot be negative")
+	// ErrConfigInvalidCatchUpLag - CatchUpLag cannot be negative
+	ErrConfigInvalidCatchUpLag = errors.New("catchUpLag cannot be negative")
+	// ErrConfigInvalidEmptyPollRetries - EmptyPollRetries cannot be negative
+	ErrConfigInvalidEmptyPollRetries = errors.New("emptyPollRetries cannot be negative")
 	// ErrConfigInvalidCommitFrequency - CommitFrequency config value is mandatory
 	ErrConfigInvalidCommitFrequency = errors.New("commitFrequency config value is mandatory")
+	// ErrConfigInvalidCheckpointTouchFrequency - CheckpointTouchFrequency cannot be negative
+	ErrConfigInvalidCheckpointTouchFrequency = errors.New("checkpointTouchFrequency cannot be negative")
 	// ErrConfigInvalidShardCheckFrequency - ShardCheckFrequency config value is mandatory
 	ErrConfigInvalidShardCheckFrequency = errors.New("shardCheckFrequency config value is mandatory")
+	// ErrConfigInvalidHeartbeatFrequency - Heartbeat frequency cannot be negative
+	ErrConfigInvalidHeartbeatFrequency = errors.New("heartbeat frequency cannot be negative")
+	// ErrConfigInvalidClientExpiryAge - Client expiry age must be longer than the heartbeat frequency
+	ErrConfigInvalidClientExpiryAge = errors.New("client expiry age must be longer than the heartbeat frequency")
+	// ErrConfigInvalidClientsCache - ClientsCache max age cannot be negative
+	ErrConfigInvalidClientsCache = errors.New("clientsCache max age cannot be negative")
+	// ErrConfigInvalidShardListCacheTTL - ShardListCacheTTL config value cannot be negative
+	ErrConfigInvalidShardListCacheTTL = errors.New("shardListCacheTTL config value cannot be negative")
 	// ErrConfigInvalidLeaderActionFrequency - LeaderActionFrequency config value is mandatory
 	ErrConfigInvalidLeaderActionFrequency = errors.New("leaderActionFrequency config value is mandatory and must be at least as long as ShardCheckFrequency")
 	// ErrConfigInvalidBufferSize - BufferSize config value is mandatory
 	ErrConfigInvalidBufferSize = errors.New("bufferSize config value is mandatory")
+	// ErrConfigInvalidShardBuffers - Shard buffer size cannot be negative, and shard buffers can't spill
+	ErrConfigInvalidShardBuffers = errors.New("shard buffer size cannot be negative, and shard buffers can't spill")
+	// ErrConfigInvalidSpillMaxBytes - Spill max bytes must be positive
+	ErrConfigInvalidSpillMaxBytes = errors.New("spill max bytes must be positive")
+	// ErrConfigInvalidArrivalOrdering - Arrival ordering window cannot be negative
+	ErrConfigInvalidArrivalOrdering = errors.New("arrival ordering window cannot be negative")
+	// ErrConfigInvalidRateLimit - Rate limits cannot be negative
+	ErrConfigInvalidRateLimit = errors.New("rate limits cannot be negative")
+	// ErrConfigInvalidDeliveryPacing - Delivery pacing rate and max bytes cannot be negative, and max bytes needs a rate
+	ErrConfigInvalidDeliveryPacing = errors.New("delivery pacing rate and max bytes cannot be negative, and max bytes needs a rate")
+	// ErrConfigInvalidFanOutConsumer - Enhanced fan-out consumer name isn't valid
+	ErrConfigInvalidFanOutConsumer = errors.New("enhanced fan-out consumer names are 1 to 128 letters, digits, '_', '.' or '-'")
+	// ErrConfigInvalidScalingAdvisor - Scaling advisor thresholds cannot be negative
+	ErrConfigInvalidScalingAdvisor = errors.New("scaling advisor thresholds cannot be negative")
+	// ErrConfigInvalidCheckpointRetention - Checkpoint retention cannot be negative
+	ErrConfigInvalidCheckpointRetention = errors.New("checkpoint retention cannot be negative")
+	// ErrConfigInvalidDeduplication - Deduplication window cannot be negative
+	ErrConfigInvalidDeduplication = errors.New("deduplication window cannot be negative")
+	// ErrConfigInvalidClaimCheck - Claim check resolver needs S3 and Detect, and its concurrency cannot be negative
+	ErrConfigInvalidClaimCheck = errors.New("claim check resolver needs S3 and Detect, and its concurrency cannot be negative")
+	// ErrConfigInvalidDecompression - Decompression must be one of the Compression constants
+	ErrConfigInvalidDecompression = errors.New("decompression must be one of the Compression constants")
+	// ErrConfigInvalidDecompressionLimit - Decompression limit must be greater than 0
+	ErrConfigInvalidDecompressionLimit = errors.New("decompression limit must be greater than 0")
+	// ErrConfigInvalidCostRates - Cost rates cannot be negative
+	ErrConfigInvalidCostRates = errors.New("cost rates cannot be negative")
+	// ErrConfigInvalidStallDetection - Stall threshold cannot be negative
+	ErrConfigInvalidStallDetection = errors.New("stall threshold cannot be negative")
+	// ErrConfigInvalidQuarantine - Quarantine threshold and window cannot be negative
+	ErrConfigInvalidQuarantine = errors.New("quarantine threshold and window cannot be negative")
 	// ErrConfigInvalidStats - Stats cannot be nil
 	ErrConfigInvalidStats = errors.New("stats cannot be nil")
 	// ErrConfigInvalidDynamoCapacity - Dynamo read/write capacity cannot be 0
 	ErrConfigInvalidDynamoCapacity = errors.New("dynamo read/write capacity cannot be 0")
 	// ErrConfigInvalidLogger - Logger cannot be nil
 	ErrConfigInvalidLogger = errors.New("logger cannot be nil")
+	// ErrConfigInvalidShardIteratorAtAge - ShardIteratorAtAge cannot be negative
+	ErrConfigInvalidShardIteratorAtAge = errors.New("shardIteratorAtAge cannot be negative")
+	// ErrConfigInvalidDeliveryTracing - DeliveryTracing cannot be negative
+	ErrConfigInvalidDeliveryTracing = errors.New("deliveryTracing cannot be negative")
+	// ErrConfigInvalidTableStreams - Table streams need a positive poll frequency and a dynamodb streams instance
+	ErrConfigInvalidTableStreams = errors.New("table streams need a positive poll frequency and a dynamodb streams instance")
+	// ErrConfigInvalidShardDiscovery - Shard discovery frequency must be 0 or at least a second
+	ErrConfigInvalidShardDiscovery = errors.New("shard discovery frequency must be 0 or at least a second")
+	// ErrConfigInvalidShardIteratorType - ShardIteratorType must be one of the kinesis shard iterator types
+	ErrConfigInvalidShardIteratorType = errors.New("shardIteratorType must be one of the kinesis shard iterator types")
+	// ErrConfigInvalidStartingPosition - Starting positions need a shard iterator type with its sequence number or timestamp
+	ErrConfigInvalidStartingPosition = errors.New("starting positions need a shard iterator type with its sequence number or timestamp")
+	// ErrConfigInvalidCheckpointFallback - Expired checkpoints can only fall back to TRIM_HORIZON, LATEST or AT_TIMESTAMP
+	ErrConfigInvalidCheckpointFallback = errors.New("expired checkpoints can only fall back to TRIM_HORIZON, LATEST or AT_TIMESTAMP")
+	// ErrConfigInvalidGlobalTables - Global tables need both the region of the client and the home region
+	ErrConfigInvalidGlobalTables = errors.New("global tables need both the region of the client and the home region")
+	// ErrConfigInvalidStreamFailover - Stream failover needs endpoints with a stream name and a kinesis interface, and a positive duration
+	ErrConfigInvalidStreamFailover = errors.New("stream failover needs endpoints with a stream name and a kinesis interface, and a positive duration")
+	// ErrConfigInvalidSetting - A setting loaded from the environment or a file is unknown or has a value of the wrong type
+	ErrConfigInvalidSetting = errors.New("setting is unknown or has a value of the wrong type")
+
+	// ErrNoSuchBookmark - No bookmark with the given name was saved
+	ErrNoSuchBookmark = errors.New("no such bookmark")
+	// ErrResumeAfterRun - ResumeFromBookmark() must be called before Run()
+	ErrResumeAfterRun = errors.New("resumeFromBookmark() must be called before run()")
+
+	// ErrCheckpointOwnershipLost - A checkpoint commit failed because another client owns the shard
+	ErrCheckpointOwnershipLost = errors.New("checkpoint commit failed because another client owns the shard")
+	// ErrShardNotOwned - This client does not currently own the shard
+	ErrShardNotOwned = errors.New("this client does not currently own the shard")
+	// ErrDispatchTransactional - Dispatch can't be used with transactional checkpoints
+	ErrDispatchTransactional = errors.New("dispatch can't be used with transactional checkpoints")
+	// ErrUnknownRecord - The record was not returned by NextRecord
+	ErrUnknownRecord = errors.New("the record was not returned by nextRecord")
+	// ErrTooManyNacks - The record was nacked too many times, and sent to the dead-letter sink
+	ErrTooManyNacks = errors.New("the record was nacked too many times")
+	// ErrCheckpointExpired - The checkpointed sequence number of a shard is no longer in the stream
+	ErrCheckpointExpired = errors.New("the checkpointed sequence number is no longer in the stream")
+	// ErrCheckpointMetadataTooLarge - Checkpoint metadata is larger than the maximum allowed
+	ErrCheckpointMetadataTooLarge = errors.New("checkpoint metadata cannot be larger than 16KB")
+
+	// ErrMigrationInProgress - The tables are already being migrated, or the migration moved on
+	ErrMigrationInProgress = errors.New("the tables are already being migrated")
+	// ErrMigrationSameApplication - Tables cannot be migrated to the application they belong to
+	ErrMigrationSameApplication = errors.New("tables cannot be migrated to the application they belong to")
+
+	// ErrInvalidAssignmentSimulation - Need at least one client and a non negative number of shards to simulate
+	ErrInvalidAssignmentSimulation = errors.New("need at least one client and a non negative number of shards to simulate")
+
+	// ErrNoGlobalTables - The Config doesn't use global tables
+	ErrNoGlobalTables = errors.New("the config doesn't use global tables")
+
+	// ErrInvalidReplayRange - The replay must start before it ends
+	ErrInvalidReplayRange = errors.New("the replay must start before it ends")
+
+	// ErrNoTableStream - The table doesn't have streams enabled
+	ErrNoTableStream = errors.New("the table doesn't have streams enabled")
+	// ErrTableStreamAtTimestamp - Dynamodb streams can't be read from a timestamp
+	ErrTableStreamAtTimestamp = errors.New("dynamodb streams can't be read from a timestamp")
+	// ErrTableStreamFanOut - Dynamodb streams don't have enhanced fan-out consumers
+	ErrTableStreamFanOut = errors.New("dynamodb streams don't have enhanced fan-out consumers")
+	// ErrTableStreamShardDiscovery - Dynamodb streams can't list the shards created after another
+	ErrTableStreamShardDiscovery = errors.New("dynamodb streams can't list the shards created after another")
+
+	// ErrInvalidState - The state to import wasn't exported by ExportState
+	ErrInvalidState = errors.New("the state to import wasn't exported by ExportState")
+	// ErrImportWithClients - The state can't be imported while clients of the application are running
+	ErrImportWithClients = errors.New("the state can't be imported while clients of the application are running")
+
+	// ErrCorruptRecord - A corrupt record halted its shard
+	ErrCorruptRecord = errors.New("a corrupt record halted its shard")
+
+	// ErrShardReaderClosed - ShardReader.Next was called after Close
+	ErrShardReaderClosed = errors.New("shard reader closed")
 
 	// ErrStreamBusy - Stream is busy
 	ErrStreamBusy = errors.New("stream is busy")
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EventType is the kind of an Event
+type EventType string
+
+const (
+	// EventShardAcquired is emitted when we capture a shard, with the fields "leaseToken" and
+	// "sequenceNumber" (the checkpoint the shard starts after)
+	EventShardAcquired EventType = "shard_acquired"
+	// EventShardReleased is emitted when we release a shard we consumed, with the field
+	// "sequenceNumber" (the checkpoint it was released at)
+	EventShardReleased EventType = "shard_released"
+	// EventLeadershipChanged is emitted when we become or stop being the leader, or our leadership
+	// is renewed with another token, with the fields "leader" and "token"
+	EventLeadershipChanged EventType = "leadership_changed"
+	// EventCheckpointFailed is emitted when writing the checkpoint of a shard failed, with the field
+	// "error"
+	EventCheckpointFailed EventType = "checkpoint_failed"
+	// EventThrottled is emitted when a request was throttled, with the fields "operation" and
+	// "delay" (how long we back off)
+	EventThrottled EventType = "throttled"
+	// EventReshardDetected is emitted when the shards of the stream changed, with the fields
+	// "added" and "removed" (the shard IDs) and "shards" (the number of shards)
+	EventReshardDetected EventType = "reshard_detected"
+)
+
+// Event is something that happened inside a running kinsumer that operators may want to alert on
+type Event struct {
+	Type  EventType
+	Level Level
+	Time  time.Time
+	// Client the event happened in, and shard it is about, empty if it isn't about a shard
+	ClientID string
+	ShardID  string
+	// Human readable description of the event
+	Message string
+	// Machine readable details of the event, documented with each EventType
+	Fields map[string]interface{}
+}
+
+// An EventHandler receives the events of a running kinsumer. HandleEvent is called from multiple go
+// routines, in the go routine where the event happened, so it must not block.
+type EventHandler interface {
+	HandleEvent(event Event)
+}
+
+// EventHandlerFunc is an EventHandler calling a function
+type EventHandlerFunc func(event Event)
+
+// HandleEvent implementation calling the function
+func (f EventHandlerFunc) HandleEvent(event Event) {
+	f(event)
+}
+
+type loggerEventHandler struct {
+	logger Logger
+}
+
+// NewLoggerEventHandler returns an EventHandler logging the events to the logger, with the fields
+// "event" (the type), "client", "shard" and the fields of the event when it is a StructuredLogger.
+// The slogevents package has an EventHandler logging to a slog logger.
+func NewLoggerEventHandler(logger Logger) EventHandler {
+	return &loggerEventHandler{logger: logger}
+}
+
+func (h *loggerEventHandler) HandleEvent(event Event) {
+	fields := []interface{}{"event", string(event.Type), "client", event.ClientID}
+	if event.ShardID != "" {
+		fields = append(fields, "shard", event.ShardID)
+	}
+	names := make([]string, 0, len(event.Fields))
+	for name := range event.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, name, event.Fields[name])
+	}
+	logf(h.logger, event.Level, fields, "%s", event.Message)
+}
+
+// emit sends an event about the given shard, empty if it isn't about a shard, to the event handler
+func (k *Kinsumer) emit(eventType EventType, level Level, shardID string, fields map[string]interface{}, format string, v ...interface{}) {
+	handler := k.config.eventHandler
+	if handler == nil {
+		return
+	}
+	handler.HandleEvent(Event{
+		Type:     eventType,
+		Level:    level,
+		Time:     time.Now(),
+		ClientID: k.clientID(),
+		ShardID:  shardID,
+		Message:  fmt.Sprintf(format, v...),
+		Fields:   fields,
+	})
+}
+
+// throttled reports a throttled request of the given operation, and how long we back off
+func (k *Kinsumer) throttled(operation, shardID string, delay time.Duration) {
+	if stats, ok := k.config.stats.(ThrottleStatReceiver); ok {
+		stats.Throttled(operation, delay)
+	}
+	k.emit(EventThrottled, LevelWarn, shardID, map[string]interface{}{"operation": operation, "delay": delay},
+		"Request %s throttled, backing off for %s", operation, delay)
+}
+
+// shardChanges returns the shard IDs that are only in after, and the ones that are only in before
+func shardChanges(before, after []string) (added, removed []string) {
+	inBefore := make(map[string]bool, len(before))
+	for _, shardID := range before {
+		inBefore[shardID] = true
+	}
+	inAfter := make(map[string]bool, len(after))
+	for _, shardID := range after {
+		inAfter[shardID] = true
+		if !inBefore[shardID] {
+			added = append(added, shardID)
+		}
+	}
+	for _, shardID := range before {
+		if !inAfter[shardID] {
+			removed = append(removed, shardID)
+		}
+	}
+	return added, removed
+}
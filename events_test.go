@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	var events []Event
+	config := NewConfig().WithEventHandler(EventHandlerFunc(func(event Event) {
+		events = append(events, event)
+	}))
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	// Only changes of the leadership are events
+	k.setLeaderToken(3)
+	k.setLeaderToken(3)
+	k.setLeaderToken(0)
+	k.throttled("getRecords", "shard", time.Second)
+	require.Len(t, events, 3)
+
+	require.Equal(t, EventLeadershipChanged, events[0].Type)
+	require.Equal(t, map[string]interface{}{"leader": true, "token": int64(3)}, events[0].Fields)
+	require.Equal(t, map[string]interface{}{"leader": false, "token": int64(0)}, events[1].Fields)
+	require.Equal(t, k.clientID(), events[1].ClientID)
+	require.Equal(t, "", events[1].ShardID)
+
+	require.Equal(t, EventThrottled, events[2].Type)
+	require.Equal(t, LevelWarn, events[2].Level)
+	require.Equal(t, "shard", events[2].ShardID)
+	require.Equal(t, map[string]interface{}{"operation": "getRecords", "delay": time.Second}, events[2].Fields)
+
+	added, removed := shardChanges([]string{"shard-0", "shard-1"}, []string{"shard-1", "shard-2", "shard-3"})
+	require.Equal(t, []string{"shard-2", "shard-3"}, added)
+	require.Equal(t, []string{"shard-0"}, removed)
+}
+
+func TestLoggerEventHandler(t *testing.T) {
+	logger := &structuredLogger{}
+	NewLoggerEventHandler(logger).HandleEvent(Event{
+		Type:     EventCheckpointFailed,
+		Level:    LevelError,
+		ClientID: "client",
+		ShardID:  "shard",
+		Message:  "Error writing the checkpoint of shard shard",
+		Fields:   map[string]interface{}{"error": "boom", "attempt": 2},
+	})
+	require.Equal(t, []string{"Error writing the checkpoint of shard shard"}, logger.lines)
+	require.Equal(t, []Level{LevelError}, logger.levels)
+	require.Equal(t, []interface{}{"event", "checkpoint_failed", "client", "client", "shard", "shard", "attempt", 2, "error", "boom"},
+		logger.fields[0])
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// StreamEndpoint is a copy of the stream in another region, for failing over to when the producers
+// mirror the stream to several regions
+type StreamEndpoint struct {
+	Region     string                  // region of the stream, only used in the logs
+	StreamName string                  // name of the stream in that region
+	Kinesis    kinesisiface.KinesisAPI // interface to the kinesis service of that region
+}
+
+// streamEndpointKey is the key of the metadata table item telling which stream endpoint the clients
+// consume, with Config.WithStreamFailover
+const streamEndpointKey = "StreamEndpoint"
+
+type streamEndpointRecord struct {
+	Key       string
+	Index     int   // endpoint consumed, 0 for the stream given to New and then the failover endpoints in order
+	Failovers int64 // number of failovers so far, the checkpoints and shard cache are only used for the same number
+	ResumeAt  int64 // timestamp the shards without a checkpoint are consumed from after the last failover
+
+	// Debug version of ResumeAt
+	ResumeAtRFC string `dynamodbav:",omitempty"`
+}
+
+// failoverKinesis is a kinesis interface sending the requests kinsumer makes through it to the stream
+// endpoint the clients consume, and keeping track of how long that endpoint has been failing
+type failoverKinesis struct {
+	kinesisiface.KinesisAPI // stream given to New, for the requests that aren't failed over
+	endpoints               []StreamEndpoint
+	after                   time.Duration
+	onFailing               func() // called once the endpoint failed for after
+
+	mutex        sync.Mutex
+	active       streamEndpointRecord
+	failingSince time.Time // first of the failures in a row of the active endpoint, zero if it isn't failing
+	notified     bool      // whether onFailing was called for these failures
+}
+
+func newFailoverKinesis(k kinesisiface.KinesisAPI, streamName string, endpoints []StreamEndpoint, after time.Duration) *failoverKinesis {
+	all := append([]StreamEndpoint{{StreamName: streamName, Kinesis: k}}, endpoints...)
+	return &failoverKinesis{
+		KinesisAPI: k,
+		endpoints:  all,
+		after:      after,
+		active:     streamEndpointRecord{Key: streamEndpointKey},
+	}
+}
+
+// endpoint returns the active endpoint
+func (f *failoverKinesis) endpoint() StreamEndpoint {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.endpoints[f.active.Index]
+}
+
+// state returns the record of the active endpoint
+func (f *failoverKinesis) state() streamEndpointRecord {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.active
+}
+
+// activate makes the endpoint of the record the active one
+func (f *failoverKinesis) activate(record streamEndpointRecord) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.active = record
+	f.failingSince = time.Time{}
+	f.notified = false
+}
+
+// failing returns since when the active endpoint has been failing, zero if it isn't
+func (f *failoverKinesis) failing() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.failingSince
+}
+
+// observe keeps track of the failures of the active endpoint after a request to it
+func (f *failoverKinesis) observe(err error) {
+	f.mutex.Lock()
+	if err == nil {
+		f.failingSince = time.Time{}
+		f.notified = false
+		f.mutex.Unlock()
+		return
+	}
+	if !endpointFailure(err) {
+		f.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if f.failingSince.IsZero() {
+		f.failingSince = now
+	}
+	notify := !f.notified && now.Sub(f.failingSince) >= f.after && f.onFailing != nil
+	if notify {
+		f.notified = true
+	}
+	f.mutex.Unlock()
+	if notify {
+		f.onFailing()
+	}
+}
+
+// endpointFailure returns whether err tells that the stream endpoint is unavailable, rather than the
+// request being throttled or wrong
+func endpointFailure(err error) bool {
+	if isThrottle(err) {
+		return false
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case kinesis.ErrCodeInvalidArgumentException, kinesis.ErrCodeExpiredIteratorException,
+			kinesis.ErrCodeExpiredNextTokenException, kinesis.ErrCodeResourceInUseException:
+			return false
+		}
+	}
+	return true
+}
+
+func (f *failoverKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	out, err := f.endpoint().Kinesis.GetRecords(in)
+	f.observe(err)
+	return out, err
+}
+
+func (f *failoverKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	endpoint := f.endpoint()
+	routed := *in
+	routed.StreamName = aws.String(endpoint.StreamName)
+	out, err := endpoint.Kinesis.GetShardIterator(&routed)
+	f.observe(err)
+	return out, err
+}
+
+func (f *failoverKinesis) ListShards(in *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	endpoint := f.endpoint()
+	routed := *in
+	// The stream name must not be set along with a NextToken
+	if routed.StreamName != nil {
+		routed.StreamName = aws.String(endpoint.StreamName)
+	}
+	out, err := endpoint.Kinesis.ListShards(&routed)
+	f.observe(err)
+	return out, err
+}
+
+func (f *failoverKinesis) DescribeStreamSummary(in *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	endpoint := f.endpoint()
+	routed := *in
+	routed.StreamName = aws.String(endpoint.StreamName)
+	out, err := endpoint.Kinesis.DescribeStreamSummary(&routed)
+	f.observe(err)
+	return out, err
+}
+
+// loadStreamEndpoint returns the stream endpoint the clients consume, nil if they never failed over
+func loadStreamEndpoint(db dynamodbiface.DynamoDBAPI, tableName string) (*streamEndpointRecord, error) {
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(streamEndpointKey)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	var record streamEndpointRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// refreshStreamEndpoint fails the clients over to the next stream endpoint if the one they consume
+// has been failing for long enough, and switches to the endpoint another client failed over to.
+// Returns whether the endpoint we consume changed.
+func (k *Kinsumer) refreshStreamEndpoint() (bool, error) {
+	f := k.failover
+	record, err := loadStreamEndpoint(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return false, fmt.Errorf("error loading the stream endpoint: %v", err)
+	}
+	if record == nil {
+		record = &streamEndpointRecord{Key: streamEndpointKey}
+	}
+	active := f.state()
+	if record.Failovers == active.Failovers {
+		since := f.failing()
+		if since.IsZero() || time.Since(since) < k.config.failoverAfter {
+			return false, nil
+		}
+		if record, err = k.failOver(record, since); err != nil {
+			return false, err
+		}
+	}
+
+	f.activate(*record)
+	k.invalidateShardList()
+	endpoint := f.endpoint()
+	k.logf(LevelWarn, "failover", "", "Consuming stream %s in %s after failover %d, shards without a checkpoint start at %s",
+		endpoint.StreamName, endpoint.Region, record.Failovers, time.Unix(0, record.ResumeAt).UTC().Format(time.RFC3339))
+	if stats, ok := k.config.stats.(FailoverStatReceiver); ok {
+		stats.StreamFailedOver(endpoint.StreamName, endpoint.Region)
+	}
+	return true, nil
+}
+
+// failOver switches the clients from the endpoint of the given record to the next one, which is
+// consumed from rewind before the failures started. Returns the endpoint the clients consume, which
+// is another one if another client failed over first.
+func (k *Kinsumer) failOver(record *streamEndpointRecord, failingSince time.Time) (*streamEndpointRecord, error) {
+	resumeAt := failingSince.Add(-k.config.failoverRewind)
+	next := &streamEndpointRecord{
+		Key:         streamEndpointKey,
+		Index:       (record.Index + 1) % len(k.failover.endpoints),
+		Failovers:   record.Failovers + 1,
+		ResumeAt:    resumeAt.UnixNano(),
+		ResumeAtRFC: resumeAt.UTC().Format(time.RFC1123Z),
+	}
+	item, err := dynamodbattribute.MarshalMap(next)
+	if err != nil {
+		return nil, err
+	}
+	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(k.metadataTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Failovers) OR Failovers = :failovers"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":failovers": {N: aws.String(fmt.Sprint(record.Failovers))},
+		},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		// Another client failed over first
+		record, err = loadStreamEndpoint(k.dynamodb, k.metadataTableName)
+		if err == nil && record == nil {
+			err = errors.New("the stream endpoint disappeared")
+		}
+		return record, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error failing over the stream endpoint: %v", err)
+	}
+	k.logf(LevelWarn, "failover", "", "Failed over from stream %s, failing since %s",
+		k.failover.endpoints[record.Index].StreamName, failingSince.UTC().Format(time.RFC3339))
+	return next, nil
+}
+
+// streamFailovers returns the number of failovers of the endpoint we consume, 0 without failover
+func (k *Kinsumer) streamFailovers() int64 {
+	if k.failover == nil {
+		return 0
+	}
+	return k.failover.state().Failovers
+}
+
+// failoverPosition returns where the shards without a checkpoint start after a failover, as the stream
+// failed over to has other shards and sequence numbers
+func (k *Kinsumer) failoverPosition() (ShardPosition, bool) {
+	if k.failover == nil {
+		return ShardPosition{}, false
+	}
+	active := k.failover.state()
+	if active.Failovers == 0 {
+		return ShardPosition{}, false
+	}
+	return ShardReaderFromAtTimestamp(time.Unix(0, active.ResumeAt)), true
+}
+
+// streamCheckpoints returns the checkpoints written for the endpoint we consume
+func (k *Kinsumer) streamCheckpoints(checkpoints map[string]*checkpointRecord) map[string]*checkpointRecord {
+	if k.failover == nil {
+		return checkpoints
+	}
+	failovers := k.streamFailovers()
+	current := make(map[string]*checkpointRecord, len(checkpoints))
+	for shardID, cp := range checkpoints {
+		if cp.Failovers == failovers {
+			current[shardID] = cp
+		}
+	}
+	return current
+}
+
+// replaceShardCache replaces the shard ID cache of the previous endpoint after a failover, returning
+// whether it did. Returns false without writing anything if the cache changed since it was loaded.
+func (k *Kinsumer) replaceShardCache(previous *shardCacheRecord, shardIDs []string, shardParents map[string][]string) (bool, error) {
+	if previous.LastUpdate == 0 {
+		return k.setCachedShardIDs(shardIDs, shardParents)
+	}
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(&shardCacheRecord{
+		Key:           shardCacheKey,
+		ShardIDs:      shardIDs,
+		ShardParents:  shardParents,
+		Failovers:     k.streamFailovers(),
+		LastUpdate:    now.UnixNano(),
+		LastUpdateRFC: now.UTC().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error marshalling map: %v", err)
+	}
+	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(k.metadataTableName),
+		Item:                item,
+		ConditionExpression: aws.String("LastUpdate = :previous"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":previous": {N: aws.String(fmt.Sprint(previous.LastUpdate))},
+		},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error replacing shard cache: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// downKinesis is a kinesis endpoint whose region is down
+type downKinesis struct {
+	kinesisiface.KinesisAPI
+}
+
+func (*downKinesis) ListShards(in *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	return nil, awserr.New("InternalFailure", "region is down", nil)
+}
+
+// endpointDynamo keeps the stream endpoint item of the metadata table
+type endpointDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	endpoint map[string]*dynamodb.AttributeValue
+}
+
+func (d *endpointDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if aws.StringValue(in.Key["Key"].S) != streamEndpointKey {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: d.endpoint}, nil
+}
+
+func (d *endpointDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if d.endpoint != nil && aws.StringValue(d.endpoint["Failovers"].N) != aws.StringValue(in.ExpressionAttributeValues[":failovers"].N) {
+		return nil, awserr.New(conditionalFail, "already failed over", nil)
+	}
+	d.endpoint = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestStreamFailover(t *testing.T) {
+	db := &endpointDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil)}
+	mirror := mocks.NewMockKinesis("mirror", []*kinesis.Shard{{ShardId: aws.String("shardId-000000000007")}})
+	config := NewConfig().WithStreamFailover([]StreamEndpoint{
+		{Region: "us-west-2", StreamName: "mirror", Kinesis: mirror},
+	}, time.Nanosecond, time.Minute)
+	k, err := NewWithInterfaces(&downKinesis{}, db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	// Nothing failed yet
+	switched, err := k.refreshStreamEndpoint()
+	require.NoError(t, err)
+	require.False(t, switched)
+	_, ok := k.failoverPosition()
+	require.False(t, ok)
+
+	var refreshes int
+	k.failover.onFailing = func() { refreshes++ }
+	_, err = loadShardsFromKinesis(k.failover, k.streamName)
+	require.Error(t, err)
+	failingSince := k.failover.failing()
+	require.False(t, failingSince.IsZero())
+	// A refresh is requested once the failures lasted long enough
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err = loadShardsFromKinesis(k.failover, k.streamName)
+		require.Error(t, err)
+	}
+	require.Equal(t, failingSince, k.failover.failing())
+	require.Equal(t, 1, refreshes)
+
+	switched, err = k.refreshStreamEndpoint()
+	require.NoError(t, err)
+	require.True(t, switched)
+	var record streamEndpointRecord
+	require.NoError(t, dynamodbattribute.UnmarshalMap(db.endpoint, &record))
+	require.Equal(t, 1, record.Index)
+	require.Equal(t, int64(1), record.Failovers)
+	require.Equal(t, failingSince.Add(-time.Minute).UnixNano(), record.ResumeAt)
+
+	// The requests go to the mirror now
+	shards, err := loadShardsFromKinesis(k.failover, k.streamName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"shardId-000000000007"}, sortedShardIDs(shards))
+	require.True(t, k.failover.failing().IsZero())
+	position, ok := k.failoverPosition()
+	require.True(t, ok)
+	require.Equal(t, ShardReaderFromAtTimestamp(time.Unix(0, record.ResumeAt)), position)
+
+	// Only the checkpoints read from the mirror are used
+	checkpoints := k.streamCheckpoints(map[string]*checkpointRecord{
+		"shardId-000000000000": {Shard: "shardId-000000000000"},
+		"shardId-000000000007": {Shard: "shardId-000000000007", Failovers: 1},
+	})
+	require.Len(t, checkpoints, 1)
+	require.Contains(t, checkpoints, "shardId-000000000007")
+
+	// Another client sees the failover at its next refresh
+	other, err := NewWithInterfaces(&downKinesis{}, db, "stream", "app", "other", config)
+	require.NoError(t, err)
+	switched, err = other.refreshStreamEndpoint()
+	require.NoError(t, err)
+	require.True(t, switched)
+	require.Equal(t, "mirror", other.failover.endpoint().StreamName)
+	switched, err = other.refreshStreamEndpoint()
+	require.NoError(t, err)
+	require.False(t, switched)
+}
+
+func TestCheckpointerReseed(t *testing.T) {
+	table := "checkpoints"
+	mock := mocks.NewMockDynamo([]string{table})
+	cp, err := capture("shard", table, mock, "ownerName", "ownerId", 3*time.Minute, 0, &NoopStatReceiver{})
+	require.NoError(t, err)
+	cp.update("seq")
+
+	cp.reseed(2)
+	require.Equal(t, "", cp.sequenceNumber)
+	require.Equal(t, int64(2), cp.failovers)
+	mocks.AssertRequestMade(t, mock.(*mocks.MockDynamo), "reseeded checkpoint", func() {
+		_, err = cp.commit()
+		require.NoError(t, err)
+	})
+}
+
+func TestConfigStreamFailover(t *testing.T) {
+	mirror := mocks.NewMockKinesis("mirror", nil)
+	require.NoError(t, NewConfig().WithStreamFailover([]StreamEndpoint{{StreamName: "mirror", Kinesis: mirror}}, time.Minute, 0).Validate())
+
+	err := NewConfig().WithStreamFailover([]StreamEndpoint{{Region: "us-west-2"}}, 0, time.Minute).Validate()
+	require.EqualError(t, err, `invalid config: StreamFailover.Endpoints[0] is stream "" in "us-west-2", must be a stream name and a kinesis interface; `+
+		`StreamFailover.After is 0s, must be greater than 0`)
+}
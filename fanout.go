@@ -0,0 +1,294 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const fanOutConsumerKey = "FanOutConsumer"
+
+// validConsumerName matches the names kinesis accepts for stream consumers
+var validConsumerName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,128}$`)
+
+// fanOutConsumerRecord is the enhanced fan-out consumer of the application in the metadata table,
+// stored by the leader once it is ACTIVE
+type fanOutConsumerRecord struct {
+	Key           string
+	ConsumerName  string
+	ConsumerARN   string
+	LastUpdate    int64
+	LastUpdateRFC string
+}
+
+// loadFanOutConsumer returns the enhanced fan-out consumer stored in the metadata table, nil if there
+// is none or no metadata table
+func (k *Kinsumer) loadFanOutConsumer() (*fanOutConsumerRecord, error) {
+	resp, err := k.dynamodb.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(k.metadataTableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(fanOutConsumerKey)},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	var record fanOutConsumerRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// manageFanOutConsumer registers the configured enhanced fan-out consumer on the stream, and stores
+// it in the metadata table once it is ACTIVE, deregistering the consumer it replaces. Consumers take
+// a few seconds to become active, following leader actions pick them up.
+func (k *Kinsumer) manageFanOutConsumer() error {
+	name := k.config.fanOutConsumer
+	stored, err := k.loadFanOutConsumer()
+	if err != nil {
+		return err
+	}
+	if stored != nil && stored.ConsumerName == name {
+		return nil
+	}
+
+	summary, err := k.kinesis.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(k.streamName),
+	})
+	if err != nil {
+		return err
+	}
+	streamARN := summary.StreamDescriptionSummary.StreamARN
+
+	out, err := k.kinesis.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+		StreamARN:    streamARN,
+		ConsumerName: aws.String(name),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeResourceNotFoundException {
+		if _, err = k.kinesis.RegisterStreamConsumer(&kinesis.RegisterStreamConsumerInput{
+			StreamARN:    streamARN,
+			ConsumerName: aws.String(name),
+		}); err != nil {
+			return fmt.Errorf("error registering stream consumer %s: %v", name, err)
+		}
+		k.logf(LevelInfo, "manageFanOutConsumer", "", "Registered stream consumer %s, waiting for it to become active", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	consumer := out.ConsumerDescription
+	if aws.StringValue(consumer.ConsumerStatus) != kinesis.ConsumerStatusActive {
+		return nil
+	}
+
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(&fanOutConsumerRecord{
+		Key:           fanOutConsumerKey,
+		ConsumerName:  name,
+		ConsumerARN:   aws.StringValue(consumer.ConsumerARN),
+		LastUpdate:    now.UnixNano(),
+		LastUpdateRFC: now.UTC().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(k.metadataTableName),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("error storing stream consumer %s: %v", name, err)
+	}
+	k.logf(LevelInfo, "manageFanOutConsumer", "", "Stream consumer %s is active: %s", name, aws.StringValue(consumer.ConsumerARN))
+
+	if stored != nil {
+		return k.deregisterStreamConsumer(stored)
+	}
+	return nil
+}
+
+// deregisterStreamConsumer deregisters a consumer stored in the metadata table from the stream
+func (k *Kinsumer) deregisterStreamConsumer(consumer *fanOutConsumerRecord) error {
+	_, err := k.kinesis.DeregisterStreamConsumer(&kinesis.DeregisterStreamConsumerInput{
+		ConsumerARN: aws.String(consumer.ConsumerARN),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error deregistering stream consumer %s: %v", consumer.ConsumerName, err)
+	}
+	k.logf(LevelInfo, "deregisterStreamConsumer", "", "Deregistered stream consumer %s", consumer.ConsumerName)
+	return nil
+}
+
+// FanOutConsumerARN returns the ARN of the enhanced fan-out consumer configured with
+// Config.WithEnhancedFanOut, so every reader of the application subscribing to the shards does it
+// with the same consumer.
+// It is empty until the leader registered the consumer and it became ACTIVE.
+func (k *Kinsumer) FanOutConsumerARN() (string, error) {
+	stored, err := k.loadFanOutConsumer()
+	if err != nil || stored == nil || stored.ConsumerName != k.config.fanOutConsumer {
+		return "", err
+	}
+	return stored.ConsumerARN, nil
+}
+
+// refreshFanOutConsumer loads the ARN of the enhanced fan-out consumer the shards are read with,
+// once the leader stored it for the configured name
+func (k *Kinsumer) refreshFanOutConsumer() error {
+	arn, err := k.FanOutConsumerARN()
+	if err != nil {
+		return fmt.Errorf("error loading the stream consumer: %v", err)
+	}
+	if previous := k.subscriptionARN(); arn != previous {
+		k.fanOutARN.Store(arn)
+		if arn != "" {
+			k.logf(LevelInfo, "refreshFanOutConsumer", "", "Reading the shards with stream consumer %s: %s", k.config.fanOutConsumer, arn)
+		}
+	}
+	return nil
+}
+
+// subscriptionARN returns the ARN of the enhanced fan-out consumer the shards are read with, empty
+// while they are read with GetRecords
+func (k *Kinsumer) subscriptionARN() string {
+	arn, _ := k.fanOutARN.Load().(string)
+	return arn
+}
+
+// shardSubscription reads a shard through an enhanced fan-out consumer with SubscribeToShard. As a
+// subscription ends after 5 minutes, it subscribes again from the continuation sequence number of the
+// last event it got.
+type shardSubscription struct {
+	kinesis     kinesisiface.KinesisAPI
+	consumerARN string
+	shardID     string
+	// position is where the next subscription starts
+	position kinesis.StartingPosition
+	events   *kinesis.SubscribeToShardEventStream
+	lag      time.Duration
+}
+
+// newShardSubscription returns a subscription to the shard starting at the given position, it only
+// subscribes when the first records are read
+func newShardSubscription(k kinesisiface.KinesisAPI, consumerARN, shardID, shardIteratorType, sequenceNumber string,
+	timestamp *time.Time) *shardSubscription {
+	s := &shardSubscription{kinesis: k, consumerARN: consumerARN, shardID: shardID}
+	s.restart(shardIteratorType, sequenceNumber, timestamp)
+	return s
+}
+
+// restart makes the next subscription start at the given position, like getShardIterator does
+func (s *shardSubscription) restart(shardIteratorType, sequenceNumber string, timestamp *time.Time) {
+	s.close()
+	position := kinesis.StartingPosition{Type: aws.String(shardIteratorType)}
+	switch shardIteratorType {
+	case kinesis.ShardIteratorTypeAfterSequenceNumber, kinesis.ShardIteratorTypeAtSequenceNumber:
+		if sequenceNumber == "" {
+			position.Type = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+		} else if sequenceNumber == "LATEST" {
+			position.Type = aws.String(kinesis.ShardIteratorTypeLatest)
+		} else {
+			position.SequenceNumber = aws.String(sequenceNumber)
+		}
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		position.Timestamp = timestamp
+	}
+	s.position = position
+}
+
+// startingSequenceNumber returns the sequence number the next subscription starts at or after, empty
+// if it starts at another position
+func (s *shardSubscription) startingSequenceNumber() string {
+	return aws.StringValue(s.position.SequenceNumber)
+}
+
+// next returns the records of the next event of the subscription, subscribing first if necessary.
+// It returns no records if no event came within wait, or if we were told to stop. ended is true
+// once the end of the shard was reached, along with its children.
+func (s *shardSubscription) next(stop <-chan struct{}, wait time.Duration) (records []*kinesis.Record, lag time.Duration,
+	childShards []*kinesis.ChildShard, ended bool, err error) {
+	if s.events == nil {
+		out, err := s.kinesis.SubscribeToShard(&kinesis.SubscribeToShardInput{
+			ConsumerARN:      aws.String(s.consumerARN),
+			ShardId:          aws.String(s.shardID),
+			StartingPosition: &s.position,
+		})
+		if err != nil {
+			return nil, s.lag, nil, false, err
+		}
+		s.events = out.EventStream
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return nil, s.lag, nil, false, nil
+	case <-timer.C:
+		return nil, s.lag, nil, false, nil
+	case event, ok := <-s.events.Events():
+		if !ok {
+			// The subscription expired or failed, the next call subscribes again
+			err := s.events.Close()
+			s.events = nil
+			return nil, s.lag, nil, false, err
+		}
+		e, ok := event.(*kinesis.SubscribeToShardEvent)
+		if !ok {
+			return nil, s.lag, nil, false, nil
+		}
+		s.lag = time.Duration(aws.Int64Value(e.MillisBehindLatest)) * time.Millisecond
+		continuation := aws.StringValue(e.ContinuationSequenceNumber)
+		if continuation == "" {
+			// The shard is closed and all its records were sent
+			s.close()
+			return e.Records, s.lag, e.ChildShards, true, nil
+		}
+		s.position = kinesis.StartingPosition{
+			Type:           aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+			SequenceNumber: aws.String(continuation),
+		}
+		return e.Records, s.lag, e.ChildShards, false, nil
+	}
+}
+
+// close ends the current subscription, if any
+func (s *shardSubscription) close() {
+	if s.events != nil {
+		s.events.Close()
+		s.events = nil
+	}
+}
+
+// isSubscriptionBusy returns whether SubscribeToShard failed because the shard still has a
+// subscription of the consumer, like the one of its previous owner, which ends within 5 minutes
+func isSubscriptionBusy(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == kinesis.ErrCodeResourceInUseException
+}
+
+// isConsumerGone returns whether SubscribeToShard failed because the consumer was deregistered
+func isConsumerGone(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == kinesis.ErrCodeResourceNotFoundException
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// fanOutKinesis keeps the status of the stream consumers, which the kinesis mock doesn't have
+type fanOutKinesis struct {
+	kinesisiface.KinesisAPI
+	status       map[string]string
+	deregistered []string
+}
+
+func (k *fanOutKinesis) DescribeStreamSummary(in *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+		StreamARN: aws.String("arn:stream"),
+	}}, nil
+}
+
+func (k *fanOutKinesis) DescribeStreamConsumer(in *kinesis.DescribeStreamConsumerInput) (*kinesis.DescribeStreamConsumerOutput, error) {
+	status, ok := k.status[aws.StringValue(in.ConsumerName)]
+	if !ok {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	return &kinesis.DescribeStreamConsumerOutput{ConsumerDescription: &kinesis.ConsumerDescription{
+		ConsumerARN:    aws.String("arn:stream/consumer/" + aws.StringValue(in.ConsumerName)),
+		ConsumerStatus: aws.String(status),
+	}}, nil
+}
+
+func (k *fanOutKinesis) RegisterStreamConsumer(in *kinesis.RegisterStreamConsumerInput) (*kinesis.RegisterStreamConsumerOutput, error) {
+	k.status[aws.StringValue(in.ConsumerName)] = kinesis.ConsumerStatusCreating
+	return &kinesis.RegisterStreamConsumerOutput{}, nil
+}
+
+func (k *fanOutKinesis) DeregisterStreamConsumer(in *kinesis.DeregisterStreamConsumerInput) (*kinesis.DeregisterStreamConsumerOutput, error) {
+	k.deregistered = append(k.deregistered, aws.StringValue(in.ConsumerARN))
+	return &kinesis.DeregisterStreamConsumerOutput{}, nil
+}
+
+func TestManageFanOutConsumer(t *testing.T) {
+	kin := &fanOutKinesis{KinesisAPI: mocks.NewMockKinesis("stream", nil), status: make(map[string]string)}
+	config := NewConfig().WithEnhancedFanOut("app")
+	k, err := NewWithInterfaces(kin, mocks.NewMockDynamo([]string{"app_metadata"}), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	// The consumer is registered, and only stored once it is active
+	require.NoError(t, k.manageFanOutConsumer())
+	require.Equal(t, kinesis.ConsumerStatusCreating, kin.status["app"])
+	require.NoError(t, k.manageFanOutConsumer())
+	arn, err := k.FanOutConsumerARN()
+	require.NoError(t, err)
+	require.Empty(t, arn)
+
+	kin.status["app"] = kinesis.ConsumerStatusActive
+	require.NoError(t, k.manageFanOutConsumer())
+	arn, err = k.FanOutConsumerARN()
+	require.NoError(t, err)
+	require.Equal(t, "arn:stream/consumer/app", arn)
+	require.Empty(t, kin.deregistered)
+
+	// The shard consumers read with it once they refreshed
+	require.Empty(t, k.subscriptionARN())
+	require.NoError(t, k.refreshFanOutConsumer())
+	require.Equal(t, "arn:stream/consumer/app", k.subscriptionARN())
+}
+
+func TestReplaceFanOutConsumer(t *testing.T) {
+	kin := &fanOutKinesis{KinesisAPI: mocks.NewMockKinesis("stream", nil), status: map[string]string{
+		"new": kinesis.ConsumerStatusActive,
+	}}
+	db := mocks.NewMockDynamo([]string{"app_metadata"})
+	item, err := dynamodbattribute.MarshalMap(&fanOutConsumerRecord{
+		Key:          fanOutConsumerKey,
+		ConsumerName: "old",
+		ConsumerARN:  "arn:stream/consumer/old",
+	})
+	require.NoError(t, err)
+	_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("app_metadata"), Item: item})
+	require.NoError(t, err)
+
+	k, err := NewWithInterfaces(kin, db, "stream", "app", "client", NewConfig().WithEnhancedFanOut("new"))
+	require.NoError(t, err)
+	arn, err := k.FanOutConsumerARN()
+	require.NoError(t, err)
+	require.Empty(t, arn, "the stored consumer isn't the configured one")
+
+	require.NoError(t, k.manageFanOutConsumer())
+	require.Equal(t, []string{"arn:stream/consumer/old"}, kin.deregistered)
+}
+
+// fakeSubscription is the events of a subscription, and the error it ends with once they were read
+type fakeSubscription struct {
+	events chan kinesis.SubscribeToShardEventStreamEvent
+	err    error
+}
+
+func (s *fakeSubscription) Events() <-chan kinesis.SubscribeToShardEventStreamEvent {
+	return s.events
+}
+
+func (s *fakeSubscription) Close() error {
+	return nil
+}
+
+func (s *fakeSubscription) Err() error {
+	return s.err
+}
+
+// subscribedKinesis returns the subscriptions in order, keeping the positions they started at
+type subscribedKinesis struct {
+	kinesisiface.KinesisAPI
+	subscriptions []*fakeSubscription
+	positions     []kinesis.StartingPosition
+}
+
+func (k *subscribedKinesis) SubscribeToShard(in *kinesis.SubscribeToShardInput) (*kinesis.SubscribeToShardOutput, error) {
+	k.positions = append(k.positions, *in.StartingPosition)
+	if len(k.subscriptions) == 0 {
+		return nil, awserr.New(kinesis.ErrCodeResourceInUseException, "already subscribed", nil)
+	}
+	reader := k.subscriptions[0]
+	k.subscriptions = k.subscriptions[1:]
+	return &kinesis.SubscribeToShardOutput{EventStream: kinesis.NewSubscribeToShardEventStream(
+		func(es *kinesis.SubscribeToShardEventStream) {
+			es.Reader = reader
+			es.StreamCloser = ioutil.NopCloser(nil)
+		})}, nil
+}
+
+// newFakeSubscription returns a subscription sending the events, then ending with err if closed
+func newFakeSubscription(closed bool, err error, events ...*kinesis.SubscribeToShardEvent) *fakeSubscription {
+	s := &fakeSubscription{events: make(chan kinesis.SubscribeToShardEventStreamEvent, len(events)), err: err}
+	for _, event := range events {
+		s.events <- event
+	}
+	if closed {
+		close(s.events)
+	}
+	return s
+}
+
+func TestShardSubscription(t *testing.T) {
+	expired := awserr.New(kinesis.ErrCodeInternalFailureException, "connection reset", nil)
+	kin := &subscribedKinesis{subscriptions: []*fakeSubscription{
+		newFakeSubscription(true, nil, &kinesis.SubscribeToShardEvent{
+			Records:                    []*kinesis.Record{{SequenceNumber: aws.String("1")}, {SequenceNumber: aws.String("2")}},
+			ContinuationSequenceNumber: aws.String("2"),
+			MillisBehindLatest:         aws.Int64(1000),
+		}),
+		newFakeSubscription(true, expired),
+		newFakeSubscription(false, nil),
+		newFakeSubscription(false, nil, &kinesis.SubscribeToShardEvent{
+			Records:     []*kinesis.Record{{SequenceNumber: aws.String("3")}},
+			ChildShards: []*kinesis.ChildShard{{ShardId: aws.String("child")}},
+		}),
+	}}
+	stop := make(chan struct{})
+	s := newShardSubscription(kin, "arn:consumer", "shard", kinesis.ShardIteratorTypeAfterSequenceNumber, "", nil)
+
+	// A shard without a checkpoint is read from the trim horizon
+	records, lag, _, ended, err := s.next(stop, time.Second)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, time.Second, lag)
+	require.False(t, ended)
+	require.Equal(t, kinesis.ShardIteratorTypeTrimHorizon, aws.StringValue(kin.positions[0].Type))
+
+	// Once the subscription expires, the next one continues after the last event
+	records, _, _, _, err = s.next(stop, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	_, _, _, _, err = s.next(stop, time.Second)
+	require.Equal(t, expired, err)
+	require.True(t, isRetryable(err))
+	require.Equal(t, kinesis.ShardIteratorTypeAfterSequenceNumber, aws.StringValue(kin.positions[1].Type))
+	require.Equal(t, "2", aws.StringValue(kin.positions[1].SequenceNumber))
+
+	// Nothing comes within the wait, or we are told to stop
+	records, _, _, _, err = s.next(stop, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	close(stop)
+	records, _, _, _, err = s.next(stop, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Len(t, kin.positions, 3, "the subscription is kept")
+
+	// The end of the shard comes without a continuation
+	s.close()
+	records, _, children, ended, err := s.next(make(chan struct{}), time.Second)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.True(t, ended)
+	require.Equal(t, "child", aws.StringValue(children[0].ShardId))
+	require.Equal(t, "2", aws.StringValue(kin.positions[3].SequenceNumber))
+
+	// The shard is still subscribed by its previous owner
+	s.restart(kinesis.ShardIteratorTypeAfterSequenceNumber, "3", nil)
+	_, _, _, _, err = s.next(make(chan struct{}), time.Second)
+	require.True(t, isSubscriptionBusy(err))
+	require.False(t, isConsumerGone(err))
+}
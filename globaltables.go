@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// homeRegionKey is the key of the metadata table item naming the region whose clients consume the
+// stream when the tables are global tables
+const homeRegionKey = "HomeRegion"
+
+// homeRegionRecord is the home region of the tables. Its epoch is incremented every time the home
+// moves, and written with the client and checkpoint records, so the records written by the
+// clients of a previous home lose to the ones of the current home.
+type homeRegionRecord struct {
+	Key    string
+	Region string
+	Epoch  int64
+}
+
+// loadHomeRegion returns the home region of the tables, nil if it wasn't set yet
+func loadHomeRegion(db dynamodbiface.DynamoDBAPI, tableName string) (*homeRegionRecord, error) {
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(homeRegionKey)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	var record homeRegionRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// refreshHomeRegion loads the home region of the tables, setting it to the configured one if it
+// wasn't set yet, and returns whether this client's region is home. The epoch of the home is kept in
+// homeEpoch, 0 while standing by.
+func (k *Kinsumer) refreshHomeRegion() (bool, error) {
+	home, err := loadHomeRegion(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return false, fmt.Errorf("error loading the home region: %v", err)
+	}
+	if home == nil {
+		home = &homeRegionRecord{Key: homeRegionKey, Region: k.config.homeRegion, Epoch: 1}
+		item, err := dynamodbattribute.MarshalMap(home)
+		if err != nil {
+			return false, err
+		}
+		_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
+			TableName:           aws.String(k.metadataTableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(#key)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#key": aws.String("Key"),
+			},
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			// Another client set it first
+			return k.refreshHomeRegion()
+		}
+		if err != nil {
+			return false, fmt.Errorf("error setting the home region: %v", err)
+		}
+	}
+
+	var epoch int64
+	if home.Region == k.config.region {
+		epoch = home.Epoch
+	}
+	if previous := atomic.SwapInt64(&k.homeEpoch, epoch); previous != epoch {
+		k.logf(LevelInfo, "homeRegion", "", "Home region of the tables is %s with epoch %d, standing by: %t",
+			home.Region, home.Epoch, epoch == 0)
+	}
+	return epoch != 0, nil
+}
+
+// standBy gives up our shards, leadership and client record while another region is home, and
+// returns whether we had shards
+func (k *Kinsumer) standBy() bool {
+	changed := len(k.shardIDs) > 0
+	if k.isLeader {
+		k.unbecomeLeader()
+	}
+	if k.totalClients > 0 {
+		if err := deregisterFromClientsTable(k.dynamodb, k.clientID(), k.clientsTableName); err != nil {
+			k.logf(LevelWarn, "homeRegion", "", "Error deregistering client %s while standing by: %s", k.clientID(), err)
+		} else {
+			k.clientsChanged()
+		}
+	}
+	k.shardIDs = nil
+	k.shardParents = nil
+	k.totalClients = 0
+	k.thisClient = 0
+	k.clientZones = nil
+	return changed
+}
+
+// standingBy returns whether the tables are global tables and another region is home
+func (k *Kinsumer) standingBy() bool {
+	return k.config.region != "" && atomic.LoadInt64(&k.homeEpoch) == 0
+}
+
+// TakeHomeRegion makes the region of this client the home region of the global tables, so its
+// clients consume the stream from the replicated checkpoints, for failing over from a region that
+// is down. The clients of the previous home stand by at their next shard check, and the checkpoints
+// they write afterwards are rejected once the new home's writes replicated to them. It should only
+// be called from one region at a time, as concurrent writes to global tables in different regions
+// are resolved with the last writer winning.
+func (k *Kinsumer) TakeHomeRegion() error {
+	if k.config.region == "" {
+		return ErrNoGlobalTables
+	}
+	_, err := k.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(k.metadataTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(homeRegionKey)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#region) OR #region <> :region"),
+		UpdateExpression:    aws.String("SET #region = :region ADD Epoch :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#region": aws.String("Region"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":region": {S: aws.String(k.config.region)},
+			":one":    {N: aws.String("1")},
+		},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		// We already are home
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error taking the home region: %v", err)
+	}
+	k.logf(LevelWarn, "homeRegion", "", "Took the home region of the tables for %s", k.config.region)
+	k.requestRefresh()
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// homeDynamo keeps the home region of the tables and the clients, as if the tables were replicated
+// instantly between the regions
+type homeDynamo struct {
+	*clientsDynamo
+	metadataTable string
+	home          *homeRegionRecord
+}
+
+func (d *homeDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if aws.StringValue(in.TableName) != d.metadataTable || d.home == nil {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	item, err := dynamodbattribute.MarshalMap(d.home)
+	return &dynamodb.GetItemOutput{Item: item}, err
+}
+
+func (d *homeDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if aws.StringValue(in.TableName) != d.metadataTable {
+		return d.clientsDynamo.PutItem(in)
+	}
+	if d.home != nil {
+		return nil, awserr.New(conditionalFail, "home region already set", nil)
+	}
+	d.home = &homeRegionRecord{}
+	return &dynamodb.PutItemOutput{}, dynamodbattribute.UnmarshalMap(in.Item, d.home)
+}
+
+func (d *homeDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if in.ExpressionAttributeValues[":region"] == nil {
+		// Generation of the clients
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	region := aws.StringValue(in.ExpressionAttributeValues[":region"].S)
+	if d.home.Region == region {
+		return nil, awserr.New(conditionalFail, "already home", nil)
+	}
+	d.home.Region = region
+	d.home.Epoch++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestGlobalTables(t *testing.T) {
+	db := &homeDynamo{clientsDynamo: &clientsDynamo{
+		DynamoDBAPI: mocks.NewMockDynamo(nil),
+		clients:     make(map[string]map[string]*dynamodb.AttributeValue),
+	}}
+	newKinsumer := func(name, region string) *Kinsumer {
+		config := NewConfig().WithHeartbeatFrequency(time.Second).WithGlobalTables(region, "us-east-1")
+		k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", name, config)
+		require.NoError(t, err)
+		db.metadataTable = k.metadataTableName
+		return k
+	}
+	east := newKinsumer("east", "us-east-1")
+	west := newKinsumer("west", "us-west-2")
+
+	// The first client sets the configured home region
+	home, err := east.refreshHomeRegion()
+	require.NoError(t, err)
+	require.True(t, home)
+	require.Equal(t, &homeRegionRecord{Key: homeRegionKey, Region: "us-east-1", Epoch: 1}, db.home)
+	home, err = west.refreshHomeRegion()
+	require.NoError(t, err)
+	require.False(t, home)
+
+	// Only the clients of the home region register
+	require.Equal(t, []string{east.clientID()}, east.beat(nil, &backoff{}))
+	east.totalClients = 1 // counted by refreshShards
+	require.Nil(t, west.beat(nil, &backoff{}))
+	require.Len(t, db.clients, 1)
+
+	// Taking the home region twice is a noop the second time
+	require.NoError(t, west.TakeHomeRegion())
+	require.NoError(t, west.TakeHomeRegion())
+	require.Equal(t, int64(2), db.home.Epoch)
+
+	home, err = west.refreshHomeRegion()
+	require.NoError(t, err)
+	require.True(t, home)
+	// The client of the previous home is ignored until it stands by
+	require.Equal(t, []string{west.clientID()}, west.beat(nil, &backoff{}))
+
+	home, err = east.refreshHomeRegion()
+	require.NoError(t, err)
+	require.False(t, home)
+	east.standBy()
+	require.Len(t, db.clients, 1)
+	require.True(t, east.standingBy())
+
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	require.Equal(t, ErrNoGlobalTables, k.TakeHomeRegion())
+
+	err = NewConfig().WithGlobalTables("us-west-2", "").Validate()
+	require.True(t, errors.Is(err, ErrConfigInvalidGlobalTables))
+}
+
+func TestCaptureFromPreviousHome(t *testing.T) {
+	db := mocks.NewMockDynamo([]string{"checkpoints"})
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(checkpointRecord{
+		Shard:          "shard",
+		SequenceNumber: aws.String("seq"),
+		LastUpdate:     now.UnixNano(),
+		OwnerID:        aws.String("east"),
+		OwnerName:      aws.String("east"),
+		HomeEpoch:      1,
+	})
+	require.NoError(t, err)
+	_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("checkpoints"), Item: item})
+	require.NoError(t, err)
+
+	// Owned by a live client of the same home
+	cp, err := capture("shard", "checkpoints", db, "west", "west", time.Minute, 1, &NoopStatReceiver{})
+	require.NoError(t, err)
+	require.Nil(t, cp)
+
+	// The owner is a client of the previous home, which stopped consuming
+	cp, err = capture("shard", "checkpoints", db, "west", "west", time.Minute, 2, &NoopStatReceiver{})
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	require.Equal(t, "seq", cp.sequenceNumber)
+	require.Equal(t, int64(2), cp.homeEpoch)
+}
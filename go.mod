@@ -3,10 +3,13 @@ module github.com/brenol/kinsumer
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.24.3
+	github.com/aws/aws-sdk-go v1.35.20
 	github.com/cactus/go-statsd-client/statsd v0.0.0-20190922113730-52b467de415c
 	github.com/google/uuid v1.1.1
+	github.com/klauspost/compress v1.11.3
+	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
+	go.uber.org/zap v1.16.0
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v2 v2.2.8
 )
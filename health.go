@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthMonitor records the internal state Healthy checks
+type healthMonitor struct {
+	mutex         sync.Mutex
+	running       bool
+	lastHeartbeat time.Time // last time our client record was updated
+	assigned      int       // number of shards assigned to us by the last assignment
+	assignedAt    time.Time
+	lastDelivery  time.Time // last time a record was handed to the application
+	lastHandled   time.Time // last time Dispatch finished with a record
+	records       chan *consumedRecord
+}
+
+func (h *healthMonitor) setRunning(running bool, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.running = running
+	h.lastDelivery = now
+	h.lastHandled = now
+}
+
+func (h *healthMonitor) setBuffer(records chan *consumedRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = records
+}
+
+func (h *healthMonitor) heartbeat(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastHeartbeat = now
+}
+
+func (h *healthMonitor) assign(shards int, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.assigned = shards
+	h.assignedAt = now
+}
+
+func (h *healthMonitor) delivered(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastDelivery = now
+}
+
+func (h *healthMonitor) handled(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastHandled = now
+}
+
+// Healthy returns an error describing what is wrong with the consumer, or nil if it is healthy.
+// The consumer is unhealthy when it isn't running, when it failed to update its client record,
+// to capture any of the shards assigned to it or to write the checkpoint of a shard it consumes for
+// longer than it takes the other clients to consider it gone, or when the buffer has been full
+// without a record being returned for that long.
+func (k *Kinsumer) Healthy() error {
+	now := time.Now()
+	timeout := k.maxAgeForClientRecord
+	k.health.mutex.Lock()
+	running, lastHeartbeat := k.health.running, k.health.lastHeartbeat
+	assigned, assignedAt, lastDelivery := k.health.assigned, k.health.assignedAt, k.health.lastDelivery
+	records := k.health.records
+	k.health.mutex.Unlock()
+
+	if !running {
+		return fmt.Errorf("not running")
+	}
+	if age := now.Sub(lastHeartbeat); age > timeout {
+		return fmt.Errorf("client record not updated for %s", age)
+	}
+
+	k.checkpointersMutex.Lock()
+	owned := make([]*checkpointer, 0, len(k.checkpointers))
+	for _, cp := range k.checkpointers {
+		owned = append(owned, cp)
+	}
+	k.checkpointersMutex.Unlock()
+	if assigned > 0 && len(owned) == 0 && now.Sub(assignedAt) > timeout {
+		return fmt.Errorf("none of the %d shards assigned %s ago captured", assigned, now.Sub(assignedAt))
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].shardID < owned[j].shardID })
+	for _, cp := range owned {
+		cp.mutex.Lock()
+		dirty, written := cp.dirty, cp.written
+		cp.mutex.Unlock()
+		if dirty && !written.IsZero() && now.Sub(written) > timeout {
+			return fmt.Errorf("checkpoint of shard %s not written for %s", cp.shardID, now.Sub(written))
+		}
+	}
+
+	if buffered := len(records); buffered > 0 && buffered == cap(records) && now.Sub(lastDelivery) > timeout {
+		return fmt.Errorf("buffer full and no record returned for %s", now.Sub(lastDelivery))
+	}
+	return nil
+}
+
+// HealthHandler returns an http.Handler for liveness and readiness probes, responding 200 OK when
+// the consumer is Healthy and 503 Service Unavailable with the reason when it isn't
+func (k *Kinsumer) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := k.Healthy(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "unhealthy: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
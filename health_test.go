@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthy(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	k.records = make(chan *consumedRecord, 1)
+	k.health.setBuffer(k.records)
+	now := time.Now()
+	stale := now.Add(-2 * k.maxAgeForClientRecord)
+
+	require.EqualError(t, k.Healthy(), "not running")
+	k.health.setRunning(true, now)
+	k.health.heartbeat(now)
+	k.health.assign(1, now)
+	require.NoError(t, k.Healthy(), "the shard was just assigned")
+
+	k.health.heartbeat(stale)
+	require.Contains(t, k.Healthy().Error(), "client record not updated")
+	k.health.heartbeat(now)
+
+	k.health.assign(1, stale)
+	require.Contains(t, k.Healthy().Error(), "none of the 1 shards assigned")
+	cp := &checkpointer{shardID: "shard", written: now}
+	k.setOwnedCheckpointer("shard", cp)
+	require.NoError(t, k.Healthy())
+
+	cp.dirty = true
+	cp.written = stale
+	require.Contains(t, k.Healthy().Error(), "checkpoint of shard shard not written")
+	cp.written = now
+
+	k.records <- &consumedRecord{}
+	k.health.delivered(stale)
+	require.Contains(t, k.Healthy().Error(), "buffer full")
+	k.health.delivered(now)
+	require.NoError(t, k.Healthy(), "records are being returned")
+
+	rec := httptest.NewRecorder()
+	k.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	k.health.setRunning(false, now)
+	rec = httptest.NewRecorder()
+	k.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "unhealthy: not running\n", rec.Body.String())
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Special checkpoint values used by the KCL instead of a sequence number
+const (
+	kclCheckpointTrimHorizon = "TRIM_HORIZON"
+	kclCheckpointLatest      = "LATEST"
+	kclCheckpointAtTimestamp = "AT_TIMESTAMP"
+	kclCheckpointShardEnd    = "SHARD_END"
+)
+
+// kclLeaseRecord is the subset of a KCL lease table item we need to import its checkpoint
+type kclLeaseRecord struct {
+	LeaseKey   string `dynamodbav:"leaseKey"`   // shard ID, prefixed by the stream identifier in multi-stream mode
+	Checkpoint string `dynamodbav:"checkpoint"` // sequence number or one of the special checkpoint values
+}
+
+// kclMultiStreamLeaseKeyParts is the number of parts of the multi-stream lease keys,
+// "account:stream:creationEpoch:shardId"
+const kclMultiStreamLeaseKeyParts = 4
+
+// shardID returns the ID of the shard the lease is for
+func (l *kclLeaseRecord) shardID() string {
+	if parts := strings.Split(l.LeaseKey, ":"); len(parts) == kclMultiStreamLeaseKeyParts {
+		return parts[3]
+	}
+	return l.LeaseKey
+}
+
+// streamName returns the name of the stream the lease is for, empty if the lease table is for a
+// single stream
+func (l *kclLeaseRecord) streamName() string {
+	if parts := strings.Split(l.LeaseKey, ":"); len(parts) == kclMultiStreamLeaseKeyParts {
+		return parts[1]
+	}
+	return ""
+}
+
+// checkpointRecord converts the lease into the checkpoint it corresponds to, returning nil if
+// the lease was never checkpointed at a position kinsumer can resume from
+func (l *kclLeaseRecord) checkpointRecord(now time.Time) *checkpointRecord {
+	record := &checkpointRecord{
+		Shard:         l.shardID(),
+		LastUpdate:    now.UnixNano(),
+		LastUpdateRFC: now.UTC().Format(time.RFC1123Z),
+	}
+	switch l.Checkpoint {
+	case "", kclCheckpointTrimHorizon, kclCheckpointAtTimestamp:
+		// Without a sequence number the shard is consumed from the configured position
+		return nil
+	case kclCheckpointLatest:
+		record.SequenceNumber = aws.String("LATEST")
+	case kclCheckpointShardEnd:
+		record.Finished = aws.Int64(now.UnixNano())
+		record.FinishedRFC = aws.String(now.UTC().Format(time.RFC1123Z))
+	default:
+		record.SequenceNumber = aws.String(l.Checkpoint)
+	}
+	return record
+}
+
+// loadKCLLeases returns all the leases in the given KCL lease table
+func loadKCLLeases(db dynamodbiface.DynamoDBAPI, tableName string) ([]*kclLeaseRecord, error) {
+	params := &dynamodb.ScanInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	var leases []*kclLeaseRecord
+	var innerError error
+	err := db.ScanPages(params, func(p *dynamodb.ScanOutput, lastPage bool) (shouldContinue bool) {
+		for _, item := range p.Items {
+			var lease kclLeaseRecord
+			innerError = dynamodbattribute.UnmarshalMap(item, &lease)
+			if innerError != nil {
+				return false
+			}
+			leases = append(leases, &lease)
+		}
+
+		return !lastPage
+	})
+
+	if innerError != nil {
+		return nil, innerError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+// ImportKCLCheckpoints copies the checkpoints of an Amazon KCL lease table into our checkpoint
+// table, so that an application can move from the KCL to kinsumer without losing its position in
+// the stream. It should be run once, after the KCL application has been stopped and before Run().
+// Shards that already have a checkpoint are only overwritten if overwrite is true, and shards
+// currently owned by a kinsumer client are never touched. The lease table of a multi-stream KCL
+// application has the leases of all its streams, only the ones of our stream are imported.
+// Sub-sequence numbers of aggregated records are not supported, so the whole aggregated record will
+// be read again.
+// Returns the number of checkpoints imported.
+func (k *Kinsumer) ImportKCLCheckpoints(leaseTableName string, overwrite bool) (int, error) {
+	leases, err := loadKCLLeases(k.dynamodb, leaseTableName)
+	if err != nil {
+		return 0, fmt.Errorf("error loading KCL leases: %v", err)
+	}
+
+	condition := "attribute_not_exists(Shard)"
+	if overwrite {
+		condition = "attribute_not_exists(OwnerID) OR attribute_type(OwnerID, :nullType)"
+	}
+
+	imported := 0
+	now := time.Now()
+	for _, lease := range leases {
+		// A multi-stream application has the leases of all its streams in the same table
+		if stream := lease.streamName(); stream != "" && stream != k.streamName {
+			continue
+		}
+		record := lease.checkpointRecord(now)
+		if record == nil {
+			continue
+		}
+
+		item, err := dynamodbattribute.MarshalMap(record)
+		if err != nil {
+			return imported, err
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName:           aws.String(k.checkpointTableName),
+			Item:                item,
+			ConditionExpression: aws.String(condition),
+		}
+		if overwrite {
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":nullType": {S: aws.String("NULL")},
+			}
+		}
+
+		if _, err = k.dynamodb.PutItem(input); err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+				continue
+			}
+			return imported, fmt.Errorf("error importing checkpoint for shard %s: %v", record.Shard, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKCLLeaseCheckpoint(t *testing.T) {
+	now := time.Now()
+
+	lease := &kclLeaseRecord{LeaseKey: "shardId-000000000001", Checkpoint: "49590338271490256608559692538361571095921575989136588898"}
+	record := lease.checkpointRecord(now)
+	require.Equal(t, "shardId-000000000001", record.Shard)
+	require.Equal(t, lease.Checkpoint, aws.StringValue(record.SequenceNumber))
+	require.Nil(t, record.Finished)
+
+	require.Equal(t, "", lease.streamName())
+
+	lease = &kclLeaseRecord{LeaseKey: "123456789012:stream:1600000000:shardId-000000000002", Checkpoint: kclCheckpointShardEnd}
+	require.Equal(t, "stream", lease.streamName())
+	record = lease.checkpointRecord(now)
+	require.Equal(t, "shardId-000000000002", record.Shard)
+	require.Nil(t, record.SequenceNumber)
+	require.NotNil(t, record.Finished)
+
+	lease = &kclLeaseRecord{LeaseKey: "shardId-000000000003", Checkpoint: kclCheckpointLatest}
+	require.Equal(t, "LATEST", aws.StringValue(lease.checkpointRecord(now).SequenceNumber))
+
+	lease = &kclLeaseRecord{LeaseKey: "shardId-000000000004", Checkpoint: kclCheckpointTrimHorizon}
+	require.Nil(t, lease.checkpointRecord(now))
+}
+
+func TestImportKCLCheckpoints(t *testing.T) {
+	db := mocks.NewMockDynamo([]string{"kcl_leases", "app_checkpoints"})
+	for _, lease := range []kclLeaseRecord{
+		{LeaseKey: "123456789012:stream:1600000000:shardId-000000000001", Checkpoint: "100"},
+		{LeaseKey: "123456789012:other:1600000000:shardId-000000000001", Checkpoint: "900"},
+		{LeaseKey: "123456789012:other:1600000000:shardId-000000000005", Checkpoint: "950"},
+		{LeaseKey: "123456789012:stream:1600000000:shardId-000000000002", Checkpoint: kclCheckpointTrimHorizon},
+	} {
+		item, err := dynamodbattribute.MarshalMap(lease)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("kcl_leases"), Item: item})
+		require.NoError(t, err)
+	}
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+
+	// Only the leases of our stream are imported, the other streams have their own shards
+	imported, err := k.ImportKCLCheckpoints("kcl_leases", false)
+	require.NoError(t, err)
+	require.Equal(t, 1, imported)
+	checkpoints, err := loadCheckpoints(db, "app_checkpoints")
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+	require.Equal(t, "100", aws.StringValue(checkpoints["shardId-000000000001"].SequenceNumber))
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// KeyExtractor maps a record to the logical key (tenant, customer, ...) it belongs to, so that
+// throughput can be tracked per key.
+type KeyExtractor func(record *kinesis.Record) string
+
+// KeyStats holds the throughput observed for a single key since Run() was called
+type KeyStats struct {
+	Records int64 // number of records retrieved from kinesis
+	Bytes   int64 // total size of the data of those records
+}
+
+// keyStatsAggregator accumulates KeyStats from all the shard consumers
+type keyStatsAggregator struct {
+	mutex sync.Mutex
+	stats map[string]KeyStats
+}
+
+func newKeyStatsAggregator() *keyStatsAggregator {
+	return &keyStatsAggregator{
+		stats: make(map[string]KeyStats),
+	}
+}
+
+// tally returns the KeyStats of a batch of records
+func tally(extract KeyExtractor, records []*kinesis.Record) map[string]KeyStats {
+	batch := make(map[string]KeyStats)
+	for _, record := range records {
+		key := extract(record)
+		s := batch[key]
+		s.Records++
+		s.Bytes += int64(len(record.Data))
+		batch[key] = s
+	}
+	return batch
+}
+
+// add merges the given batch into the aggregated stats
+func (a *keyStatsAggregator) add(batch map[string]KeyStats) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for key, b := range batch {
+		s := a.stats[key]
+		s.Records += b.Records
+		s.Bytes += b.Bytes
+		a.stats[key] = s
+	}
+}
+
+// snapshot returns a copy of the aggregated stats
+func (a *keyStatsAggregator) snapshot() map[string]KeyStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	out := make(map[string]KeyStats, len(a.stats))
+	for key, s := range a.stats {
+		out[key] = s
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStats(t *testing.T) {
+	extract := func(record *kinesis.Record) string {
+		return aws.StringValue(record.PartitionKey)
+	}
+	records := []*kinesis.Record{
+		{PartitionKey: aws.String("a"), Data: []byte("12")},
+		{PartitionKey: aws.String("b"), Data: []byte("123")},
+		{PartitionKey: aws.String("a"), Data: []byte("1234")},
+	}
+
+	a := newKeyStatsAggregator()
+	a.add(tally(extract, records))
+	a.add(tally(extract, records[:1]))
+
+	require.Equal(t, map[string]KeyStats{
+		"a": {Records: 3, Bytes: 8},
+		"b": {Records: 1, Bytes: 3},
+	}, a.snapshot())
+}
@@ -4,6 +4,7 @@ package kinsumer
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/google/uuid"
@@ -29,16 +31,47 @@ type consumedRecord struct {
 	record       *kinesis.Record // Record retrieved from kinesis
 	checkpointer *checkpointer   // Object that will store the checkpoint back to the database
 	retrievedAt  time.Time       // Time the record was retrieved from Kinesis
+	trace        *deliveryTrace  // Set if the record was sampled for delivery tracing
+	previous     string          // Sequence number of the shard checkpoint before the record was delivered
+	redelivered  bool            // Whether the record was nacked and is being delivered again
+	attempts     int             // Number of times the record was nacked or failed the record hook
+}
+
+// Record is a record consumed from kinesis, along with the shard it was read from
+type Record struct {
+	ShardID                     string    // ID of the shard the record was read from
+	SequenceNumber              string    // Sequence number of the record within the shard
+	PartitionKey                string    // Partition key the record was put with
+	ApproximateArrivalTimestamp time.Time // Approximate time the record was inserted into kinesis
+	Data                        []byte    // Data of the record
+	DeliveryID                  uint64    // ID in the delivery trace logs if the record was sampled, 0 otherwise
+
+	consumed *consumedRecord // the record as it went through kinsumer, used by Nack
+}
+
+// newRecord returns the Record of a kinesis record read from the given shard
+func newRecord(shardID string, record *kinesis.Record) *Record {
+	return &Record{
+		ShardID:                     shardID,
+		SequenceNumber:              aws.StringValue(record.SequenceNumber),
+		PartitionKey:                aws.StringValue(record.PartitionKey),
+		ApproximateArrivalTimestamp: aws.TimeValue(record.ApproximateArrivalTimestamp),
+		Data:                        record.Data,
+	}
 }
 
 // Kinsumer is a Kinesis Consumer that tries to reduce duplicate reads while allowing for multiple
 // clients each processing multiple shards
 type Kinsumer struct {
 	kinesis               kinesisiface.KinesisAPI   // interface to the kinesis service
+	failover              *failoverKinesis          // routes kinesis requests to the stream endpoint consumed, nil without failover
 	dynamodb              dynamodbiface.DynamoDBAPI // interface to the dynamodb service
 	streamName            string                    // name of the kinesis stream to consume from
 	shardIDs              []string                  // all the shards in the stream, for detecting when the shards change
+	shardParents          map[string][]string       // parents of each shard in shardIDs that still exist in the stream
 	stop                  chan struct{}             // channel used to signal to all the go routines that we want to stop consuming
+	stopMutex             sync.Mutex                // mutex protecting stop and shutdownDeadline, which the retries read from any go routine
+	shutdownDeadline      chan struct{}             // closed once the consumers have been stopped for maxAgeForClientRecord
 	stoprequest           chan bool                 // channel used internally to signal to the main go routine to stop processing
 	records               chan *consumedRecord      // channel for the go routines to put the consumed records on
 	output                chan *consumedRecord      // unbuffered channel used to communicate from the main loop to the Next() method
@@ -49,18 +82,57 @@ type Kinsumer struct {
 	clientsTableName      string                    // dynamo table of info about each client
 	checkpointTableName   string                    // dynamo table of the checkpoints for each shard
 	metadataTableName     string                    // dynamo table of metadata about the leader and shards
-	clientID              string                    // identifier to differentiate between the running clients
+	dedupTableName        string                    // dynamo table of the records recently returned, with config.deduplicationWindow
+	id                    atomic.Value              // identifier to differentiate between the running clients, a string replaced when we quarantine ourselves
+	fanOutARN             atomic.Value              // ARN of the enhanced fan-out consumer the shards are read with, a string empty while they are polled
 	clientName            string                    // display name of the client - used just for debugging
 	totalClients          int                       // The number of clients that are currently working on this stream
 	thisClient            int                       // The (sorted by name) index of this client in the total list
+	clientZones           []string                  // availability zone of each client, in the order of the list
 	config                Config                    // configuration struct
 	numberOfRuns          int32                     // Used to atomically make sure we only ever allow one Run() to be called
-	isLeader              bool                      // Whether this client is the leader
+	dispatching           int32                     // 1 once Dispatch was called, the records are acked once they were handled
+	isLeader              bool                      // Whether this client runs for leader, it is the leader if leaderToken isn't 0
+	leaderElector         LeaderElector             // elects the client performing the leader actions
+	leaderToken           int64                     // token of our leadership, 0 if we aren't the leader
+	homeEpoch             int64                     // epoch of the home region with config.region, 0 while standing by
 	leaderLost            chan bool                 // Channel that receives an event when the node loses leadership
 	leaderWG              sync.WaitGroup            // waitGroup for the leader loop
+	heartbeatStop         chan struct{}             // closed to stop the heartbeat, nil when it isn't running
+	heartbeatWG           sync.WaitGroup            // waitGroup for the heartbeat loop
 	maxAgeForClientRecord time.Duration             // Cutoff for client/checkpoint records we read from dynamodb before we assume the record is stale
 	maxAgeForLeaderRecord time.Duration             // Cutoff for leader/shard cache records we read from dynamodb before we assume the record is stale
 	fromCheckpoint        bool                      // if there is already a consumer from the shard, we should move on from the checkpoint
+	startedAt             time.Time                 // Time Run() was called
+	runStartedAt          time.Time                 // Start of the run of the clients, checkpoints older than this are replaced, see startRun
+	keyStats              *keyStatsAggregator       // Throughput per key, only updated when config.keyExtractor is set
+	bookmark              map[string]string         // Sequence numbers by shard to resume from, set by ResumeFromBookmark
+	checkpointers         map[string]*checkpointer  // Checkpointers of the shards we currently own, by shard ID
+	checkpointersMutex    sync.Mutex                // Mutex protecting checkpointers
+	refreshRequested      chan struct{}             // channel signaled when the shards should be refreshed before the next shard check
+	spill                 *spillBuffer              // records that didn't fit in the records channel, only with bufferOverflowSpill
+	droppedRecords        uint64                    // number of records dropped with bufferOverflowDropOldest
+	bufferedBytes         int64                     // bytes of record data buffered and not returned yet with delivery pacing
+	deliveries            uint64                    // number of records fetched, used to sample them for delivery tracing
+	shardList             []*kinesis.Shard          // shards last loaded from kinesis, see listShards
+	shardListLoadedAt     time.Time                 // when shardList was loaded
+	shardListMutex        sync.Mutex                // mutex protecting shardList, used by both the leader and the main loop
+	ownershipLosses       []time.Time               // times of the recent checkpoint commits lost to another owner
+	redeliveries          *redeliveryQueue          // nacked records waiting to be returned again
+	merger                *arrivalMerger            // records held to be returned in arrival order, only with config.arrivalOrderingWindow
+	shardBuffers          *shardBuffers             // records of each shard not moved to the records channel yet, only with config.shardBufferSize
+	live                  *liveConfig               // settings that can be changed by UpdateConfig while we run
+	configUpdated         chan struct{}             // channel signaled when UpdateConfig was called
+	bufferMutex           sync.RWMutex              // mutex read locked by the shard workers while they put records on the records channel, see lockBuffer
+	bufferPause           chan struct{}             // channel closed when the shard workers should unlock bufferMutex so the records channel can be replaced
+	bufferResumed         chan struct{}             // channel closed once the records channel was replaced, nil unless it is being replaced
+	usage                 *usage                    // calls made to kinesis and dynamo, for EstimateCosts
+	migrating             *migratingDynamo          // routes dynamodb requests to other tables while migrating them
+	unrouted              dynamodbiface.DynamoDBAPI // interface to the dynamodb service bypassing migrating
+	claimCheckSlots       chan struct{}             // limits the payloads fetched from S3 at once, nil for no limit
+	recovery              *recovery                 // where the shards assigned when Run was called were resumed
+	health                *healthMonitor            // internal state checked by Healthy
+	clientsCache          *clientsCache             // last scan of the clients table, with config.clientsCacheAge
 }
 
 // New returns a Kinsumer Interface with default kinesis and dynamodb instances, to be used in ec2 instances to get default auth and config
@@ -76,6 +148,9 @@ func New(streamName, applicationName, clientName string, config Config) (*Kinsum
 func NewWithSession(session *session.Session, streamName, applicationName, clientName string, config Config) (*Kinsumer, error) {
 	k := kinesis.New(session)
 	d := dynamodb.New(session)
+	if config.tableStreamsPollFrequency > 0 && config.dynamoStreams == nil {
+		config.dynamoStreams = dynamodbstreams.New(session)
+	}
 
 	return NewWithInterfaces(k, d, streamName, applicationName, clientName, config)
 }
@@ -97,50 +172,169 @@ func NewWithInterfaces(kinesis kinesisiface.KinesisAPI, dynamodb dynamodbiface.D
 	if err := validateConfig(&config); err != nil {
 		return nil, err
 	}
+	if _, ok := kinesis.(*dynamoStreamsKinesis); ok && config.fanOutConsumer != "" {
+		return nil, ErrTableStreamFanOut
+	}
+	if _, ok := kinesis.(*dynamoStreamsKinesis); ok && config.shardDiscoveryFrequency > 0 {
+		return nil, ErrTableStreamShardDiscovery
+	}
+	if config.clientMetadata.Hostname == "" {
+		config.clientMetadata.Hostname, _ = os.Hostname()
+	}
 
-	consumer := &Kinsumer{
+	// The requests are retried by the Retryer rather than the AWS SDK
+	kinesis = kinesisWithoutSDKRetries(kinesis)
+	dynamodb = dynamoWithoutSDKRetries(dynamodb)
+	if len(config.failoverEndpoints) > 0 {
+		endpoints := make([]StreamEndpoint, len(config.failoverEndpoints))
+		for i, e := range config.failoverEndpoints {
+			e.Kinesis = kinesisWithoutSDKRetries(e.Kinesis)
+			endpoints[i] = e
+		}
+		config.failoverEndpoints = endpoints
+	}
+	if config.claimCheck != nil {
+		resolver := *config.claimCheck
+		resolver.S3 = s3WithoutSDKRetries(resolver.S3)
+		config.claimCheck = &resolver
+	}
+
+	tables := config.tableNames.withDefaults(applicationName)
+	usage := newUsage()
+	metered := &meteredDynamo{DynamoDBAPI: dynamodb, usage: usage}
+	migrating := newMigratingDynamo(metered, config.logger)
+	var failover *failoverKinesis
+	if len(config.failoverEndpoints) > 0 {
+		failover = newFailoverKinesis(kinesis, streamName, config.failoverEndpoints, config.failoverAfter)
+		kinesis = failover
+	}
+	// The retries stop waiting when the consumers stop, except for the dynamo writes made while we
+	// shut down, which stop once our client record expired
+	var consumer *Kinsumer
+	stopping := func() <-chan struct{} { return consumer.stopping() }
+	shutdownExpired := func() <-chan struct{} { return consumer.shutdownExpired() }
+	_, unrouted := withRetries(kinesis, metered, &config, stopping, shutdownExpired)
+	kinesis, dynamodb = withRetries(kinesis, migrating, &config, stopping, shutdownExpired)
+	consumer = &Kinsumer{
 		streamName:            streamName,
 		kinesis:               kinesis,
+		failover:              failover,
 		dynamodb:              dynamodb,
 		stoprequest:           make(chan bool),
 		records:               make(chan *consumedRecord, config.bufferSize),
 		output:                make(chan *consumedRecord),
 		errors:                make(chan error, 10),
 		shardErrors:           make(chan shardConsumerError, 10),
-		checkpointTableName:   applicationName + "_checkpoints",
-		clientsTableName:      applicationName + "_clients",
-		metadataTableName:     applicationName + "_metadata",
-		clientID:              uuid.New().String(),
+		checkpointTableName:   tables.Checkpoints,
+		clientsTableName:      tables.Clients,
+		metadataTableName:     tables.Metadata,
+		dedupTableName:        tables.Deduplication,
 		clientName:            clientName,
 		config:                config,
-		maxAgeForClientRecord: config.shardCheckFrequency * 5,
+		maxAgeForClientRecord: config.clientExpiry(),
 		maxAgeForLeaderRecord: config.leaderActionFrequency * 5,
+		keyStats:              newKeyStatsAggregator(),
+		checkpointers:         make(map[string]*checkpointer),
+		refreshRequested:      make(chan struct{}, 1),
+		redeliveries:          newRedeliveryQueue(),
+		recovery:              newRecovery(),
+		health:                &healthMonitor{},
+		clientsCache:          &clientsCache{},
+		live:                  newLiveConfig(&config),
+		configUpdated:         make(chan struct{}, 1),
+		bufferPause:           make(chan struct{}),
+		usage:                 usage,
+		migrating:             migrating,
+		unrouted:              unrouted,
+	}
+	if config.bufferOverflowPolicy == bufferOverflowSpill {
+		consumer.spill = newSpillBuffer(config.spillDirectory, config.spillMaxBytes)
+	}
+	if config.shardBufferSize > 0 {
+		consumer.shardBuffers = newShardBuffers(config.shardBufferSize)
+	}
+	if config.arrivalOrderingWindow > 0 {
+		consumer.merger = newArrivalMerger(config.arrivalOrderingWindow, config.bufferSize)
+	}
+	consumer.setClientID(uuid.New().String())
+	consumer.leaderElector = config.leaderElector
+	if consumer.leaderElector == nil {
+		consumer.leaderElector = &leaseElector{
+			dynamodb:        consumer.dynamodb,
+			tableName:       consumer.metadataTableName,
+			lease:           consumer.maxAgeForLeaderRecord,
+			firstClientOnly: config.firstClientLeader,
+		}
+	}
+	if failover != nil {
+		failover.onFailing = consumer.requestRefresh
+	}
+	if config.claimCheck != nil && config.claimCheck.Concurrency > 0 {
+		consumer.claimCheckSlots = make(chan struct{}, config.claimCheck.Concurrency)
 	}
 	return consumer, nil
 }
 
 // refreshShards registers our client, refreshes the lists of clients and shards, checks if we
 // have become/unbecome the leader, and returns whether the shards/clients changed.
-//TODO: Write unit test - needs dynamo _and_ kinesis mocking
+// TODO: Write unit test - needs dynamo _and_ kinesis mocking
 func (k *Kinsumer) refreshShards() (bool, error) {
 	var shardIDs []string
 
-	if err := registerWithClientsTable(k.dynamodb, k.clientID, k.clientName, k.clientsTableName); err != nil {
+	if err := k.refreshMigration(); err != nil {
 		return false, err
 	}
 
+	if k.config.region != "" {
+		home, err := k.refreshHomeRegion()
+		if err != nil {
+			return false, err
+		}
+		if !home {
+			k.health.heartbeat(time.Now())
+			return k.standBy(), nil
+		}
+	}
+
+	var switched bool
+	if k.failover != nil {
+		var err error
+		if switched, err = k.refreshStreamEndpoint(); err != nil {
+			return false, err
+		}
+	}
+
+	if k.config.fanOutConsumer != "" {
+		if err := k.refreshFanOutConsumer(); err != nil {
+			return false, err
+		}
+	}
+
+	joined, err := registerWithClientsTable(k.dynamodb, k.clientRecord(), k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return false, err
+	}
+	if joined {
+		k.clientsChanged()
+	}
+	k.health.heartbeat(time.Now())
+
 	//TODO: Move this out of refreshShards and into refreshClients
-	clients, err := getClients(k.dynamodb, k.clientID, k.clientsTableName, k.maxAgeForClientRecord)
+	clients, err := k.loadClients()
 	if err != nil {
 		return false, err
 	}
 
 	totalClients := len(clients)
 	thisClient := 0
+	zones := make([]string, len(clients))
+	for i, c := range clients {
+		zones[i] = c.Zone
+	}
 
 	found := false
 	for i, c := range clients {
-		if c.ID == k.clientID {
+		if c.ID == k.clientID() {
 			thisClient = i
 			found = true
 			break
@@ -151,22 +345,33 @@ func (k *Kinsumer) refreshShards() (bool, error) {
 		return false, ErrThisClientNotInDynamo
 	}
 
-	if thisClient == 0 && !k.isLeader {
+	candidate := k.leaderElector.Candidate(thisClient, totalClients)
+	if candidate && !k.isLeader {
 		k.becomeLeader()
-	} else if thisClient != 0 && k.isLeader {
+	} else if !candidate && k.isLeader {
 		k.unbecomeLeader()
 	}
 
-	shardIDs, err = loadShardIDsFromDynamo(k.dynamodb, k.metadataTableName)
+	shardCache, err := loadShardCacheFromDynamo(k.dynamodb, k.metadataTableName)
 
 	if err != nil {
 		return false, err
 	}
 
+	var shardParents map[string][]string
+	// The cache of the endpoint we failed over from is replaced by the leader
+	if shardCache != nil && shardCache.Failovers == k.streamFailovers() {
+		shardIDs = shardCache.ShardIDs
+		shardParents = shardCache.ShardParents
+	}
+
 	if len(shardIDs) == 0 {
-		shardIDs, err = loadShardIDsFromKinesis(k.kinesis, k.streamName)
+		var shards []*kinesis.Shard
+		shards, err = k.listShards()
 		if err == nil {
-			err = k.setCachedShardIDs(shardIDs)
+			shardIDs = sortedShardIDs(shards)
+			shardParents = parentShardIDs(shards, shardIDs)
+			_, err = k.setCachedShardIDs(shardIDs, shardParents)
 		}
 	}
 
@@ -174,9 +379,10 @@ func (k *Kinsumer) refreshShards() (bool, error) {
 		return false, err
 	}
 
-	changed := (totalClients != k.totalClients) ||
+	changed := switched || (totalClients != k.totalClients) ||
 		(thisClient != k.thisClient) ||
-		(len(k.shardIDs) != len(shardIDs))
+		(len(k.shardIDs) != len(shardIDs)) ||
+		(k.config.assignmentStrategy.zoned() && !stringSlicesEqual(zones, k.clientZones))
 
 	if !changed {
 		for idx := range shardIDs {
@@ -187,51 +393,185 @@ func (k *Kinsumer) refreshShards() (bool, error) {
 		}
 	}
 
+	if added, removed := shardChanges(k.shardIDs, shardIDs); len(k.shardIDs) > 0 && len(added)+len(removed) > 0 {
+		k.emit(EventReshardDetected, LevelInfo, "", map[string]interface{}{
+			"added":   added,
+			"removed": removed,
+			"shards":  len(shardIDs),
+		}, "Shards changed, %d added and %d removed", len(added), len(removed))
+	}
 	if changed {
 		k.shardIDs = shardIDs
+		k.shardParents = shardParents
 	}
 
 	k.thisClient = thisClient
 	k.totalClients = totalClients
+	k.clientZones = zones
 
 	return changed, nil
 }
 
+// shouldQuarantine records a checkpoint commit lost to another owner, and returns whether enough of
+// them happened recently that we should quarantine ourselves.
+func (k *Kinsumer) shouldQuarantine(now time.Time) bool {
+	if k.config.quarantineThreshold == 0 {
+		return false
+	}
+	cutoff := now.Add(-k.config.quarantineWindow)
+	recent := k.ownershipLosses[:0]
+	for _, t := range k.ownershipLosses {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	k.ownershipLosses = append(recent, now)
+	return len(k.ownershipLosses) >= k.config.quarantineThreshold
+}
+
+// quarantine gives up our identity after we repeatedly lost checkpoints to other clients: we stop
+// being the leader, deregister, and pick a new client ID. Consumers must be stopped beforehand.
+func (k *Kinsumer) quarantine() {
+	oldID := k.clientID()
+	// The leader resigns and the heartbeat registers with the ID they read, so they are stopped
+	// before it changes
+	k.unbecomeLeader()
+	k.stopHeartbeat()
+	defer k.startHeartbeat()
+	if err := deregisterFromClientsTable(k.dynamodb, oldID, k.clientsTableName); err != nil {
+		k.logf(LevelWarn, "quarantine", "", "Error deregistering quarantined client %s: %s", oldID, err)
+	} else {
+		k.clientsChanged()
+	}
+
+	k.setClientID(uuid.New().String())
+	// Forget the previous assignment so it is recomputed from scratch
+	k.shardIDs = nil
+	k.totalClients = 0
+	k.thisClient = 0
+	k.clientZones = nil
+
+	k.logf(LevelWarn, "quarantine", "", "Quarantined client %s (%s) after %d checkpoint commits were lost to other clients "+
+		"within %s, re-registered as %s", oldID, k.clientName, len(k.ownershipLosses), k.config.quarantineWindow, k.clientID())
+	k.ownershipLosses = nil
+}
+
+// clientID returns the identifier of our client, it can be read from any go routine
+func (k *Kinsumer) clientID() string {
+	id, _ := k.id.Load().(string)
+	return id
+}
+
+// setClientID changes the identifier of our client
+func (k *Kinsumer) setClientID(id string) {
+	k.id.Store(id)
+}
+
+// requestRefresh asks the main loop to refresh the shards without waiting for the next shard check
+func (k *Kinsumer) requestRefresh() {
+	select {
+	case k.refreshRequested <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+}
+
+// stopping returns the channel closed when the consumers stop, for the go routines that may run
+// while they are started
+func (k *Kinsumer) stopping() <-chan struct{} {
+	k.stopMutex.Lock()
+	defer k.stopMutex.Unlock()
+	return k.stop
+}
+
+// shutdownExpired returns the channel closed once the consumers have been stopped for as long as our
+// client record lasts, for the writes retried while we shut down, as they include the final commits,
+// the release of our shards and our deregistration
+func (k *Kinsumer) shutdownExpired() <-chan struct{} {
+	k.stopMutex.Lock()
+	defer k.stopMutex.Unlock()
+	return k.shutdownDeadline
+}
+
 // startConsumers launches a shard consumer for each shard we should own
 // TODO: Can we unit test this at all?
 func (k *Kinsumer) startConsumers() error {
+	k.stopMutex.Lock()
 	k.stop = make(chan struct{})
-	assigned := false
+	k.shutdownDeadline = make(chan struct{})
+	k.stopMutex.Unlock()
 
-	if k.thisClient >= len(k.shardIDs) {
-		return nil
+	if k.spill != nil {
+		k.waitGroup.Add(1)
+		go k.feedSpilledRecords()
 	}
 
-	for i, shard := range k.shardIDs {
-		if (i % k.totalClients) == k.thisClient {
-			k.waitGroup.Add(1)
-			assigned = true
-			go k.consume(shard)
-		}
+	shards := k.assignedShards()
+	k.health.assign(len(shards), time.Now())
+	if k.shardBuffers != nil {
+		k.shardBuffers.reset(shards)
+		k.waitGroup.Add(1)
+		go k.mergeShardBuffers()
 	}
-	if len(k.shardIDs) != 0 && !assigned {
+	for _, shard := range shards {
+		k.waitGroup.Add(1)
+		// The consumers get the parents when they start, as refreshShards replaces the map while they run
+		go k.consume(shard, k.shardParents[shard])
+	}
+	// With more clients than shards the last ones have nothing to do, and the zoned strategies can
+	// leave clients idle in zones with more clients than shards
+	if k.thisClient < len(k.shardIDs) && !k.config.assignmentStrategy.zoned() && len(shards) == 0 {
 		return ErrNoShardsAssigned
 	}
 	return nil
 }
 
+// assignedShards returns the shards assigned to this client
+func (k *Kinsumer) assignedShards() []string {
+	var shards []string
+	zones := k.clientZones
+	if len(zones) != k.totalClients {
+		// Zones aren't known, like in tests setting the clients directly
+		zones = make([]string, k.totalClients)
+	}
+	for i, shard := range k.shardIDs {
+		if k.config.assignmentStrategy.zonedShardOwner(i, len(k.shardIDs), zones) == k.thisClient {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
 // stopConsumers stops all our shard consumers
 func (k *Kinsumer) stopConsumers() {
 	close(k.stop)
+	deadline := k.shutdownDeadline
+	time.AfterFunc(k.maxAgeForClientRecord, func() { close(deadline) })
 	k.waitGroup.Wait()
+	// Shards read after they were reassigned don't tell how much restarting cost
+	k.publishRecovery(k.recovery.cut())
 DrainLoop:
 	for {
 		select {
-		case <-k.records:
+		case cr := <-k.records:
+			cr.trace.log(k.config.logger, "discarded when the consumers were stopped", time.Now())
 		default:
 			break DrainLoop
 		}
 	}
+	if k.spill != nil {
+		k.spill.reset()
+	}
+	if k.shardBuffers != nil {
+		k.shardBuffers.drain(func(cr *consumedRecord) {
+			cr.trace.log(k.config.logger, "discarded when the consumers were stopped", time.Now())
+		})
+	}
+	atomic.StoreInt64(&k.bufferedBytes, 0)
+	k.redeliveries.reset()
+	if k.merger != nil {
+		k.merger.reset()
+	}
 }
 
 // dynamoTableActive returns an error if the given table is not ACTIVE
@@ -258,12 +598,21 @@ func (k *Kinsumer) dynamoTableExists(name string) bool {
 }
 
 // dynamoCreateTableIfNotExists creates a table with the given name and distKey
-// if it doesn't exist and will wait until it is created
-func (k *Kinsumer) dynamoCreateTableIfNotExists(name, distKey string) error {
+// if it doesn't exist and will wait until it is created. If withStream is true
+// and we were configured to follow the table streams, the table is created with a stream.
+func (k *Kinsumer) dynamoCreateTableIfNotExists(name, distKey string, withStream bool) error {
 	if k.dynamoTableExists(name) {
 		return nil
 	}
 
+	var streamSpecification *dynamodb.StreamSpecification
+	if withStream && k.config.tableStreamsPollFrequency > 0 {
+		streamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeKeysOnly),
+		}
+	}
+
 	_, err := k.dynamodb.CreateTable(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []*dynamodb.AttributeDefinition{{
 			AttributeName: aws.String(distKey),
@@ -277,7 +626,8 @@ func (k *Kinsumer) dynamoCreateTableIfNotExists(name, distKey string) error {
 			ReadCapacityUnits:  aws.Int64(k.config.dynamoReadCapacity),
 			WriteCapacityUnits: aws.Int64(k.config.dynamoWriteCapacity),
 		},
-		TableName: aws.String(name),
+		StreamSpecification: streamSpecification,
+		TableName:           aws.String(name),
 	})
 	if err != nil {
 		return err
@@ -316,14 +666,14 @@ func (k *Kinsumer) dynamoDeleteTableIfExists(name string) error {
 
 // kinesisStreamReady returns an error if the given stream is not ACTIVE
 func (k *Kinsumer) kinesisStreamReady() error {
-	out, err := k.kinesis.DescribeStream(&kinesis.DescribeStreamInput{
+	out, err := k.kinesis.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
 		StreamName: aws.String(k.streamName),
 	})
 	if err != nil {
 		return fmt.Errorf("error describing stream %s: %v", k.streamName, err)
 	}
 
-	status := aws.StringValue(out.StreamDescription.StreamStatus)
+	status := aws.StringValue(out.StreamDescriptionSummary.StreamStatus)
 	if status != "ACTIVE" && status != "UPDATING" {
 		return fmt.Errorf("stream %s exists but state '%s' is not 'ACTIVE' or 'UPDATING'", k.streamName, status)
 	}
@@ -334,7 +684,7 @@ func (k *Kinsumer) kinesisStreamReady() error {
 // Run runs the main kinesis consumer process. This is a non-blocking call, use Stop() to force it to return.
 // This goroutine is responsible for startin/stopping consumers, aggregating all consumers' records,
 // updating checkpointers as records are consumed, and refreshing our shard/client list and leadership
-//TODO: Can we unit test this at all?
+// TODO: Can we unit test this at all?
 func (k *Kinsumer) Run() error {
 	if err := k.dynamoTableActive(k.checkpointTableName); err != nil {
 		return err
@@ -342,6 +692,16 @@ func (k *Kinsumer) Run() error {
 	if err := k.dynamoTableActive(k.clientsTableName); err != nil {
 		return err
 	}
+	if k.config.deduplicationWindow > 0 {
+		if err := k.dynamoTableActive(k.dedupTableName); err != nil {
+			return err
+		}
+	}
+	if k.failover != nil {
+		if _, err := k.refreshStreamEndpoint(); err != nil {
+			return err
+		}
+	}
 	if err := k.kinesisStreamReady(); err != nil {
 		return err
 	}
@@ -350,26 +710,41 @@ func (k *Kinsumer) Run() error {
 	if !allowRun {
 		return ErrRunTwice
 	}
+	k.startedAt = time.Now()
+	if err := k.startRun(k.startedAt); err != nil {
+		return err
+	}
+	if k.config.shardIteratorType == kinesis.ShardIteratorTypeAtTimestamp && k.config.atTimestamp == nil {
+		atTimestamp := k.startedAt.Add(-k.config.atAge)
+		k.config.atTimestamp = &atTimestamp
+	}
 
 	if _, err := k.refreshShards(); err != nil {
-		deregErr := deregisterFromClientsTable(k.dynamodb, k.clientID, k.clientsTableName)
+		deregErr := deregisterFromClientsTable(k.dynamodb, k.clientID(), k.clientsTableName)
 		if deregErr != nil {
 			return fmt.Errorf("error in kinsumer Run initial refreshShards: (%v); "+
 				"error deregistering from clients table: (%v)", err, deregErr)
 		}
 		return fmt.Errorf("error in kinsumer Run initial refreshShards: %v", err)
 	}
+	k.recovery.start(k.startedAt, k.assignedShards())
 
 	k.mainWG.Add(1)
 	go func() {
 		defer k.mainWG.Done()
+		defer k.recoverPanic("run", "")
+		k.health.setRunning(true, time.Now())
+		defer k.health.setRunning(false, time.Now())
 
 		defer func() {
 			// Deregister is a nice to have but clients also time out if they
-			// fail to deregister, so ignore error here.
-			err := deregisterFromClientsTable(k.dynamodb, k.clientID, k.clientsTableName)
+			// fail to deregister, so ignore error here. The heartbeat was stopped and
+			// joined before, so it can't register us again.
+			err := deregisterFromClientsTable(k.dynamodb, k.clientID(), k.clientsTableName)
 			if err != nil {
-				k.errors <- fmt.Errorf("error deregistering client: %s", err)
+				k.reportError("deregisterClient", "", fmt.Errorf("error deregistering client: %s", err))
+			} else {
+				k.clientsChanged()
 			}
 			k.unbecomeLeader()
 			// Do this outside the k.isLeader check in case k.isLeader was false because
@@ -387,51 +762,177 @@ func (k *Kinsumer) Run() error {
 		}()
 
 		var record *consumedRecord
+		// limiter limits the records returned to the application when we have a rate limit or pace the
+		// delivery. limited is the last record accounted for by the limiter, and deliverAt when it can
+		// be handed out.
+		limiter := newRateLimiter(k.config.recordsPerSecond, k.config.bytesPerSecond)
+		if k.config.pacingBytesPerSecond > 0 {
+			if limiter == nil {
+				limiter = &rateLimiter{}
+			}
+			limiter.pacing = newPacingBucket(k.config.pacingBytesPerSecond)
+		}
+		var limited *consumedRecord
+		var deliverAt time.Time
+
+		// refresh restarts the consumers if the shards or clients changed
+		refresh := func() {
+			changed, err := k.refreshShards()
+			if err != nil {
+				k.reportError("refreshShards", "", fmt.Errorf("error refreshing shards: %s", err))
+			} else if changed {
+				shardChangeTicker.Stop()
+				k.stopConsumers()
+				record = nil
+				if err := k.startConsumers(); err != nil {
+					k.reportError("startConsumers", "", fmt.Errorf("error restarting consumers: %s", err))
+				}
+				// We create a new shardChangeTicker here so that the time it takes to stop and
+				// start the consumers is not included in the wait for the next tick.
+				shardChangeTicker = time.NewTicker(k.config.shardCheckFrequency)
+			}
+		}
+
+		// resize pauses the shard workers if the size of the records buffer was changed, the buffer is
+		// replaced once it holds no more records than the new one
+		var resizing bool
+		resize := func() {
+			if !resizing && k.live.getBufferSize() != cap(k.records) {
+				k.pauseBuffer()
+				resizing = true
+			}
+		}
+
+		// quarantine drops all our shards and starts over with a new identity
+		quarantine := func() {
+			shardChangeTicker.Stop()
+			k.stopConsumers()
+			record = nil
+			k.quarantine()
+			if _, err := k.refreshShards(); err != nil {
+				k.reportError("refreshShards", "", fmt.Errorf("error refreshing shards after quarantine: %s", err))
+			}
+			if err := k.startConsumers(); err != nil {
+				k.reportError("startConsumers", "", fmt.Errorf("error restarting consumers after quarantine: %s", err))
+			}
+			shardChangeTicker = time.NewTicker(k.config.shardCheckFrequency)
+		}
+
+		if k.config.tableStreamsPollFrequency > 0 {
+			watchStop := make(chan struct{})
+			defer close(watchStop)
+			go k.watchTables(watchStop)
+		}
+
+		monitorStop := make(chan struct{})
+		defer close(monitorStop)
+		go k.monitorBuffer(monitorStop)
+
+		if k.config.shardDiscoveryFrequency > 0 {
+			discoveryStop := make(chan struct{})
+			defer close(discoveryStop)
+			go k.discoverShards(discoveryStop)
+		}
+
+		k.startHeartbeat()
+		defer k.stopHeartbeat()
+
+		if k.spill != nil {
+			defer k.spill.close()
+		}
+		k.resizeBuffer()
 		if err := k.startConsumers(); err != nil {
-			k.errors <- fmt.Errorf("error starting consumers: %s", err)
+			k.reportError("startConsumers", "", fmt.Errorf("error starting consumers: %s", err))
 		}
 		defer k.stopConsumers()
 
 		for {
+			if resizing && k.replaceBuffer() {
+				resizing = false
+			}
+
 			var (
 				input  chan *consumedRecord
 				output chan *consumedRecord
+				// wait is how long until the next nacked or merged record is due, or the rate limit lets
+				// the record through, 0 if we aren't waiting for anything
+				wait time.Duration
+				due  <-chan time.Time
 			)
 
+			// Nacked records due for redelivery go first, then records held for arrival ordering
+			if record == nil {
+				record, wait = k.redeliveries.pop(time.Now())
+			}
+			if record == nil && k.merger != nil {
+				var mergeWait time.Duration
+				record, mergeWait = k.merger.pop(time.Now())
+				if record != nil {
+					record.previous = record.checkpointer.currentSequenceNumber()
+				} else if mergeWait > 0 && (wait == 0 || mergeWait < wait) {
+					wait = mergeWait
+				}
+			}
+			// Hold the record back until the rate limit lets it through
+			ready := record != nil
+			if record != nil && limiter != nil {
+				now := time.Now()
+				if limited != record {
+					limited = record
+					deliverAt = now.Add(limiter.take(now, len(record.record.Data)))
+				}
+				if deliverAt.After(now) {
+					ready = false
+					wait = deliverAt.Sub(now)
+				}
+			}
+			if wait > 0 {
+				due = time.After(wait)
+			}
+
 			// We only want to be handing one record from the consumers
 			// to the user of kinsumer at a time. We do this by only reading
 			// one record off the records queue if we do not already have a
-			// record to give away
-			if record != nil {
+			// record to give away, or the merger is not full when ordering by arrival
+			if ready {
 				output = k.output
-			} else {
+			}
+			if k.merger != nil {
+				if !k.merger.full() {
+					input = k.records
+				}
+			} else if record == nil {
 				input = k.records
 			}
 
 			select {
 			case <-k.stoprequest:
 				return
-			case record = <-input:
+			case cr := <-input:
+				if k.merger != nil {
+					k.merger.push(cr)
+				} else {
+					record = cr
+					record.previous = record.checkpointer.currentSequenceNumber()
+				}
 			case output <- record:
-				record.checkpointer.update(aws.StringValue(record.record.SequenceNumber))
+				k.health.delivered(time.Now())
+				k.unbuffered(record)
+				k.returned(record)
 				record = nil
 			case se := <-k.shardErrors:
-				k.errors <- fmt.Errorf("shard error (%s) in %s: %s", se.shardID, se.action, se.err)
-			case <-shardChangeTicker.C:
-				changed, err := k.refreshShards()
-				if err != nil {
-					k.errors <- fmt.Errorf("error refreshing shards: %s", err)
-				} else if changed {
-					shardChangeTicker.Stop()
-					k.stopConsumers()
-					record = nil
-					if err := k.startConsumers(); err != nil {
-						k.errors <- fmt.Errorf("error restarting consumers: %s", err)
-					}
-					// We create a new shardChangeTicker here so that the time it takes to stop and
-					// start the consumers is not included in the wait for the next tick.
-					shardChangeTicker = time.NewTicker(k.config.shardCheckFrequency)
+				k.reportError(se.action, se.shardID, fmt.Errorf("shard error (%s) in %s: %s", se.shardID, se.action, se.err))
+				if se.err == ErrCheckpointOwnershipLost && k.shouldQuarantine(time.Now()) {
+					quarantine()
 				}
+			case <-shardChangeTicker.C:
+				refresh()
+			case <-k.refreshRequested:
+				refresh()
+			case <-k.configUpdated:
+				resize()
+			case <-due:
+			case <-k.redeliveries.wake:
 			}
 		}
 	}()
@@ -439,8 +940,33 @@ func (k *Kinsumer) Run() error {
 	return nil
 }
 
+// returned moves the checkpoint of the shard of a record handed to NextRecord past it, or holds it
+// there until Dispatch handled the record
+func (k *Kinsumer) returned(record *consumedRecord) {
+	if k.isDispatching() {
+		// Held until Dispatch handled the record, a redelivered record is still held
+		if !record.redelivered {
+			record.checkpointer.updateHeld(aws.StringValue(record.record.SequenceNumber), record.previous)
+		}
+		record.trace.log(k.config.logger, "returned", time.Now())
+	} else if record.redelivered {
+		// The checkpoint was updated when the record was first delivered, it can
+		// move past it again
+		record.checkpointer.unhold(aws.StringValue(record.record.SequenceNumber))
+		record.trace.log(k.config.logger, "acked", time.Now())
+	} else if k.config.transactionalCheckpoints {
+		// The checkpoint moves when the application commits a transaction
+		record.trace.log(k.config.logger, "returned", time.Now())
+	} else if record.trace != nil {
+		record.checkpointer.updateTraced(aws.StringValue(record.record.SequenceNumber), record.trace)
+		record.trace.log(k.config.logger, "acked", time.Now())
+	} else {
+		record.checkpointer.update(aws.StringValue(record.record.SequenceNumber))
+	}
+}
+
 // Stop stops the consumption of kinesis events
-//TODO: Can we unit test this at all?
+// TODO: Can we unit test this at all?
 func (k *Kinsumer) Stop() {
 	k.stoprequest <- true
 	k.mainWG.Wait()
@@ -452,17 +978,137 @@ func (k *Kinsumer) Stop() {
 // if err is non nil an error occurred in the system.
 // if err is nil and data is nil then kinsumer has been stopped
 func (k *Kinsumer) Next() (data []byte, err error) {
-	select {
-	case err = <-k.errors:
-		return nil, err
-	case record, ok := <-k.output:
-		if ok {
-			k.config.stats.EventToClient(*record.record.ApproximateArrivalTimestamp, record.retrievedAt)
-			data = record.record.Data
+	record, err := k.NextRecord()
+	if record != nil {
+		data = record.Data
+	}
+	return data, err
+}
+
+// NextRecord is like Next, but returns the record along with the shard it was read from. It can't be
+// called while Dispatch runs, only once it returned.
+//
+// if err is non nil an error occurred in the system.
+// if err is nil and record is nil then kinsumer has been stopped
+func (k *Kinsumer) NextRecord() (record *Record, err error) {
+	return k.nextRecord(nil)
+}
+
+// nextRecord is NextRecord returning no record once stop is closed
+func (k *Kinsumer) nextRecord(stop <-chan struct{}) (record *Record, err error) {
+	for {
+		select {
+		case <-stop:
+			return nil, nil
+		case err = <-k.errors:
+			return nil, err
+		case cr, ok := <-k.output:
+			if !ok {
+				return nil, nil
+			}
+			k.config.stats.EventToClient(*cr.record.ApproximateArrivalTimestamp, cr.retrievedAt)
+			record = newRecord(cr.checkpointer.shardID, cr.record)
+			record.consumed = cr
+			if cr.trace != nil {
+				record.DeliveryID = cr.trace.id
+				cr.trace.log(k.config.logger, "delivered", time.Now())
+			}
+		}
+
+		// Nacked records are meant to be returned again
+		if k.config.deduplicationWindow > 0 && !record.consumed.redelivered && k.processedBefore(record) {
+			record.consumed.trace.log(k.config.logger, "deduplicated", time.Now())
+			// Held when dispatching
+			record.consumed.checkpointer.unhold(record.SequenceNumber)
+			continue
+		}
+		if k.config.recordHook == nil {
+			return record, nil
+		}
+		hookErr := k.config.recordHook(record)
+		if hookErr == nil {
+			return record, nil
+		}
+		// Not returning the record, try it again later or give up on it
+		if err := k.failRecord(record, k.config.recordHookRetryDelay, hookErr); err != nil {
+			k.logf(LevelError, "recordHook", record.ShardID, "Dropping record %s of shard %s which failed the record hook: %s",
+				record.SequenceNumber, record.ShardID, err)
 		}
 	}
+}
 
-	return data, err
+// SetCheckpointMetadata attaches an opaque blob to the checkpoint of the given shard. It is written
+// along with the next checkpoint commit, so it should describe the application's state as of the
+// last record returned for that shard. The blob is handed back to the ShardCaptureHook whenever the
+// shard is captured again, by this or any other client. Returns ErrShardNotOwned if this client
+// does not currently own the shard.
+func (k *Kinsumer) SetCheckpointMetadata(shardID string, metadata []byte) error {
+	if len(metadata) > maxCheckpointMetadataSize {
+		return ErrCheckpointMetadataTooLarge
+	}
+	cp := k.ownedCheckpointer(shardID)
+	if cp == nil {
+		return ErrShardNotOwned
+	}
+	cp.setMetadata(metadata)
+	return nil
+}
+
+// CommitNow writes the checkpoints of all the shards we own that changed since they were last written,
+// without waiting for the commit frequency. It is meant to be called before a planned shutdown or a
+// long downstream flush, so fewer records are processed again on restart. The checkpoints hold the
+// records returned so far, the same as the periodic commits. Returns the first error encountered,
+// the other checkpoints are written regardless.
+func (k *Kinsumer) CommitNow() error {
+	k.checkpointersMutex.Lock()
+	owned := make([]*checkpointer, 0, len(k.checkpointers))
+	for _, cp := range k.checkpointers {
+		owned = append(owned, cp)
+	}
+	k.checkpointersMutex.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(owned))
+	for i, cp := range owned {
+		wg.Add(1)
+		go func(i int, cp *checkpointer) {
+			defer wg.Done()
+			if _, err := cp.commit(); err != nil {
+				errs[i] = fmt.Errorf("error committing the checkpoint of shard %s: %w", cp.shardID, err)
+			}
+		}(i, cp)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedCheckpointer returns the checkpointer of the given shard, or nil if we don't own it
+func (k *Kinsumer) ownedCheckpointer(shardID string) *checkpointer {
+	k.checkpointersMutex.Lock()
+	defer k.checkpointersMutex.Unlock()
+	return k.checkpointers[shardID]
+}
+
+// setOwnedCheckpointer records the checkpointer of a shard we captured, or forgets it if cp is nil
+func (k *Kinsumer) setOwnedCheckpointer(shardID string, cp *checkpointer) {
+	k.checkpointersMutex.Lock()
+	defer k.checkpointersMutex.Unlock()
+	if cp == nil {
+		delete(k.checkpointers, shardID)
+	} else {
+		k.checkpointers[shardID] = cp
+	}
+}
+
+// KeyStats returns the throughput per key observed since Run() was called. It is
+// always empty unless a KeyExtractor was set with Config.WithKeyExtractor.
+func (k *Kinsumer) KeyStats() map[string]KeyStats {
+	return k.keyStats.snapshot()
 }
 
 // CreateRequiredTables will create the required dynamodb tables
@@ -471,14 +1117,17 @@ func (k *Kinsumer) CreateRequiredTables() error {
 	g := &errgroup.Group{}
 
 	g.Go(func() error {
-		return k.dynamoCreateTableIfNotExists(k.clientsTableName, "ID")
+		return k.dynamoCreateTableIfNotExists(k.clientsTableName, "ID", true)
 	})
 	g.Go(func() error {
-		return k.dynamoCreateTableIfNotExists(k.checkpointTableName, "Shard")
+		return k.dynamoCreateTableIfNotExists(k.checkpointTableName, "Shard", false)
 	})
 	g.Go(func() error {
-		return k.dynamoCreateTableIfNotExists(k.metadataTableName, "Key")
+		return k.dynamoCreateTableIfNotExists(k.metadataTableName, "Key", true)
 	})
+	if k.config.deduplicationWindow > 0 {
+		g.Go(k.createDeduplicationTable)
+	}
 
 	return g.Wait()
 }
@@ -497,6 +1146,9 @@ func (k *Kinsumer) DeleteTables() error {
 	g.Go(func() error {
 		return k.dynamoDeleteTableIfExists(k.metadataTableName)
 	})
+	g.Go(func() error {
+		return k.dynamoDeleteTableIfExists(k.dedupTableName)
+	})
 
 	return g.Wait()
 }
@@ -2,6 +2,7 @@
 package kinsumer
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -19,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -366,6 +368,8 @@ func TestLeader(t *testing.T) {
 	config := NewConfig().WithBufferSize(numberOfEventsToTest)
 	config = config.WithShardCheckFrequency(500 * time.Millisecond)
 	config = config.WithLeaderActionFrequency(500 * time.Millisecond)
+	// The first client by ID is the leader
+	config = config.WithFirstClientLeader()
 
 	for i := 0; i < numberOfClients; i++ {
 		if i > 0 {
@@ -374,7 +378,7 @@ func TestLeader(t *testing.T) {
 
 		clients[i], err = NewWithInterfaces(k, d, *streamName, *applicationName, fmt.Sprintf("test_%d", i), config)
 		require.NoError(t, err, "NewWithInterfaces() failed")
-		clients[i].clientID = strconv.Itoa(i + 1)
+		clients[i].setClientID(strconv.Itoa(i + 1))
 
 		err = clients[i].Run()
 		require.NoError(t, err, "kinsumer.Run() failed")
@@ -419,7 +423,7 @@ func TestLeader(t *testing.T) {
 
 	c, err := NewWithInterfaces(k, d, *streamName, *applicationName, fmt.Sprintf("_test_%d", numberOfClients), config)
 	require.NoError(t, err, "NewWithInterfaces() failed")
-	c.clientID = "0"
+	c.setClientID("0")
 	err = c.Run()
 	require.NoError(t, err, "kinsumer.Run() failed")
 	require.Equal(t, true, c.isLeader, "New client is not leader")
@@ -476,7 +480,7 @@ func TestSplit(t *testing.T) {
 
 		clients[i], err = NewWithInterfaces(k, d, *streamName, *applicationName, fmt.Sprintf("test_%d", i), config)
 		require.NoError(t, err, "NewWithInterfaces() failed")
-		clients[i].clientID = strconv.Itoa(i + 1)
+		clients[i].setClientID(strconv.Itoa(i + 1))
 
 		err = clients[i].Run()
 		require.NoError(t, err, "kinsumer.Run() failed")
@@ -615,3 +619,107 @@ ProcessLoop:
 
 	t.Logf("Got all %d out of %d events\n", total, numberOfEventsToTest)
 }
+
+func TestShouldQuarantine(t *testing.T) {
+	k := &Kinsumer{config: NewConfig().WithQuarantine(3, time.Minute)}
+	now := time.Now()
+
+	require.False(t, k.shouldQuarantine(now.Add(-2*time.Minute)))
+	require.False(t, k.shouldQuarantine(now.Add(-30*time.Second)))
+	// The first loss is out of the window by now
+	require.False(t, k.shouldQuarantine(now))
+	require.True(t, k.shouldQuarantine(now))
+
+	k = &Kinsumer{config: NewConfig().WithQuarantine(0, time.Minute)}
+	for i := 0; i < 5; i++ {
+		require.False(t, k.shouldQuarantine(now))
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	db := &clientsDynamo{
+		DynamoDBAPI: mocks.NewMockDynamo(nil),
+		clients:     make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+	config := NewConfig().WithHeartbeatFrequency(time.Millisecond).WithQuarantine(1, time.Minute)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+	oldID := k.clientID()
+
+	k.startHeartbeat()
+	time.Sleep(5 * time.Millisecond)
+	// The heartbeat doesn't register the old ID again once it is deregistered
+	k.quarantine()
+	time.Sleep(5 * time.Millisecond)
+	k.stopHeartbeat()
+
+	require.NotEqual(t, oldID, k.clientID())
+	clients, err := getClients(db, "client", "app_clients", k.maxAgeForClientRecord)
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, k.clientID(), clients[0].ID)
+}
+
+func TestUpdateConfig(t *testing.T) {
+	config := NewConfig()
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(k.UpdateConfig(LiveConfig{BufferSize: -1}), ErrConfigInvalidBufferSize))
+
+	err = k.UpdateConfig(LiveConfig{
+		ThrottleDelay:   time.Second,
+		CommitFrequency: time.Minute,
+		GetRecordsLimit: 500,
+		BufferSize:      10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, k.live.getThrottleDelay())
+	require.Equal(t, time.Minute, k.live.getCommitFrequency())
+	require.Equal(t, int64(500), k.live.getGetRecordsLimit())
+
+	// The settings left out are unchanged
+	require.NoError(t, k.UpdateConfig(LiveConfig{GetRecordsLimit: 100}))
+	require.Equal(t, time.Second, k.live.getThrottleDelay())
+	require.Equal(t, int64(100), k.live.getGetRecordsLimit())
+
+	require.True(t, k.resizeBuffer())
+	require.Equal(t, 10, cap(k.records))
+	require.False(t, k.resizeBuffer())
+}
+
+func TestReplaceBuffer(t *testing.T) {
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client",
+		NewConfig().WithBufferSize(2))
+	require.NoError(t, err)
+	k.stop = make(chan struct{})
+	k.records <- testConsumedRecord("1")
+	k.records <- testConsumedRecord("2")
+
+	// A shard worker waits for room in the full buffer
+	commitTicker := time.NewTicker(time.Hour)
+	defer commitTicker.Stop()
+	buffered := make(chan bool)
+	go func() {
+		buffered <- k.bufferRecord(testConsumedRecord("3"), commitTicker, &backoff{policy: k.config.throttleBackoff})
+	}()
+
+	// The smaller buffer replaces the paused one once the records that don't fit were taken
+	require.NoError(t, k.UpdateConfig(LiveConfig{BufferSize: 1}))
+	k.pauseBuffer()
+	require.False(t, k.replaceBuffer())
+	require.Equal(t, "1", aws.StringValue((<-k.records).record.SequenceNumber))
+	require.True(t, k.replaceBuffer())
+	require.Equal(t, 1, cap(k.records))
+
+	// The worker goes on with the new buffer, keeping the records in order
+	require.Equal(t, "2", aws.StringValue((<-k.records).record.SequenceNumber))
+	require.Equal(t, "3", aws.StringValue((<-k.records).record.SequenceNumber))
+	require.True(t, <-buffered)
+
+	require.NoError(t, k.UpdateConfig(LiveConfig{BufferSize: 4}))
+	k.pauseBuffer()
+	require.True(t, k.replaceBuffer())
+	require.Equal(t, 4, cap(k.records))
+	require.Equal(t, 4, cap(k.health.records))
+}
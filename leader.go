@@ -5,6 +5,7 @@ package kinsumer
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,11 +28,65 @@ type shardCacheRecord struct {
 	ShardIDs   []string // Slice of unfinished shard IDs
 	LastUpdate int64    // timestamp of last update
 
+	// Parents of each shard in ShardIDs that still exist in the stream. A shard
+	// is only consumed once all its parents are finished.
+	ShardParents map[string][]string
+
+	// Number of failovers of the stream the shards are of, with stream failover
+	Failovers int64 `dynamodbav:",omitempty"`
+
 	// Debug versions of LastUpdate
 	LastUpdateRFC string
 }
 
-// becomeLeader starts the leadership goroutine with a channel to stop it.
+// ReshardEvent describes a change of the shards of the stream, as detected by the leader
+type ReshardEvent struct {
+	PreviousShardIDs []string            // shards that were consumed before the change, sorted
+	ShardIDs         []string            // shards consumed after the change, sorted
+	Added            []string            // shards of ShardIDs that weren't in PreviousShardIDs
+	Removed          []string            // shards of PreviousShardIDs that are finished or gone from the stream
+	ShardParents     map[string][]string // parents of each shard of ShardIDs that still exist in the stream
+}
+
+// A ReshardHook is called by the leader every time it detects that the shards of the stream changed.
+// It is called on a single client only, from the leader go routine.
+type ReshardHook func(event ReshardEvent)
+
+// newReshardEvent returns the event for the shards changing from previous to current, or nil if
+// they didn't change. The first shards cached aren't a change.
+func newReshardEvent(previous, current []string, parents map[string][]string) *ReshardEvent {
+	if len(previous) == 0 {
+		return nil
+	}
+	event := &ReshardEvent{
+		PreviousShardIDs: previous,
+		ShardIDs:         current,
+		ShardParents:     parents,
+	}
+	before := make(map[string]bool, len(previous))
+	for _, s := range previous {
+		before[s] = true
+	}
+	for _, s := range current {
+		if before[s] {
+			delete(before, s)
+		} else {
+			event.Added = append(event.Added, s)
+		}
+	}
+	for _, s := range previous {
+		if before[s] {
+			event.Removed = append(event.Removed, s)
+		}
+	}
+	if len(event.Added) == 0 && len(event.Removed) == 0 {
+		return nil
+	}
+	return event
+}
+
+// becomeLeader starts the leadership goroutine with a channel to stop it. It runs the leader actions
+// while the LeaderElector elects us.
 // TODO(dwe): Factor out dependencies and unit test
 func (k *Kinsumer) becomeLeader() {
 	if k.isLeader {
@@ -41,39 +96,48 @@ func (k *Kinsumer) becomeLeader() {
 	k.leaderWG.Add(1)
 	go func() {
 		defer k.leaderWG.Done()
+		defer k.recoverPanic("leader", "")
+		leaderBackoff := &backoff{policy: k.config.throttleBackoff}
 		leaderActions := time.NewTicker(k.config.leaderActionFrequency)
 		defer func() {
 			leaderActions.Stop()
-			err := k.deregisterLeadership()
+			err := k.leaderElector.Resign(k.clientID())
+			k.setLeaderToken(0)
 			if err != nil {
-				k.errors <- fmt.Errorf("error deregistering leadership: %v", err)
+				k.reportError("deregisterLeadership", "", fmt.Errorf("error deregistering leadership: %v", err))
 			}
 		}()
-		ok, err := k.registerLeadership()
-		if err != nil {
-			k.errors <- fmt.Errorf("error registering initial leadership: %v", err)
+		ok, err := k.elect()
+		if err != nil && !k.leaderThrottled("registerLeadership", err, leaderBackoff) {
+			k.reportError("registerLeadership", "", fmt.Errorf("error registering initial leadership: %v", err))
 		}
 		// Perform leadership actions immediately if we became leader. If we didn't
 		// become leader yet, wait until the first tick to try again.
 		if ok {
 			err = k.performLeaderActions()
-			if err != nil {
-				k.errors <- fmt.Errorf("error performing initial leader actions: %v", err)
+			if err != nil && !k.leaderThrottled("leaderActions", err, leaderBackoff) {
+				k.reportError("leaderActions", "", fmt.Errorf("error performing initial leader actions: %v", err))
 			}
 		}
 		for {
 			select {
 			case <-leaderActions.C:
-				ok, err := k.registerLeadership()
-				if err != nil {
-					k.errors <- fmt.Errorf("error registering leadership: %v", err)
+				// Skip the ticks until we are done backing off after a throttled request
+				if !leaderBackoff.ready(time.Now()) {
+					continue
+				}
+				ok, err := k.elect()
+				if err != nil && !k.leaderThrottled("registerLeadership", err, leaderBackoff) {
+					k.reportError("registerLeadership", "", fmt.Errorf("error registering leadership: %v", err))
 				}
 				if !ok {
 					continue
 				}
 				err = k.performLeaderActions()
-				if err != nil {
-					k.errors <- fmt.Errorf("error performing repeated leader actions: %v", err)
+				if err == nil {
+					leaderBackoff.reset()
+				} else if !k.leaderThrottled("leaderActions", err, leaderBackoff) {
+					k.reportError("leaderActions", "", fmt.Errorf("error performing repeated leader actions: %v", err))
 				}
 			case <-k.leaderLost:
 				return
@@ -83,13 +147,23 @@ func (k *Kinsumer) becomeLeader() {
 	k.isLeader = true
 }
 
+// leaderThrottled returns whether the error of a leader operation means it was throttled, backing
+// off the following leader actions if it was
+func (k *Kinsumer) leaderThrottled(operation string, err error, leaderBackoff *backoff) bool {
+	if !isThrottle(err) {
+		return false
+	}
+	k.throttled(operation, "", leaderBackoff.throttled(time.Now()))
+	return true
+}
+
 // unbecomeLeader stops the leadership goroutine.
 func (k *Kinsumer) unbecomeLeader() {
 	if !k.isLeader {
 		return
 	}
 	if k.leaderLost == nil {
-		k.config.logger.Log("Lost leadership but k.leaderLost was nil")
+		k.logf(LevelWarn, "unbecomeLeader", "", "Lost leadership but k.leaderLost was nil")
 	} else {
 		close(k.leaderLost)
 		k.leaderWG.Wait()
@@ -98,68 +172,293 @@ func (k *Kinsumer) unbecomeLeader() {
 	k.isLeader = false
 }
 
-// performLeaderActions updates the shard ID cache and reaps old clients
+// performLeaderActions advances the table migration, manages the stream consumer, checks for expired
+// clients, updates the shard ID cache, reaps old clients, compacts the checkpoints and advises on
+// scaling the stream
 // TODO(dwe): Factor out dependencies and unit test
 func (k *Kinsumer) performLeaderActions() error {
+	if err := k.advanceMigration(); err != nil {
+		return fmt.Errorf("error advancing table migration: %w", err)
+	}
+
+	if k.config.fanOutConsumer != "" {
+		if err := k.manageFanOutConsumer(); err != nil {
+			return fmt.Errorf("error managing stream consumer: %w", err)
+		}
+	}
+
+	if k.config.clientsCacheAge > 0 {
+		if err := k.checkExpiredClients(); err != nil {
+			return fmt.Errorf("error checking for expired clients: %w", err)
+		}
+	}
+
 	shardCache, err := loadShardCacheFromDynamo(k.dynamodb, k.metadataTableName)
 	if err != nil {
-		return fmt.Errorf("error loading shard cache from dynamo: %v", err)
+		return fmt.Errorf("error loading shard cache from dynamo: %w", err)
 	}
 	cachedShardIDs := shardCache.ShardIDs
+	// The cache of the endpoint we failed over from is replaced right away
+	failedOver := shardCache.LastUpdate > 0 && shardCache.Failovers != k.streamFailovers()
+	if failedOver {
+		cachedShardIDs = nil
+	}
 	now := time.Now().UnixNano()
-	if now-shardCache.LastUpdate < k.config.leaderActionFrequency.Nanoseconds() {
+	if now-shardCache.LastUpdate < k.config.leaderActionFrequency.Nanoseconds() && !failedOver {
 		return nil
 	}
-	curShardIDs, err := loadShardIDsFromKinesis(k.kinesis, k.streamName)
+	curShards, err := k.listShards()
 	if err != nil {
-		return fmt.Errorf("error loading shard IDs from kinesis: %v", err)
+		return fmt.Errorf("error loading shard IDs from kinesis: %w", err)
 	}
+	curShardIDs := sortedShardIDs(curShards)
 
-	checkpoints, err := loadCheckpoints(k.dynamodb, k.checkpointTableName)
+	allCheckpoints, err := loadCheckpoints(k.dynamodb, k.checkpointTableName)
 	if err != nil {
-		return fmt.Errorf("error loading shard IDs from dynamo: %v", err)
+		return fmt.Errorf("error loading shard IDs from dynamo: %w", err)
 	}
+	checkpoints := k.streamCheckpoints(allCheckpoints)
 
 	updatedShardIDs, changed := diffShardIDs(curShardIDs, cachedShardIDs, checkpoints)
-	if changed {
-		err = k.setCachedShardIDs(updatedShardIDs)
+	shardParents := parentShardIDs(curShards, updatedShardIDs)
+	if failedOver {
+		if _, err := k.replaceShardCache(shardCache, updatedShardIDs, shardParents); err != nil {
+			return fmt.Errorf("error caching shard IDs to dynamo: %w", err)
+		}
+	} else if changed || (shardCache.ShardParents == nil && len(shardParents) > 0) {
+		// Caches written before shard lineage was tracked need to be rewritten once
+		written, err := k.updateCachedShardIDs(shardCache, updatedShardIDs, shardParents)
 		if err != nil {
-			return fmt.Errorf("error caching shard IDs to dynamo: %v", err)
+			return fmt.Errorf("error caching shard IDs to dynamo: %w", err)
+		}
+		// If another client updated the cache since we loaded it we try again on the next leader action
+		if event := newReshardEvent(cachedShardIDs, updatedShardIDs, shardParents); written && event != nil && k.config.reshardHook != nil {
+			k.config.reshardHook(*event)
 		}
 	}
 
 	err = reapClients(k.dynamodb, k.clientsTableName)
 	if err != nil {
-		return fmt.Errorf("error reaping old clients: %v", err)
+		return fmt.Errorf("error reaping old clients: %w", err)
+	}
+
+	if k.config.checkpointRetention > 0 {
+		if err = k.compactCheckpoints(curShards, allCheckpoints); err != nil {
+			return fmt.Errorf("error compacting checkpoints: %w", err)
+		}
+	}
+
+	if k.config.scalingAdvisor != nil {
+		k.adviseScaling(curShards, checkpoints)
 	}
 
 	return nil
 }
 
-// setCachedShardIDs updates the shard ID cache in dynamo.
-func (k *Kinsumer) setCachedShardIDs(shardIDs []string) error {
+// setCachedShardIDs writes the shard ID cache in dynamo if there is none yet, returning whether it did.
+func (k *Kinsumer) setCachedShardIDs(shardIDs []string, shardParents map[string][]string) (bool, error) {
 	if len(shardIDs) == 0 {
-		return nil
+		return false, nil
 	}
 	now := time.Now()
 	item, err := dynamodbattribute.MarshalMap(&shardCacheRecord{
 		Key:           shardCacheKey,
 		ShardIDs:      shardIDs,
+		ShardParents:  shardParents,
+		Failovers:     k.streamFailovers(),
 		LastUpdate:    now.UnixNano(),
 		LastUpdateRFC: now.UTC().Format(time.RFC1123Z),
 	})
 	if err != nil {
-		return fmt.Errorf("error marshalling map: %v", err)
+		return false, fmt.Errorf("error marshalling map: %v", err)
 	}
 
 	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(k.metadataTableName),
-		Item:      item,
+		TableName:           aws.String(k.metadataTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(LastUpdate)"),
 	})
 	if err != nil {
-		return fmt.Errorf("error updating shard cache: %v", err)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			return false, nil
+		}
+		return false, fmt.Errorf("error updating shard cache: %v", err)
+	}
+	return true, nil
+}
+
+// updateCachedShardIDs updates the shard ID cache in dynamo from the given version of it, only
+// writing the attributes and shard parents that changed. Returns false without writing anything if
+// the cache changed since that version was loaded.
+func (k *Kinsumer) updateCachedShardIDs(previous *shardCacheRecord, shardIDs []string, shardParents map[string][]string) (bool, error) {
+	if previous.LastUpdate == 0 {
+		return k.setCachedShardIDs(shardIDs, shardParents)
+	}
+	if len(shardIDs) == 0 {
+		return false, nil
+	}
+	update, err := shardCacheUpdate(previous, shardIDs, shardParents, time.Now())
+	if err != nil {
+		return false, err
 	}
-	return nil
+	update.TableName = aws.String(k.metadataTableName)
+	if _, err = k.dynamodb.UpdateItem(update); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			return false, nil
+		}
+		return false, fmt.Errorf("error updating shard cache: %v", err)
+	}
+	return true, nil
+}
+
+// shardCacheUpdate returns the update of the shard cache from the previous version to the given shards,
+// conditioned on the cache still being at the previous version
+func shardCacheUpdate(previous *shardCacheRecord, shardIDs []string, shardParents map[string][]string, now time.Time) (*dynamodb.UpdateItemInput, error) {
+	sets := []string{"LastUpdate = :lastUpdate", "LastUpdateRFC = :lastUpdateRFC"}
+	var removes []string
+	names := map[string]*string{}
+	values := map[string]interface{}{
+		":lastUpdate":    now.UnixNano(),
+		":lastUpdateRFC": now.UTC().Format(time.RFC1123Z),
+		":previous":      previous.LastUpdate,
+	}
+
+	if !stringSlicesEqual(previous.ShardIDs, shardIDs) {
+		sets = append(sets, "ShardIDs = :shardIDs")
+		values[":shardIDs"] = shardIDs
+	}
+
+	if previous.ShardParents == nil {
+		if len(shardParents) > 0 {
+			sets = append(sets, "ShardParents = :shardParents")
+			values[":shardParents"] = shardParents
+		}
+	} else {
+		// Only touch the parents of the shards that changed, in a stable order
+		var children []string
+		for child := range previous.ShardParents {
+			if _, ok := shardParents[child]; !ok {
+				children = append(children, child)
+			}
+		}
+		for child, parents := range shardParents {
+			if !stringSlicesEqual(previous.ShardParents[child], parents) {
+				children = append(children, child)
+			}
+		}
+		sort.Strings(children)
+		for i, child := range children {
+			name := fmt.Sprintf("#child%d", i)
+			names[name] = aws.String(child)
+			if parents, ok := shardParents[child]; ok {
+				value := fmt.Sprintf(":parents%d", i)
+				sets = append(sets, fmt.Sprintf("ShardParents.%s = %s", name, value))
+				values[value] = parents
+			} else {
+				removes = append(removes, "ShardParents."+name)
+			}
+		}
+	}
+
+	attrVals, err := dynamodbattribute.MarshalMap(values)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling shardCacheUpdate ExpressionAttributeValues: %v", err)
+	}
+	expression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expression += " REMOVE " + strings.Join(removes, ", ")
+	}
+	update := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(shardCacheKey)},
+		},
+		ConditionExpression:       aws.String("LastUpdate = :previous"),
+		UpdateExpression:          aws.String(expression),
+		ExpressionAttributeValues: attrVals,
+	}
+	if len(names) > 0 {
+		update.ExpressionAttributeNames = names
+	}
+	return update, nil
+}
+
+// stringSlicesEqual returns whether both slices hold the same strings in the same order
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addChildShards adds the children of a shard we just finished to the shard cache, so that they are
+// consumed right away instead of once the leader notices the reshard, and refreshes our shards. Other
+// clients pick the children up on their next shard check, or right away when following the table streams.
+func (k *Kinsumer) addChildShards(children []*kinesis.ChildShard) error {
+	shards := make(map[string][]string, len(children))
+	for _, child := range children {
+		shards[aws.StringValue(child.ShardId)] = aws.StringValueSlice(child.ParentShards)
+	}
+	_, err := k.addShards(shards)
+	return err
+}
+
+// addShards adds the given shards, with their parents, to the shard cache and refreshes our shards,
+// returning the IDs of the shards we added, none if the cache changed since we loaded it
+func (k *Kinsumer) addShards(shards map[string][]string) ([]string, error) {
+	shardCache, err := loadShardCacheFromDynamo(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return nil, fmt.Errorf("error loading shard cache from dynamo: %v", err)
+	}
+	if shardCache == nil || len(shardCache.ShardIDs) == 0 {
+		// Nothing cached yet, the next shard check loads everything from kinesis
+		k.requestRefresh()
+		return nil, nil
+	}
+
+	cached := make(map[string]bool, len(shardCache.ShardIDs))
+	for _, s := range shardCache.ShardIDs {
+		cached[s] = true
+	}
+	shardIDs := append([]string(nil), shardCache.ShardIDs...)
+	shardParents := make(map[string][]string, len(shardCache.ShardParents)+len(shards))
+	for s, parents := range shardCache.ShardParents {
+		shardParents[s] = parents
+	}
+
+	var added []string
+	for shardID, parents := range shards {
+		if cached[shardID] {
+			continue
+		}
+		shardIDs = append(shardIDs, shardID)
+		if len(parents) > 0 {
+			shardParents[shardID] = parents
+		}
+		added = append(added, shardID)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	sort.Strings(shardIDs)
+	sort.Strings(added)
+
+	// If somebody updated the cache since we read it, they already know better
+	written, err := k.updateCachedShardIDs(shardCache, shardIDs, shardParents)
+	if err != nil {
+		return nil, err
+	}
+
+	k.invalidateShardList()
+	k.requestRefresh()
+	if !written {
+		return nil, nil
+	}
+	return added, nil
 }
 
 // diffShardIDs takes the current shard IDs and cached shards and returns the new sorted cache, ignoring
@@ -180,12 +479,12 @@ func diffShardIDs(curShardIDs, cachedShardIDs []string, checkpoints map[string]*
 				updatedShardIDs = append(updatedShardIDs, s)
 			}
 		} else {
-			// If a shard is no longer returned by DescribeStream, drop it.
+			// If a shard is no longer returned by ListShards, drop it.
 			changed = true
 		}
 	}
 	for s := range cur {
-		// If the shard is returned by DescribeStream and not already Finished, add it.
+		// If the shard is returned by ListShards and not already Finished, add it.
 		if c, ok := checkpoints[s]; !ok || c.Finished == nil {
 			updatedShardIDs = append(updatedShardIDs, s)
 			changed = true
@@ -195,110 +494,105 @@ func diffShardIDs(curShardIDs, cachedShardIDs []string, checkpoints map[string]*
 	return
 }
 
-// deregisterLeadership marks us as no longer the leader in dynamo.
-func (k *Kinsumer) deregisterLeadership() error {
-	now := time.Now()
-	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
-		":ID":            aws.String(k.clientID),
-		":lastUpdate":    aws.Int64(now.UnixNano()),
-		":lastUpdateRFC": aws.String(now.UTC().Format(time.RFC1123Z)),
-	})
-	if err != nil {
-		return fmt.Errorf("error marshaling deregisterLeadership ExpressionAttributeValues: %v", err)
-	}
-	_, err = k.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(k.metadataTableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"Key": {S: aws.String(leaderKey)},
-		},
-		ConditionExpression:       aws.String("ID = :ID"),
-		UpdateExpression:          aws.String("REMOVE ID SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC"),
-		ExpressionAttributeValues: attrVals,
+// loadShardsFromKinesis returns all the shards of the stream from kinesis, following the
+// ListShards pagination. ListShards has a throttling limit of 100/s per stream, which is shared
+// by every client, so unless you need an as-recent-as-possible list you should use
+// Kinsumer.listShards, or the cache returned by loadShardCacheFromDynamo below.
+func loadShardsFromKinesis(kin kinesisiface.KinesisAPI, streamName string) ([]*kinesis.Shard, error) {
+	return listShardPages(kin, &kinesis.ListShardsInput{
+		StreamName: aws.String(streamName),
 	})
-	if err != nil {
-		// It's ok if we never actually became leader.
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
-			return nil
-		}
-	}
-	return err
 }
 
-// registerLeadership marks us as the leader or just refreshes LastUpdate in dynamo, returning false if
-// another node is the leader.
-func (k *Kinsumer) registerLeadership() (bool, error) {
-	now := time.Now()
-	cutoff := now.Add(-k.maxAgeForLeaderRecord).UnixNano()
-	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
-		":ID":     aws.String(k.clientID),
-		":cutoff": aws.Int64(cutoff),
-	})
-	if err != nil {
-		return false, fmt.Errorf("error marshaling registerLeadership ExpressionAttributeValues: %v", err)
-	}
-	item, err := dynamodbattribute.MarshalMap(map[string]interface{}{
-		"Key":           aws.String(leaderKey),
-		"ID":            aws.String(k.clientID),
-		"Name":          aws.String(k.clientName),
-		"LastUpdate":    aws.Int64(now.UnixNano()),
-		"LastUpdateRFC": aws.String(now.UTC().Format(time.RFC1123Z)),
-	})
-	if err != nil {
-		return false, fmt.Errorf("error marshaling registerLeadership Item: %v", err)
-	}
-	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{
-		TableName:                 aws.String(k.metadataTableName),
-		Item:                      item,
-		ConditionExpression:       aws.String("ID = :ID OR attribute_not_exists(ID) OR LastUpdate <= :cutoff"),
-		ExpressionAttributeValues: attrVals,
-	})
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
-			return false, nil
+// listShardPages returns the shards listed by all the pages of the given ListShards request
+func listShardPages(kin kinesisiface.KinesisAPI, params *kinesis.ListShardsInput) ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	for {
+		res, err := kin.ListShards(params)
+		if err != nil {
+			if e, ok := err.(awserr.Error); ok {
+				switch e.Code() {
+				case "ResourceInUseException":
+					return nil, ErrStreamBusy
+				case "ResourceNotFoundException":
+					return nil, ErrNoSuchStream
+				}
+			}
+			return nil, err
 		}
-		return false, err
-	}
-	return true, nil
-}
-
-// loadShardIDsFromKinesis returns a sorted slice of shardIDs from kinesis.
-// This function uses kinesis.DescribeStream, which has a very low throttling limit of 10/s per account.
-// To avoid hitting that limit, unless you need an as-recent-as-possible list,
-// you should use the cache, returned by loadShardIDsFromDynamo below.
-//TODO: Write unit test - needs kinesis mocking
-func loadShardIDsFromKinesis(kin kinesisiface.KinesisAPI, streamName string) ([]string, error) {
-	var innerError error
-
-	res, err := kin.ListShards(&kinesis.ListShardsInput{
-		StreamName: aws.String(streamName),
-	})
 
-	if err != nil {
-		if e, ok := err.(awserr.Error); ok {
-			switch e.Code() {
-			case "ResourceInUseException":
-				innerError = ErrStreamBusy
-			case "ResourceNotFoundException":
-				innerError = ErrNoSuchStream
-			}
+		shards = append(shards, res.Shards...)
+		if res.NextToken == nil {
+			return shards, nil
+		}
+		// The stream name must not be set along with a NextToken
+		params = &kinesis.ListShardsInput{
+			NextToken: res.NextToken,
 		}
 	}
+}
 
-	if innerError != nil {
-		return nil, innerError
+// listShards returns the shards of the stream, from kinesis or from a list loaded less than
+// config.shardListCacheTTL ago, so that the leader and the shard check don't both hit kinesis.
+func (k *Kinsumer) listShards() ([]*kinesis.Shard, error) {
+	k.shardListMutex.Lock()
+	defer k.shardListMutex.Unlock()
+
+	if k.shardList != nil && time.Since(k.shardListLoadedAt) < k.config.shardListCacheTTL {
+		return k.shardList, nil
 	}
 
+	shards, err := loadShardsFromKinesis(k.kinesis, k.streamName)
 	if err != nil {
 		return nil, err
 	}
+	k.shardList = shards
+	k.shardListLoadedAt = time.Now()
+	return shards, nil
+}
 
-	shardIDs := make([]string, len(res.Shards))
-	for i, s := range res.Shards {
+// invalidateShardList makes the next call to listShards load the shards from kinesis
+func (k *Kinsumer) invalidateShardList() {
+	k.shardListMutex.Lock()
+	defer k.shardListMutex.Unlock()
+	k.shardList = nil
+}
+
+// sortedShardIDs returns the sorted IDs of the given shards.
+func sortedShardIDs(shards []*kinesis.Shard) []string {
+	shardIDs := make([]string, len(shards))
+	for i, s := range shards {
 		shardIDs[i] = aws.StringValue(s.ShardId)
 	}
 	sort.Strings(shardIDs)
+	return shardIDs
+}
+
+// parentShardIDs returns the parents of each of the given shard IDs that are still among the
+// given shards, or nil if none of them has a parent left.
+func parentShardIDs(shards []*kinesis.Shard, shardIDs []string) map[string][]string {
+	byID := make(map[string]*kinesis.Shard, len(shards))
+	for _, s := range shards {
+		byID[aws.StringValue(s.ShardId)] = s
+	}
 
-	return shardIDs, nil
+	var parents map[string][]string
+	for _, shardID := range shardIDs {
+		shard, ok := byID[shardID]
+		if !ok {
+			continue
+		}
+		for _, parentID := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+			if _, ok := byID[aws.StringValue(parentID)]; !ok {
+				continue
+			}
+			if parents == nil {
+				parents = make(map[string][]string)
+			}
+			parents[shardID] = append(parents[shardID], aws.StringValue(parentID))
+		}
+	}
+	return parents
 }
 
 // loadShardIDsFromDynamo returns the sorted slice of shardIDs from the metadata table in dynamo.
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParentShardIDs(t *testing.T) {
+	shards := []*kinesis.Shard{
+		{ShardId: aws.String("shard-0")},
+		{ShardId: aws.String("shard-1")},
+		{ShardId: aws.String("shard-2"), ParentShardId: aws.String("shard-0"), AdjacentParentShardId: aws.String("shard-1")},
+		{ShardId: aws.String("shard-3"), ParentShardId: aws.String("trimmed")},
+	}
+
+	require.Equal(t, []string{"shard-0", "shard-1", "shard-2", "shard-3"}, sortedShardIDs(shards))
+	require.Equal(t, map[string][]string{
+		"shard-2": {"shard-0", "shard-1"},
+	}, parentShardIDs(shards, []string{"shard-0", "shard-1", "shard-2", "shard-3"}))
+	require.Nil(t, parentShardIDs(shards, []string{"shard-3"}))
+}
+
+func TestListShards(t *testing.T) {
+	var shards []*kinesis.Shard
+	for i := 0; i < 5; i++ {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shard-%d", i))})
+	}
+	kin := mocks.NewMockKinesis("stream", shards)
+
+	// All the pages are loaded
+	loaded, err := loadShardsFromKinesis(kin, "stream")
+	require.NoError(t, err)
+	require.Equal(t, shards, loaded)
+
+	_, err = loadShardsFromKinesis(kin, "other")
+	require.Equal(t, ErrNoSuchStream, err)
+
+	// The list is reused until the cache TTL expires
+	k := &Kinsumer{kinesis: kin, streamName: "stream", config: NewConfig().WithShardListCacheTTL(time.Hour)}
+	kin.ListShardsCalls = 0
+	for i := 0; i < 2; i++ {
+		loaded, err = k.listShards()
+		require.NoError(t, err)
+		require.Equal(t, shards, loaded)
+	}
+	require.Equal(t, 3, kin.ListShardsCalls)
+}
+
+func TestNewReshardEvent(t *testing.T) {
+	parents := map[string][]string{"shard-2": {"shard-0", "shard-1"}}
+	event := newReshardEvent([]string{"shard-0", "shard-1"}, []string{"shard-1", "shard-2"}, parents)
+	require.Equal(t, &ReshardEvent{
+		PreviousShardIDs: []string{"shard-0", "shard-1"},
+		ShardIDs:         []string{"shard-1", "shard-2"},
+		Added:            []string{"shard-2"},
+		Removed:          []string{"shard-0"},
+		ShardParents:     parents,
+	}, event)
+
+	require.Nil(t, newReshardEvent(nil, []string{"shard-0"}, nil), "the first shards cached aren't a change")
+	require.Nil(t, newReshardEvent([]string{"shard-0"}, []string{"shard-0"}, nil))
+}
+
+func TestShardCacheUpdate(t *testing.T) {
+	now := time.Now()
+	previous := &shardCacheRecord{
+		ShardIDs:     []string{"shard-1", "shard-2"},
+		ShardParents: map[string][]string{"shard-2": {"shard-0"}},
+		LastUpdate:   42,
+	}
+
+	// Only the timestamp changes when nothing else did
+	update, err := shardCacheUpdate(previous, previous.ShardIDs, previous.ShardParents, now)
+	require.NoError(t, err)
+	require.Equal(t, "SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC", aws.StringValue(update.UpdateExpression))
+	require.Equal(t, "LastUpdate = :previous", aws.StringValue(update.ConditionExpression))
+	require.Equal(t, "42", aws.StringValue(update.ExpressionAttributeValues[":previous"].N))
+	require.Nil(t, update.ExpressionAttributeNames)
+
+	// The changed shards and parents are written, the others left alone
+	update, err = shardCacheUpdate(previous, []string{"shard-1", "shard-3"}, map[string][]string{"shard-3": {"shard-1"}}, now)
+	require.NoError(t, err)
+	require.Equal(t, "SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC, ShardIDs = :shardIDs, "+
+		"ShardParents.#child1 = :parents1 REMOVE ShardParents.#child0", aws.StringValue(update.UpdateExpression))
+	require.Equal(t, map[string]*string{"#child0": aws.String("shard-2"), "#child1": aws.String("shard-3")}, update.ExpressionAttributeNames)
+	require.Len(t, update.ExpressionAttributeValues[":shardIDs"].L, 2)
+	require.Len(t, update.ExpressionAttributeValues[":parents1"].L, 1)
+
+	// Caches written before shard lineage was tracked get all the parents at once
+	previous.ShardParents = nil
+	update, err = shardCacheUpdate(previous, previous.ShardIDs, map[string][]string{"shard-2": {"shard-0"}}, now)
+	require.NoError(t, err)
+	require.Equal(t, "SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC, ShardParents = :shardParents", aws.StringValue(update.UpdateExpression))
+}
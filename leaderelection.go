@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// A LeaderElector elects the client performing the leader actions, such as updating the shard cache
+// and reaping old clients. One client at most must be elected at a time.
+type LeaderElector interface {
+	// Candidate returns whether a client runs for leader, given its position among the clients
+	// sorted by ID. It is called by every client at every shard check.
+	Candidate(position, clients int) bool
+	// Elect acquires or renews the leadership of a candidate, it is called every leader action
+	// period. It returns whether the client is the leader, and the token of its leadership, which is
+	// positive and greater than the tokens of all the leaderships before it.
+	Elect(clientID, clientName string) (bool, int64, error)
+	// Resign gives up the leadership of a client that stopped running for leader, if it has it
+	Resign(clientID string) error
+}
+
+// leaseElector elects the client holding a lease in a dynamo table, renewed at every election
+type leaseElector struct {
+	dynamodb  dynamodbiface.DynamoDBAPI
+	tableName string
+	lease     time.Duration
+	// Whether only the first client by ID runs for leader
+	firstClientOnly bool
+}
+
+// NewLeaseLeaderElector returns a LeaderElector that elects the client holding a lease in the given
+// dynamo table, which has a string hash key named Key like the <applicationName>_metadata table. Every
+// client runs for leader, but the leader keeps its lease until it fails to renew it for the lease
+// duration, so leadership doesn't move when clients come and go during deploys. Its token is
+// incremented every time the lease changes hands. It is the default elector with the metadata table,
+// and shares its lease with Config.WithFirstClientLeader, so clients using either can run together.
+func NewLeaseLeaderElector(db dynamodbiface.DynamoDBAPI, tableName string, lease time.Duration) LeaderElector {
+	return &leaseElector{dynamodb: db, tableName: tableName, lease: lease}
+}
+
+// Candidate implementation
+func (e *leaseElector) Candidate(position, clients int) bool {
+	return !e.firstClientOnly || position == 0
+}
+
+// Elect implementation, renewing our lease if we have it or taking it if it expired
+func (e *leaseElector) Elect(clientID, clientName string) (bool, int64, error) {
+	now := time.Now()
+	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":ID":            aws.String(clientID),
+		":name":          aws.String(clientName),
+		":lastUpdate":    aws.Int64(now.UnixNano()),
+		":lastUpdateRFC": aws.String(now.UTC().Format(time.RFC1123Z)),
+		":one":           aws.Int64(1),
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("error marshaling Elect ExpressionAttributeValues: %v", err)
+	}
+	renewal := &dynamodb.UpdateItemInput{
+		TableName: aws.String(e.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(leaderKey)},
+		},
+		ConditionExpression: aws.String("ID = :ID"),
+		// Leases taken before there were tokens get the first one
+		UpdateExpression: aws.String("SET #name = :name, LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC, " +
+			"Token = if_not_exists(Token, :one)"),
+		ExpressionAttributeNames:  map[string]*string{"#name": aws.String("Name")},
+		ExpressionAttributeValues: attrVals,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	}
+	leader, token, err := e.update(renewal)
+	if leader || err != nil {
+		return leader, token, err
+	}
+
+	// We don't have the lease, take it if nobody renewed it in time
+	acquisition := *renewal
+	acquisition.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+		":cutoff": {N: aws.String(strconv.FormatInt(now.Add(-e.lease).UnixNano(), 10))},
+		":zero":   {N: aws.String("0")},
+	}
+	for name, value := range attrVals {
+		acquisition.ExpressionAttributeValues[name] = value
+	}
+	acquisition.ConditionExpression = aws.String("attribute_not_exists(ID) OR LastUpdate <= :cutoff")
+	acquisition.UpdateExpression = aws.String("SET ID = :ID, #name = :name, LastUpdate = :lastUpdate, " +
+		"LastUpdateRFC = :lastUpdateRFC, Token = if_not_exists(Token, :zero) + :one")
+	return e.update(&acquisition)
+}
+
+// update makes an update of the lease, returning false if its condition failed
+func (e *leaseElector) update(in *dynamodb.UpdateItemInput) (bool, int64, error) {
+	out, err := e.dynamodb.UpdateItem(in)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	var lease struct {
+		Token int64
+	}
+	if err = dynamodbattribute.UnmarshalMap(out.Attributes, &lease); err != nil {
+		return false, 0, err
+	}
+	return true, lease.Token, nil
+}
+
+// Resign implementation, releasing our lease so the next candidate doesn't wait for it to expire
+func (e *leaseElector) Resign(clientID string) error {
+	now := time.Now()
+	attrVals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":ID":            aws.String(clientID),
+		":lastUpdate":    aws.Int64(now.UnixNano()),
+		":lastUpdateRFC": aws.String(now.UTC().Format(time.RFC1123Z)),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling Resign ExpressionAttributeValues: %v", err)
+	}
+	_, err = e.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(e.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(leaderKey)},
+		},
+		ConditionExpression:       aws.String("ID = :ID"),
+		UpdateExpression:          aws.String("REMOVE ID SET LastUpdate = :lastUpdate, LastUpdateRFC = :lastUpdateRFC"),
+		ExpressionAttributeValues: attrVals,
+	})
+	if err != nil {
+		// It's ok if we never actually became leader.
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+			return nil
+		}
+	}
+	return err
+}
+
+// elect runs for leader, returning whether we are the leader
+func (k *Kinsumer) elect() (bool, error) {
+	leader, token, err := k.leaderElector.Elect(k.clientID(), k.clientName)
+	if err != nil || !leader {
+		token = 0
+	}
+	k.setLeaderToken(token)
+	return leader && err == nil, err
+}
+
+// setLeaderToken sets the token of our leadership, 0 if we aren't the leader, emitting an
+// event if it changed
+func (k *Kinsumer) setLeaderToken(token int64) {
+	if previous := atomic.SwapInt64(&k.leaderToken, token); previous != token {
+		k.emit(EventLeadershipChanged, LevelInfo, "", map[string]interface{}{"leader": token != 0, "token": token},
+			"Leadership changed from token %d to %d", previous, token)
+	}
+}
+
+// Leadership returns whether this client is the leader, and the token of its leadership. Kinsumer
+// doesn't fence its own leader actions with the token. Instead the shard cache and the migration are
+// only written if they didn't change since they were read, and reaping clients, compacting
+// checkpoints, signaling client changes and registering the fan-out consumer can be repeated
+// safely, so a leader that was deposed without knowing it yet at worst repeats work. Applications
+// can pass the token along with the writes only the current leader should make, for their storage
+// to reject the writes with older tokens.
+func (k *Kinsumer) Leadership() (bool, int64) {
+	token := atomic.LoadInt64(&k.leaderToken)
+	return token != 0, token
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// leaseDynamo evaluates the updates of the leader lease, which the dynamo mock ignores
+type leaseDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	id         string
+	lastUpdate int64
+	token      int64
+}
+
+func (d *leaseDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	value := func(name string) string {
+		v := in.ExpressionAttributeValues[name]
+		if v.S != nil {
+			return *v.S
+		}
+		return aws.StringValue(v.N)
+	}
+	number := func(name string) int64 {
+		n, _ := strconv.ParseInt(value(name), 10, 64)
+		return n
+	}
+	failed := awserr.New(conditionalFail, "condition failed", nil)
+
+	switch aws.StringValue(in.ConditionExpression) {
+	case "ID = :ID":
+		if d.id != value(":ID") {
+			return nil, failed
+		}
+		if _, ok := in.ExpressionAttributeValues[":name"]; !ok {
+			d.id = "" // resigning
+		} else if d.token == 0 {
+			d.token = 1
+		}
+	case "attribute_not_exists(ID) OR LastUpdate <= :cutoff":
+		if d.id != "" && d.lastUpdate > number(":cutoff") {
+			return nil, failed
+		}
+		d.id = value(":ID")
+		d.token++
+	}
+	d.lastUpdate = number(":lastUpdate")
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"Token": {N: aws.String(strconv.FormatInt(d.token, 10))},
+	}}, nil
+}
+
+func TestLeaseLeaderElector(t *testing.T) {
+	db := &leaseDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil)}
+	elector := NewLeaseLeaderElector(db, "app_metadata", time.Minute)
+	require.True(t, elector.Candidate(3, 4), "every client runs for leader")
+
+	leader, token, err := elector.Elect("a", "client a")
+	require.NoError(t, err)
+	require.True(t, leader)
+	require.Equal(t, int64(1), token)
+
+	// The lease is renewed with the same token, and others can't take it
+	leader, token, err = elector.Elect("a", "client a")
+	require.NoError(t, err)
+	require.True(t, leader)
+	require.Equal(t, int64(1), token)
+	leader, _, err = elector.Elect("b", "client b")
+	require.NoError(t, err)
+	require.False(t, leader)
+
+	// An expired lease goes to the next candidate with a greater token
+	db.lastUpdate = time.Now().Add(-2 * time.Minute).UnixNano()
+	leader, token, err = elector.Elect("b", "client b")
+	require.NoError(t, err)
+	require.True(t, leader)
+	require.Equal(t, int64(2), token)
+	leader, _, err = elector.Elect("a", "client a")
+	require.NoError(t, err)
+	require.False(t, leader)
+
+	// Resigning frees the lease right away
+	require.NoError(t, elector.Resign("a"), "resigning without the lease")
+	require.NoError(t, elector.Resign("b"))
+	leader, token, err = elector.Elect("a", "client a")
+	require.NoError(t, err)
+	require.True(t, leader)
+	require.Equal(t, int64(3), token)
+}
+
+func TestDefaultLeaderElector(t *testing.T) {
+	db := &leaseDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil)}
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	require.True(t, k.leaderElector.Candidate(0, 2))
+	require.True(t, k.leaderElector.Candidate(1, 2), "every client runs for leader")
+
+	leader, err := k.elect()
+	require.NoError(t, err)
+	require.True(t, leader)
+	leader, token := k.Leadership()
+	require.True(t, leader)
+	require.Equal(t, int64(1), token)
+}
+
+func TestFirstClientLeader(t *testing.T) {
+	db := &leaseDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil)}
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client",
+		NewConfig().WithFirstClientLeader())
+	require.NoError(t, err)
+	require.True(t, k.leaderElector.Candidate(0, 2))
+	require.False(t, k.leaderElector.Candidate(1, 2), "only the first client runs for leader")
+}
@@ -1,12 +1,54 @@
 package kinsumer
 
-import "log"
+import (
+	"fmt"
+	"log"
+)
 
 // Logger is a minimal interface to allow custom loggers to be used
 type Logger interface {
 	Log(string, ...interface{})
 }
 
+// Level is the severity of a log line
+type Level int
+
+const (
+	// LevelDebug is for the lines only useful when diagnosing a problem, such as delivery traces
+	LevelDebug Level = iota
+	// LevelInfo is for the normal operation of the consumer
+	LevelInfo
+	// LevelWarn is for the problems the consumer recovers from by itself
+	LevelWarn
+	// LevelError is for the problems the consumer can't recover from
+	LevelError
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// StructuredLogger is a Logger taking leveled lines with key/value fields. When the configured
+// Logger implements it, every line is logged with LogFields instead of Log, with the field "op"
+// (the operation), "shard" (shard ID) when the line is about a shard, and "client" (client ID)
+// unless the line is about a single request or record, like retries and delivery traces.
+// The zaplogger and logruslogger packages adapt zap and logrus loggers.
+type StructuredLogger interface {
+	Logger
+	LogFields(level Level, msg string, keysAndValues ...interface{})
+}
+
 // DefaultLogger is a logger that will log using the
 // standard golang log library
 type DefaultLogger struct{}
@@ -15,3 +57,21 @@ type DefaultLogger struct{}
 func (*DefaultLogger) Log(format string, v ...interface{}) {
 	log.Printf(format, v...)
 }
+
+// logf logs a line through LogFields with the given fields if the logger is structured, or Log otherwise
+func logf(logger Logger, level Level, fields []interface{}, format string, v ...interface{}) {
+	if structured, ok := logger.(StructuredLogger); ok {
+		structured.LogFields(level, fmt.Sprintf(format, v...), fields...)
+		return
+	}
+	logger.Log(format, v...)
+}
+
+// logf logs a line about the given operation and shard, empty if it isn't about a shard
+func (k *Kinsumer) logf(level Level, operation, shardID string, format string, v ...interface{}) {
+	fields := []interface{}{"client", k.clientID(), "op", operation}
+	if shardID != "" {
+		fields = append(fields, "shard", shardID)
+	}
+	logf(k.config.logger, level, fields, format, v...)
+}
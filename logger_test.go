@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// structuredLogger records the lines logged with their level and fields
+type structuredLogger struct {
+	recordingLogger
+	levels []Level
+	fields [][]interface{}
+}
+
+func (l *structuredLogger) LogFields(level Level, msg string, keysAndValues ...interface{}) {
+	l.lines = append(l.lines, msg)
+	l.levels = append(l.levels, level)
+	l.fields = append(l.fields, keysAndValues)
+}
+
+func TestStructuredLogging(t *testing.T) {
+	logger := &structuredLogger{}
+	config := NewConfig().WithLogger(logger)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	k.logf(LevelWarn, "getRecords", "shard", "Shard %s is %s", "shard", "late")
+	k.logf(LevelInfo, "quarantine", "", "Quarantined")
+	require.Equal(t, []string{"Shard shard is late", "Quarantined"}, logger.lines)
+	require.Equal(t, []Level{LevelWarn, LevelInfo}, logger.levels)
+	require.Equal(t, []interface{}{"client", k.clientID(), "op", "getRecords", "shard", "shard"}, logger.fields[0])
+	require.Equal(t, []interface{}{"client", k.clientID(), "op", "quarantine"}, logger.fields[1], "no shard")
+
+	// Plain loggers get the formatted line
+	plain := &recordingLogger{}
+	logf(plain, LevelError, []interface{}{"op", "retry"}, "%s failed", "GetRecords")
+	require.Equal(t, []string{"GetRecords failed"}, plain.lines)
+	require.Equal(t, "warn", fmt.Sprint(LevelWarn))
+}
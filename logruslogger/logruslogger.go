@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package logruslogger
+
+import (
+	"fmt"
+
+	"github.com/brenol/kinsumer"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is a kinsumer.StructuredLogger that writes to a logrus logger
+type Logger struct {
+	logger logrus.FieldLogger
+}
+
+// New creates a new Logger writing to the given logrus logger or entry
+func New(logger logrus.FieldLogger) *Logger {
+	return &Logger{logger: logger}
+}
+
+// Log implementation, logging at the info level
+func (l *Logger) Log(format string, v ...interface{}) {
+	l.logger.Infof(format, v...)
+}
+
+// LogFields implementation
+func (l *Logger) LogFields(level kinsumer.Level, msg string, keysAndValues ...interface{}) {
+	fields := make(logrus.Fields, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	entry := l.logger.WithFields(fields)
+	switch level {
+	case kinsumer.LevelDebug:
+		entry.Debug(msg)
+	case kinsumer.LevelWarn:
+		entry.Warn(msg)
+	case kinsumer.LevelError:
+		entry.Error(msg)
+	default:
+		entry.Info(msg)
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const migrationKey = "Migration"
+
+// MigrationPhase is how far a migration of the kinsumer tables to another application name has gone
+type MigrationPhase int
+
+const (
+	// MigrationDualWrite - Clients read the old tables, and write to both the old and the new ones
+	// while the leader copies the old tables to the new ones
+	MigrationDualWrite MigrationPhase = iota + 1
+	// MigrationCutover - Clients read the new tables, and write to both so clients that haven't
+	// noticed the cutover yet still see every change
+	MigrationCutover
+	// MigrationDone - Clients only use the new tables, the old ones can be deleted once every client
+	// runs with the new application name
+	MigrationDone
+)
+
+// String returns the name of the phase
+func (p MigrationPhase) String() string {
+	switch p {
+	case MigrationDualWrite:
+		return "dual-write"
+	case MigrationCutover:
+		return "cutover"
+	case MigrationDone:
+		return "done"
+	default:
+		return fmt.Sprintf("MigrationPhase(%d)", int(p))
+	}
+}
+
+// Migration is the state of a migration of the kinsumer tables to another application name
+type Migration struct {
+	Application    string         // name of the application whose tables the data moves to
+	Phase          MigrationPhase // current phase of the migration
+	PhaseChangedAt time.Time      // when the migration entered its current phase
+}
+
+type migrationRecord struct {
+	Key               string // must be "Migration"
+	Application       string
+	Phase             MigrationPhase
+	PhaseChangedAt    int64
+	PhaseChangedAtRFC string
+}
+
+// migratingDynamo is a dynamo interface that routes the item and scan requests made to the tables of
+// one application to the tables of another, as told by the phase of a migration
+type migratingDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	logger Logger
+	mutex  sync.RWMutex
+	phase  MigrationPhase    // 0 if there is no migration
+	tables map[string]string // new name of each old table being migrated
+}
+
+func newMigratingDynamo(db dynamodbiface.DynamoDBAPI, logger Logger) *migratingDynamo {
+	return &migratingDynamo{DynamoDBAPI: db, logger: logger}
+}
+
+// set changes the phase of the migration of the tables in the given map, keyed by their old names
+func (d *migratingDynamo) set(phase MigrationPhase, tables map[string]string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.phase = phase
+	d.tables = tables
+}
+
+// route returns the table a request to the given table goes to, and the table its writes are
+// mirrored to, if any
+func (d *migratingDynamo) route(table *string) (primary, mirror *string) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	to, ok := d.tables[aws.StringValue(table)]
+	if !ok {
+		return table, nil
+	}
+	switch d.phase {
+	case MigrationDualWrite:
+		return table, aws.String(to)
+	case MigrationCutover:
+		return aws.String(to), table
+	case MigrationDone:
+		return aws.String(to), nil
+	}
+	return table, nil
+}
+
+func (d *migratingDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	routed := *in
+	routed.TableName, _ = d.route(in.TableName)
+	return d.DynamoDBAPI.GetItem(&routed)
+}
+
+func (d *migratingDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	routed := *in
+	routed.TableName, _ = d.route(in.TableName)
+	return d.DynamoDBAPI.ScanPages(&routed, fn)
+}
+
+// PutItem writes are mirrored with their condition, so a mirrored write doesn't overwrite a newer
+// version of the item written to the other table. A failed mirror write is only logged, the leader
+// copies the whole table before the cutover anyway, like the other writes.
+func (d *migratingDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	routed := *in
+	var mirror *string
+	routed.TableName, mirror = d.route(in.TableName)
+	out, err := d.DynamoDBAPI.PutItem(&routed)
+	if err == nil && mirror != nil {
+		d.mirrorPut(mirror, in.Item, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	}
+	return out, err
+}
+
+// UpdateItem writes are mirrored by putting the updated item with the condition of the update, as we
+// can't replay the update on an item that may not be the same
+func (d *migratingDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	routed := *in
+	var mirror *string
+	routed.TableName, mirror = d.route(in.TableName)
+	if mirror == nil {
+		return d.DynamoDBAPI.UpdateItem(&routed)
+	}
+	returnValues := aws.StringValue(in.ReturnValues)
+	if returnValues == "" || returnValues == dynamodb.ReturnValueNone {
+		routed.ReturnValues = aws.String(dynamodb.ReturnValueAllNew)
+	}
+	out, err := d.DynamoDBAPI.UpdateItem(&routed)
+	if err != nil {
+		return out, err
+	}
+	switch returnValues {
+	case "", dynamodb.ReturnValueNone:
+		d.mirrorUpdated(mirror, out.Attributes, in)
+		// The caller didn't ask for the item
+		returned := *out
+		returned.Attributes = nil
+		out = &returned
+	case dynamodb.ReturnValueAllNew:
+		d.mirrorUpdated(mirror, out.Attributes, in)
+	default:
+		logf(d.logger, LevelError, []interface{}{"op", "mirror"}, "Error mirroring update of %s returning %s, only the updated item can be mirrored",
+			aws.StringValue(routed.TableName), returnValues)
+	}
+	return out, err
+}
+
+// mirrorUpdated mirrors the item an update returned
+func (d *migratingDynamo) mirrorUpdated(table *string, item map[string]*dynamodb.AttributeValue, in *dynamodb.UpdateItemInput) {
+	// The values of the update expression are rejected by a put only using the condition
+	names, values := expressionAttributes(aws.StringValue(in.ConditionExpression), in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	d.mirrorPut(table, item, in.ConditionExpression, names, values)
+}
+
+func (d *migratingDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	routed := *in
+	var mirror *string
+	routed.TableName, mirror = d.route(in.TableName)
+	out, err := d.DynamoDBAPI.DeleteItem(&routed)
+	if err == nil && mirror != nil {
+		d.mirrorDelete(mirror, in.Key, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	}
+	return out, err
+}
+
+// TransactWriteItems routes the items written to kinsumer tables, and mirrors the puts and deletes once
+// the transaction succeeded, updates are left to the copy made before the cutover. The application's
+// own tables are left alone.
+func (d *migratingDynamo) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	routed := *in
+	routed.TransactItems = make([]*dynamodb.TransactWriteItem, len(in.TransactItems))
+	var mirrors []func()
+	for i, item := range in.TransactItems {
+		r := *item
+		switch {
+		case item.Put != nil:
+			put := *item.Put
+			var mirror *string
+			put.TableName, mirror = d.route(item.Put.TableName)
+			if mirror != nil {
+				mirrors = append(mirrors, func() {
+					d.mirrorPut(mirror, put.Item, put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues)
+				})
+			}
+			r.Put = &put
+		case item.Delete != nil:
+			del := *item.Delete
+			var mirror *string
+			del.TableName, mirror = d.route(item.Delete.TableName)
+			if mirror != nil {
+				mirrors = append(mirrors, func() {
+					d.mirrorDelete(mirror, del.Key, del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues)
+				})
+			}
+			r.Delete = &del
+		case item.Update != nil:
+			update := *item.Update
+			update.TableName, _ = d.route(item.Update.TableName)
+			r.Update = &update
+		case item.ConditionCheck != nil:
+			check := *item.ConditionCheck
+			check.TableName, _ = d.route(item.ConditionCheck.TableName)
+			r.ConditionCheck = &check
+		}
+		routed.TransactItems[i] = &r
+	}
+	out, err := d.DynamoDBAPI.TransactWriteItems(&routed)
+	if err == nil {
+		for _, mirror := range mirrors {
+			mirror()
+		}
+	}
+	return out, err
+}
+
+func (d *migratingDynamo) mirrorPut(table *string, item map[string]*dynamodb.AttributeValue, condition *string,
+	names map[string]*string, values map[string]*dynamodb.AttributeValue) {
+	_, err := d.DynamoDBAPI.PutItem(&dynamodb.PutItemInput{
+		TableName:                 table,
+		Item:                      item,
+		ConditionExpression:       condition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	d.mirrored(table, "item", err)
+}
+
+func (d *migratingDynamo) mirrorDelete(table *string, key map[string]*dynamodb.AttributeValue, condition *string,
+	names map[string]*string, values map[string]*dynamodb.AttributeValue) {
+	_, err := d.DynamoDBAPI.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 table,
+		Key:                       key,
+		ConditionExpression:       condition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	d.mirrored(table, "deletion", err)
+}
+
+// mirrored logs the error of a mirrored write
+func (d *migratingDynamo) mirrored(table *string, what string, err error) {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		// The item changed in the other table, or wasn't copied there yet
+		logf(d.logger, LevelDebug, []interface{}{"op", "mirror"}, "Skipped mirroring %s to %s, its condition doesn't hold there", what, aws.StringValue(table))
+	} else if err != nil {
+		logf(d.logger, LevelError, []interface{}{"op", "mirror"}, "Error mirroring %s to %s: %s", what, aws.StringValue(table), err)
+	}
+}
+
+// expressionPlaceholder matches the attribute names and values used by an expression
+var expressionPlaceholder = regexp.MustCompile(`[#:][A-Za-z0-9_]+`)
+
+// expressionAttributes returns the attribute names and values used by the given expression
+func expressionAttributes(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*string, map[string]*dynamodb.AttributeValue) {
+	var usedNames map[string]*string
+	var usedValues map[string]*dynamodb.AttributeValue
+	for _, placeholder := range expressionPlaceholder.FindAllString(expression, -1) {
+		if name, ok := names[placeholder]; ok {
+			if usedNames == nil {
+				usedNames = make(map[string]*string)
+			}
+			usedNames[placeholder] = name
+		}
+		if value, ok := values[placeholder]; ok {
+			if usedValues == nil {
+				usedValues = make(map[string]*dynamodb.AttributeValue)
+			}
+			usedValues[placeholder] = value
+		}
+	}
+	return usedNames, usedValues
+}
+
+// migrationTables returns the new name of each of our tables when migrating to the given application
+func (k *Kinsumer) migrationTables(applicationName string) map[string]string {
+	tables := map[string]string{
+		k.clientsTableName:    applicationName + "_clients",
+		k.checkpointTableName: applicationName + "_checkpoints",
+		k.metadataTableName:   applicationName + "_metadata",
+	}
+	if k.config.deduplicationWindow > 0 {
+		tables[k.dedupTableName] = applicationName + "_deduplication"
+	}
+	return tables
+}
+
+// tableKey returns the key attribute of one of our tables
+func (k *Kinsumer) tableKey(tableName string) string {
+	switch tableName {
+	case k.clientsTableName:
+		return "ID"
+	case k.checkpointTableName:
+		return "Shard"
+	default:
+		return "Key"
+	}
+}
+
+// loadMigration returns the migration of our tables, or nil if there is none. The migration is
+// always stored in our own metadata table, whatever its phase.
+func (k *Kinsumer) loadMigration() (*migrationRecord, error) {
+	resp, err := k.unrouted.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(k.metadataTableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(migrationKey)},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ResourceNotFoundException" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, nil
+	}
+	var record migrationRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// refreshMigration loads the migration of our tables, and routes our requests as told by its phase
+func (k *Kinsumer) refreshMigration() error {
+	record, err := k.loadMigration()
+	if err != nil {
+		return fmt.Errorf("error loading migration from dynamo: %v", err)
+	}
+	if record == nil {
+		k.migrating.set(0, nil)
+		return nil
+	}
+	k.migrating.set(record.Phase, k.migrationTables(record.Application))
+	return nil
+}
+
+// writeMigrationPhase moves the migration to the given phase, if it is still in the phase we
+// loaded it in. previous is nil when starting the migration.
+func (k *Kinsumer) writeMigrationPhase(applicationName string, phase MigrationPhase, previous *migrationRecord) error {
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(&migrationRecord{
+		Key:               migrationKey,
+		Application:       applicationName,
+		Phase:             phase,
+		PhaseChangedAt:    now.UnixNano(),
+		PhaseChangedAtRFC: now.UTC().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling map: %v", err)
+	}
+
+	condition := "attribute_not_exists(Phase)"
+	var attrVals map[string]*dynamodb.AttributeValue
+	if previous != nil {
+		condition = "Phase = :phase"
+		attrVals, err = dynamodbattribute.MarshalMap(map[string]interface{}{
+			":phase": previous.Phase,
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling writeMigrationPhase ExpressionAttributeValues: %v", err)
+		}
+	}
+	_, err = k.unrouted.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(k.metadataTableName),
+		Item:                      item,
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: attrVals,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		return ErrMigrationInProgress
+	}
+	return err
+}
+
+// MigrateTables starts moving the clients, checkpoints and metadata of this application, and the
+// records processed with Config.WithDeduplication, to the tables of another application name, while
+// the clients keep consuming. The new tables must
+// already exist, CreateRequiredTables on a Kinsumer with the new application name creates them.
+//
+// The clients first write to both the old and the new tables while the leader copies the old
+// tables to the new ones, then switch to the new tables while still writing to the old ones for
+// the clients that haven't switched yet, and finally only use the new tables. Each phase lasts at
+// least two shard checks so every client notices it. Once MigrationStatus reports MigrationDone the
+// clients can be restarted with the new application name, and the old tables deleted.
+func (k *Kinsumer) MigrateTables(applicationName string) error {
+	for from, to := range k.migrationTables(applicationName) {
+		if from == to {
+			return ErrMigrationSameApplication
+		}
+		if err := k.dynamoTableActive(to); err != nil {
+			return err
+		}
+	}
+	if err := k.writeMigrationPhase(applicationName, MigrationDualWrite, nil); err != nil {
+		return err
+	}
+	k.logf(LevelInfo, "migrate", "", "Started migrating the tables of %s to %s", k.metadataTableName, applicationName)
+	return nil
+}
+
+// MigrationStatus returns the migration started with MigrateTables, or nil if there is none
+func (k *Kinsumer) MigrationStatus() (*Migration, error) {
+	record, err := k.loadMigration()
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return &Migration{
+		Application:    record.Application,
+		Phase:          record.Phase,
+		PhaseChangedAt: time.Unix(0, record.PhaseChangedAt),
+	}, nil
+}
+
+// advanceMigration moves the migration of our tables to its next phase once every client had the
+// time to notice the current one, copying the tables before the cutover. Only the leader calls it.
+func (k *Kinsumer) advanceMigration() error {
+	record, err := k.loadMigration()
+	if err != nil || record == nil || record.Phase == MigrationDone {
+		return err
+	}
+	if time.Since(time.Unix(0, record.PhaseChangedAt)) < 2*k.config.shardCheckFrequency {
+		return nil
+	}
+
+	next := MigrationDone
+	if record.Phase == MigrationDualWrite {
+		next = MigrationCutover
+		for from, to := range k.migrationTables(record.Application) {
+			if err := k.copyTable(from, to, k.tableKey(from)); err != nil {
+				return fmt.Errorf("error copying table %s to %s: %v", from, to, err)
+			}
+		}
+	}
+	if err := k.writeMigrationPhase(record.Application, next, record); err != nil {
+		return err
+	}
+	k.logf(LevelInfo, "advanceMigration", "", "Migration of the tables of %s to %s entered the %s phase", k.metadataTableName, record.Application, next)
+	return k.refreshMigration()
+}
+
+// versionAttributes are the attributes of the items of our tables telling which version of an item
+// is the newest, in the order they are looked for
+var versionAttributes = []string{"LastUpdate", "ExpiresAt"}
+
+// copyTable copies every item of a table to another, keyed by the given attribute. An item only
+// overwrites an older version of itself, as told by its version attribute, since the items written to
+// both tables while we copy may be newer than the ones we read. The items without a version
+// attribute are only copied if they aren't there yet.
+func (k *Kinsumer) copyTable(from, to, keyAttribute string) error {
+	var items []map[string]*dynamodb.AttributeValue
+	err := k.unrouted.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(from),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if key, ok := item["Key"]; ok && aws.StringValue(key.S) == migrationKey {
+			continue
+		}
+		input := &dynamodb.PutItemInput{
+			TableName:                aws.String(to),
+			Item:                     item,
+			ConditionExpression:      aws.String("attribute_not_exists(#key)"),
+			ExpressionAttributeNames: map[string]*string{"#key": aws.String(keyAttribute)},
+		}
+		for _, attribute := range versionAttributes {
+			if version, ok := item[attribute]; ok {
+				input.ConditionExpression = aws.String("attribute_not_exists(#key) OR #version < :version")
+				input.ExpressionAttributeNames["#version"] = aws.String(attribute)
+				input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":version": version}
+				break
+			}
+		}
+		if _, err := k.unrouted.PutItem(input); err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+				// The item is newer there
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigratingDynamo(t *testing.T) {
+	mock := mocks.NewMockDynamo([]string{"old", "new"})
+	d := newMigratingDynamo(mock, &recordingLogger{})
+	count := func(table string) int {
+		n := 0
+		err := mock.ScanPages(&dynamodb.ScanInput{TableName: aws.String(table)}, func(page *dynamodb.ScanOutput, last bool) bool {
+			n += len(page.Items)
+			return true
+		})
+		require.NoError(t, err)
+		return n
+	}
+	put := func(shard string) {
+		_, err := d.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("old"),
+			Item:      map[string]*dynamodb.AttributeValue{"Shard": {S: aws.String(shard)}},
+		})
+		require.NoError(t, err)
+	}
+	get := func(shard string) bool {
+		resp, err := d.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String("old"),
+			Key:       map[string]*dynamodb.AttributeValue{"Shard": {S: aws.String(shard)}},
+		})
+		require.NoError(t, err)
+		return resp.Item != nil
+	}
+
+	// Without a migration requests go where they were sent
+	put("a")
+	require.Equal(t, 1, count("old"))
+	require.Equal(t, 0, count("new"))
+
+	tables := map[string]string{"old": "new"}
+	d.set(MigrationDualWrite, tables)
+	put("b")
+	require.Equal(t, 2, count("old"))
+	require.Equal(t, 1, count("new"))
+	require.True(t, get("a"), "reads still go to the old table")
+
+	d.set(MigrationCutover, tables)
+	put("c")
+	require.Equal(t, 3, count("old"))
+	require.Equal(t, 2, count("new"))
+	require.False(t, get("a"), "reads go to the new table")
+
+	d.set(MigrationDone, tables)
+	put("d")
+	require.Equal(t, 3, count("old"))
+	require.Equal(t, 3, count("new"))
+}
+
+// tablesDynamo keeps the items of its tables by key, evaluating the conditions made of
+// attribute_not_exists(a), a = :v and a < :v terms joined by OR, which the dynamo mock ignores
+type tablesDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	keys   map[string]string // key attribute of each table
+	items  map[string]map[string]map[string]*dynamodb.AttributeValue
+	gets   int
+	writes []string // conditions of the writes made, by table
+}
+
+func newTablesDynamo(keys map[string]string) *tablesDynamo {
+	d := &tablesDynamo{keys: keys, items: make(map[string]map[string]map[string]*dynamodb.AttributeValue)}
+	for table := range keys {
+		d.items[table] = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	return d
+}
+
+func (d *tablesDynamo) key(table string, item map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(item[d.keys[table]].S)
+}
+
+// holds evaluates a condition on an item, nil if there is none
+func holds(item map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if condition == nil {
+		return true
+	}
+	attribute := func(name string) *dynamodb.AttributeValue {
+		if names[name] != nil {
+			name = *names[name]
+		}
+		return item[name]
+	}
+	scalar := func(v *dynamodb.AttributeValue) string {
+		if v == nil {
+			return ""
+		}
+		return aws.StringValue(v.S) + aws.StringValue(v.N)
+	}
+	for _, term := range strings.Split(*condition, " OR ") {
+		var name, op, value string
+		if _, err := fmt.Sscanf(term, "attribute_not_exists(%s", &name); err == nil {
+			if attribute(strings.TrimSuffix(name, ")")) == nil {
+				return true
+			}
+			continue
+		}
+		if _, err := fmt.Sscanf(term, "%s %s %s", &name, &op, &value); err != nil {
+			panic(term)
+		}
+		current, expected := scalar(attribute(name)), scalar(values[value])
+		if attribute(name) != nil && (op == "=" && current == expected || op == "<" && sequenceNumberLess(current, expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *tablesDynamo) DescribeTable(in *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	if _, ok := d.items[aws.StringValue(in.TableName)]; !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no such table", nil)
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableStatus: aws.String("ACTIVE")}}, nil
+}
+
+func (d *tablesDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	d.gets++
+	table := aws.StringValue(in.TableName)
+	return &dynamodb.GetItemOutput{Item: d.items[table][d.key(table, in.Key)]}, nil
+}
+
+func (d *tablesDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	out := &dynamodb.ScanOutput{}
+	for _, item := range d.items[aws.StringValue(in.TableName)] {
+		out.Items = append(out.Items, item)
+	}
+	fn(out, true)
+	return nil
+}
+
+func (d *tablesDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	table := aws.StringValue(in.TableName)
+	d.writes = append(d.writes, table+": "+aws.StringValue(in.ConditionExpression))
+	key := d.key(table, in.Item)
+	if !holds(d.items[table][key], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, awserr.New(conditionalFail, "condition doesn't hold", nil)
+	}
+	d.items[table][key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// UpdateItem only supports SET a = :v expressions
+func (d *tablesDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	table := aws.StringValue(in.TableName)
+	d.writes = append(d.writes, table+": "+aws.StringValue(in.ConditionExpression))
+	key := d.key(table, in.Key)
+	if !holds(d.items[table][key], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, awserr.New(conditionalFail, "condition doesn't hold", nil)
+	}
+	item := make(map[string]*dynamodb.AttributeValue)
+	for name, value := range d.items[table][key] {
+		item[name] = value
+	}
+	for name, value := range in.Key {
+		item[name] = value
+	}
+	for _, assignment := range strings.Split(strings.TrimPrefix(aws.StringValue(in.UpdateExpression), "SET "), ", ") {
+		parts := strings.Split(assignment, " = ")
+		item[parts[0]] = in.ExpressionAttributeValues[parts[1]]
+	}
+	d.items[table][key] = item
+	out := &dynamodb.UpdateItemOutput{}
+	if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllNew {
+		out.Attributes = item
+	}
+	return out, nil
+}
+
+func (d *tablesDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	table := aws.StringValue(in.TableName)
+	key := d.key(table, in.Key)
+	if !holds(d.items[table][key], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, awserr.New(conditionalFail, "condition doesn't hold", nil)
+	}
+	delete(d.items[table], key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// checkpointItem returns a checkpoint item of the given shard, lease token and last update
+func checkpointItem(shard, token, lastUpdate string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Shard":      {S: aws.String(shard)},
+		"LeaseToken": {N: aws.String(token)},
+		"LastUpdate": {N: aws.String(lastUpdate)},
+	}
+}
+
+func TestMirroredConditions(t *testing.T) {
+	db := newTablesDynamo(map[string]string{"old": "Shard", "new": "Shard"})
+	d := newMigratingDynamo(db, &recordingLogger{})
+	d.set(MigrationDualWrite, map[string]string{"old": "new"})
+	db.items["old"]["a"] = checkpointItem("a", "2", "10")
+	// A client that already cut over took the shard in the new table
+	db.items["new"]["a"] = checkpointItem("a", "3", "20")
+
+	// Our capture goes through the old table, its mirror doesn't overwrite the newer capture
+	_, err := d.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String("old"),
+		Item:                      checkpointItem("a", "3", "15"),
+		ConditionExpression:       aws.String("LeaseToken = :previousToken"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":previousToken": {N: aws.String("2")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "15", aws.StringValue(db.items["old"]["a"]["LastUpdate"].N))
+	require.Equal(t, "20", aws.StringValue(db.items["new"]["a"]["LastUpdate"].N))
+
+	// An update is mirrored as the item it returned, with the values of its condition only
+	db.items["new"]["a"] = checkpointItem("a", "3", "15")
+	out, err := d.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String("old"),
+		Key:                 map[string]*dynamodb.AttributeValue{"Shard": {S: aws.String("a")}},
+		UpdateExpression:    aws.String("SET SequenceNumber = :sequenceNumber"),
+		ConditionExpression: aws.String("LeaseToken = :leaseToken"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sequenceNumber": {S: aws.String("100")},
+			":leaseToken":     {N: aws.String("3")},
+		},
+	})
+	require.NoError(t, err)
+	require.Nil(t, out.Attributes, "the item wasn't asked for")
+	require.Equal(t, 0, db.gets, "the item isn't read back")
+	require.Equal(t, "100", aws.StringValue(db.items["new"]["a"]["SequenceNumber"].S))
+	require.Equal(t, []string{"old: LeaseToken = :previousToken", "new: LeaseToken = :previousToken",
+		"old: LeaseToken = :leaseToken", "new: LeaseToken = :leaseToken"}, db.writes)
+
+	names, values := expressionAttributes("#key = :key OR :other < :key", map[string]*string{"#key": aws.String("Key"), "#unused": aws.String("Unused")},
+		map[string]*dynamodb.AttributeValue{":key": {S: aws.String("k")}, ":keyed": {S: aws.String("x")}})
+	require.Equal(t, map[string]*string{"#key": aws.String("Key")}, names)
+	require.Equal(t, map[string]*dynamodb.AttributeValue{":key": {S: aws.String("k")}}, values)
+}
+
+func TestMigrateTables(t *testing.T) {
+	db := newTablesDynamo(map[string]string{
+		"app_clients": "ID", "app_checkpoints": "Shard", "app_metadata": "Key", "app_deduplication": "Key",
+		"next_clients": "ID", "next_checkpoints": "Shard", "next_metadata": "Key",
+	})
+	config := NewConfig().WithShardCheckFrequency(time.Millisecond).WithDeduplication(time.Hour, nil)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(k.MigrateTables("app"), ErrMigrationSameApplication))
+	require.Error(t, k.MigrateTables("next"), "the deduplication table doesn't exist")
+	db.items["next_deduplication"] = make(map[string]map[string]*dynamodb.AttributeValue)
+	db.keys["next_deduplication"] = "Key"
+	require.NoError(t, k.MigrateTables("next"))
+	require.Equal(t, ErrMigrationInProgress, k.MigrateTables("next"))
+	migration, err := k.MigrationStatus()
+	require.NoError(t, err)
+	require.Equal(t, MigrationDualWrite, migration.Phase)
+
+	db.items["app_checkpoints"]["a"] = checkpointItem("a", "1", "10")
+	db.items["app_checkpoints"]["b"] = checkpointItem("b", "1", "10")
+	db.items["app_deduplication"]["shard/1"] = map[string]*dynamodb.AttributeValue{
+		"Key": {S: aws.String("shard/1")}, "ExpiresAt": {N: aws.String("100")},
+	}
+	db.items["app_metadata"]["Bookmark:x"] = map[string]*dynamodb.AttributeValue{"Key": {S: aws.String("Bookmark:x")}}
+	// Written to both tables since the copy read it
+	db.items["next_checkpoints"]["b"] = checkpointItem("b", "2", "20")
+	db.items["next_metadata"]["Bookmark:x"] = map[string]*dynamodb.AttributeValue{
+		"Key": {S: aws.String("Bookmark:x")}, "SequenceNumbers": {M: map[string]*dynamodb.AttributeValue{}},
+	}
+
+	// The tables are copied once the clients had the time to notice the phase
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, k.advanceMigration())
+	migration, err = k.MigrationStatus()
+	require.NoError(t, err)
+	require.Equal(t, MigrationCutover, migration.Phase)
+	require.Equal(t, checkpointItem("a", "1", "10"), db.items["next_checkpoints"]["a"])
+	require.Equal(t, checkpointItem("b", "2", "20"), db.items["next_checkpoints"]["b"], "newer items aren't overwritten")
+	require.NotNil(t, db.items["next_metadata"]["Bookmark:x"]["SequenceNumbers"], "items without a version are only added")
+	require.NotNil(t, db.items["next_deduplication"]["shard/1"], "the processed records are migrated")
+	require.Nil(t, db.items["next_metadata"][migrationKey], "the migration stays in the old table")
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, k.advanceMigration())
+	migration, err = k.MigrationStatus()
+	require.NoError(t, err)
+	require.Equal(t, MigrationDone, migration.Phase)
+}
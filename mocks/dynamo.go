@@ -50,7 +50,7 @@ type mockDynamoCallRecord struct {
 }
 
 // MockDynamo mocks the DynamoDB API in memory. It only supports GetItem,
-// PutItem, and ScanPages. It only supports the most simple filter expressions:
+// PutItem, DeleteItem, and ScanPages. It only supports the most simple filter expressions:
 // they must be of the form <column> <operator> :<value>, and operator must be
 // =, <, <=, >, >=, or <>.
 type MockDynamo struct {
@@ -167,6 +167,40 @@ ItemLoop:
 	return &dynamodb.GetItemOutput{Item: match}, nil
 }
 
+// DeleteItem mocks the dynamo DeleteItem method
+func (d *MockDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (out *dynamodb.DeleteItemOutput, err error) {
+	defer d.recordCall("DeleteItem", in, out, err)
+
+	if in.TableName == nil {
+		return nil, errMissingParameter("TableName")
+	}
+	if in.Key == nil {
+		return nil, errMissingParameter("Key")
+	}
+	if aws.StringValue(in.TableName) == mockDynamoErrorTrigger {
+		return nil, errInternalError()
+	}
+
+	tableName := aws.StringValue(in.TableName)
+	if _, ok := d.tables[tableName]; !ok {
+		return nil, errTableNotFound(tableName)
+	}
+
+	var kept []mockDynamoItem
+ItemLoop:
+	for _, item := range d.tables[tableName] {
+		for col, operand := range in.Key {
+			if !item.applyFilter(dynamoFilter{col: col, comp: attrEqual, operand: operand}) {
+				kept = append(kept, item)
+				continue ItemLoop
+			}
+		}
+	}
+	d.tables[tableName] = kept
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
 // ScanPages mocks the dynamo ScanPages method
 func (d *MockDynamo) ScanPages(in *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool) (err error) {
 	defer d.recordCall("ScanPages", in, nil, err)
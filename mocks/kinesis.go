@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package mocks
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// shards per page when listing shards
+var mockKinesisPageSize = 2
+
+// MockKinesis mocks the Kinesis API in memory. It only supports ListShards, with AFTER_SHARD_ID
+// shard filters.
+type MockKinesis struct {
+	kinesisiface.KinesisAPI
+
+	// Stored data
+	streamName string
+	shards     []*kinesis.Shard
+
+	// Diagnostic tools
+	ListShardsCalls int
+}
+
+// NewMockKinesis gets a kinesis interface for testing, with a single stream with the given shards
+func NewMockKinesis(streamName string, shards []*kinesis.Shard) *MockKinesis {
+	return &MockKinesis{
+		streamName: streamName,
+		shards:     shards,
+	}
+}
+
+// ListShards mocks the kinesis ListShards method
+func (k *MockKinesis) ListShards(in *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	k.ListShardsCalls++
+
+	// The next token is the index of the next shard, followed by the shard ID listed after
+	start := 0
+	after := ""
+	if in.NextToken != nil {
+		if in.StreamName != nil {
+			return nil, awserr.New("InvalidArgumentException", "NextToken and StreamName cannot be provided together", nil)
+		}
+		token := strings.SplitN(aws.StringValue(in.NextToken), "/", 2)
+		var err error
+		if start, err = strconv.Atoi(token[0]); err != nil || len(token) != 2 {
+			return nil, awserr.New("InvalidArgumentException", "invalid NextToken", err)
+		}
+		after = token[1]
+	} else if aws.StringValue(in.StreamName) != k.streamName {
+		return nil, awserr.New("ResourceNotFoundException", "stream not found", nil)
+	} else if filter := in.ShardFilter; filter != nil {
+		if aws.StringValue(filter.Type) != kinesis.ShardFilterTypeAfterShardId {
+			return nil, awserr.New("InvalidArgumentException", "only AFTER_SHARD_ID shard filters are supported", nil)
+		}
+		after = aws.StringValue(filter.ShardId)
+	}
+
+	shards := k.shards
+	if after != "" {
+		shards = nil
+		for _, shard := range k.shards {
+			if aws.StringValue(shard.ShardId) > after {
+				shards = append(shards, shard)
+			}
+		}
+	}
+	end := start + mockKinesisPageSize
+	out := &kinesis.ListShardsOutput{}
+	if end < len(shards) {
+		out.NextToken = aws.String(strconv.Itoa(end) + "/" + after)
+	} else {
+		end = len(shards)
+	}
+	out.Shards = shards[start:end]
+	return out, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// redelivery is a nacked record waiting to be delivered again
+type redelivery struct {
+	record *consumedRecord
+	due    time.Time
+}
+
+// redeliveryQueue holds the nacked records until they are due for redelivery
+type redeliveryQueue struct {
+	mutex   sync.Mutex
+	pending []redelivery  // sorted by due time
+	wake    chan struct{} // signaled when a record is added, so the main loop can recompute when the next one is due
+}
+
+func newRedeliveryQueue() *redeliveryQueue {
+	return &redeliveryQueue{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// push adds a record to redeliver at the given time
+func (q *redeliveryQueue) push(cr *consumedRecord, due time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i := sort.Search(len(q.pending), func(i int) bool { return q.pending[i].due.After(due) })
+	q.pending = append(q.pending, redelivery{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = redelivery{record: cr, due: due}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next record due for redelivery, skipping the ones of shards we don't own anymore.
+// If no record is due, it returns how long until the next one is, or 0 if there are none.
+func (q *redeliveryQueue) pop(now time.Time) (*consumedRecord, time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.pending) > 0 {
+		next := q.pending[0]
+		if next.due.After(now) {
+			return nil, next.due.Sub(now)
+		}
+		q.pending = q.pending[1:]
+		if next.record.checkpointer.isCaptured() {
+			return next.record, 0
+		}
+	}
+	return nil, 0
+}
+
+// reset drops all the records waiting for redelivery
+func (q *redeliveryQueue) reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = nil
+}
+
+// Nack negatively acknowledges a record returned by NextRecord, so that it is returned again after
+// the given delay, without holding back the other records of its shard. Until the record has been
+// redelivered the checkpoint of its shard doesn't move past it, so it is read again from kinesis if
+// the shard changes owner in the meantime. With a dead-letter sink, a record nacked too many times
+// is sent to the sink with ErrTooManyNacks instead. Returns ErrShardNotOwned if this client doesn't
+// own the shard of the record anymore.
+func (k *Kinsumer) Nack(record *Record, delay time.Duration) error {
+	if record == nil || record.consumed == nil {
+		return ErrUnknownRecord
+	}
+	return k.failRecord(record, delay, ErrTooManyNacks)
+}
+
+// sequenceNumberLess returns whether the sequence number a is before b. Sequence numbers are
+// decimal numbers too large for an int64, the empty string is before any sequence number.
+func sequenceNumberLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedeliveryQueue(t *testing.T) {
+	owned := &checkpointer{captured: true}
+	released := &checkpointer{}
+	record := func(cp *checkpointer, seq string) *consumedRecord {
+		return &consumedRecord{
+			record:       &kinesis.Record{SequenceNumber: aws.String(seq)},
+			checkpointer: cp,
+		}
+	}
+
+	now := time.Now()
+	q := newRedeliveryQueue()
+	cr, wait := q.pop(now)
+	require.Nil(t, cr)
+	require.Equal(t, time.Duration(0), wait)
+
+	q.push(record(owned, "2"), now.Add(2*time.Second))
+	q.push(record(released, "1"), now.Add(time.Second))
+	q.push(record(owned, "3"), now.Add(3*time.Second))
+
+	cr, wait = q.pop(now)
+	require.Nil(t, cr)
+	require.Equal(t, time.Second, wait)
+
+	// The record of the released shard is skipped
+	cr, _ = q.pop(now.Add(2 * time.Second))
+	require.Equal(t, "2", aws.StringValue(cr.record.SequenceNumber))
+	cr, wait = q.pop(now.Add(2 * time.Second))
+	require.Nil(t, cr)
+	require.Equal(t, time.Second, wait)
+
+	q.reset()
+	cr, wait = q.pop(now.Add(time.Hour))
+	require.Nil(t, cr)
+	require.Equal(t, time.Duration(0), wait)
+}
+
+func TestSequenceNumberLess(t *testing.T) {
+	require.True(t, sequenceNumberLess("", "1"))
+	require.True(t, sequenceNumberLess("9", "10"))
+	require.True(t, sequenceNumberLess("49590338271490256608559692538361571095921575989136588898",
+		"49590338271490256608559692540925702759324208523137515618"))
+	require.False(t, sequenceNumberLess("10", "9"))
+	require.False(t, sequenceNumberLess("10", "10"))
+}
@@ -17,3 +17,48 @@ func (*NoopStatReceiver) EventToClient(inserted, retrieved time.Time) {}
 
 // EventsFromKinesis implementation that doesn't do anything
 func (*NoopStatReceiver) EventsFromKinesis(num int, shardID string, lag time.Duration) {}
+
+// EventsForKey implementation that doesn't do anything
+func (*NoopStatReceiver) EventsForKey(num int, size int, key string) {}
+
+// BufferOccupancy implementation that doesn't do anything
+func (*NoopStatReceiver) BufferOccupancy(buffered, capacity int) {}
+
+// TimeSinceDrained implementation that doesn't do anything
+func (*NoopStatReceiver) TimeSinceDrained(elapsed time.Duration) {}
+
+// ShardBufferOccupancy implementation that doesn't do anything
+func (*NoopStatReceiver) ShardBufferOccupancy(shardID string, buffered, capacity int) {}
+
+// BufferBlocked implementation that doesn't do anything
+func (*NoopStatReceiver) BufferBlocked(shardID string, blocked time.Duration) {}
+
+// EventsDropped implementation that doesn't do anything
+func (*NoopStatReceiver) EventsDropped(num int, shardID string) {}
+
+// IteratorExpired implementation that doesn't do anything
+func (*NoopStatReceiver) IteratorExpired(shardID string) {}
+
+// CheckpointExpired implementation that doesn't do anything
+func (*NoopStatReceiver) CheckpointExpired(shardID string) {}
+
+// StreamFailedOver implementation that doesn't do anything
+func (*NoopStatReceiver) StreamFailedOver(streamName, region string) {}
+
+// Throttled implementation that doesn't do anything
+func (*NoopStatReceiver) Throttled(operation string, delay time.Duration) {}
+
+// DeadLettered implementation that doesn't do anything
+func (*NoopStatReceiver) DeadLettered(shardID string) {}
+
+// DecompressionFailed implementation that doesn't do anything
+func (*NoopStatReceiver) DecompressionFailed(shardID string) {}
+
+// CorruptRecord implementation that doesn't do anything
+func (*NoopStatReceiver) CorruptRecord(shardID string) {}
+
+// ShardRecovered implementation that doesn't do anything
+func (*NoopStatReceiver) ShardRecovered(shardID string, checkpointAge, backlog time.Duration) {}
+
+// Deduplicated implementation that doesn't do anything
+func (*NoopStatReceiver) Deduplicated(shardID string) {}
@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// arrivalMerger holds the records of all our shards, and hands them out in approximate arrival time
+// order across shards while keeping the order of the records of each shard. It is only used by the
+// main loop, so it isn't safe for concurrent use.
+type arrivalMerger struct {
+	window time.Duration                // how long after its arrival in kinesis a record is held, waiting for earlier ones
+	max    int                          // records held before handing out the earliest one regardless of the window
+	shards map[string][]*consumedRecord // records held by shard, in shard order
+	size   int                          // number of records held
+}
+
+func newArrivalMerger(window time.Duration, max int) *arrivalMerger {
+	return &arrivalMerger{
+		window: window,
+		max:    max,
+		shards: make(map[string][]*consumedRecord),
+	}
+}
+
+// push holds a record until it is its turn
+func (m *arrivalMerger) push(cr *consumedRecord) {
+	shardID := cr.checkpointer.shardID
+	m.shards[shardID] = append(m.shards[shardID], cr)
+	m.size++
+}
+
+// full returns whether we shouldn't take more records until one is handed out
+func (m *arrivalMerger) full() bool {
+	return m.size >= m.max
+}
+
+// pop returns the earliest record to arrive among the first records of every shard, if it arrived at
+// least window ago or we are full. Otherwise it returns how long until it is due, or 0 if we are empty.
+func (m *arrivalMerger) pop(now time.Time) (*consumedRecord, time.Duration) {
+	var earliest string
+	var arrival time.Time
+	for shardID, records := range m.shards {
+		t := aws.TimeValue(records[0].record.ApproximateArrivalTimestamp)
+		if earliest == "" || t.Before(arrival) {
+			earliest = shardID
+			arrival = t
+		}
+	}
+	if earliest == "" {
+		return nil, 0
+	}
+
+	if due := arrival.Add(m.window); due.After(now) && !m.full() {
+		return nil, due.Sub(now)
+	}
+
+	records := m.shards[earliest]
+	cr := records[0]
+	if len(records) == 1 {
+		delete(m.shards, earliest)
+	} else {
+		m.shards[earliest] = records[1:]
+	}
+	m.size--
+	return cr, 0
+}
+
+// reset drops every record held
+func (m *arrivalMerger) reset() {
+	m.shards = make(map[string][]*consumedRecord)
+	m.size = 0
+}
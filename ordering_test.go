@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrivalMerger(t *testing.T) {
+	now := time.Now()
+	shard0 := &checkpointer{shardID: "shard0"}
+	shard1 := &checkpointer{shardID: "shard1"}
+	record := func(cp *checkpointer, seq string, arrival time.Time) *consumedRecord {
+		return &consumedRecord{
+			record: &kinesis.Record{
+				SequenceNumber:              aws.String(seq),
+				ApproximateArrivalTimestamp: aws.Time(arrival),
+			},
+			checkpointer: cp,
+		}
+	}
+	popped := func(m *arrivalMerger, at time.Time) string {
+		cr, _ := m.pop(at)
+		if cr == nil {
+			return ""
+		}
+		return aws.StringValue(cr.record.SequenceNumber)
+	}
+
+	m := newArrivalMerger(time.Second, 10)
+	cr, wait := m.pop(now)
+	require.Nil(t, cr)
+	require.Equal(t, time.Duration(0), wait)
+
+	m.push(record(shard0, "0a", now.Add(-900*time.Millisecond)))
+	m.push(record(shard0, "0b", now.Add(-100*time.Millisecond)))
+	m.push(record(shard1, "1a", now.Add(-500*time.Millisecond)))
+
+	// Nothing arrived a second ago yet
+	cr, wait = m.pop(now)
+	require.Nil(t, cr)
+	require.Equal(t, 100*time.Millisecond, wait)
+
+	later := now.Add(time.Second)
+	require.Equal(t, "0a", popped(m, later))
+	require.Equal(t, "1a", popped(m, later))
+	require.Equal(t, "0b", popped(m, later))
+	require.Equal(t, "", popped(m, later))
+
+	// Records of a shard stay in order even if their timestamps don't
+	m.push(record(shard0, "0c", now))
+	m.push(record(shard0, "0d", now.Add(-time.Hour)))
+	require.Equal(t, "0c", popped(m, later))
+	require.Equal(t, "0d", popped(m, later))
+}
+
+func TestArrivalMergerFull(t *testing.T) {
+	now := time.Now()
+	m := newArrivalMerger(time.Minute, 2)
+	cp := &checkpointer{shardID: "shard0"}
+	for _, seq := range []string{"a", "b"} {
+		m.push(&consumedRecord{
+			record:       &kinesis.Record{SequenceNumber: aws.String(seq), ApproximateArrivalTimestamp: aws.Time(now)},
+			checkpointer: cp,
+		})
+	}
+	require.True(t, m.full())
+
+	// The earliest record is handed out without waiting when we are full
+	cr, _ := m.pop(now)
+	require.Equal(t, "a", aws.StringValue(cr.record.SequenceNumber))
+	require.False(t, m.full())
+
+	m.reset()
+	cr, _ = m.pop(now.Add(time.Hour))
+	require.Nil(t, cr)
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// pacingBurst is how much record data delivery pacing lets through at once, at its rate
+const pacingBurst = 10 * time.Millisecond
+
+// newPacingBucket returns a token bucket of bytes that starts empty and only holds pacingBurst
+// worth of bytes, so the records are spaced out at the rate even after a quiet period
+func newPacingBucket(bytesPerSecond float64) *tokenBucket {
+	b := newTokenBucket(bytesPerSecond)
+	b.burst = bytesPerSecond * pacingBurst.Seconds()
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = 0
+	return b
+}
+
+// paceBuffered waits until there is room for size bytes of record data in the buffer with delivery
+// pacing, committing the checkpoint while it waits, then accounts for them. The wait is how long
+// pacing takes to deliver the excess, and a record larger than the max goes through once the buffer
+// is empty. Returns false if the consumer should stop.
+func (k *Kinsumer) paceBuffered(cp *checkpointer, size int, commitTicker *time.Ticker, commitBackoff *backoff) bool {
+	if k.config.pacingMaxBytes > 0 {
+		for {
+			buffered := atomic.LoadInt64(&k.bufferedBytes)
+			excess := buffered + int64(size) - k.config.pacingMaxBytes
+			if buffered == 0 || excess <= 0 {
+				break
+			}
+			delay := time.Duration(float64(excess) / k.config.pacingBytesPerSecond * float64(time.Second))
+			if delay < pacingBurst {
+				delay = pacingBurst
+			}
+			if !k.waitForShardRateLimit(cp, delay, commitTicker, commitBackoff) {
+				return false
+			}
+		}
+	}
+	atomic.AddInt64(&k.bufferedBytes, int64(size))
+	return true
+}
+
+// unbuffered accounts for a record leaving the buffer with delivery pacing, when it is returned for
+// the first time or dropped
+func (k *Kinsumer) unbuffered(cr *consumedRecord) {
+	if k.config.pacingBytesPerSecond > 0 && !cr.redelivered {
+		atomic.AddInt64(&k.bufferedBytes, -int64(len(cr.record.Data)))
+	}
+}
+
+// BufferedBytes returns the bytes of record data buffered and not returned yet, which are only
+// counted with Config.WithDeliveryPacing.
+func (k *Kinsumer) BufferedBytes() int64 {
+	return atomic.LoadInt64(&k.bufferedBytes)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacingBucket(t *testing.T) {
+	now := time.Now()
+	b := newPacingBucket(1000)
+
+	// Nothing goes through at once, even after a quiet period
+	require.Equal(t, 100*time.Millisecond, b.take(now, 100))
+	now = now.Add(time.Hour)
+	require.Equal(t, 90*time.Millisecond, b.take(now, 100), "only 10ms worth of bytes were saved")
+
+	// Pacing slows down the rate limit
+	l := newRateLimiter(0, 1e6)
+	l.pacing = newPacingBucket(1000)
+	require.Equal(t, time.Second, l.take(now, 1000))
+}
+
+func TestPaceBuffered(t *testing.T) {
+	config := NewConfig().WithDeliveryPacing(1000, 100)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+	k.stop = make(chan struct{})
+	cp := &checkpointer{shardID: "shard", captured: true}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	commitBackoff := &backoff{policy: k.config.throttleBackoff}
+
+	// A record larger than the max goes through an empty buffer
+	require.True(t, k.paceBuffered(cp, 150, ticker, commitBackoff))
+	require.Equal(t, int64(150), k.BufferedBytes())
+
+	// The next one waits until the buffer was delivered
+	close(k.stop)
+	require.False(t, k.paceBuffered(cp, 10, ticker, commitBackoff))
+	require.Equal(t, int64(150), k.BufferedBytes())
+	k.unbuffered(&consumedRecord{record: &kinesis.Record{SequenceNumber: aws.String("1"), Data: make([]byte, 150)}})
+	require.True(t, k.paceBuffered(cp, 10, ticker, commitBackoff))
+	require.Equal(t, int64(10), k.BufferedBytes())
+
+	// Redelivered records were already accounted for
+	k.unbuffered(&consumedRecord{record: &kinesis.Record{Data: make([]byte, 10)}, redelivered: true})
+	require.Equal(t, int64(10), k.BufferedBytes())
+
+	config = NewConfig().WithDeliveryPacing(0, 100)
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidDeliveryPacing))
+}
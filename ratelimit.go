@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import "time"
+
+// tokenBucket is a token bucket refilled at rate tokens per second, holding at most burst tokens.
+// Taking more tokens than there are puts the bucket in debt, so a take larger than the burst still
+// goes through once enough time has passed. It isn't safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	// Allow bursts of a second worth of tokens, and at least one token
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// take takes n tokens and returns how long to wait until the bucket is out of debt
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the records and bytes per second going through it, it isn't safe for concurrent use
+type rateLimiter struct {
+	records *tokenBucket // nil if the number of records isn't limited
+	bytes   *tokenBucket // nil if the number of bytes isn't limited
+	pacing  *tokenBucket // nil if the delivery isn't paced
+}
+
+// newRateLimiter returns a rate limiter, or nil if neither the records nor the bytes are limited
+func newRateLimiter(recordsPerSecond, bytesPerSecond float64) *rateLimiter {
+	if recordsPerSecond == 0 && bytesPerSecond == 0 {
+		return nil
+	}
+	l := &rateLimiter{}
+	if recordsPerSecond > 0 {
+		l.records = newTokenBucket(recordsPerSecond)
+	}
+	if bytesPerSecond > 0 {
+		l.bytes = newTokenBucket(bytesPerSecond)
+	}
+	return l
+}
+
+// take accounts for a record of the given size, and returns how long to wait before it can go through
+func (l *rateLimiter) take(now time.Time, size int) time.Duration {
+	var wait time.Duration
+	if l.records != nil {
+		wait = l.records.take(now, 1)
+	}
+	for _, b := range []*tokenBucket{l.bytes, l.pacing} {
+		if b == nil {
+			continue
+		}
+		if w := b.take(now, float64(size)); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// waitForShardRateLimit waits for the given delay before a record of the shard can be buffered, committing
+// the checkpoint while it waits. Returns false if the consumer should stop.
+func (k *Kinsumer) waitForShardRateLimit(cp *checkpointer, delay time.Duration, commitTicker *time.Ticker, commitBackoff *backoff) bool {
+	wait := time.After(delay)
+	for {
+		select {
+		case <-wait:
+			return true
+		case <-k.stop:
+			return false
+		case <-commitTicker.C:
+			finishCommitted, err := k.commitCheckpoint(cp, commitBackoff)
+			if err != nil {
+				k.shardErrors <- shardConsumerError{shardID: cp.shardID, action: "checkpointer.commit", err: err}
+				return false
+			}
+			if finishCommitted {
+				return false
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10)
+
+	// A full second worth of tokens is available right away
+	for i := 0; i < 10; i++ {
+		require.Equal(t, time.Duration(0), b.take(now, 1))
+	}
+	require.Equal(t, 100*time.Millisecond, b.take(now, 1))
+
+	// Refilled after a while, but never past the burst
+	now = now.Add(time.Hour)
+	require.Equal(t, time.Duration(0), b.take(now, 10))
+	require.Equal(t, time.Second, b.take(now, 10))
+}
+
+func TestRateLimiter(t *testing.T) {
+	require.Nil(t, newRateLimiter(0, 0))
+
+	now := time.Now()
+	l := newRateLimiter(0, 1000)
+	require.Nil(t, l.records)
+	require.Equal(t, time.Duration(0), l.take(now, 1000))
+	// Records larger than the burst go through once the debt is paid off
+	require.Equal(t, 2*time.Second, l.take(now, 2000))
+
+	// The longest wait wins
+	l = newRateLimiter(1, 1000)
+	require.Equal(t, time.Duration(0), l.take(now, 10))
+	require.Equal(t, time.Second, l.take(now, 10))
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync"
+	"time"
+)
+
+// ShardRecovery is where this client resumed consuming a shard after Run was called
+type ShardRecovery struct {
+	ShardID string
+	// Checkpointed sequence number the shard was resumed after, empty if it had no checkpoint
+	SequenceNumber string
+	// Iterator type the shard was resumed with, AFTER_SEQUENCE_NUMBER when resuming after the checkpoint
+	IteratorType string
+	// How long before the shard was captured its checkpoint was last written, 0 if it had none
+	CheckpointAge time.Duration
+	// How far behind the tip of the stream the shard was, according to the first GetRecords call
+	Backlog time.Duration
+}
+
+// RecoveryReport tells how much reprocessing starting the client caused, for the shards it was
+// assigned when Run was called
+type RecoveryReport struct {
+	StartedAt time.Time
+	Shards    []ShardRecovery
+	// Whether every shard is in the report, it is cut short if the shards are reassigned before
+	// all of them were read
+	Complete bool
+}
+
+// RecoveryHook is called with the RecoveryReport once Run started consuming all its shards
+type RecoveryHook func(report *RecoveryReport)
+
+// recovery collects the RecoveryReport as the shard workers start
+type recovery struct {
+	mutex   sync.Mutex
+	pending map[string]bool // shards not in the report yet
+	report  *RecoveryReport
+	done    bool
+}
+
+func newRecovery() *recovery {
+	return &recovery{pending: make(map[string]bool)}
+}
+
+// start starts collecting the report for the shards assigned when Run was called
+func (r *recovery) start(startedAt time.Time, shardIDs []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.report = &RecoveryReport{StartedAt: startedAt}
+	for _, shardID := range shardIDs {
+		r.pending[shardID] = true
+	}
+	if len(shardIDs) == 0 {
+		r.done = true
+		r.report.Complete = true
+	}
+}
+
+// add adds a shard to the report, and returns the report if it is now complete
+func (r *recovery) add(shard ShardRecovery) *RecoveryReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.done || !r.pending[shard.ShardID] {
+		return nil
+	}
+	delete(r.pending, shard.ShardID)
+	r.report.Shards = append(r.report.Shards, shard)
+	if len(r.pending) > 0 {
+		return nil
+	}
+	r.done = true
+	r.report.Complete = true
+	return r.report
+}
+
+// cut ends the report with the shards added so far, and returns it unless it was already ended
+func (r *recovery) cut() *RecoveryReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.done || r.report == nil {
+		return nil
+	}
+	r.done = true
+	return r.report
+}
+
+// finished returns the report if it ended
+func (r *recovery) finished() *RecoveryReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.done {
+		return nil
+	}
+	return r.report
+}
+
+// shardRecovered adds a shard worker's starting position to the RecoveryReport
+func (k *Kinsumer) shardRecovered(shard ShardRecovery) {
+	if stats, ok := k.config.stats.(RecoveryStatReceiver); ok {
+		stats.ShardRecovered(shard.ShardID, shard.CheckpointAge, shard.Backlog)
+	}
+	k.publishRecovery(k.recovery.add(shard))
+}
+
+// publishRecovery logs the ended RecoveryReport and hands it to the RecoveryHook, report is nil
+// if it didn't end
+func (k *Kinsumer) publishRecovery(report *RecoveryReport) {
+	if report == nil {
+		return
+	}
+	k.logf(LevelInfo, "recovery", "", "Recovered %d shards %s after Run was called, complete: %t",
+		len(report.Shards), time.Since(report.StartedAt), report.Complete)
+	for _, s := range report.Shards {
+		position := s.IteratorType
+		if s.SequenceNumber != "" {
+			position += " " + s.SequenceNumber
+		}
+		k.logf(LevelInfo, "recovery", s.ShardID, "Recovered shard %s at %s, checkpoint written %s before, %s behind the stream",
+			s.ShardID, position, s.CheckpointAge, s.Backlog)
+	}
+	if k.config.recoveryHook != nil {
+		k.config.recoveryHook(report)
+	}
+}
+
+// RecoveryReport returns where this client resumed the shards it was assigned when Run was called,
+// nil until all of them were read once or reassigned
+func (k *Kinsumer) RecoveryReport() *RecoveryReport {
+	return k.recovery.finished()
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryReport(t *testing.T) {
+	var reports []*RecoveryReport
+	config := NewConfig().WithLogger(&recordingLogger{}).WithRecoveryHook(func(report *RecoveryReport) {
+		reports = append(reports, report)
+	})
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	k.recovery.start(time.Now(), []string{"shard1", "shard2"})
+	k.shardRecovered(ShardRecovery{ShardID: "shard1", SequenceNumber: "1", CheckpointAge: time.Minute, Backlog: time.Hour})
+	require.Nil(t, k.RecoveryReport())
+	require.Empty(t, reports)
+
+	// Shards that weren't assigned when Run was called are left out
+	k.shardRecovered(ShardRecovery{ShardID: "shard3"})
+	k.shardRecovered(ShardRecovery{ShardID: "shard2"})
+	report := k.RecoveryReport()
+	require.NotNil(t, report)
+	require.True(t, report.Complete)
+	require.Len(t, report.Shards, 2)
+	require.Equal(t, time.Hour, report.Shards[0].Backlog)
+	require.Equal(t, []*RecoveryReport{report}, reports)
+
+	// Reassigning the shards doesn't report it again
+	require.Nil(t, k.recovery.cut())
+}
+
+func TestRecoveryReportCut(t *testing.T) {
+	r := newRecovery()
+	require.Nil(t, r.cut(), "Run wasn't called")
+
+	r.start(time.Now(), []string{"shard1", "shard2"})
+	require.Nil(t, r.add(ShardRecovery{ShardID: "shard1"}))
+	report := r.cut()
+	require.NotNil(t, report)
+	require.False(t, report.Complete)
+	require.Len(t, report.Shards, 1)
+	require.Nil(t, r.add(ShardRecovery{ShardID: "shard2"}))
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import "fmt"
+
+// A Redactor returns the given text without the sensitive data, such as PII, that record payloads
+// may have left in it. It is called from multiple go routines.
+type Redactor func(text string) string
+
+// redactedError is an error whose message was redacted, it still unwraps to the original error
+type redactedError struct {
+	err  error
+	text string
+}
+
+func (e *redactedError) Error() string {
+	return e.text
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with its message redacted by the configured Redactor
+func (k *Kinsumer) redactError(err error) error {
+	redactor := k.config.redactor
+	if redactor == nil || err == nil {
+		return err
+	}
+	return &redactedError{err: err, text: redactor(err.Error())}
+}
+
+// redactPanic returns the value of a panic redacted by the configured Redactor, as a string
+// unless there is no Redactor
+func (k *Kinsumer) redactPanic(value interface{}) interface{} {
+	redactor := k.config.redactor
+	if redactor == nil {
+		return value
+	}
+	return redactor(fmt.Sprint(value))
+}
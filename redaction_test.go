@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	var causes []error
+	sink := DeadLetterFunc(func(record *Record, cause error) error {
+		causes = append(causes, cause)
+		return nil
+	})
+	logger := &recordingLogger{}
+	redactor := func(text string) string {
+		return strings.Replace(text, "jane@example.com", "<redacted>", -1)
+	}
+	config := NewConfig().WithLogger(logger).WithDeadLetterSink(sink, 1).WithRedactor(redactor)
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	record := &Record{
+		ShardID:        "shard",
+		SequenceNumber: "1",
+		consumed: &consumedRecord{
+			record:       &kinesis.Record{SequenceNumber: aws.String("1")},
+			checkpointer: &checkpointer{shardID: "shard", captured: true},
+		},
+	}
+	bad := errors.New("invalid email jane@example.com")
+	require.NoError(t, k.failRecord(record, 0, bad))
+
+	require.Len(t, causes, 1)
+	require.Equal(t, "invalid email <redacted>", causes[0].Error())
+	require.True(t, errors.Is(causes[0], bad))
+	for _, line := range logger.lines {
+		require.NotContains(t, line, "jane@example.com")
+	}
+	require.Equal(t, "<redacted>", k.redactPanic("jane@example.com"))
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// liveConfig holds the settings that UpdateConfig can change while we run. They are read by the
+// shard consumers and the main loop, so they are only accessed atomically, and must be used instead
+// of the corresponding Config fields.
+type liveConfig struct {
+	throttleDelay   int64 // time.Duration
+	commitFrequency int64 // time.Duration
+	getRecordsLimit int64
+	bufferSize      int64
+}
+
+func newLiveConfig(c *Config) *liveConfig {
+	l := &liveConfig{}
+	l.set(c)
+	return l
+}
+
+// set replaces the live settings with the ones of the given config
+func (l *liveConfig) set(c *Config) {
+	atomic.StoreInt64(&l.throttleDelay, int64(c.throttleDelay))
+	atomic.StoreInt64(&l.commitFrequency, int64(c.commitFrequency))
+	atomic.StoreInt64(&l.getRecordsLimit, c.getRecordsLimit)
+	atomic.StoreInt64(&l.bufferSize, int64(c.bufferSize))
+}
+
+func (l *liveConfig) getThrottleDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.throttleDelay))
+}
+
+func (l *liveConfig) getCommitFrequency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.commitFrequency))
+}
+
+func (l *liveConfig) getGetRecordsLimit() int64 {
+	return atomic.LoadInt64(&l.getRecordsLimit)
+}
+
+func (l *liveConfig) getBufferSize() int {
+	return int(atomic.LoadInt64(&l.bufferSize))
+}
+
+// LiveConfig holds the settings UpdateConfig changes on a Kinsumer. A zero field leaves the setting
+// unchanged.
+type LiveConfig struct {
+	// ThrottleDelay is the setting of Config.WithThrottleDelay
+	ThrottleDelay time.Duration
+	// CommitFrequency is the setting of Config.WithCommitFrequency
+	CommitFrequency time.Duration
+	// GetRecordsLimit is the setting of Config.WithGetRecordsLimit
+	GetRecordsLimit int64
+	// BufferSize is the setting of Config.WithBufferSize
+	BufferSize int
+}
+
+// UpdateConfig changes the throttle delay, commit frequency, GetRecords limit and buffer size of a
+// Kinsumer, whether it is running or not. The shard workers pick up the new throttle delay, commit
+// frequency and GetRecords limit as they go. A new buffer size pauses the shard workers while the
+// buffered records are moved to a new buffer, after the application took the ones that don't fit in
+// a smaller one. The client keeps its shards, so the other clients are not affected.
+func (k *Kinsumer) UpdateConfig(update LiveConfig) error {
+	config := k.config
+	config.throttleDelay = k.live.getThrottleDelay()
+	config.commitFrequency = k.live.getCommitFrequency()
+	config.getRecordsLimit = k.live.getGetRecordsLimit()
+	config.bufferSize = k.live.getBufferSize()
+	if update.ThrottleDelay != 0 {
+		config.throttleDelay = update.ThrottleDelay
+	}
+	if update.CommitFrequency != 0 {
+		config.commitFrequency = update.CommitFrequency
+	}
+	if update.GetRecordsLimit != 0 {
+		config.getRecordsLimit = update.GetRecordsLimit
+	}
+	if update.BufferSize != 0 {
+		config.bufferSize = update.BufferSize
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+	k.live.set(&config)
+
+	select {
+	case k.configUpdated <- struct{}{}:
+	default:
+		// An update is already pending
+	}
+	return nil
+}
+
+// lockBuffer returns the records buffer read locked against being replaced, the function unlocking
+// it, and a channel closed when it should be unlocked so that the buffer can be replaced. While the
+// buffer is being replaced it returns a nil buffer instead, and a channel closed once it was.
+func (k *Kinsumer) lockBuffer() (chan *consumedRecord, <-chan struct{}, func()) {
+	k.bufferMutex.RLock()
+	if resumed := k.bufferResumed; resumed != nil {
+		k.bufferMutex.RUnlock()
+		return nil, resumed, func() {}
+	}
+	return k.records, k.bufferPause, k.bufferMutex.RUnlock
+}
+
+// pauseBuffer stops the shard workers from putting records on the buffer, so that replaceBuffer can
+// replace it. It must only be called from the main loop.
+func (k *Kinsumer) pauseBuffer() {
+	// The workers waiting for room in the buffer unlock it
+	close(k.bufferPause)
+	k.bufferMutex.Lock()
+	defer k.bufferMutex.Unlock()
+	k.bufferPause = make(chan struct{})
+	k.bufferResumed = make(chan struct{})
+}
+
+// replaceBuffer replaces the buffer paused by pauseBuffer with one of the size set by UpdateConfig,
+// moving the buffered records to it, and lets the shard workers go on. Returns false while the
+// buffer holds more records than the new one would, the main loop takes them first. It must only be
+// called from the main loop.
+func (k *Kinsumer) replaceBuffer() bool {
+	size := k.live.getBufferSize()
+	if len(k.records) > size {
+		return false
+	}
+
+	k.bufferMutex.Lock()
+	defer k.bufferMutex.Unlock()
+	if size != cap(k.records) {
+		records := make(chan *consumedRecord, size)
+		for len(k.records) > 0 {
+			records <- <-k.records
+		}
+		k.setBuffer(records)
+	}
+	close(k.bufferResumed)
+	k.bufferResumed = nil
+	return true
+}
+
+// resizeBuffer replaces the records buffer if UpdateConfig changed its size. It must only be called
+// when no consumer is running.
+func (k *Kinsumer) resizeBuffer() bool {
+	size := k.live.getBufferSize()
+	if size == cap(k.records) {
+		return false
+	}
+
+	k.bufferMutex.Lock()
+	defer k.bufferMutex.Unlock()
+	k.setBuffer(make(chan *consumedRecord, size))
+	return true
+}
+
+// setBuffer makes records the records buffer. The write lock of bufferMutex must be held.
+func (k *Kinsumer) setBuffer(records chan *consumedRecord) {
+	k.records = records
+	k.health.setBuffer(k.records)
+	if k.merger != nil {
+		k.merger.max = cap(records)
+	}
+}
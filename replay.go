@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// replayedShard is the outcome of the replay of a shard
+type replayedShard struct {
+	shardID string
+	err     error
+}
+
+// Replay calls the handler with the records of the stream that arrived between from and to, as a
+// consumer group of its own that keeps no state: it doesn't register in the clients table nor write
+// checkpoints, so it can be called with the application name of the running clients without changing
+// where they resume, and Run doesn't have to be called. A to in the future waits for the records
+// until then.
+//
+// Up to parallelism shards are read at once, with the Config of the Kinsumer for the GetRecords
+// calls as for OpenShard. A shard is only read once its parents were, so the records of a partition
+// key are handed in order, but the handler is called from multiple go routines. The records are raw,
+// they don't go through the claim check, decompression or record filter. Replay stops at the first
+// error of the handler or of kinesis and returns it, or the error of the context if it is done first.
+func (k *Kinsumer) Replay(ctx context.Context, from, to time.Time, parallelism int, handler RecordHandler) error {
+	if !from.Before(to) {
+		return fmt.Errorf("%w: from %s to %s", ErrInvalidReplayRange, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	shards, err := loadShardsFromKinesis(k.kinesis, k.streamName)
+	if err != nil {
+		return err
+	}
+
+	// The parents that expired from the stream are done already
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[*shard.ShardId] = true
+	}
+	parents := make(map[string][]string, len(shards))
+	for _, shard := range shards {
+		for _, parentID := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+			if parentID != nil && listed[*parentID] {
+				parents[*shard.ShardId] = append(parents[*shard.ShardId], *parentID)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replayed := make(chan replayedShard, len(shards))
+	finished := make(map[string]bool, len(shards))
+	ready := func(shardID string) bool {
+		for _, parentID := range parents[shardID] {
+			if !finished[parentID] {
+				return false
+			}
+		}
+		return true
+	}
+
+	pending := sortedShardIDs(shards)
+	running := 0
+	for {
+		if err == nil {
+			waiting := pending[:0]
+			for _, shardID := range pending {
+				if running < parallelism && ready(shardID) {
+					running++
+					go func(shardID string) {
+						replayed <- replayedShard{shardID: shardID, err: k.replayShard(ctx, shardID, from, to, handler)}
+					}(shardID)
+				} else {
+					waiting = append(waiting, shardID)
+				}
+			}
+			pending = waiting
+		}
+		if running == 0 {
+			return err
+		}
+
+		shard := <-replayed
+		running--
+		finished[shard.shardID] = true
+		if shard.err != nil && err == nil {
+			// The other shards stop with the error of the context
+			err = shard.err
+			cancel()
+		}
+	}
+}
+
+// replayShard calls the handler with the records of the shard that arrived between from and to
+func (k *Kinsumer) replayShard(ctx context.Context, shardID string, from, to time.Time, handler RecordHandler) error {
+	defer k.recoverPanic("replayShard", shardID)
+	reader, err := k.OpenShard(ctx, shardID, ShardReaderFromAtTimestamp(from))
+	if err != nil {
+		return fmt.Errorf("error opening shard %s: %w", shardID, err)
+	}
+	defer reader.Close()
+	reader.until = to
+
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if record == nil || record.ApproximateArrivalTimestamp.After(to) {
+			return nil
+		}
+		if err := handler(record); err != nil {
+			return fmt.Errorf("error handling record %s of shard %s: %w", record.SequenceNumber, shardID, err)
+		}
+	}
+}
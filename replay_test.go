@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// replayKinesis serves shards with a record per second, the iterators being the shard ID and the
+// index of the next record
+type replayKinesis struct {
+	kinesisiface.KinesisAPI
+	start   time.Time
+	records map[string]int  // number of records per shard
+	closed  map[string]bool // whether the shard is closed
+}
+
+func (k *replayKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	index := int(in.Timestamp.Sub(k.start) / time.Second)
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(aws.StringValue(in.ShardId) + "/" + strconv.Itoa(index))}, nil
+}
+
+func (k *replayKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	parts := strings.Split(aws.StringValue(in.ShardIterator), "/")
+	shardID := parts[0]
+	index, _ := strconv.Atoi(parts[1])
+	out := &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}
+	// one record per page
+	if index < k.records[shardID] {
+		arrived := k.start.Add(time.Duration(index) * time.Second)
+		out.Records = []*kinesis.Record{{
+			SequenceNumber:              aws.String(strconv.Itoa(index)),
+			ApproximateArrivalTimestamp: &arrived,
+		}}
+		index++
+	}
+	if index < k.records[shardID] || !k.closed[shardID] {
+		out.NextShardIterator = aws.String(shardID + "/" + strconv.Itoa(index))
+	}
+	return out, nil
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	kin := &replayKinesis{
+		KinesisAPI: mocks.NewMockKinesis("stream", []*kinesis.Shard{
+			{ShardId: aws.String("parent")},
+			{ShardId: aws.String("child"), ParentShardId: aws.String("parent")},
+			{ShardId: aws.String("other"), ParentShardId: aws.String("expired")},
+		}),
+		start:   start,
+		records: map[string]int{"parent": 5, "child": 10, "other": 2},
+		closed:  map[string]bool{"parent": true},
+	}
+	k, err := NewWithInterfaces(kin, mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var replayed []string
+	err = k.Replay(context.Background(), start.Add(time.Second), start.Add(7*time.Second), 2, func(record *Record) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		replayed = append(replayed, record.ShardID+"/"+record.SequenceNumber)
+		return nil
+	})
+	require.NoError(t, err)
+	// The child is read after its parent, and both stop at the end of the range
+	require.Equal(t, []string{"parent/1", "parent/2", "parent/3", "parent/4", "child/1", "child/2", "child/3", "child/4",
+		"child/5", "child/6", "child/7"}, withoutShard(replayed, "other"))
+	require.Equal(t, []string{"other/1"}, withoutShard(withoutShard(replayed, "parent"), "child"))
+
+	// The first handler error stops the replay
+	failure := errors.New("failed")
+	err = k.Replay(context.Background(), start, start.Add(time.Minute), 3, func(record *Record) error {
+		return failure
+	})
+	require.True(t, errors.Is(err, failure))
+
+	err = k.Replay(context.Background(), start, start, 1, nil)
+	require.True(t, errors.Is(err, ErrInvalidReplayRange))
+}
+
+// withoutShard returns the replayed records that were not read from the given shard
+func withoutShard(replayed []string, shardID string) []string {
+	var records []string
+	for _, record := range replayed {
+		if !strings.HasPrefix(record, shardID+"/") {
+			records = append(records, record)
+		}
+	}
+	return records
+}
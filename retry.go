@@ -0,0 +1,334 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// A Retryer decides whether kinsumer retries a request to kinesis or dynamo that failed, and how long
+// it waits first. Throttled requests are not given to the Retryer, they are retried a few times as told
+// by the throttle BackoffPolicy. Its methods are called from multiple go routines.
+type Retryer interface {
+	// Retry returns how long to wait before retrying a request whose attempts, starting at 1, all
+	// failed, the last one with err, and false if the request shouldn't be retried
+	Retry(attempts int, err error) (time.Duration, bool)
+}
+
+// RetryPolicy is a Retryer that makes up to MaxAttempts attempts of a request, waiting as told by
+// Backoff between them, as long as it failed with an error Retryable returns true for. A nil
+// Retryable retries any AWS error that retrying could fix.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     BackoffPolicy
+	Retryable   func(err error) bool
+}
+
+// Retry implementation
+func (p RetryPolicy) Retry(attempts int, err error) (time.Duration, bool) {
+	if attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	if !retryable(err) {
+		return 0, false
+	}
+	return p.Backoff.Delay(attempts), true
+}
+
+// nonRetryableCodes are the codes of the AWS errors that a retry would fail with again, or that
+// kinsumer handles itself
+var nonRetryableCodes = map[string]bool{
+	dynamodb.ErrCodeConditionalCheckFailedException: true,
+	dynamodb.ErrCodeResourceNotFoundException:       true,
+	kinesis.ErrCodeInvalidArgumentException:         true,
+	kinesis.ErrCodeExpiredIteratorException:         true,
+	s3.ErrCodeNoSuchBucket:                          true,
+	s3.ErrCodeNoSuchKey:                             true,
+	"ValidationException":                           true,
+	"MissingParameter":                              true,
+	"AccessDeniedException":                         true,
+	"UnrecognizedClientException":                   true,
+	request.CanceledErrorCode:                       true,
+}
+
+// isRetryable returns whether err is an AWS error that retrying could fix
+func isRetryable(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	return !nonRetryableCodes[awsErr.Code()]
+}
+
+// finalError is returned to a retrier by a request that must not be retried whatever its error
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string {
+	return e.err.Error()
+}
+
+// incrementPattern matches the update expressions adding to an attribute
+var incrementPattern = regexp.MustCompile(`(?i)(^|\s)ADD\s|\+`)
+
+// throttleRetries is how many times a throttled request is retried before the error is returned, as
+// the AWS SDK doesn't retry the requests anymore. The callers that back off from throttles themselves
+// take over after that.
+const throttleRetries = 3
+
+// retrier calls a request until it succeeds or the Retryer gives up, and retries throttled requests
+// as told by the throttle BackoffPolicy
+type retrier struct {
+	retryer         Retryer
+	throttleBackoff BackoffPolicy
+	logger          Logger
+	// stop returns a channel closed when we should stop waiting to retry
+	stop func() <-chan struct{}
+}
+
+func (r retrier) do(operation string, fn func() error) error {
+	return r.call(operation, fn, r.retryer)
+}
+
+// doThrottled is do for the requests that can't be retried after they failed, unless they were
+// throttled, as a throttled request wasn't carried out
+func (r retrier) doThrottled(operation string, fn func() error) error {
+	return r.call(operation, fn, nil)
+}
+
+func (r retrier) call(operation string, fn func() error, retryer Retryer) error {
+	var attempts, throttles int
+	for {
+		err := fn()
+		var final finalError
+		if errors.As(err, &final) {
+			return final.err
+		}
+		if err == nil {
+			return nil
+		}
+		var delay time.Duration
+		if isThrottle(err) {
+			if throttles++; throttles > throttleRetries || r.throttleBackoff == nil {
+				return err
+			}
+			delay = r.throttleBackoff.Delay(throttles)
+			logf(r.logger, LevelDebug, []interface{}{"op", operation}, "%s throttled, retrying in %s", operation, delay)
+		} else {
+			if retryer == nil {
+				return err
+			}
+			attempts++
+			var ok bool
+			if delay, ok = retryer.Retry(attempts, err); !ok {
+				return err
+			}
+			logf(r.logger, LevelWarn, []interface{}{"op", operation}, "%s failed: %s, attempt %d, retrying in %s", operation, err, attempts, delay)
+		}
+		var stop <-chan struct{}
+		if r.stop != nil {
+			stop = r.stop()
+		}
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return err
+		}
+	}
+}
+
+// retriedUpdate returns whether an update can be made again after it failed: an update adding to
+// an attribute may have gone through, and would add twice
+func retriedUpdate(in *dynamodb.UpdateItemInput) bool {
+	return !incrementPattern.MatchString(aws.StringValue(in.UpdateExpression))
+}
+
+// retriedPut returns whether a put can be made again after it failed: a conditional put writing
+// another lease token than the one it expects, as when capturing a shard, may have gone through,
+// and its retry would fail and give up the lease it took
+func retriedPut(in *dynamodb.PutItemInput) bool {
+	written, ok := in.Item["LeaseToken"]
+	if !ok || in.ConditionExpression == nil {
+		return true
+	}
+	expected, ok := in.ExpressionAttributeValues[":leaseToken"]
+	return ok && aws.StringValue(expected.N) == aws.StringValue(written.N)
+}
+
+// retryingKinesis is a kinesis interface that retries the requests kinsumer makes through it
+type retryingKinesis struct {
+	kinesisiface.KinesisAPI
+	retrier retrier
+}
+
+func (k *retryingKinesis) GetRecords(in *kinesis.GetRecordsInput) (out *kinesis.GetRecordsOutput, err error) {
+	err = k.retrier.do("GetRecords", func() error {
+		out, err = k.KinesisAPI.GetRecords(in)
+		return err
+	})
+	return out, err
+}
+
+func (k *retryingKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (out *kinesis.GetShardIteratorOutput, err error) {
+	err = k.retrier.do("GetShardIterator", func() error {
+		out, err = k.KinesisAPI.GetShardIterator(in)
+		return err
+	})
+	return out, err
+}
+
+func (k *retryingKinesis) ListShards(in *kinesis.ListShardsInput) (out *kinesis.ListShardsOutput, err error) {
+	err = k.retrier.do("ListShards", func() error {
+		out, err = k.KinesisAPI.ListShards(in)
+		return err
+	})
+	return out, err
+}
+
+func (k *retryingKinesis) DescribeStreamSummary(in *kinesis.DescribeStreamSummaryInput) (out *kinesis.DescribeStreamSummaryOutput, err error) {
+	err = k.retrier.do("DescribeStreamSummary", func() error {
+		out, err = k.KinesisAPI.DescribeStreamSummary(in)
+		return err
+	})
+	return out, err
+}
+
+// retryingDynamo is a dynamo interface that retries the item and scan requests kinsumer makes through
+// it. The writes are retried with writeRetrier, as they include the checkpoint commits and releases and
+// the deregistration made while we shut down.
+type retryingDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	retrier      retrier
+	writeRetrier retrier
+}
+
+func (d *retryingDynamo) GetItem(in *dynamodb.GetItemInput) (out *dynamodb.GetItemOutput, err error) {
+	err = d.retrier.do("GetItem", func() error {
+		out, err = d.DynamoDBAPI.GetItem(in)
+		return err
+	})
+	return out, err
+}
+
+func (d *retryingDynamo) PutItem(in *dynamodb.PutItemInput) (out *dynamodb.PutItemOutput, err error) {
+	if !retriedPut(in) {
+		err = d.writeRetrier.doThrottled("PutItem", func() error {
+			out, err = d.DynamoDBAPI.PutItem(in)
+			return err
+		})
+		return out, err
+	}
+	err = d.writeRetrier.do("PutItem", func() error {
+		out, err = d.DynamoDBAPI.PutItem(in)
+		return err
+	})
+	return out, err
+}
+
+func (d *retryingDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (out *dynamodb.UpdateItemOutput, err error) {
+	if !retriedUpdate(in) {
+		err = d.writeRetrier.doThrottled("UpdateItem", func() error {
+			out, err = d.DynamoDBAPI.UpdateItem(in)
+			return err
+		})
+		return out, err
+	}
+	err = d.writeRetrier.do("UpdateItem", func() error {
+		out, err = d.DynamoDBAPI.UpdateItem(in)
+		return err
+	})
+	return out, err
+}
+
+func (d *retryingDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (out *dynamodb.DeleteItemOutput, err error) {
+	err = d.writeRetrier.do("DeleteItem", func() error {
+		out, err = d.DynamoDBAPI.DeleteItem(in)
+		return err
+	})
+	return out, err
+}
+
+// ScanPages is only retried while no page was handed to fn, as the caller can't take pages twice
+func (d *retryingDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	var paged bool
+	return d.retrier.do("Scan", func() error {
+		err := d.DynamoDBAPI.ScanPages(in, func(page *dynamodb.ScanOutput, last bool) bool {
+			paged = true
+			return fn(page, last)
+		})
+		if err != nil && paged {
+			return finalError{err: err}
+		}
+		return err
+	})
+}
+
+// withRetries wraps the kinesis and dynamo interfaces so the requests made through them are retried
+// as told by the configured Retryer and throttle BackoffPolicy, until the channel returned by stop is
+// closed, or the one returned by stopWrites for the dynamo writes
+func withRetries(k kinesisiface.KinesisAPI, d dynamodbiface.DynamoDBAPI, config *Config, stop, stopWrites func() <-chan struct{}) (kinesisiface.KinesisAPI, dynamodbiface.DynamoDBAPI) {
+	r := retrier{retryer: config.retryer, throttleBackoff: config.throttleBackoff, logger: config.logger, stop: stop}
+	w := retrier{retryer: config.retryer, throttleBackoff: config.throttleBackoff, logger: config.logger, stop: stopWrites}
+	return &retryingKinesis{KinesisAPI: k, retrier: r}, &retryingDynamo{DynamoDBAPI: d, retrier: r, writeRetrier: w}
+}
+
+// kinesisWithoutSDKRetries returns the kinesis client with the retries of the AWS SDK disabled, as the
+// requests made through it are retried by the Retryer, and would be retried up to the product of
+// both otherwise. Other implementations of the interface are returned as is.
+func kinesisWithoutSDKRetries(k kinesisiface.KinesisAPI) kinesisiface.KinesisAPI {
+	svc, ok := k.(*kinesis.Kinesis)
+	if !ok || svc.Client == nil {
+		return k
+	}
+	copied := *svc
+	copied.Client = clientWithoutRetries(svc.Client)
+	return &copied
+}
+
+// s3WithoutSDKRetries is kinesisWithoutSDKRetries for the S3 client of the claim checks
+func s3WithoutSDKRetries(c s3iface.S3API) s3iface.S3API {
+	svc, ok := c.(*s3.S3)
+	if !ok || svc.Client == nil {
+		return c
+	}
+	copied := *svc
+	copied.Client = clientWithoutRetries(svc.Client)
+	return &copied
+}
+
+// dynamoWithoutSDKRetries is kinesisWithoutSDKRetries for the dynamo client
+func dynamoWithoutSDKRetries(d dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI {
+	svc, ok := d.(*dynamodb.DynamoDB)
+	if !ok || svc.Client == nil {
+		return d
+	}
+	copied := *svc
+	copied.Client = clientWithoutRetries(svc.Client)
+	return &copied
+}
+
+// clientWithoutRetries returns a copy of the client of an AWS service that doesn't retry requests
+func clientWithoutRetries(c *client.Client) *client.Client {
+	copied := *c
+	copied.Config.MaxRetries = aws.Int(0)
+	copied.Retryer = client.NoOpRetryer{}
+	return &copied
+}
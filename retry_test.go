@@ -0,0 +1,248 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}}
+	failure := awserr.New("InternalFailure", "oops", nil)
+
+	delay, ok := p.Retry(1, failure)
+	require.True(t, ok)
+	require.True(t, delay <= time.Millisecond)
+	_, ok = p.Retry(3, failure)
+	require.False(t, ok, "out of attempts")
+	_, ok = p.Retry(1, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "nope", nil))
+	require.False(t, ok, "not retryable")
+	_, ok = p.Retry(1, errors.New("not from aws"))
+	require.False(t, ok, "not from aws")
+
+	p.Retryable = func(err error) bool { return true }
+	_, ok = p.Retry(1, errors.New("not from aws"))
+	require.True(t, ok, "custom classifier")
+}
+
+// failingDynamo fails the first failures requests made to it, with err if set
+type failingDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	failures int
+	calls    int
+	page     bool // whether ScanPages hands out a page before failing
+	err      error
+}
+
+func (d *failingDynamo) fail() error {
+	d.calls++
+	if d.calls <= d.failures {
+		if d.err != nil {
+			return d.err
+		}
+		return awserr.New("InternalFailure", "oops", nil)
+	}
+	return nil
+}
+
+func (d *failingDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (d *failingDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *failingDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (d *failingDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	if d.page {
+		fn(&dynamodb.ScanOutput{}, false)
+	}
+	return d.fail()
+}
+
+func TestRetryingDynamo(t *testing.T) {
+	config := NewConfig().WithLogger(&recordingLogger{}).
+		WithRetryer(RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}})
+	db := &failingDynamo{failures: 2}
+	_, retrying := withRetries(nil, db, &config, nil, nil)
+
+	_, err := retrying.GetItem(&dynamodb.GetItemInput{TableName: aws.String("table")})
+	require.NoError(t, err)
+	require.Equal(t, 3, db.calls)
+
+	db.calls, db.failures = 0, 3
+	_, err = retrying.GetItem(&dynamodb.GetItemInput{TableName: aws.String("table")})
+	require.Error(t, err)
+	require.Equal(t, 3, db.calls)
+
+	// A scan that handed out a page isn't retried, the caller would get it twice
+	db.calls, db.failures, db.page = 0, 1, true
+	err = retrying.ScanPages(&dynamodb.ScanInput{}, func(*dynamodb.ScanOutput, bool) bool { return true })
+	require.Error(t, err)
+	require.Equal(t, 1, db.calls)
+}
+
+func TestRetriedWrites(t *testing.T) {
+	config := NewConfig().WithLogger(&recordingLogger{}).
+		WithRetryer(RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}})
+	db := &failingDynamo{failures: 1}
+	_, retrying := withRetries(nil, db, &config, nil, nil)
+
+	// Writes that would add twice or give up the lease they took aren't retried
+	for _, update := range []string{"ADD Generation :one", "SET #region = :region ADD Epoch :one", "SET Token = if_not_exists(Token, :zero) + :one"} {
+		db.calls = 0
+		_, err := retrying.UpdateItem(&dynamodb.UpdateItemInput{UpdateExpression: aws.String(update)})
+		require.Error(t, err, update)
+		require.Equal(t, 1, db.calls, update)
+	}
+	capture := &dynamodb.PutItemInput{
+		Item:                      map[string]*dynamodb.AttributeValue{"LeaseToken": {N: aws.String("3")}},
+		ConditionExpression:       aws.String("LeaseToken = :previousToken"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":previousToken": {N: aws.String("2")}},
+	}
+	db.calls = 0
+	_, err := retrying.PutItem(capture)
+	require.Error(t, err)
+	require.Equal(t, 1, db.calls)
+
+	// Conditional and idempotent writes are
+	db.calls = 0
+	_, err = retrying.UpdateItem(&dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("REMOVE OwnerID, OwnerName SET SequenceNumber = :sequenceNumber"),
+		ConditionExpression: aws.String("OwnerID = :ownerID AND LeaseToken = :leaseToken"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, db.calls)
+	commit := &dynamodb.PutItemInput{
+		Item:                      map[string]*dynamodb.AttributeValue{"LeaseToken": {N: aws.String("3")}},
+		ConditionExpression:       aws.String("OwnerID = :ownerID AND LeaseToken = :leaseToken"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":leaseToken": {N: aws.String("3")}},
+	}
+	db.calls = 0
+	_, err = retrying.PutItem(commit)
+	require.NoError(t, err)
+	require.Equal(t, 2, db.calls)
+}
+
+func TestRetriedThrottles(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	config := NewConfig().WithLogger(&recordingLogger{}).
+		WithRetryer(RetryPolicy{MaxAttempts: 1}).
+		WithThrottleBackoff(ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond})
+	db := &failingDynamo{failures: throttleRetries, err: throttled}
+	_, retrying := withRetries(nil, db, &config, nil, nil)
+
+	// Throttles are retried even though the Retryer doesn't retry
+	err := retrying.ScanPages(&dynamodb.ScanInput{}, func(*dynamodb.ScanOutput, bool) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, throttleRetries+1, db.calls)
+
+	// Up to a point, the callers backing off themselves take over then
+	db.calls, db.failures = 0, throttleRetries+1
+	_, err = retrying.GetItem(&dynamodb.GetItemInput{TableName: aws.String("table")})
+	require.True(t, isThrottle(err))
+	require.Equal(t, throttleRetries+1, db.calls)
+
+	// The writes that aren't retried after a failure are after a throttle
+	db.calls, db.failures = 0, 1
+	_, err = retrying.UpdateItem(&dynamodb.UpdateItemInput{UpdateExpression: aws.String("ADD Generation :one")})
+	require.NoError(t, err)
+	require.Equal(t, 2, db.calls)
+}
+
+// throttledScanDynamo throttles the first scans made to it
+type throttledScanDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	throttles int
+}
+
+func (d *throttledScanDynamo) ScanPages(in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	if d.throttles > 0 {
+		d.throttles--
+		return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	}
+	return d.DynamoDBAPI.ScanPages(in, fn)
+}
+
+func TestThrottledScanNotReported(t *testing.T) {
+	db := &throttledScanDynamo{DynamoDBAPI: mocks.NewMockDynamo([]string{"app_clients"}), throttles: 2}
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client",
+		NewConfig().WithThrottleBackoff(ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}))
+	require.NoError(t, err)
+
+	_, err = k.loadClients()
+	require.NoError(t, err)
+	require.Zero(t, db.throttles)
+	require.Empty(t, k.errors)
+}
+
+func TestRetriesStop(t *testing.T) {
+	config := NewConfig().WithLogger(&recordingLogger{}).
+		WithRetryer(RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Hour, Max: time.Hour}})
+	stop := make(chan struct{})
+	close(stop)
+	db := &failingDynamo{failures: 1}
+	_, retrying := withRetries(nil, db, &config, func() <-chan struct{} { return stop }, nil)
+
+	// The consumers stopped, we don't wait an hour to retry
+	_, err := retrying.GetItem(&dynamodb.GetItemInput{TableName: aws.String("table")})
+	require.Error(t, err)
+	require.Equal(t, 1, db.calls)
+
+	// The writes made while shutting down are still retried until the shutdown deadline
+	config = config.WithRetryer(RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}})
+	deadline := make(chan struct{})
+	db = &failingDynamo{failures: 1}
+	_, retrying = withRetries(nil, db, &config, func() <-chan struct{} { return stop }, func() <-chan struct{} { return deadline })
+	_, err = retrying.UpdateItem(&dynamodb.UpdateItemInput{UpdateExpression: aws.String("SET SequenceNumber = :sequenceNumber")})
+	require.NoError(t, err)
+	require.Equal(t, 2, db.calls)
+
+	config = config.WithRetryer(RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Hour, Max: time.Hour}})
+	close(deadline)
+	db = &failingDynamo{failures: 1}
+	_, retrying = withRetries(nil, db, &config, func() <-chan struct{} { return stop }, func() <-chan struct{} { return deadline })
+	_, err = retrying.UpdateItem(&dynamodb.UpdateItemInput{UpdateExpression: aws.String("SET SequenceNumber = :sequenceNumber")})
+	require.Error(t, err)
+	require.Equal(t, 1, db.calls)
+}
+
+func TestWithoutSDKRetries(t *testing.T) {
+	s, err := session.NewSession(aws.NewConfig().WithRegion("us-east-1").WithMaxRetries(5))
+	require.NoError(t, err)
+
+	k := kinesis.New(s)
+	require.Equal(t, 0, kinesisWithoutSDKRetries(k).(*kinesis.Kinesis).MaxRetries())
+	require.Equal(t, 5, k.MaxRetries(), "the given client is left alone")
+	require.Equal(t, 0, dynamoWithoutSDKRetries(dynamodb.New(s)).(*dynamodb.DynamoDB).MaxRetries())
+	require.Equal(t, 0, s3WithoutSDKRetries(s3.New(s)).(*s3.S3).MaxRetries())
+
+	// Other implementations are used as is
+	db := &failingDynamo{}
+	require.Equal(t, db, dynamoWithoutSDKRetries(db))
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// runKey is the key of the metadata table item recording when the clients started the run that
+// replaces the checkpoints written before it, so that they all agree on which checkpoints are stale
+const runKey = "Run"
+
+// runRecord is the start of the run of the clients ignoring checkpoints, resuming from a bookmark
+// or overriding the starting position of shards
+type runRecord struct {
+	Key          string
+	StartedAt    int64
+	StartedAtRFC string
+}
+
+// loadRun returns the run of the clients, nil if there is none
+func loadRun(db dynamodbiface.DynamoDBAPI, tableName string) (*runRecord, error) {
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(runKey)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	var record runRecord
+	if err = dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// replacesCheckpoints returns whether the checkpoints written before the run started are replaced
+func (k *Kinsumer) replacesCheckpoints() bool {
+	return k.config.ignoreCheckpoints || k.bookmark != nil || k.config.startingPositionFor != nil
+}
+
+// startRun sets runStartedAt to the start of the run we are joining, before registering. A run starts
+// when a client replacing checkpoints finds no run or no other live client, the clients joining
+// while others are alive, as in a rolling deploy, continue their run. A fleet restarted before the
+// records of its previous clients expired continues their run too. The clients that don't replace
+// checkpoints end the run, so that the next one starts afresh.
+func (k *Kinsumer) startRun(now time.Time) error {
+	if !k.replacesCheckpoints() {
+		_, err := k.dynamodb.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(k.metadataTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"Key": {S: aws.String(runKey)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error ending the run: %v", err)
+		}
+		return nil
+	}
+
+	run, err := loadRun(k.dynamodb, k.metadataTableName)
+	if err != nil {
+		return fmt.Errorf("error loading the run: %v", err)
+	}
+	if run != nil {
+		clients, err := getClients(k.dynamodb, k.clientName, k.clientsTableName, k.maxAgeForClientRecord)
+		if err != nil {
+			return fmt.Errorf("error loading the clients: %v", err)
+		}
+		for _, client := range clients {
+			if client.ID != k.clientID() {
+				k.runStartedAt = time.Unix(0, run.StartedAt)
+				return nil
+			}
+		}
+	}
+
+	next := &runRecord{Key: runKey, StartedAt: now.UnixNano(), StartedAtRFC: now.UTC().Format(time.RFC1123Z)}
+	item, err := dynamodbattribute.MarshalMap(next)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(k.metadataTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(StartedAt)"),
+	}
+	if run != nil {
+		input.ConditionExpression = aws.String("StartedAt = :startedAt")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":startedAt": {N: aws.String(fmt.Sprint(run.StartedAt))},
+		}
+	}
+	_, err = k.dynamodb.PutItem(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == conditionalFail {
+		// Another client started the run first
+		if run, err = loadRun(k.dynamodb, k.metadataTableName); err == nil && run != nil {
+			k.runStartedAt = time.Unix(0, run.StartedAt)
+			return nil
+		}
+		if err == nil {
+			err = errors.New("the run disappeared")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error starting the run: %v", err)
+	}
+	k.logf(LevelInfo, "run", "", "Started a run replacing the checkpoints written before %s", next.StartedAtRFC)
+	k.runStartedAt = now
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// runDynamo keeps the run item of the metadata table and the records of the live clients
+type runDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	run     map[string]*dynamodb.AttributeValue
+	clients []clientRecord
+}
+
+func (d *runDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: d.run}, nil
+}
+
+func (d *runDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	var current *dynamodb.AttributeValue
+	if d.run != nil {
+		current = d.run["StartedAt"]
+	}
+	expected := in.ExpressionAttributeValues[":startedAt"]
+	if (current == nil) != (expected == nil) || (current != nil && aws.StringValue(current.N) != aws.StringValue(expected.N)) {
+		return nil, awserr.New(conditionalFail, "the run changed", nil)
+	}
+	d.run = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *runDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	d.run = nil
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (d *runDynamo) ScanPages(in *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool) error {
+	out := &dynamodb.ScanOutput{}
+	for _, client := range d.clients {
+		item, err := dynamodbattribute.MarshalMap(client)
+		if err != nil {
+			return err
+		}
+		out.Items = append(out.Items, item)
+	}
+	pager(out, true)
+	return nil
+}
+
+func TestStartRun(t *testing.T) {
+	db := &runDynamo{DynamoDBAPI: mocks.NewMockDynamo(nil)}
+	newClient := func(id string) *Kinsumer {
+		k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", id,
+			NewConfig().WithIgnoreCheckpoints(false))
+		require.NoError(t, err)
+		return k
+	}
+
+	// The first client starts the run
+	first := newClient("first")
+	startedAt := time.Now().Add(-time.Hour)
+	require.NoError(t, first.startRun(startedAt))
+	require.Equal(t, startedAt.UnixNano(), first.runStartedAt.UnixNano())
+
+	// A client joining while the first is alive continues its run
+	db.clients = []clientRecord{{ID: first.clientID()}}
+	second := newClient("second")
+	require.NoError(t, second.startRun(time.Now()))
+	require.Equal(t, startedAt.UnixNano(), second.runStartedAt.UnixNano())
+
+	// Once the clients are gone the next one starts a new run
+	db.clients = []clientRecord{{ID: second.clientID()}}
+	restartedAt := time.Now()
+	require.NoError(t, second.startRun(restartedAt))
+	require.Equal(t, restartedAt.UnixNano(), second.runStartedAt.UnixNano())
+
+	// A client that doesn't replace checkpoints ends the run
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "other", NewConfig())
+	require.NoError(t, err)
+	require.NoError(t, k.startRun(time.Now()))
+	require.Nil(t, db.run)
+	third := newClient("third")
+	require.NoError(t, third.startRun(time.Now()))
+	require.NotNil(t, db.run)
+	require.True(t, third.runStartedAt.After(restartedAt))
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// Write limits of a kinesis shard
+	shardBytesPerSecondLimit   = 1024 * 1024
+	shardRecordsPerSecondLimit = 1000
+)
+
+// ScalingAction is a change of the shards of the stream recommended by the ScalingAdvisor
+type ScalingAction int
+
+const (
+	// ScaleSplit splits a shard in two
+	ScaleSplit ScalingAction = iota
+	// ScaleMerge merges two adjacent shards
+	ScaleMerge
+)
+
+// String returns the name of the action
+func (a ScalingAction) String() string {
+	switch a {
+	case ScaleSplit:
+		return "split"
+	case ScaleMerge:
+		return "merge"
+	}
+	return fmt.Sprintf("ScalingAction(%d)", int(a))
+}
+
+// ScalingRecommendation is a change of the shards of the stream recommended by the ScalingAdvisor
+type ScalingRecommendation struct {
+	Action ScalingAction
+	// The shard to split, or the two adjacent shards to merge
+	ShardIDs []string
+	Reason   string
+	// Throughput of the shards, and how far behind the stream the furthest of them is
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	Lag              time.Duration
+}
+
+// ScalingAdvisor recommends splitting the shards that are close to their write limits or that the
+// clients can't keep up with, and merging the adjacent shards that are mostly idle. Every client
+// measures the throughput of its shards once per leader action period and writes it along with its
+// checkpoints, and the leader makes the recommendations from the measures of all the shards.
+type ScalingAdvisor struct {
+	// Fraction of the shard write limits, 1 MiB or 1000 records per second, above which a shard
+	// should be split, 0.8 if 0
+	SplitAbove float64
+	// Fraction of the shard write limits under which two adjacent shards should be merged, 0.1 if 0
+	MergeBelow float64
+	// How far behind the stream a shard can fall before it should be split, 0 to ignore how far
+	// behind the shards are
+	MaxLag time.Duration
+	// Called by the leader with the recommendations every leader action period there are some,
+	// they are only logged if nil
+	Recommend func(recommendations []ScalingRecommendation)
+}
+
+// shardThroughput is the throughput of a shard measured by its owner, written with its checkpoint
+type shardThroughput struct {
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	LagMillis        int64
+	MeasuredAt       int64 // end of the measure
+}
+
+// utilization returns the fraction of the shard write limits the throughput uses
+func (t *shardThroughput) utilization() float64 {
+	bytes := t.BytesPerSecond / shardBytesPerSecondLimit
+	records := t.RecordsPerSecond / shardRecordsPerSecondLimit
+	if bytes > records {
+		return bytes
+	}
+	return records
+}
+
+// throughputMeter measures the throughput of a shard worker over periods of a given duration
+type throughputMeter struct {
+	period  time.Duration
+	start   time.Time
+	records int
+	bytes   int
+	lag     time.Duration
+}
+
+// add adds the records returned by a GetRecords call, and returns the throughput once the period
+// is over
+func (m *throughputMeter) add(now time.Time, records []*kinesis.Record, lag time.Duration) (shardThroughput, bool) {
+	m.records += len(records)
+	for _, r := range records {
+		m.bytes += len(r.Data)
+	}
+	m.lag = lag
+	elapsed := now.Sub(m.start)
+	if elapsed < m.period {
+		return shardThroughput{}, false
+	}
+	t := shardThroughput{
+		RecordsPerSecond: float64(m.records) / elapsed.Seconds(),
+		BytesPerSecond:   float64(m.bytes) / elapsed.Seconds(),
+		LagMillis:        int64(m.lag / time.Millisecond),
+		MeasuredAt:       now.UnixNano(),
+	}
+	*m = throughputMeter{period: m.period, start: now}
+	return t, true
+}
+
+// recommendScaling returns the recommendations of the advisor for the open shards of the stream,
+// given their checkpoints. Throughputs measured before cutoff are ignored.
+func recommendScaling(advisor *ScalingAdvisor, shards []*kinesis.Shard,
+	checkpoints map[string]*checkpointRecord, cutoff time.Time) []ScalingRecommendation {
+	splitAbove := advisor.SplitAbove
+	if splitAbove == 0 {
+		splitAbove = 0.8
+	}
+	mergeBelow := advisor.MergeBelow
+	if mergeBelow == 0 {
+		mergeBelow = 0.1
+	}
+	measured := func(shardID string) *shardThroughput {
+		cp := checkpoints[shardID]
+		if cp == nil || cp.Throughput == nil || cp.Throughput.MeasuredAt < cutoff.UnixNano() {
+			return nil
+		}
+		return cp.Throughput
+	}
+
+	// Open shards sorted by hash key, so adjacent shards are next to each other
+	type openShard struct {
+		id         string
+		start, end *big.Int
+	}
+	var open []openShard
+	for _, s := range shards {
+		if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+			continue
+		}
+		if s.HashKeyRange == nil {
+			continue
+		}
+		start, ok := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.StartingHashKey), 10)
+		if !ok {
+			continue
+		}
+		end, ok := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.EndingHashKey), 10)
+		if !ok {
+			continue
+		}
+		open = append(open, openShard{id: aws.StringValue(s.ShardId), start: start, end: end})
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].start.Cmp(open[j].start) < 0 })
+
+	var recommendations []ScalingRecommendation
+	for _, s := range open {
+		t := measured(s.id)
+		if t == nil {
+			continue
+		}
+		lag := time.Duration(t.LagMillis) * time.Millisecond
+		var reason string
+		if u := t.utilization(); u >= splitAbove {
+			reason = fmt.Sprintf("at %.0f%% of the shard write limits", u*100)
+		} else if advisor.MaxLag > 0 && lag > advisor.MaxLag {
+			reason = fmt.Sprintf("%s behind the stream", lag)
+		} else {
+			continue
+		}
+		recommendations = append(recommendations, ScalingRecommendation{
+			Action:           ScaleSplit,
+			ShardIDs:         []string{s.id},
+			Reason:           reason,
+			RecordsPerSecond: t.RecordsPerSecond,
+			BytesPerSecond:   t.BytesPerSecond,
+			Lag:              lag,
+		})
+	}
+
+	one := big.NewInt(1)
+	for i := 0; i+1 < len(open); i++ {
+		left, right := open[i], open[i+1]
+		if new(big.Int).Add(left.end, one).Cmp(right.start) != 0 {
+			continue
+		}
+		l, r := measured(left.id), measured(right.id)
+		if l == nil || r == nil || l.utilization() >= mergeBelow || r.utilization() >= mergeBelow {
+			continue
+		}
+		if advisor.MaxLag > 0 && (time.Duration(l.LagMillis)*time.Millisecond > advisor.MaxLag ||
+			time.Duration(r.LagMillis)*time.Millisecond > advisor.MaxLag) {
+			continue
+		}
+		lag := l.LagMillis
+		if r.LagMillis > lag {
+			lag = r.LagMillis
+		}
+		recommendations = append(recommendations, ScalingRecommendation{
+			Action:           ScaleMerge,
+			ShardIDs:         []string{left.id, right.id},
+			Reason:           fmt.Sprintf("both under %.0f%% of the shard write limits", mergeBelow*100),
+			RecordsPerSecond: l.RecordsPerSecond + r.RecordsPerSecond,
+			BytesPerSecond:   l.BytesPerSecond + r.BytesPerSecond,
+			Lag:              time.Duration(lag) * time.Millisecond,
+		})
+		// Each shard is merged at most once
+		i++
+	}
+	return recommendations
+}
+
+// adviseScaling hands the recommendations of the ScalingAdvisor to its callback, or logs them
+func (k *Kinsumer) adviseScaling(shards []*kinesis.Shard, checkpoints map[string]*checkpointRecord) {
+	advisor := k.config.scalingAdvisor
+	// Older measures are from owners that stopped
+	cutoff := time.Now().Add(-2 * k.config.leaderActionFrequency)
+	recommendations := recommendScaling(advisor, shards, checkpoints, cutoff)
+	if len(recommendations) == 0 {
+		return
+	}
+	if advisor.Recommend != nil {
+		advisor.Recommend(recommendations)
+		return
+	}
+	for _, r := range recommendations {
+		k.logf(LevelInfo, "adviseScaling", "", "Scaling advisor recommends to %s %s: %s, %.0f records/s, %.0f bytes/s, %s behind",
+			r.Action, strings.Join(r.ShardIDs, " and "), r.Reason, r.RecordsPerSecond, r.BytesPerSecond, r.Lag)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThroughputMeter(t *testing.T) {
+	start := time.Now()
+	meter := &throughputMeter{period: 10 * time.Second, start: start}
+	records := []*kinesis.Record{{Data: make([]byte, 100)}, {Data: make([]byte, 300)}}
+
+	_, ok := meter.add(start.Add(5*time.Second), records, time.Minute)
+	require.False(t, ok)
+	measured, ok := meter.add(start.Add(10*time.Second), records, time.Second)
+	require.True(t, ok)
+	require.Equal(t, 0.4, measured.RecordsPerSecond)
+	require.Equal(t, 80.0, measured.BytesPerSecond)
+	require.Equal(t, int64(1000), measured.LagMillis)
+
+	// The next period starts over
+	measured, ok = meter.add(start.Add(20*time.Second), nil, 0)
+	require.True(t, ok)
+	require.Equal(t, 0.0, measured.RecordsPerSecond)
+}
+
+func TestRecommendScaling(t *testing.T) {
+	now := time.Now()
+	shard := func(id, start, end string) *kinesis.Shard {
+		return &kinesis.Shard{
+			ShardId:             aws.String(id),
+			HashKeyRange:        &kinesis.HashKeyRange{StartingHashKey: aws.String(start), EndingHashKey: aws.String(end)},
+			SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+		}
+	}
+	closed := shard("closed", "0", "99")
+	closed.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+	shards := []*kinesis.Shard{
+		closed,
+		shard("hot", "0", "9"),
+		shard("cold1", "10", "19"),
+		shard("cold2", "20", "29"),
+		shard("cold3", "30", "39"),
+		shard("behind", "40", "49"),
+		shard("stale", "50", "59"),
+	}
+	measure := func(recordsPerSecond float64, lag time.Duration, at time.Time) *checkpointRecord {
+		return &checkpointRecord{Throughput: &shardThroughput{
+			RecordsPerSecond: recordsPerSecond,
+			LagMillis:        int64(lag / time.Millisecond),
+			MeasuredAt:       at.UnixNano(),
+		}}
+	}
+	checkpoints := map[string]*checkpointRecord{
+		"closed": measure(0, 0, now),
+		"hot":    measure(900, 0, now),
+		"cold1":  measure(10, 0, now),
+		"cold2":  measure(20, 0, now),
+		"cold3":  measure(30, 0, now),
+		"behind": measure(500, time.Hour, now),
+		"stale":  measure(1000, 0, now.Add(-time.Hour)),
+	}
+
+	recommendations := recommendScaling(&ScalingAdvisor{MaxLag: time.Minute}, shards, checkpoints, now.Add(-time.Minute))
+	require.Len(t, recommendations, 3)
+	require.Equal(t, ScaleSplit, recommendations[0].Action)
+	require.Equal(t, []string{"hot"}, recommendations[0].ShardIDs)
+	require.Equal(t, "at 90% of the shard write limits", recommendations[0].Reason)
+	require.Equal(t, ScaleSplit, recommendations[1].Action)
+	require.Equal(t, []string{"behind"}, recommendations[1].ShardIDs)
+	require.Equal(t, time.Hour, recommendations[1].Lag)
+	// Each shard is merged once, cold3 waits for the next round
+	require.Equal(t, ScaleMerge, recommendations[2].Action)
+	require.Equal(t, []string{"cold1", "cold2"}, recommendations[2].ShardIDs)
+	require.Equal(t, 30.0, recommendations[2].RecordsPerSecond)
+
+	// Lag is ignored without MaxLag
+	recommendations = recommendScaling(&ScalingAdvisor{}, shards, checkpoints, now.Add(-time.Minute))
+	require.Len(t, recommendations, 2)
+}
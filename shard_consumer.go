@@ -3,6 +3,9 @@
 package kinsumer
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,17 +15,14 @@ import (
 )
 
 const (
-	// getRecordsLimit is the max number of records in a single request. This effectively limits the
-	// total processing speed to getRecordsLimit*5/n where n is the number of parallel clients trying
-	// to consume from the same kinesis stream
+	// getRecordsLimit is the max number of records in a single request, and the default limit. This
+	// effectively limits the total processing speed to getRecordsLimit*5/n where n is the number of
+	// parallel clients trying to consume from the same kinesis stream
 	getRecordsLimit = 10000 // 10,000 is the max according to the docs
 
-	// maxErrorRetries is how many times we will retry on a shard error
-	maxErrorRetries = 3
-
-	// errorSleepDuration is how long we sleep when an error happens, this is multiplied by the number
-	// of retries to give a minor backoff behavior
-	errorSleepDuration = 1 * time.Second
+	// minThrottleDelay is the shortest delay between two GetRecords calls on a shard, kinesis allows
+	// 5 calls per second per shard
+	minThrottleDelay = 200 * time.Millisecond
 )
 
 // getShardIterator gets a shard iterator after the last sequence number we read or at the start of the stream
@@ -64,28 +64,70 @@ func getShardIterator(
 	return aws.StringValue(resp.ShardIterator), err
 }
 
-// getRecords returns the next records and shard iterator from the given shard iterator
-func getRecords(k kinesisiface.KinesisAPI, iterator string) (records []*kinesis.Record, nextIterator string, lag time.Duration, err error) {
+// getRecords returns the next records and shard iterator from the given shard iterator, and the
+// children of the shard once we reached its end
+func getRecords(k kinesisiface.KinesisAPI, iterator string, limit int64) (records []*kinesis.Record, nextIterator string, lag time.Duration, childShards []*kinesis.ChildShard, err error) {
 	params := &kinesis.GetRecordsInput{
-		Limit:         aws.Int64(getRecordsLimit),
+		Limit:         aws.Int64(limit),
 		ShardIterator: aws.String(iterator),
 	}
 
 	output, err := k.GetRecords(params)
 
 	if err != nil {
-		return nil, "", 0, err
+		return nil, "", 0, nil, err
 	}
 
 	records = output.Records
 	nextIterator = aws.StringValue(output.NextShardIterator)
 	lag = time.Duration(aws.Int64Value(output.MillisBehindLatest)) * time.Millisecond
 
-	return records, nextIterator, lag, nil
+	return records, nextIterator, lag, output.ChildShards, nil
+}
+
+// fetchLimit returns the GetRecords limit to use after getting the given records, so that a call
+// returns about maxBytes of data based on the size of those records, but never more than limit records.
+// A maxBytes of 0 means there is no target, and the limit is always used.
+func fetchLimit(limit int64, maxBytes int, records []*kinesis.Record) int64 {
+	if maxBytes <= 0 || len(records) == 0 {
+		return limit
+	}
+	size := 0
+	for _, record := range records {
+		size += len(record.Data)
+	}
+	if size == 0 {
+		return limit
+	}
+	n := int64(maxBytes) * int64(len(records)) / int64(size)
+	if n < 1 {
+		return 1
+	}
+	if n > limit {
+		return limit
+	}
+	return n
+}
+
+// adaptiveFetch returns the max GetRecords limit and the delay before the next call for a shard
+// that is lag behind the tip of the stream. While it is at least catchUpLag behind the limit
+// doubles after every call, up to the max allowed by kinesis, and the delay drops to minThrottleDelay.
+// Otherwise, or if there is no catchUpLag, the configured limit and delay are used.
+func adaptiveFetch(catchUpLag time.Duration, configuredLimit int64, configuredDelay time.Duration,
+	limit int64, lag time.Duration) (int64, time.Duration) {
+	if catchUpLag == 0 || lag < catchUpLag {
+		return configuredLimit, configuredDelay
+	}
+	limit *= 2
+	if limit > getRecordsLimit {
+		limit = getRecordsLimit
+	}
+	return limit, minThrottleDelay
 }
 
 // captureShard blocks until we capture the given shardID
 func (k *Kinsumer) captureShard(shardID string) (*checkpointer, error) {
+	captureBackoff := &backoff{policy: k.config.throttleBackoff}
 	// Attempt to capture the shard in dynamo
 	for {
 		// Ask the checkpointer to capture the shard
@@ -94,14 +136,34 @@ func (k *Kinsumer) captureShard(shardID string) (*checkpointer, error) {
 			k.checkpointTableName,
 			k.dynamodb,
 			k.clientName,
-			k.clientID,
+			k.clientID(),
 			k.maxAgeForClientRecord,
+			atomic.LoadInt64(&k.homeEpoch),
 			k.config.stats)
+		if isThrottle(err) {
+			delay := captureBackoff.throttled(time.Now())
+			k.throttled("captureShard", shardID, delay)
+			select {
+			case <-k.stop:
+				return nil, nil
+			case <-time.After(delay):
+			}
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		captureBackoff.reset()
 
 		if checkpointer != nil {
+			checkpointer.onCheckpoint = k.config.onCheckpoint
+			checkpointer.onCommit = k.config.onCommit
+			checkpointer.touchFrequency = k.config.checkpointTouchInterval()
+			checkpointer.logger = k.config.logger
+			k.emit(EventShardAcquired, LevelInfo, shardID, map[string]interface{}{
+				"leaseToken":     checkpointer.leaseToken,
+				"sequenceNumber": checkpointer.sequenceNumber,
+			}, "Captured shard %s", shardID)
 			return checkpointer, nil
 		}
 
@@ -110,21 +172,264 @@ func (k *Kinsumer) captureShard(shardID string) (*checkpointer, error) {
 		case <-k.stop:
 			// If we are told to stop consuming we should stop attempting to capture
 			return nil, nil
-		case <-time.After(k.config.throttleDelay):
+		case <-time.After(k.live.getThrottleDelay()):
+		}
+	}
+}
+
+// releaseCheckpoint releases the checkpoint, backing off and trying again while it is throttled. It
+// gives up once our client record expired, as other clients take the shard over then anyway.
+func (k *Kinsumer) releaseCheckpoint(cp *checkpointer) error {
+	releaseBackoff := &backoff{policy: k.config.throttleBackoff}
+	deadline := time.Now().Add(k.maxAgeForClientRecord)
+	for {
+		err := cp.release()
+		now := time.Now()
+		if !isThrottle(err) || now.After(deadline) {
+			return err
+		}
+		delay := releaseBackoff.throttled(now)
+		k.throttled("checkpointer.release", cp.shardID, delay)
+		time.Sleep(delay)
+	}
+}
+
+// commitCheckpoint commits the checkpoint, unless we are still backing off after the previous commit
+// was throttled. Throttled commits are not errors, the checkpoint is committed on a later tick instead.
+func (k *Kinsumer) commitCheckpoint(cp *checkpointer, commitBackoff *backoff) (bool, error) {
+	now := time.Now()
+	if !commitBackoff.ready(now) {
+		return false, nil
+	}
+	finishCommitted, err := cp.commit()
+	if isThrottle(err) {
+		k.throttled("checkpointer.commit", cp.shardID, commitBackoff.throttled(now))
+		return false, nil
+	}
+	if err == nil {
+		commitBackoff.reset()
+	} else {
+		k.emit(EventCheckpointFailed, LevelError, cp.shardID, map[string]interface{}{"error": err.Error()},
+			"Error writing the checkpoint of shard %s: %s", cp.shardID, err)
+	}
+	return finishCommitted, err
+}
+
+// ShardCaptureHook is called with the metadata attached to a shard's checkpoint when it is captured
+type ShardCaptureHook func(shardID string, metadata []byte)
+
+// replaceStaleCheckpoint replaces a checkpoint that was written before the run started with the
+// bookmarked position we were asked to resume from, or clears it if we were asked to ignore
+// checkpoints. Checkpoints written during this run are left alone, unless they were written for the
+// copy of the stream we failed over from.
+func (k *Kinsumer) replaceStaleCheckpoint(cp *checkpointer) error {
+	if failovers := k.streamFailovers(); cp.failovers != failovers {
+		// Written for the copy of the stream we failed over from, the shard starts at the failover position
+		cp.reseed(failovers)
+		_, err := cp.commit()
+		return err
+	}
+
+	if cp.capturedLastUpdate >= k.runStartedAt.UnixNano() {
+		return nil
+	}
+
+	if k.bookmark != nil {
+		// Shards that are not in the bookmark were created after it was saved,
+		// so they are consumed from the configured position.
+		if sequenceNumber, ok := k.bookmark[cp.shardID]; ok {
+			cp.update(sequenceNumber)
+		} else {
+			cp.reset(true)
+		}
+		_, err := cp.commit()
+		return err
+	}
+
+	if position, ok := k.startingPositionOverride(cp.shardID); ok {
+		// The shard worker starts from the override once the checkpoint is cleared, except for
+		// AFTER_SEQUENCE_NUMBER which is where it resumes from a checkpoint anyway
+		if position.IteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber {
+			cp.update(position.SequenceNumber)
+		} else {
+			cp.reset(true)
+		}
+		_, err := cp.commit()
+		return err
+	}
+
+	if k.config.ignoreCheckpoints {
+		cp.reset(k.config.rewriteCheckpoints)
+		if k.config.rewriteCheckpoints {
+			_, err := cp.commit()
+			return err
+		}
+	}
+	return nil
+}
+
+// startingPosition returns where a shard with the given checkpointed sequence number starts. As the
+// LATEST, TRIM_HORIZON and AT_TIMESTAMP iterator types and a configured sequence number take precedence
+// over the checkpoints, shards only resume after their checkpoint with the default AFTER_SEQUENCE_NUMBER
+// or when it was positioned for this run by a bookmark, an override or a failover. The other shards
+// start from the failover position, their override, the missing checkpoint fallback or the configured
+// position, in that order.
+func (k *Kinsumer) startingPosition(shardID, sequenceNumber string) ShardPosition {
+	if sequenceNumber != "" && !k.configuredPositionFirst(shardID) {
+		return ShardReaderFromAfterSequenceNumber(sequenceNumber)
+	}
+	if position, ok := k.failoverPosition(); ok {
+		return position
+	}
+	if position, ok := k.startingPositionOverride(shardID); ok {
+		return position
+	}
+	if k.config.missingCheckpointFallback != nil && !k.configuredPositionFirst(shardID) {
+		return *k.config.missingCheckpointFallback
+	}
+	return ShardPosition{
+		IteratorType:   k.config.shardIteratorType,
+		SequenceNumber: k.config.sequenceNumber,
+		Timestamp:      k.config.atTimestamp,
+	}
+}
+
+// configuredPositionFirst returns whether the configured starting point takes precedence over the
+// checkpoint of the shard
+func (k *Kinsumer) configuredPositionFirst(shardID string) bool {
+	switch k.config.shardIteratorType {
+	case kinesis.ShardIteratorTypeAfterSequenceNumber, kinesis.ShardIteratorTypeAtSequenceNumber:
+		if k.config.sequenceNumber == "" {
+			return false
+		}
+	}
+	if k.bookmark != nil {
+		return false
+	}
+	if _, ok := k.failoverPosition(); ok {
+		return false
+	}
+	_, ok := k.startingPositionOverride(shardID)
+	return !ok
+}
+
+// startingPositionOverride returns the position the shard was configured to start at, if any
+func (k *Kinsumer) startingPositionOverride(shardID string) (ShardPosition, bool) {
+	if k.config.startingPositionFor == nil {
+		return ShardPosition{}, false
+	}
+	return k.config.startingPositionFor(shardID)
+}
+
+// trimHorizonProbes is the most GetRecords calls made to find the oldest record of a shard, as
+// kinesis can return no records from the trim horizon of a shard that has some
+const trimHorizonProbes = 5
+
+// expiredCheckpointIterator returns an iterator of a shard whose sequence number was rejected by
+// kinesis with err, at the expired checkpoint fallback if the sequence number aged out of the
+// stream. The fallback is returned along with the iterator when it was used.
+func (k *Kinsumer) expiredCheckpointIterator(shardID, sequenceNumber string, err error) (string, *ShardPosition, error) {
+	oldest, trimmed := k.trimmedBefore(shardID, sequenceNumber)
+	if !trimmed {
+		// Something else is wrong with the sequence number
+		return "", nil, err
+	}
+	fallback, err := k.expiredCheckpointFallback(shardID, sequenceNumber, oldest, err)
+	if err != nil {
+		return "", nil, err
+	}
+	iterator, err := getShardIterator(k.kinesis, k.streamName, shardID, fallback.IteratorType, "", fallback.Timestamp)
+	return iterator, &fallback, err
+}
+
+// trimmedBefore returns the sequence number of the oldest record of a shard, empty if it has no
+// records left, and whether the given sequence number is older so it was trimmed from the stream.
+// The sequence number isn't considered trimmed if the oldest record couldn't be found.
+func (k *Kinsumer) trimmedBefore(shardID, sequenceNumber string) (string, bool) {
+	iterator, err := getShardIterator(k.kinesis, k.streamName, shardID, kinesis.ShardIteratorTypeTrimHorizon, "", nil)
+	for i := 0; err == nil && i < trimHorizonProbes; i++ {
+		var records []*kinesis.Record
+		var lag time.Duration
+		if records, iterator, lag, _, err = getRecords(k.kinesis, iterator, 1); err != nil {
+			break
+		}
+		k.usage.getRecords(records)
+		if len(records) > 0 {
+			oldest := aws.StringValue(records[0].SequenceNumber)
+			return oldest, sequenceNumberLess(sequenceNumber, oldest)
+		}
+		if iterator == "" || lag == 0 {
+			// All the records of the shard aged out
+			return "", true
+		}
+	}
+	if err != nil {
+		k.logf(LevelWarn, "getShardIterator", shardID, "Error reading the oldest record of shard %s: %s", shardID, err)
+	}
+	return "", false
+}
+
+// expiredCheckpointFallback returns where to start a shard whose checkpointed sequence number is no
+// longer in the stream, the oldest record being oldest, or ErrCheckpointExpired if it shouldn't be
+// started
+func (k *Kinsumer) expiredCheckpointFallback(shardID, sequenceNumber, oldest string, err error) (ShardPosition, error) {
+	fallback := k.config.expiredCheckpointFallback
+	if fallback == nil {
+		return ShardPosition{}, fmt.Errorf("%w, sequence number %s of shard %s: %v", ErrCheckpointExpired, sequenceNumber, shardID, err)
+	}
+	k.logf(LevelWarn, "getShardIterator", shardID, "Sequence number %s of shard %s is no longer in the stream, its oldest record being %q, "+
+		"starting at %s: %s", sequenceNumber, shardID, oldest, fallback.IteratorType, err)
+	if stats, ok := k.config.stats.(CheckpointFallbackStatReceiver); ok {
+		stats.CheckpointExpired(shardID)
+	}
+	return *fallback, nil
+}
+
+// isInvalidArgument returns whether err is the error kinesis returns for sequence numbers it doesn't have
+func isInvalidArgument(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == kinesis.ErrCodeInvalidArgumentException
+}
+
+// waitForParents blocks until all the given parents of a shard have been fully consumed, so that
+// records of a child shard are never returned before the unread records of its parents after a
+// reshard. Returns false if we were told to stop while waiting.
+func (k *Kinsumer) waitForParents(parents []string) (bool, error) {
+	for len(parents) > 0 {
+		finished, err := shardFinished(k.dynamodb, k.checkpointTableName, parents[0])
+		if err != nil {
+			return false, err
+		}
+		if finished {
+			parents = parents[1:]
+			continue
+		}
+
+		select {
+		case <-k.stop:
+			return false, nil
+		case <-time.After(k.live.getCommitFrequency()):
 		}
 	}
+	return true, nil
 }
 
-// consume is a blocking call that captures then consumes the given shard in a loop.
-// It is also responsible for writing out the checkpoint updates to dynamo.
-// TODO: There are no tests for this file. Not sure how to even unit test this.
-func (k *Kinsumer) consume(shardID string) {
+// consume is a blocking call that captures then consumes the given shard in a loop, once the given
+// parents of the shard are finished. It is also responsible for writing out the checkpoint updates
+// to dynamo.
+func (k *Kinsumer) consume(shardID string, parents []string) {
 	defer k.waitGroup.Done()
+	defer k.recoverPanic("consume", shardID)
 
 	// commitTicker is used to periodically commit, so that we don't hammer dynamo every time
 	// a shard wants to be check pointed
-	commitTicker := time.NewTicker(k.config.commitFrequency)
-	defer commitTicker.Stop()
+	commitFrequency := k.live.getCommitFrequency()
+	commitTicker := time.NewTicker(commitFrequency)
+	defer func() {
+		commitTicker.Stop()
+	}()
+	commitBackoff := &backoff{policy: k.config.throttleBackoff}
+	getRecordsBackoff := &backoff{policy: k.config.throttleBackoff}
 
 	// capture the checkpointer
 	checkpointer, err := k.captureShard(shardID)
@@ -138,33 +443,63 @@ func (k *Kinsumer) consume(shardID string) {
 	if checkpointer == nil {
 		return
 	}
-
-	sequenceNumber := checkpointer.sequenceNumber
+	capturedAt := time.Now()
 
 	// finished means we have reached the end of the shard but haven't necessarily processed/committed everything
 	finished := false
 	// Make sure we release the shard when we are done.
 	defer func() {
-		innerErr := checkpointer.release()
+		innerErr := k.releaseCheckpoint(checkpointer)
 		if innerErr != nil {
 			k.shardErrors <- shardConsumerError{shardID: shardID, action: "checkpointer.release", err: innerErr}
 			return
 		}
+		checkpointer.mutex.Lock()
+		released := checkpointer.checkpointedSequenceNumber()
+		checkpointer.mutex.Unlock()
+		k.emit(EventShardReleased, LevelInfo, shardID, map[string]interface{}{"sequenceNumber": released},
+			"Released shard %s", shardID)
 	}()
 
-	if k.config.sequenceNumber != "" {
-		sequenceNumber = k.config.sequenceNumber
+	if err = k.replaceStaleCheckpoint(checkpointer); err != nil {
+		k.shardErrors <- shardConsumerError{shardID: shardID, action: "checkpointer.commit", err: err}
+		return
+	}
+
+	k.setOwnedCheckpointer(shardID, checkpointer)
+	defer k.setOwnedCheckpointer(shardID, nil)
+
+	ok, err := k.waitForParents(parents)
+	if err != nil {
+		k.shardErrors <- shardConsumerError{shardID: shardID, action: "waitForParents", err: err}
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if k.config.shardCaptureHook != nil {
+		k.config.shardCaptureHook(shardID, checkpointer.metadata)
 	}
 
+	position := k.startingPosition(shardID, checkpointer.sequenceNumber)
+	shardIteratorType, sequenceNumber, timestamp := position.IteratorType, position.SequenceNumber, position.Timestamp
+
 	// Get the starting shard iterator
 	iterator, err := getShardIterator(
 		k.kinesis,
 		k.streamName,
 		shardID,
-		k.config.shardIteratorType,
+		shardIteratorType,
 		sequenceNumber,
-		k.config.atTimestamp,
+		timestamp,
 	)
+	if err != nil && sequenceNumber != "" && sequenceNumber == checkpointer.sequenceNumber && isInvalidArgument(err) {
+		var fallback *ShardPosition
+		if iterator, fallback, err = k.expiredCheckpointIterator(shardID, sequenceNumber, err); fallback != nil {
+			shardIteratorType, sequenceNumber, timestamp = fallback.IteratorType, "", fallback.Timestamp
+		}
+	}
 	if err != nil {
 		k.shardErrors <- shardConsumerError{shardID: shardID, action: "getShardIterator", err: err}
 		return
@@ -173,9 +508,39 @@ func (k *Kinsumer) consume(shardID string) {
 	// no throttle on the first request.
 	nextThrottle := time.After(0)
 
-	retryCount := 0
+	// whether the shard's starting position was added to the recovery report
+	var recovered bool
+
+	// sequence number of the last record we buffered, records the filter skips are checkpointed
+	// once it is acked
+	var lastBuffered string
+
+	// number of records asked for in the next GetRecords call, adjusted to the size of the records
+	// if we have a target size for the calls, and the max it can be adjusted to
+	limit := k.live.getGetRecordsLimit()
+	maxLimit := limit
+	// delay between GetRecords calls, shortened while we catch up with adaptive fetching
+	pollDelay := k.live.getThrottleDelay()
+	// number of GetRecords calls in a row that were made right away after returning no records
+	var emptyPolls int
+	// limiter of the records buffered from this shard, nil if there is no per shard rate limit
+	limiter := newRateLimiter(k.config.shardRecordsPerSecond, k.config.shardBytesPerSecond)
+	// meter of the throughput of the shard, nil if there is no scaling advisor
+	var meter *throughputMeter
+	if k.config.scalingAdvisor != nil {
+		meter = &throughputMeter{period: k.config.leaderActionFrequency, start: time.Now()}
+	}
 
 	var lastSeqNum string
+	// children of the shard, returned by kinesis once we reached its end
+	var childShards []*kinesis.ChildShard
+	// subscription of the shard with the enhanced fan-out consumer, nil while we poll with GetRecords
+	var subscription *shardSubscription
+	defer func() {
+		if subscription != nil {
+			subscription.close()
+		}
+	}()
 mainloop:
 	for {
 		// We have reached the end of the shard's data. Set Finished in dynamo and stop processing.
@@ -184,17 +549,29 @@ mainloop:
 			finished = true
 		}
 
+		// Pick up a commit frequency changed by UpdateConfig
+		if f := k.live.getCommitFrequency(); f != commitFrequency {
+			commitFrequency = f
+			commitTicker.Stop()
+			commitTicker = time.NewTicker(commitFrequency)
+		}
+
 		// Handle async actions, and throttle requests to keep kinesis happy
 		select {
 		case <-k.stop:
 			return
 		case <-commitTicker.C:
-			finishCommitted, err := checkpointer.commit()
+			finishCommitted, err := k.commitCheckpoint(checkpointer, commitBackoff)
 			if err != nil {
 				k.shardErrors <- shardConsumerError{shardID: shardID, action: "checkpointer.commit", err: err}
 				return
 			}
 			if finishCommitted {
+				if len(childShards) > 0 {
+					if err := k.addChildShards(childShards); err != nil {
+						k.shardErrors <- shardConsumerError{shardID: shardID, action: "addChildShards", err: err}
+					}
+				}
 				return
 			}
 			// Go back to waiting for a throttle/stop.
@@ -203,65 +580,238 @@ mainloop:
 		}
 
 		// Reset the nextThrottle
-		nextThrottle = time.After(k.config.throttleDelay)
+		nextThrottle = time.After(pollDelay)
 
 		if finished {
 			continue mainloop
 		}
 
+		// Read through the enhanced fan-out consumer once it is active, picking up the one replacing it
+		if arn := k.subscriptionARN(); arn != "" && subscription == nil {
+			subscription = newShardSubscription(k.kinesis, arn, shardID, shardIteratorType, sequenceNumber, timestamp)
+			if lastSeqNum != "" {
+				subscription.restart(kinesis.ShardIteratorTypeAfterSequenceNumber, lastSeqNum, nil)
+			}
+		} else if arn != "" && arn != subscription.consumerARN {
+			subscription.close()
+			subscription.consumerARN = arn
+		}
+
 		// Get records from kinesis
-		records, next, lag, err := getRecords(k.kinesis, iterator)
+		var records []*kinesis.Record
+		var next string
+		var lag time.Duration
+		var children []*kinesis.ChildShard
+		if subscription != nil {
+			var ended bool
+			records, lag, children, ended, err = subscription.next(k.stop, commitFrequency)
+			if next = iterator; ended {
+				next = ""
+			}
+		} else {
+			records, next, lag, children, err = getRecords(k.kinesis, iterator, limit)
+			if err == nil {
+				k.usage.getRecords(records)
+			}
+		}
 
-		if err != nil {
-			if awsErr, ok := err.(awserr.Error); ok {
-				k.config.logger.Log("Got error: %s (%s) retry count is %d / %d", awsErr.Message(), awsErr.OrigErr(), retryCount, maxErrorRetries)
-				if retryCount < maxErrorRetries {
-					retryCount++
-
-					// casting retryCount here to time.Duration purely for the multiplication, there is
-					// no meaning to retryCount nanoseconds
-					time.Sleep(errorSleepDuration * time.Duration(retryCount))
+		if isThrottle(err) || isSubscriptionBusy(err) {
+			// Back off without counting it as an error, we will get through eventually
+			delay := getRecordsBackoff.throttled(time.Now())
+			k.throttled("getRecords", shardID, delay)
+			nextThrottle = time.After(delay)
+			continue mainloop
+		}
+		if err != nil && subscription != nil {
+			if isConsumerGone(err) {
+				// The consumer was replaced if the leader deregistered it, the next read subscribes
+				// with the new one
+				if err := k.refreshFanOutConsumer(); err != nil {
+					k.shardErrors <- shardConsumerError{shardID: shardID, action: "refreshFanOutConsumer", err: err}
+					return
+				}
+				if arn := k.subscriptionARN(); arn != "" && arn != subscription.consumerARN {
+					nextThrottle = time.After(0)
 					continue mainloop
 				}
 			}
+			if seq := subscription.startingSequenceNumber(); seq != "" && isInvalidArgument(err) {
+				// The record we were reading from aged out of the stream meanwhile
+				var fallback *ShardPosition
+				if _, fallback, err = k.expiredCheckpointIterator(shardID, seq, err); fallback != nil {
+					shardIteratorType, sequenceNumber, timestamp = fallback.IteratorType, "", fallback.Timestamp
+					subscription.restart(shardIteratorType, sequenceNumber, timestamp)
+					nextThrottle = time.After(0)
+					continue mainloop
+				}
+			} else if isRetryable(err) {
+				// The subscription failed, subscribe again once we backed off
+				delay := getRecordsBackoff.throttled(time.Now())
+				k.logf(LevelWarn, "subscribeToShard", shardID, "Subscription to shard %s failed: %s, subscribing again in %s", shardID, err, delay)
+				nextThrottle = time.After(delay)
+				continue mainloop
+			}
+			k.shardErrors <- shardConsumerError{shardID: shardID, action: "subscribeToShard", err: err}
+			return
+		}
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+				// We took too long to use the iterator, get a new one right after the last record
+				// we read, or at the starting position if we haven't read anything yet
+				k.logf(LevelInfo, "getRecords", shardID, "Shard iterator expired for shard %s, getting a new one", shardID)
+				if stats, ok := k.config.stats.(IteratorStatReceiver); ok {
+					stats.IteratorExpired(shardID)
+				}
+				if lastSeqNum != "" {
+					shardIteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+					sequenceNumber = lastSeqNum
+				}
+				iterator, err = getShardIterator(
+					k.kinesis,
+					k.streamName,
+					shardID,
+					shardIteratorType,
+					sequenceNumber,
+					timestamp,
+				)
+				if err != nil && sequenceNumber != "" && isInvalidArgument(err) {
+					// The record we were reading from aged out of the stream meanwhile
+					var fallback *ShardPosition
+					if iterator, fallback, err = k.expiredCheckpointIterator(shardID, sequenceNumber, err); fallback != nil {
+						shardIteratorType, sequenceNumber, timestamp = fallback.IteratorType, "", fallback.Timestamp
+					}
+				}
+				if err != nil {
+					k.shardErrors <- shardConsumerError{shardID: shardID, action: "getShardIterator", err: err}
+					return
+				}
+				nextThrottle = time.After(0)
+				continue mainloop
+			}
 			k.shardErrors <- shardConsumerError{shardID: shardID, action: "getRecords", err: err}
 			return
 		}
-		retryCount = 0
+		if !recovered {
+			recovered = true
+			recovery := ShardRecovery{
+				ShardID:      shardID,
+				IteratorType: shardIteratorType,
+				Backlog:      lag,
+			}
+			if shardIteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber {
+				recovery.SequenceNumber = sequenceNumber
+			}
+			if checkpointer.capturedLastUpdate > 0 {
+				recovery.CheckpointAge = capturedAt.Sub(time.Unix(0, checkpointer.capturedLastUpdate))
+			}
+			k.shardRecovered(recovery)
+		}
+		getRecordsBackoff.reset()
+		checkpointer.polled(time.Now(), lag)
+		maxLimit, pollDelay = adaptiveFetch(k.config.catchUpLag, k.live.getGetRecordsLimit(), k.live.getThrottleDelay(), maxLimit, lag)
+		// Sparse parts of the stream return no records while we are still behind, poll them again
+		// right away rather than sleeping
+		if len(records) == 0 && lag > 0 && next != "" && emptyPolls < k.config.emptyPollRetries {
+			emptyPolls++
+			nextThrottle = time.After(0)
+		} else {
+			emptyPolls = 0
+		}
+		if subscription != nil {
+			// Subscriptions push the records as they come, waiting for them is enough
+			nextThrottle = time.After(0)
+		}
+		if len(records) > 0 {
+			limit = fetchLimit(maxLimit, k.config.getRecordsMaxBytes, records)
+		} else if limit > maxLimit {
+			limit = maxLimit
+		}
 
 		// Put all the records we got onto the channel
 		k.config.stats.EventsFromKinesis(len(records), shardID, lag)
+		if meter != nil {
+			if t, ok := meter.add(time.Now(), records, lag); ok {
+				checkpointer.setThroughput(t)
+			}
+		}
+		if k.config.keyExtractor != nil && len(records) > 0 {
+			batch := tally(k.config.keyExtractor, records)
+			if stats, ok := k.config.stats.(KeyStatReceiver); ok {
+				for key, ks := range batch {
+					stats.EventsForKey(int(ks.Records), int(ks.Bytes), key)
+				}
+			}
+			k.keyStats.add(batch)
+		}
 		if len(records) > 0 {
 			retrievedAt := time.Now()
 			for _, record := range records {
-			RecordLoop:
-				// Loop until we stop or the record is consumed, checkpointing if necessary.
-				for {
-					select {
-					case <-commitTicker.C:
-						finishCommitted, err := checkpointer.commit()
-						if err != nil {
-							k.shardErrors <- shardConsumerError{shardID: shardID, action: "checkpointer.commit", err: err}
-							return
+				if err := k.resolveClaimCheck(record); err == errClaimCheckStopped {
+					return
+				} else if err != nil {
+					k.shardErrors <- shardConsumerError{shardID: shardID, action: "resolveClaimCheck", err: err}
+					return
+				}
+				if k.config.decompression != CompressionNone {
+					data, err := decompress(k.config.decompression, record.Data, k.config.decompressionLimit)
+					if err != nil {
+						if stats, ok := k.config.stats.(DecompressionStatReceiver); ok {
+							stats.DecompressionFailed(shardID)
 						}
-						if finishCommitted {
+						if !k.corruptRecord(checkpointer, lastBuffered, newRecord(shardID, record),
+							fmt.Errorf("error decompressing record: %w", err), commitTicker, commitBackoff) {
 							return
 						}
-					case <-k.stop:
+						continue
+					}
+					record.Data = data
+				}
+				if k.config.recordValidator != nil {
+					valid, ok := k.validateRecord(checkpointer, lastBuffered, record, commitTicker, commitBackoff)
+					if !ok {
 						return
-					case k.records <- &consumedRecord{
-						record:       record,
-						checkpointer: checkpointer,
-						retrievedAt:  retrievedAt,
-					}:
-						break RecordLoop
 					}
+					if !valid {
+						continue
+					}
+				}
+				if k.config.recordFilter != nil && !k.config.recordFilter(*newRecord(shardID, record)) {
+					// Checkpoint past it once the records buffered before it are acked
+					checkpointer.skip(lastBuffered, aws.StringValue(record.SequenceNumber))
+					continue
+				}
+				cr := &consumedRecord{
+					record:       record,
+					checkpointer: checkpointer,
+					retrievedAt:  retrievedAt,
+					trace:        k.newDeliveryTrace(shardID, record, retrievedAt),
 				}
+				if limiter != nil {
+					if delay := limiter.take(time.Now(), len(record.Data)); delay > 0 &&
+						!k.waitForShardRateLimit(checkpointer, delay, commitTicker, commitBackoff) {
+						return
+					}
+				}
+				if k.config.pacingBytesPerSecond > 0 &&
+					!k.paceBuffered(checkpointer, len(record.Data), commitTicker, commitBackoff) {
+					return
+				}
+				// Wait until we stop or the record is buffered, checkpointing if necessary.
+				if !k.bufferRecord(cr, commitTicker, commitBackoff) {
+					k.unbuffered(cr)
+					cr.trace.log(k.config.logger, "discarded when the consumer was stopped", time.Now())
+					return
+				}
+				cr.trace.log(k.config.logger, "buffered", time.Now())
+				lastBuffered = aws.StringValue(record.SequenceNumber)
 			}
 
 			// Update the last sequence number we saw, in case we reached the end of the stream.
 			lastSeqNum = aws.StringValue(records[len(records)-1].SequenceNumber)
 		}
+		if len(children) > 0 {
+			childShards = children
+		}
 		iterator = next
 	}
 }
@@ -0,0 +1,420 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchLimit(t *testing.T) {
+	records := []*kinesis.Record{
+		{Data: make([]byte, 100)},
+		{Data: make([]byte, 300)},
+	}
+
+	// No target, always use the limit
+	require.Equal(t, int64(500), fetchLimit(500, 0, records))
+	// 200 bytes per record on average
+	require.Equal(t, int64(50), fetchLimit(500, 10000, records))
+	require.Equal(t, int64(500), fetchLimit(500, 1000000, records))
+	require.Equal(t, int64(1), fetchLimit(500, 10, records))
+	// Nothing to go by
+	require.Equal(t, int64(500), fetchLimit(500, 10000, nil))
+	require.Equal(t, int64(500), fetchLimit(500, 10000, []*kinesis.Record{{}}))
+}
+
+func TestAdaptiveFetch(t *testing.T) {
+	throttleDelay := time.Second
+
+	// Not enabled
+	limit, delay := adaptiveFetch(0, 1000, throttleDelay, 1000, time.Hour)
+	require.Equal(t, int64(1000), limit)
+	require.Equal(t, throttleDelay, delay)
+
+	limit, delay = adaptiveFetch(time.Minute, 1000, throttleDelay, 1000, time.Hour)
+	require.Equal(t, int64(2000), limit)
+	require.Equal(t, minThrottleDelay, delay)
+	limit, _ = adaptiveFetch(time.Minute, 1000, throttleDelay, 8000, time.Hour)
+	require.Equal(t, int64(getRecordsLimit), limit)
+
+	// Caught up
+	limit, delay = adaptiveFetch(time.Minute, 1000, throttleDelay, 8000, time.Second)
+	require.Equal(t, int64(1000), limit)
+	require.Equal(t, throttleDelay, delay)
+}
+
+func TestStartingPositionOverrides(t *testing.T) {
+	startedAt := time.Now()
+	k := &Kinsumer{
+		runStartedAt: startedAt,
+		config: NewConfig().WithStartingPositions(map[string]ShardPosition{
+			"replayed": ShardReaderFromAfterSequenceNumber("2"),
+			"latest":   ShardReaderFromLatest(),
+		}),
+	}
+	db := mocks.NewMockDynamo([]string{"checkpoints"})
+	checkpoint := func(shardID string, lastUpdate time.Time) *checkpointer {
+		return &checkpointer{
+			shardID:            shardID,
+			tableName:          "checkpoints",
+			dynamodb:           db,
+			stats:              &NoopStatReceiver{},
+			sequenceNumber:     "5",
+			capturedLastUpdate: lastUpdate.UnixNano(),
+		}
+	}
+	stale := startedAt.Add(-time.Hour)
+
+	cp := checkpoint("replayed", stale)
+	require.NoError(t, k.replaceStaleCheckpoint(cp))
+	require.Equal(t, "2", cp.sequenceNumber)
+
+	cp = checkpoint("latest", stale)
+	require.NoError(t, k.replaceStaleCheckpoint(cp))
+	require.Equal(t, "", cp.sequenceNumber)
+
+	// Shards without an override, and checkpoints written during this run, are left alone
+	cp = checkpoint("other", stale)
+	require.NoError(t, k.replaceStaleCheckpoint(cp))
+	require.Equal(t, "5", cp.sequenceNumber)
+	cp = checkpoint("replayed", startedAt.Add(time.Second))
+	require.NoError(t, k.replaceStaleCheckpoint(cp))
+	require.Equal(t, "5", cp.sequenceNumber)
+
+	config := NewConfig().WithStartingPositions(map[string]ShardPosition{
+		"shard": {IteratorType: kinesis.ShardIteratorTypeAtTimestamp},
+	})
+	require.True(t, errors.Is(config.Validate(), ErrConfigInvalidStartingPosition))
+}
+
+func TestStartingPosition(t *testing.T) {
+	// By default the shards resume after their checkpoint, the others start at the trim horizon
+	k := &Kinsumer{config: NewConfig()}
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("5"), k.startingPosition("shard", "5"))
+	require.Equal(t, kinesis.ShardIteratorTypeAfterSequenceNumber, k.startingPosition("shard", "").IteratorType)
+	require.Equal(t, "", k.startingPosition("shard", "").SequenceNumber)
+
+	at := time.Now()
+	k.config = NewConfig().WithMissingCheckpointFallback(ShardReaderFromAtTimestamp(at))
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("5"), k.startingPosition("shard", "5"))
+	require.Equal(t, ShardReaderFromAtTimestamp(at), k.startingPosition("shard", ""))
+
+	// The other iterator types and a configured sequence number take precedence over the checkpoints
+	k.config = NewConfig().WithShardIteratorLatest()
+	require.Equal(t, kinesis.ShardIteratorTypeLatest, k.startingPosition("shard", "5").IteratorType)
+	k.config = NewConfig().WithShardIteratorAtTimestamp(at).WithMissingCheckpointFallback(ShardReaderFromLatest())
+	require.Equal(t, ShardReaderFromAtTimestamp(at), k.startingPosition("shard", "5"))
+	require.Equal(t, ShardReaderFromAtTimestamp(at), k.startingPosition("shard", ""))
+	k.config = NewConfig().WithShardIteratorAfterSequenceNumber("2")
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("2"), k.startingPosition("shard", "5"))
+
+	// Unless the checkpoint was positioned by an override or a bookmark
+	k.config = NewConfig().WithShardIteratorLatest().WithStartingPositions(map[string]ShardPosition{
+		"replayed": ShardReaderFromTrimHorizon(),
+	})
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("5"), k.startingPosition("replayed", "5"))
+	require.Equal(t, ShardReaderFromTrimHorizon(), k.startingPosition("replayed", ""))
+	require.Equal(t, kinesis.ShardIteratorTypeLatest, k.startingPosition("other", "5").IteratorType)
+	k.bookmark = map[string]string{"other": "5"}
+	require.Equal(t, ShardReaderFromAfterSequenceNumber("5"), k.startingPosition("other", "5"))
+}
+
+// trimmedKinesis is a shard whose records before oldest aged out, and whose other sequence numbers
+// are rejected, empty if all the records aged out
+type trimmedKinesis struct {
+	kinesisiface.KinesisAPI
+	oldest string
+}
+
+func (k *trimmedKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	switch aws.StringValue(in.ShardIteratorType) {
+	case kinesis.ShardIteratorTypeAfterSequenceNumber:
+		return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "StartingSequenceNumber is invalid", nil)
+	default:
+		return &kinesis.GetShardIteratorOutput{ShardIterator: in.ShardIteratorType}, nil
+	}
+}
+
+func (k *trimmedKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	out := &kinesis.GetRecordsOutput{NextShardIterator: aws.String("next"), MillisBehindLatest: aws.Int64(0)}
+	if aws.StringValue(in.ShardIterator) == kinesis.ShardIteratorTypeTrimHorizon && k.oldest != "" {
+		out.Records = []*kinesis.Record{{SequenceNumber: aws.String(k.oldest)}}
+		out.MillisBehindLatest = aws.Int64(1000)
+	}
+	return out, nil
+}
+
+func TestExpiredCheckpointFallback(t *testing.T) {
+	invalidArgument := awserr.New(kinesis.ErrCodeInvalidArgumentException, "StartingSequenceNumber is invalid", nil)
+	require.True(t, isInvalidArgument(fmt.Errorf("error getting shard iterator: %w", invalidArgument)))
+	require.False(t, isInvalidArgument(errors.New("other")))
+
+	stream := &trimmedKinesis{oldest: "10"}
+	k, err := NewWithInterfaces(stream, mocks.NewMockDynamo(nil), "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+	_, _, err = k.expiredCheckpointIterator("shard", "5", invalidArgument)
+	require.True(t, errors.Is(err, ErrCheckpointExpired))
+
+	k.config = k.config.WithExpiredCheckpointFallback(ShardReaderFromLatest())
+	require.NoError(t, k.config.Validate())
+	iterator, position, err := k.expiredCheckpointIterator("shard", "5", invalidArgument)
+	require.NoError(t, err)
+	require.Equal(t, ShardReaderFromLatest(), *position)
+	require.Equal(t, kinesis.ShardIteratorTypeLatest, iterator)
+
+	// A sequence number kinesis rejects for another reason than aging out doesn't fall back
+	_, position, err = k.expiredCheckpointIterator("shard", "50", invalidArgument)
+	require.Equal(t, invalidArgument, err)
+	require.Nil(t, position)
+
+	// A shard without records left had all of them age out
+	stream.oldest = ""
+	_, position, err = k.expiredCheckpointIterator("shard", "50", invalidArgument)
+	require.NoError(t, err)
+	require.Equal(t, ShardReaderFromLatest(), *position)
+
+	config := NewConfig().WithExpiredCheckpointFallback(ShardReaderFromAfterSequenceNumber("1"))
+	require.True(t, errors.Is(config.Validate(), ErrConfigInvalidCheckpointFallback))
+	config = NewConfig().WithExpiredCheckpointFallback(ShardPosition{IteratorType: kinesis.ShardIteratorTypeAtTimestamp})
+	require.True(t, errors.Is(config.Validate(), ErrConfigInvalidCheckpointFallback))
+
+	at := time.Now()
+	config = NewConfig().WithMissingCheckpointFallback(ShardReaderFromAtTimestamp(at))
+	require.Equal(t, kinesis.ShardIteratorTypeAfterSequenceNumber, config.shardIteratorType)
+	require.Equal(t, ShardReaderFromAtTimestamp(at), *config.missingCheckpointFallback)
+	config = NewConfig().WithMissingCheckpointFallback(ShardPosition{IteratorType: kinesis.ShardIteratorTypeAtTimestamp})
+	require.True(t, errors.Is(config.Validate(), ErrConfigInvalidStartingPosition))
+}
+
+// expiringKinesis is a shard whose iterators are the sequence number of the record they read after.
+// GetRecords returns one record at a time, and fails with ExpiredIteratorException at call expireAt.
+type expiringKinesis struct {
+	kinesisiface.KinesisAPI
+	records  []string // sequence numbers of the records of the shard
+	expireAt int
+
+	mutex     sync.Mutex
+	calls     int
+	iterators []string // iterator type and sequence number of the iterators asked for
+}
+
+func (k *expiringKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.iterators = append(k.iterators, aws.StringValue(in.ShardIteratorType)+" "+aws.StringValue(in.StartingSequenceNumber))
+	return &kinesis.GetShardIteratorOutput{ShardIterator: in.StartingSequenceNumber}, nil
+}
+
+func (k *expiringKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.calls++; k.calls == k.expireAt {
+		return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "Iterator expired", nil)
+	}
+	out := &kinesis.GetRecordsOutput{NextShardIterator: in.ShardIterator, MillisBehindLatest: aws.Int64(0)}
+	for i, seq := range k.records[:len(k.records)-1] {
+		if seq == aws.StringValue(in.ShardIterator) {
+			next := k.records[i+1]
+			out.Records = []*kinesis.Record{{SequenceNumber: aws.String(next), PartitionKey: aws.String(next), Data: []byte(next)}}
+			out.NextShardIterator = aws.String(next)
+		}
+	}
+	return out, nil
+}
+
+func (k *expiringKinesis) requestedIterators() []string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return append([]string(nil), k.iterators...)
+}
+
+// iteratorStats counts the expired iterators
+type iteratorStats struct {
+	NoopStatReceiver
+	mutex   sync.Mutex
+	expired map[string]int
+}
+
+func (s *iteratorStats) IteratorExpired(shardID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expired[shardID]++
+}
+
+// consumeShard starts consuming a shard with the given checkpoint, returning the function stopping it
+func consumeShard(t *testing.T, k *Kinsumer, shardID, checkpoint string, parents []string) func() {
+	item, err := dynamodbattribute.MarshalMap(&checkpointRecord{Shard: shardID, SequenceNumber: aws.String(checkpoint)})
+	require.NoError(t, err)
+	_, err = k.dynamodb.PutItem(&dynamodb.PutItemInput{TableName: aws.String(k.checkpointTableName), Item: item})
+	require.NoError(t, err)
+
+	k.stop = make(chan struct{})
+	k.shutdownDeadline = make(chan struct{})
+	k.waitGroup.Add(1)
+	go k.consume(shardID, parents)
+	return func() {
+		close(k.stop)
+		k.waitGroup.Wait()
+	}
+}
+
+func TestExpiredIterator(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		expireAt  int
+		iterators []string
+	}{
+		// Before any record was delivered, the new iterator reads after the checkpoint
+		{"checkpointed", 1, []string{"AFTER_SEQUENCE_NUMBER 1", "AFTER_SEQUENCE_NUMBER 1"}},
+		// Then after the last record delivered
+		{"delivered", 3, []string{"AFTER_SEQUENCE_NUMBER 1", "AFTER_SEQUENCE_NUMBER 3"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &expiringKinesis{records: []string{"1", "2", "3", "4", "5"}, expireAt: test.expireAt}
+			stats := &iteratorStats{expired: make(map[string]int)}
+			k, err := NewWithInterfaces(stream, mocks.NewMockDynamo([]string{"app_checkpoints"}), "stream", "app", "client",
+				NewConfig().WithStats(stats).WithThrottleDelay(minThrottleDelay))
+			require.NoError(t, err)
+			stop := consumeShard(t, k, "shard", "1", nil)
+
+			// The records are delivered once each, in order
+			for _, seq := range []string{"2", "3", "4", "5"} {
+				select {
+				case cr := <-k.records:
+					require.Equal(t, seq, aws.StringValue(cr.record.SequenceNumber))
+				case err := <-k.shardErrors:
+					require.NoError(t, err.err)
+				}
+			}
+			stop()
+
+			require.Equal(t, test.iterators, stream.requestedIterators())
+			require.Equal(t, map[string]int{"shard": 1}, stats.expired)
+			require.Empty(t, k.shardErrors)
+		})
+	}
+}
+
+// reshardDynamo keeps the last checkpoint written for each shard, and the shard cache
+type reshardDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	mutex       sync.Mutex
+	checkpoints map[string]map[string]*dynamodb.AttributeValue
+	cache       shardCacheDynamo
+}
+
+func (d *reshardDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if shard, ok := in.Key["Shard"]; ok {
+		return &dynamodb.GetItemOutput{Item: d.checkpoints[aws.StringValue(shard.S)]}, nil
+	}
+	return d.cache.GetItem(in)
+}
+
+func (d *reshardDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.checkpoints[aws.StringValue(in.Item["Shard"].S)] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *reshardDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := in.Key["Shard"]; ok {
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	return d.cache.UpdateItem(in)
+}
+
+func (d *reshardDynamo) shardCache() shardCacheRecord {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cache.cache
+}
+
+// closedKinesis has a parent shard closed after its one record, with a child shard of one record
+type closedKinesis struct {
+	kinesisiface.KinesisAPI
+}
+
+func (k *closedKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	return &kinesis.GetShardIteratorOutput{ShardIterator: in.ShardId}, nil
+}
+
+func (k *closedKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	out := &kinesis.GetRecordsOutput{NextShardIterator: in.ShardIterator, MillisBehindLatest: aws.Int64(0)}
+	switch aws.StringValue(in.ShardIterator) {
+	case "parent":
+		out.Records = []*kinesis.Record{{SequenceNumber: aws.String("1"), PartitionKey: aws.String("1"), Data: []byte("1")}}
+		out.NextShardIterator = nil
+		out.ChildShards = []*kinesis.ChildShard{{ShardId: aws.String("child"), ParentShards: aws.StringSlice([]string{"parent"})}}
+	case "child":
+		out.Records = []*kinesis.Record{{SequenceNumber: aws.String("2"), PartitionKey: aws.String("2"), Data: []byte("2")}}
+		out.NextShardIterator = aws.String("child-end")
+	}
+	return out, nil
+}
+
+func TestChildShardsOfClosedShard(t *testing.T) {
+	db := &reshardDynamo{
+		checkpoints: make(map[string]map[string]*dynamodb.AttributeValue),
+		cache:       shardCacheDynamo{cache: shardCacheRecord{ShardIDs: []string{"parent"}, LastUpdate: 1}},
+	}
+	k, err := NewWithInterfaces(&closedKinesis{}, db, "stream", "app", "client",
+		NewConfig().WithThrottleDelay(minThrottleDelay).WithCommitFrequency(10*time.Millisecond))
+	require.NoError(t, err)
+
+	// The consumer of the child waits for the parent to finish, as when a shard check found the child
+	stop := consumeShard(t, k, "parent", "0", nil)
+	defer stop()
+	k.waitGroup.Add(1)
+	go k.consume("child", []string{"parent"})
+
+	var cr *consumedRecord
+	select {
+	case cr = <-k.records:
+	case err := <-k.shardErrors:
+		require.NoError(t, err.err)
+	}
+	require.Equal(t, "1", aws.StringValue(cr.record.SequenceNumber))
+
+	// The parent isn't finished until its last record was returned, and its children are added once
+	// it is
+	select {
+	case cr := <-k.records:
+		require.Fail(t, "child consumed before its parent finished", aws.StringValue(cr.record.SequenceNumber))
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, []string{"parent"}, db.shardCache().ShardIDs)
+
+	k.returned(cr)
+	select {
+	case cr = <-k.records:
+	case err := <-k.shardErrors:
+		require.NoError(t, err.err)
+	}
+	require.Equal(t, "2", aws.StringValue(cr.record.SequenceNumber))
+	finished, err := shardFinished(db, k.checkpointTableName, "parent")
+	require.NoError(t, err)
+	require.True(t, finished)
+	require.Eventually(t, func() bool { return len(db.shardCache().ShardIDs) == 2 }, time.Second, time.Millisecond)
+	cache := db.shardCache()
+	require.Equal(t, []string{"child", "parent"}, cache.ShardIDs)
+	require.Equal(t, map[string][]string{"child": {"parent"}}, cache.ShardParents)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync"
+	"time"
+)
+
+// shardBuffers are bounded buffers of the records of each shard. The shard workers put their records
+// on the buffer of their shard rather than on the combined records buffer, so a worker only waits for
+// room when the records of its own shard are slow to be returned, and a fair merger moves the records
+// to the combined buffer taking one from each shard in turn.
+type shardBuffers struct {
+	size int
+
+	mutex   sync.Mutex
+	buffers map[string]chan *consumedRecord
+	order   []string      // shard IDs in the order the merger takes their records
+	next    int           // index in order of the shard the merger takes a record from next
+	wake    chan struct{} // signaled when a record is buffered, so the merger looks at the buffers again
+}
+
+func newShardBuffers(size int) *shardBuffers {
+	return &shardBuffers{
+		size:    size,
+		buffers: make(map[string]chan *consumedRecord),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// reset replaces the buffers with empty ones for the given shards, it must only be called when no
+// consumer is running
+func (b *shardBuffers) reset(shardIDs []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.buffers = make(map[string]chan *consumedRecord, len(shardIDs))
+	for _, shardID := range shardIDs {
+		b.buffers[shardID] = make(chan *consumedRecord, b.size)
+	}
+	b.order = append([]string(nil), shardIDs...)
+	b.next = 0
+}
+
+// get returns the buffer of a shard
+func (b *shardBuffers) get(shardID string) chan *consumedRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffers[shardID]
+}
+
+// notify wakes up the merger after a record was buffered
+func (b *shardBuffers) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the next record of the first shard with buffered records after the shard of the last
+// record taken, or returns nil if no records are buffered
+func (b *shardBuffers) pop() *consumedRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := range b.order {
+		n := (b.next + i) % len(b.order)
+		select {
+		case cr := <-b.buffers[b.order[n]]:
+			b.next = n + 1
+			return cr
+		default:
+		}
+	}
+	return nil
+}
+
+// drain removes all the buffered records, calling discard for each of them
+func (b *shardBuffers) drain(discard func(*consumedRecord)) {
+	for cr := b.pop(); cr != nil; cr = b.pop() {
+		discard(cr)
+	}
+}
+
+// occupancy returns the number of records buffered by shard
+func (b *shardBuffers) occupancy() map[string]int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buffered := make(map[string]int, len(b.buffers))
+	for shardID, records := range b.buffers {
+		buffered[shardID] = len(records)
+	}
+	return buffered
+}
+
+// mergeShardBuffers moves the records of the shard buffers to the combined records buffer, taking
+// one from each shard in turn, until the consumers stop
+func (k *Kinsumer) mergeShardBuffers() {
+	defer k.waitGroup.Done()
+	defer k.recoverPanic("mergeShardBuffers", "")
+
+	for {
+		cr := k.shardBuffers.pop()
+		if cr == nil {
+			select {
+			case <-k.shardBuffers.wake:
+				continue
+			case <-k.stop:
+				return
+			}
+		}
+
+		// Put it on the combined buffer, waiting for it if UpdateConfig is replacing it
+		for sent := false; !sent; {
+			buffer, replacing, unlock := k.lockBuffer()
+			select {
+			case buffer <- cr:
+				sent = true
+			case <-replacing:
+			case <-k.stop:
+				unlock()
+				cr.trace.log(k.config.logger, "discarded when the consumers were stopped", time.Now())
+				return
+			}
+			unlock()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardBuffers(t *testing.T) {
+	config := NewConfig().WithShardBuffers(2)
+	k := &Kinsumer{
+		records:      make(chan *consumedRecord, 10),
+		config:       config,
+		shardBuffers: newShardBuffers(config.shardBufferSize),
+		stop:         make(chan struct{}),
+	}
+	k.shardBuffers.reset([]string{"busy", "quiet"})
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	shardRecord := func(shardID, sn string) *consumedRecord {
+		cr := testConsumedRecord(sn)
+		cr.checkpointer = &checkpointer{shardID: shardID}
+		return cr
+	}
+	commitBackoff := &backoff{policy: k.config.throttleBackoff}
+
+	// The busy shard fills its buffer without holding back the quiet one
+	require.True(t, k.bufferRecord(shardRecord("busy", "1"), ticker, commitBackoff))
+	require.True(t, k.bufferRecord(shardRecord("busy", "2"), ticker, commitBackoff))
+	buffered := make(chan bool)
+	go func() { buffered <- k.bufferRecord(shardRecord("busy", "3"), ticker, commitBackoff) }()
+	require.True(t, k.bufferRecord(shardRecord("quiet", "10"), ticker, commitBackoff))
+	require.Equal(t, map[string]int{"busy": 2, "quiet": 1}, k.shardBuffers.occupancy())
+
+	// The merger takes one record of each shard in turn
+	var merged []string
+	for len(merged) < 3 {
+		cr := k.shardBuffers.pop()
+		require.NotNil(t, cr)
+		merged = append(merged, aws.StringValue(cr.record.SequenceNumber))
+		if len(merged) == 1 {
+			// The blocked worker of the busy shard buffers its record once there is room
+			require.True(t, <-buffered)
+		}
+	}
+	require.Equal(t, []string{"1", "10", "2"}, merged)
+
+	k.waitGroup.Add(1)
+	go k.mergeShardBuffers()
+	require.Equal(t, "3", aws.StringValue((<-k.records).record.SequenceNumber))
+	close(k.stop)
+	k.waitGroup.Wait()
+	k.shardBuffers.drain(func(*consumedRecord) { t.Fatal("nothing is left in the shard buffers") })
+
+	config = NewConfig().WithShardBuffers(10).WithBufferOverflowSpill("", 1024)
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidShardBuffers))
+}
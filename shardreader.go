@@ -0,0 +1,165 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ShardPosition is where OpenShard starts reading a shard
+type ShardPosition struct {
+	IteratorType   string     // kinesis shard iterator type
+	SequenceNumber string     // for AT_SEQUENCE_NUMBER and AFTER_SEQUENCE_NUMBER
+	Timestamp      *time.Time // for AT_TIMESTAMP
+}
+
+// ShardReaderFromTrimHorizon is the position of the oldest record of a shard
+func ShardReaderFromTrimHorizon() ShardPosition {
+	return ShardPosition{IteratorType: kinesis.ShardIteratorTypeTrimHorizon}
+}
+
+// ShardReaderFromLatest is the position right after the newest record of a shard
+func ShardReaderFromLatest() ShardPosition {
+	return ShardPosition{IteratorType: kinesis.ShardIteratorTypeLatest}
+}
+
+// ShardReaderFromAtSequenceNumber is the position of the record with the given sequence number
+func ShardReaderFromAtSequenceNumber(sequenceNumber string) ShardPosition {
+	return ShardPosition{IteratorType: kinesis.ShardIteratorTypeAtSequenceNumber, SequenceNumber: sequenceNumber}
+}
+
+// ShardReaderFromAfterSequenceNumber is the position right after the record with the given sequence number
+func ShardReaderFromAfterSequenceNumber(sequenceNumber string) ShardPosition {
+	return ShardPosition{IteratorType: kinesis.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: sequenceNumber}
+}
+
+// ShardReaderFromAtTimestamp is the position of the first record that arrived at or after t
+func ShardReaderFromAtTimestamp(t time.Time) ShardPosition {
+	return ShardPosition{IteratorType: kinesis.ShardIteratorTypeAtTimestamp, Timestamp: &t}
+}
+
+// valid returns whether the position has what its iterator type needs
+func (p ShardPosition) valid() bool {
+	switch p.IteratorType {
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		return p.SequenceNumber != ""
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		return p.Timestamp != nil
+	case kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest:
+		return true
+	}
+	return false
+}
+
+// StartingPositionFunc returns the position a shard starts at, ok is false for the shards starting
+// at their checkpoint or the configured starting point. It is called from multiple go routines.
+type StartingPositionFunc func(shardID string) (position ShardPosition, ok bool)
+
+// ShardReader reads the raw records of a single shard, without taking part in the shard assignment
+// or writing checkpoints. It is not safe for concurrent use.
+type ShardReader struct {
+	ctx      context.Context
+	k        *Kinsumer
+	shardID  string
+	iterator string
+	position ShardPosition // where a new iterator starts, right after the records read so far
+	records  []*kinesis.Record
+	backoff  *backoff
+	closed   bool
+	until    time.Time // Next returns nil once caught up after this time, zero to wait for records forever
+}
+
+// OpenShard returns a ShardReader of the given shard starting at position, to inspect the contents
+// of a shard while debugging. It uses the Config of the Kinsumer for its GetRecords calls, but
+// Run doesn't have to be called, and other clients consuming the shard are not affected.
+func (k *Kinsumer) OpenShard(ctx context.Context, shardID string, position ShardPosition) (*ShardReader, error) {
+	iterator, err := k.getShardIterator(shardID, position)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardReader{
+		ctx:      ctx,
+		k:        k,
+		shardID:  shardID,
+		iterator: iterator,
+		position: position,
+		backoff:  &backoff{policy: k.config.throttleBackoff},
+	}, nil
+}
+
+// Next returns the next record of the shard, waiting for one to be put on the stream if necessary.
+// It returns nil once the end of a closed shard was reached, and the error of the context if it is
+// done first. An iterator that expired while the reader wasn't used is replaced by one right after
+// the last record read.
+func (r *ShardReader) Next() (*Record, error) {
+	for len(r.records) == 0 {
+		if r.closed {
+			return nil, ErrShardReaderClosed
+		}
+		if r.iterator == "" {
+			return nil, nil
+		}
+		if err := r.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		records, next, lag, _, err := getRecords(r.k.kinesis, r.iterator, r.k.config.getRecordsLimit)
+		delay := r.k.config.throttleDelay
+		if isThrottle(err) {
+			delay = r.backoff.throttled(time.Now())
+		} else if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+			if r.iterator, err = r.k.getShardIterator(r.shardID, r.position); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		} else {
+			r.backoff.reset()
+			r.records = records
+			r.iterator = next
+			if len(records) > 0 {
+				r.position = ShardReaderFromAfterSequenceNumber(aws.StringValue(records[len(records)-1].SequenceNumber))
+			}
+			if len(records) == 0 && lag == 0 && !r.until.IsZero() && time.Now().After(r.until) {
+				return nil, nil
+			}
+		}
+
+		if len(r.records) == 0 && r.iterator != "" {
+			select {
+			case <-r.ctx.Done():
+				return nil, r.ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	record := newRecord(r.shardID, r.records[0])
+	r.records = r.records[1:]
+	return record, nil
+}
+
+// Close releases the reader, Next returns ErrShardReaderClosed afterwards
+func (r *ShardReader) Close() error {
+	r.closed = true
+	r.records = nil
+	return nil
+}
+
+// getShardIterator returns an iterator of the shard at position
+func (k *Kinsumer) getShardIterator(shardID string, position ShardPosition) (string, error) {
+	return getShardIterator(
+		k.kinesis,
+		k.streamName,
+		shardID,
+		position.IteratorType,
+		position.SequenceNumber,
+		position.Timestamp,
+	)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// pagedKinesis serves a closed shard whose records come in pages, the iterators being page indexes.
+// The iterator of page expire has expired the first time it is used.
+type pagedKinesis struct {
+	kinesisiface.KinesisAPI
+	pages   [][]string
+	expire  int
+	started *kinesis.GetShardIteratorInput
+}
+
+func (k *pagedKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	k.started = in
+	page := 0
+	if in.StartingSequenceNumber != nil {
+		// Start at the page after the one of the sequence number
+		for i, seqs := range k.pages {
+			for _, seq := range seqs {
+				if seq == aws.StringValue(in.StartingSequenceNumber) {
+					page = i + 1
+				}
+			}
+		}
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(strconv.Itoa(page))}, nil
+}
+
+func (k *pagedKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	page, _ := strconv.Atoi(aws.StringValue(in.ShardIterator))
+	if page == k.expire {
+		k.expire = -1
+		return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "iterator expired", nil)
+	}
+	out := &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}
+	for _, seq := range k.pages[page] {
+		out.Records = append(out.Records, &kinesis.Record{SequenceNumber: aws.String(seq), Data: []byte("data" + seq)})
+	}
+	if page+1 < len(k.pages) {
+		out.NextShardIterator = aws.String(strconv.Itoa(page + 1))
+	}
+	return out, nil
+}
+
+func TestOpenShard(t *testing.T) {
+	kin := &pagedKinesis{KinesisAPI: mocks.NewMockKinesis("stream", nil), pages: [][]string{{"1", "2"}, {}, {"3"}}, expire: 2}
+	config := NewConfig().WithThrottleDelay(minThrottleDelay)
+	k, err := NewWithInterfaces(kin, mocks.NewMockDynamo(nil), "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	reader, err := k.OpenShard(context.Background(), "shard", ShardReaderFromAfterSequenceNumber("0"))
+	require.NoError(t, err)
+	require.Equal(t, kinesis.ShardIteratorTypeAfterSequenceNumber, aws.StringValue(kin.started.ShardIteratorType))
+	require.Equal(t, "0", aws.StringValue(kin.started.StartingSequenceNumber))
+
+	var read []string
+	for {
+		record, err := reader.Next()
+		require.NoError(t, err)
+		if record == nil {
+			break
+		}
+		require.Equal(t, "shard", record.ShardID)
+		require.Equal(t, "data"+record.SequenceNumber, string(record.Data))
+		read = append(read, record.SequenceNumber)
+	}
+	// The iterator that expired was replaced by one after the last record read
+	require.Equal(t, []string{"1", "2", "3"}, read)
+	require.Equal(t, "2", aws.StringValue(kin.started.StartingSequenceNumber))
+
+	require.NoError(t, reader.Close())
+	_, err = reader.Next()
+	require.Equal(t, ErrShardReaderClosed, err)
+
+	// A cancelled context stops the reader
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err = k.OpenShard(ctx, "shard", ShardReaderFromTrimHorizon())
+	require.NoError(t, err)
+	cancel()
+	_, err = reader.Next()
+	require.Equal(t, context.Canceled, err)
+}
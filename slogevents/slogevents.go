@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Twitch Interactive
+
+//go:build go1.21
+// +build go1.21
+
+package slogevents
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/brenol/kinsumer"
+)
+
+// Handler is a kinsumer.EventHandler that writes the events to a slog logger, with the attributes
+// "event" (the type), "client", "shard" when the event is about a shard, and the fields of the event
+type Handler struct {
+	logger *slog.Logger
+}
+
+// New creates a new Handler writing to the given slog logger, or slog.Default() if nil
+func New(logger *slog.Logger) *Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Handler{logger: logger}
+}
+
+// HandleEvent implementation
+func (h *Handler) HandleEvent(event kinsumer.Event) {
+	attrs := []slog.Attr{slog.String("event", string(event.Type)), slog.String("client", event.ClientID)}
+	if event.ShardID != "" {
+		attrs = append(attrs, slog.String("shard", event.ShardID))
+	}
+	names := make([]string, 0, len(event.Fields))
+	for name := range event.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, slog.Any(name, event.Fields[name]))
+	}
+	h.logger.LogAttrs(context.Background(), level(event.Level), event.Message, attrs...)
+}
+
+// level returns the slog level of a kinsumer level
+func level(level kinsumer.Level) slog.Level {
+	switch level {
+	case kinsumer.LevelDebug:
+		return slog.LevelDebug
+	case kinsumer.LevelWarn:
+		return slog.LevelWarn
+	case kinsumer.LevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"time"
+)
+
+// bufferMonitorFrequency is how often the buffer stats are reported and stalls are looked for
+const bufferMonitorFrequency = time.Second
+
+// StallHook is called when records have been waiting in the buffer for longer than the stall
+// threshold without the application draining any, with how long they waited and how many there are
+type StallHook func(stalledFor time.Duration, buffered int)
+
+// stallDetector tells when the records in the buffer have been waiting for too long
+type stallDetector struct {
+	threshold    time.Duration
+	waitingSince time.Time // when the buffer last stopped being empty
+	stalled      bool      // whether the current stall was reported
+}
+
+// check returns how long the buffered records have been waiting, and whether that is a new stall.
+// They wait from the later of when the buffer stopped being empty and the last record drained.
+func (d *stallDetector) check(now time.Time, buffered int, drained time.Time) (time.Duration, bool) {
+	if buffered == 0 {
+		d.waitingSince = time.Time{}
+		d.stalled = false
+		return 0, false
+	}
+	if d.waitingSince.IsZero() {
+		d.waitingSince = now
+	}
+	since := d.waitingSince
+	if drained.After(since) {
+		since = drained
+	}
+
+	waited := now.Sub(since)
+	if waited <= d.threshold {
+		d.stalled = false
+		return waited, false
+	}
+	if d.threshold == 0 || d.stalled {
+		return waited, false
+	}
+	d.stalled = true
+	return waited, true
+}
+
+// monitorBuffer reports how full the buffer is and how long ago the application drained a record,
+// and reports stalls, until stop is closed
+func (k *Kinsumer) monitorBuffer(stop <-chan struct{}) {
+	defer k.recoverPanic("monitorBuffer", "")
+	ticker := time.NewTicker(bufferMonitorFrequency)
+	defer ticker.Stop()
+
+	detector := &stallDetector{threshold: k.config.stallThreshold}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		k.checkBuffer(detector, time.Now())
+	}
+}
+
+// checkBuffer reports the buffer stats, and calls the stall hook when the detector found a new stall
+func (k *Kinsumer) checkBuffer(detector *stallDetector, now time.Time) {
+	k.health.mutex.Lock()
+	records := k.health.records
+	drained := k.health.lastDelivery
+	if k.isDispatching() {
+		// The records are only drained once they were handled
+		drained = k.health.lastHandled
+	}
+	k.health.mutex.Unlock()
+
+	buffered := len(records)
+	stats, ok := k.config.stats.(BufferStatReceiver)
+	if ok {
+		stats.BufferOccupancy(buffered, cap(records))
+	}
+	if shardStats, ok := k.config.stats.(ShardBufferStatReceiver); ok && k.shardBuffers != nil {
+		for shardID, shardBuffered := range k.shardBuffers.occupancy() {
+			shardStats.ShardBufferOccupancy(shardID, shardBuffered, k.config.shardBufferSize)
+		}
+	}
+	if ok {
+		stats.TimeSinceDrained(now.Sub(drained))
+	}
+	waited, stalled := detector.check(now, buffered, drained)
+	if !stalled {
+		return
+	}
+	k.logf(LevelWarn, "monitorBuffer", "", "Consumer stalled, %d records waited %s in the buffer without any being drained",
+		buffered, waited)
+	if hook := k.config.stallHook; hook != nil {
+		hook(waited, buffered)
+	}
+}
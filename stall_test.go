@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bufferStats records the buffer stats
+type bufferStats struct {
+	NoopStatReceiver
+	buffered, capacity int
+	sinceDrained       time.Duration
+	blocked            map[string]time.Duration
+}
+
+func (s *bufferStats) BufferOccupancy(buffered, capacity int) {
+	s.buffered, s.capacity = buffered, capacity
+}
+
+func (s *bufferStats) TimeSinceDrained(elapsed time.Duration) {
+	s.sinceDrained = elapsed
+}
+
+func (s *bufferStats) BufferBlocked(shardID string, blocked time.Duration) {
+	s.blocked[shardID] += blocked
+}
+
+func TestStallDetector(t *testing.T) {
+	d := &stallDetector{threshold: time.Minute}
+	start := time.Now()
+	drained := start.Add(-time.Hour)
+
+	// Idle for an hour, the records that just arrived didn't wait yet
+	_, stalled := d.check(start, 1, drained)
+	require.False(t, stalled)
+	waited, stalled := d.check(start.Add(2*time.Minute), 1, drained)
+	require.True(t, stalled)
+	require.Equal(t, 2*time.Minute, waited)
+	// Reported once per stall
+	_, stalled = d.check(start.Add(3*time.Minute), 5, drained)
+	require.False(t, stalled)
+
+	// Draining a record ends the stall
+	drained = start.Add(3 * time.Minute)
+	_, stalled = d.check(start.Add(3*time.Minute+time.Second), 5, drained)
+	require.False(t, stalled)
+	_, stalled = d.check(start.Add(5*time.Minute), 5, drained)
+	require.True(t, stalled)
+}
+
+func TestCheckBuffer(t *testing.T) {
+	stats := &bufferStats{blocked: make(map[string]time.Duration)}
+	var stalledFor time.Duration
+	var stalledRecords int
+	config := NewConfig().WithStats(stats).WithStallDetection(time.Minute, func(waited time.Duration, buffered int) {
+		stalledFor, stalledRecords = waited, buffered
+	})
+	k := &Kinsumer{config: config, health: &healthMonitor{}}
+	now := time.Now()
+	k.health.setRunning(true, now.Add(-time.Hour))
+	records := make(chan *consumedRecord, 4)
+	records <- testConsumedRecord("1")
+	records <- testConsumedRecord("2")
+	k.health.setBuffer(records)
+
+	detector := &stallDetector{threshold: k.config.stallThreshold}
+	k.checkBuffer(detector, now)
+	require.Equal(t, 2, stats.buffered)
+	require.Equal(t, 4, stats.capacity)
+	require.Equal(t, time.Hour, stats.sinceDrained)
+	require.Zero(t, stalledRecords)
+
+	k.checkBuffer(detector, now.Add(2*time.Minute))
+	require.Equal(t, 2*time.Minute, stalledFor)
+	require.Equal(t, 2, stalledRecords)
+}
+
+func TestBufferBlocked(t *testing.T) {
+	stats := &bufferStats{blocked: make(map[string]time.Duration)}
+	k := &Kinsumer{
+		records: make(chan *consumedRecord, 1),
+		config:  NewConfig().WithStats(stats),
+		stop:    make(chan struct{}),
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	// Only waiting for room is reported
+	require.True(t, k.bufferRecord(testConsumedRecord("1"), ticker, &backoff{}))
+	require.Empty(t, stats.blocked)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-k.records
+	}()
+	require.True(t, k.bufferRecord(testConsumedRecord("2"), ticker, &backoff{}))
+	require.True(t, stats.blocked["shard"] >= 10*time.Millisecond)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// stateVersion is the version of the format written by ExportState
+const stateVersion = 1
+
+// unimportedMetadataKeys are the metadata items describing the running clients, the stream or the
+// region they run in rather than the state of the application, which ImportState doesn't restore
+var unimportedMetadataKeys = map[string]bool{
+	leaderKey:            true,
+	shardCacheKey:        true,
+	clientsGenerationKey: true,
+	migrationKey:         true,
+	homeRegionKey:        true,
+	streamEndpointKey:    true,
+	fanOutConsumerKey:    true,
+	runKey:               true,
+}
+
+// exportedState is the state of an application written by ExportState, with the items of its
+// tables in the DynamoDB JSON of the AWS CLI
+type exportedState struct {
+	Version int
+	// Stream and tables the state was exported from
+	Stream           string
+	CheckpointsTable string
+	MetadataTable    string
+	ExportedAt       time.Time
+	Checkpoints      []map[string]*stateValue
+	Metadata         []map[string]*stateValue
+}
+
+// stateValue is a dynamodb attribute value encoded with only its type set
+type stateValue struct {
+	S    *string                `json:",omitempty"`
+	N    *string                `json:",omitempty"`
+	B    []byte                 `json:",omitempty"`
+	BOOL *bool                  `json:",omitempty"`
+	NULL *bool                  `json:",omitempty"`
+	SS   []*string              `json:",omitempty"`
+	NS   []*string              `json:",omitempty"`
+	BS   [][]byte               `json:",omitempty"`
+	M    map[string]*stateValue `json:",omitempty"`
+	L    []*stateValue          `json:",omitempty"`
+
+	// Empty maps and lists are attributes too
+	emptyM bool
+	emptyL bool
+}
+
+func (v *stateValue) MarshalJSON() ([]byte, error) {
+	type value stateValue
+	switch {
+	case v.emptyM:
+		return []byte(`{"M":{}}`), nil
+	case v.emptyL:
+		return []byte(`{"L":[]}`), nil
+	}
+	return json.Marshal((*value)(v))
+}
+
+func (v *stateValue) UnmarshalJSON(data []byte) error {
+	type value stateValue
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, (*value)(v)); err != nil {
+		return err
+	}
+	v.emptyM = raw["M"] != nil && len(v.M) == 0
+	v.emptyL = raw["L"] != nil && len(v.L) == 0
+	return nil
+}
+
+// newStateValue returns the state value of a dynamodb attribute value
+func newStateValue(attr *dynamodb.AttributeValue) *stateValue {
+	v := &stateValue{S: attr.S, N: attr.N, B: attr.B, BOOL: attr.BOOL, NULL: attr.NULL, SS: attr.SS, NS: attr.NS, BS: attr.BS}
+	if attr.M != nil {
+		v.M = newStateItem(attr.M)
+		v.emptyM = len(attr.M) == 0
+	}
+	if attr.L != nil {
+		v.L = make([]*stateValue, len(attr.L))
+		for i, elem := range attr.L {
+			v.L[i] = newStateValue(elem)
+		}
+		v.emptyL = len(attr.L) == 0
+	}
+	return v
+}
+
+// attributeValue returns the dynamodb attribute value of the state value
+func (v *stateValue) attributeValue() *dynamodb.AttributeValue {
+	attr := &dynamodb.AttributeValue{S: v.S, N: v.N, B: v.B, BOOL: v.BOOL, NULL: v.NULL, SS: v.SS, NS: v.NS, BS: v.BS}
+	if v.M != nil || v.emptyM {
+		attr.M = stateAttributes(v.M)
+	}
+	if v.L != nil || v.emptyL {
+		attr.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, elem := range v.L {
+			attr.L[i] = elem.attributeValue()
+		}
+	}
+	return attr
+}
+
+// newStateItem returns the state values of the attributes of a dynamodb item
+func newStateItem(attrs map[string]*dynamodb.AttributeValue) map[string]*stateValue {
+	values := make(map[string]*stateValue, len(attrs))
+	for name, attr := range attrs {
+		values[name] = newStateValue(attr)
+	}
+	return values
+}
+
+// stateAttributes returns the dynamodb attributes of the state values of an item
+func stateAttributes(values map[string]*stateValue) map[string]*dynamodb.AttributeValue {
+	attrs := make(map[string]*dynamodb.AttributeValue, len(values))
+	for name, value := range values {
+		attrs[name] = value.attributeValue()
+	}
+	return attrs
+}
+
+// scanItems returns all the items of the given table
+func scanItems(db dynamodbiface.DynamoDBAPI, tableName string) ([]map[string]*stateValue, error) {
+	items := []map[string]*stateValue{}
+	err := db.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	}, func(p *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, attrs := range p.Items {
+			items = append(items, newStateItem(attrs))
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning table %s: %v", tableName, err)
+	}
+	return items, nil
+}
+
+// ExportState writes the checkpoints and metadata tables of the application to w as JSON, for
+// restoring them with ImportState in a disaster recovery or in another application, such as a copy
+// of the application in a staging environment. The clients table isn't exported. The tables are
+// scanned one after the other, so checkpoints written meanwhile may be exported or not.
+func (k *Kinsumer) ExportState(w io.Writer) error {
+	state := exportedState{
+		Version:          stateVersion,
+		Stream:           k.streamName,
+		CheckpointsTable: k.checkpointTableName,
+		MetadataTable:    k.metadataTableName,
+		ExportedAt:       time.Now().UTC(),
+	}
+	var err error
+	if state.Checkpoints, err = scanItems(k.dynamodb, k.checkpointTableName); err != nil {
+		return err
+	}
+	if state.Metadata, err = scanItems(k.dynamodb, k.metadataTableName); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&state)
+}
+
+// ImportState writes the checkpoints and metadata exported by ExportState into the tables of the
+// application, which must exist, overwriting the items with the same keys and leaving the others.
+// The imported shards are owned by no client, and the leader lease, caches and migration of the
+// exported application aren't imported. It fails with ErrImportWithClients if clients of the
+// application are running, as they would overwrite the imported checkpoints.
+func (k *Kinsumer) ImportState(r io.Reader) error {
+	var state exportedState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidState, state.Version)
+	}
+	for _, checkpoint := range state.Checkpoints {
+		if checkpoint["Shard"] == nil || checkpoint["Shard"].S == nil {
+			return fmt.Errorf("%w: checkpoint without shard", ErrInvalidState)
+		}
+	}
+	for _, metadata := range state.Metadata {
+		if metadata["Key"] == nil || metadata["Key"].S == nil {
+			return fmt.Errorf("%w: metadata without key", ErrInvalidState)
+		}
+	}
+
+	clients, err := getClients(k.dynamodb, k.clientName, k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return fmt.Errorf("error loading clients: %v", err)
+	}
+	if len(clients) > 0 {
+		return fmt.Errorf("%w: %d clients", ErrImportWithClients, len(clients))
+	}
+
+	for _, checkpoint := range state.Checkpoints {
+		delete(checkpoint, "OwnerID")
+		delete(checkpoint, "OwnerName")
+		if err := k.importItem(k.checkpointTableName, checkpoint); err != nil {
+			return fmt.Errorf("error importing the checkpoint of shard %s: %v", *checkpoint["Shard"].S, err)
+		}
+	}
+	for _, metadata := range state.Metadata {
+		key := *metadata["Key"].S
+		if unimportedMetadataKeys[key] {
+			continue
+		}
+		if err := k.importItem(k.metadataTableName, metadata); err != nil {
+			return fmt.Errorf("error importing metadata %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// importItem writes an imported item in the given table
+func (k *Kinsumer) importItem(tableName string, values map[string]*stateValue) error {
+	_, err := k.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      stateAttributes(values),
+	})
+	return err
+}
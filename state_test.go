@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportState(t *testing.T) {
+	db := mocks.NewMockDynamo([]string{"app_checkpoints", "app_metadata", "app_clients"})
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", NewConfig())
+	require.NoError(t, err)
+
+	finished := int64(1600000000000000000)
+	checkpoints := []checkpointRecord{
+		{Shard: "shard0", SequenceNumber: aws.String("100"), LastUpdate: 1, OwnerID: aws.String("owner"), OwnerName: aws.String("name"),
+			Metadata: []byte{0, 1, 2}, LeaseToken: 3, Throughput: &shardThroughput{}},
+		{Shard: "shard1", SequenceNumber: aws.String("200"), LastUpdate: 2, Finished: &finished},
+	}
+	for _, checkpoint := range checkpoints {
+		item, err := dynamodbattribute.MarshalMap(checkpoint)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("app_checkpoints"), Item: item})
+		require.NoError(t, err)
+	}
+	bookmark, err := dynamodbattribute.MarshalMap(bookmarkRecord{
+		Key:             bookmarkKeyPrefix + "before-deploy",
+		SequenceNumbers: map[string]string{"shard0": "50"},
+	})
+	require.NoError(t, err)
+	for _, item := range []map[string]*dynamodb.AttributeValue{
+		bookmark,
+		{"Key": {S: aws.String(bookmarkKeyPrefix + "empty")}, "SequenceNumbers": {M: map[string]*dynamodb.AttributeValue{}}},
+		{"Key": {S: aws.String(leaderKey)}, "ID": {S: aws.String("owner")}},
+		{"Key": {S: aws.String(homeRegionKey)}, "Region": {S: aws.String("us-east-1")}},
+		{"Key": {S: aws.String(streamEndpointKey)}, "Index": {N: aws.String("1")}},
+		{"Key": {S: aws.String(fanOutConsumerKey)}, "ConsumerARN": {S: aws.String("arn:consumer")}},
+	} {
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("app_metadata"), Item: item})
+		require.NoError(t, err)
+	}
+
+	var exported bytes.Buffer
+	require.NoError(t, k.ExportState(&exported))
+	require.Contains(t, exported.String(), `"CheckpointsTable": "app_checkpoints"`)
+
+	// The state is cloned into another application
+	staging := mocks.NewMockDynamo([]string{"staging_checkpoints", "staging_metadata", "staging_clients"})
+	clone, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), staging, "stream", "staging", "client", NewConfig())
+	require.NoError(t, err)
+	require.NoError(t, clone.ImportState(bytes.NewReader(exported.Bytes())))
+
+	imported, err := loadCheckpoints(staging, "staging_checkpoints")
+	require.NoError(t, err)
+	require.Len(t, imported, 2)
+	// The shards are free for the clients of the application
+	owned := checkpoints[0]
+	owned.OwnerID, owned.OwnerName = nil, nil
+	require.Equal(t, &owned, imported["shard0"])
+	require.Equal(t, &checkpoints[1], imported["shard1"])
+
+	var keys []string
+	err = staging.ScanPages(&dynamodb.ScanInput{TableName: aws.String("staging_metadata")}, func(p *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range p.Items {
+			keys = append(keys, aws.StringValue(item["Key"].S))
+			if aws.StringValue(item["Key"].S) == bookmarkKeyPrefix+"empty" {
+				require.NotNil(t, item["SequenceNumbers"].M, "empty maps are imported")
+			}
+		}
+		return true
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{bookmarkKeyPrefix + "before-deploy", bookmarkKeyPrefix + "empty"}, keys,
+		"the leader lease, home region, stream endpoint and fan-out consumer aren't imported")
+
+	// Nor is it imported while clients run
+	_, err = registerWithClientsTable(staging, clone.clientRecord(), clone.clientsTableName, clone.maxAgeForClientRecord)
+	require.NoError(t, err)
+	err = clone.ImportState(bytes.NewReader(exported.Bytes()))
+	require.True(t, errors.Is(err, ErrImportWithClients))
+
+	err = clone.ImportState(strings.NewReader(`{"Version": 2}`))
+	require.True(t, errors.Is(err, ErrInvalidState))
+}
@@ -10,6 +10,9 @@ import "time"
 //
 // The methods will get called from multiple go routines and it is
 // the implementors responsibility to handle thread synchronization
+//
+// The stats added since are in optional interfaces, such as KeyStatReceiver, whose methods are
+// called when the StatReceiver implements them. NoopStatReceiver implements all of them.
 type StatReceiver interface {
 	// Dynamo operations
 
@@ -28,3 +31,128 @@ type StatReceiver interface {
 	// `lag` How far the records are from the tip of the stream.
 	EventsFromKinesis(num int, shardID string, lag time.Duration)
 }
+
+// KeyStatReceiver is a StatReceiver also receiving the throughput of every key, when a KeyExtractor
+// has been configured.
+type KeyStatReceiver interface {
+	// EventsForKey is called for every key found in a bunch of records retrieved from
+	// kinesis, when a KeyExtractor has been configured.
+	// `num` Number of records retrieved for the key.
+	// `size` Total size in bytes of the data of those records.
+	// `key` Key returned by the KeyExtractor.
+	EventsForKey(num int, size int, key string)
+}
+
+// OverflowStatReceiver is a StatReceiver also receiving the records dropped when the buffer
+// overflows.
+type OverflowStatReceiver interface {
+	// EventsDropped is called every time records are dropped from the buffer to make
+	// room for new ones, when the buffer overflow policy is to drop the oldest records.
+	// `num` Number of records dropped.
+	// `shardID` ID of the shard that the records were retrieved from
+	EventsDropped(num int, shardID string)
+}
+
+// IteratorStatReceiver is a StatReceiver also receiving the shard iterators that expired.
+type IteratorStatReceiver interface {
+	// IteratorExpired is called every time the shard iterator of a shard expired before
+	// it was used, and a new one was fetched at the last sequence number read.
+	// `shardID` ID of the shard whose iterator expired
+	IteratorExpired(shardID string)
+}
+
+// ThrottleStatReceiver is a StatReceiver also receiving the requests to kinesis or dynamo that were
+// throttled.
+type ThrottleStatReceiver interface {
+	// Throttled is called every time a request to kinesis or dynamo was throttled.
+	// `operation` What kinsumer was doing, such as getRecords or checkpointer.commit.
+	// `delay` How long kinsumer backs off before trying again.
+	Throttled(operation string, delay time.Duration)
+}
+
+// DeadLetterStatReceiver is a StatReceiver also receiving the records sent to the dead-letter sink.
+type DeadLetterStatReceiver interface {
+	// DeadLettered is called every time a record is sent to the dead-letter sink after
+	// failing too many times.
+	// `shardID` ID of the shard that the record was retrieved from
+	DeadLettered(shardID string)
+}
+
+// DecompressionStatReceiver is a StatReceiver also receiving the records that failed to decompress.
+type DecompressionStatReceiver interface {
+	// DecompressionFailed is called every time the data of a record fails to decompress or is
+	// larger than the decompression limit, before the corrupt record policy is applied.
+	// `shardID` ID of the shard that the record was retrieved from
+	DecompressionFailed(shardID string)
+}
+
+// RecoveryStatReceiver is a StatReceiver also receiving where the shards were resumed from.
+type RecoveryStatReceiver interface {
+	// ShardRecovered is called once per shard captured, after its first GetRecords call.
+	// `shardID` ID of the shard captured
+	// `checkpointAge` How long before the capture its checkpoint was last written, 0 if it had none
+	// `backlog` How far behind the tip of the stream the shard was
+	ShardRecovered(shardID string, checkpointAge, backlog time.Duration)
+}
+
+// DeduplicationStatReceiver is a StatReceiver also receiving the records that were deduplicated.
+type DeduplicationStatReceiver interface {
+	// Deduplicated is called every time a record isn't returned because it was already
+	// returned within the deduplication window.
+	// `shardID` ID of the shard that the record was retrieved from
+	Deduplicated(shardID string)
+}
+
+// CheckpointFallbackStatReceiver is a StatReceiver also receiving the checkpoints that expired.
+type CheckpointFallbackStatReceiver interface {
+	// CheckpointExpired is called every time the checkpointed sequence number of a shard was no
+	// longer in the stream, and the shard was started at the expired checkpoint fallback.
+	// `shardID` ID of the shard whose checkpoint expired
+	CheckpointExpired(shardID string)
+}
+
+// FailoverStatReceiver is a StatReceiver also receiving the failovers between copies of the stream.
+type FailoverStatReceiver interface {
+	// StreamFailedOver is called every time the clients failed over to another copy of the stream.
+	// `streamName` Name of the stream consumed from now on
+	// `region` Region of that stream, empty for the stream given to New
+	StreamFailedOver(streamName, region string)
+}
+
+// BufferStatReceiver is a StatReceiver also receiving the occupancy of the buffer, and how long the
+// application and the shard workers waited on each other.
+type BufferStatReceiver interface {
+	// BufferOccupancy is called every second while kinsumer is running.
+	// `buffered` Number of records waiting in the buffer for the application
+	// `capacity` Size of the buffer
+	BufferOccupancy(buffered, capacity int)
+
+	// TimeSinceDrained is called every second while kinsumer is running.
+	// `elapsed` Time since the application last took a record with Next() or finished
+	// one with Dispatch
+	TimeSinceDrained(elapsed time.Duration)
+
+	// BufferBlocked is called every time a shard worker had to wait for room in the full
+	// buffer, when the buffer overflow policy is to block.
+	// `shardID` ID of the shard whose worker waited
+	// `blocked` How long it waited
+	BufferBlocked(shardID string, blocked time.Duration)
+}
+
+// CorruptRecordStatReceiver is a StatReceiver also receiving the records found corrupt.
+type CorruptRecordStatReceiver interface {
+	// CorruptRecord is called every time a record fails the record validator or to decompress,
+	// before the corrupt record policy is applied.
+	// `shardID` ID of the shard that the record was retrieved from
+	CorruptRecord(shardID string)
+}
+
+// ShardBufferStatReceiver is a StatReceiver also receiving the occupancy of the shard buffers.
+type ShardBufferStatReceiver interface {
+	// ShardBufferOccupancy is called every second for every shard while kinsumer is
+	// running with shard buffers.
+	// `shardID` ID of the shard whose buffer it is
+	// `buffered` Number of records in the buffer of the shard
+	// `capacity` Size of the buffer of the shard
+	ShardBufferOccupancy(shardID string, buffered, capacity int)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// checkpointStats is a StatReceiver only counting the checkpoints
+type checkpointStats struct {
+	checkpoints int
+}
+
+func (s *checkpointStats) Checkpoint() {
+	s.checkpoints++
+}
+
+func (s *checkpointStats) EventToClient(inserted, retrieved time.Time) {}
+
+func (s *checkpointStats) EventsFromKinesis(num int, shardID string, lag time.Duration) {}
+
+func TestOptionalStatReceivers(t *testing.T) {
+	// NoopStatReceiver is a base for the receivers collecting a subset of the stats
+	var stats StatReceiver = &NoopStatReceiver{}
+	require.Implements(t, (*KeyStatReceiver)(nil), stats)
+	require.Implements(t, (*OverflowStatReceiver)(nil), stats)
+	require.Implements(t, (*IteratorStatReceiver)(nil), stats)
+	require.Implements(t, (*ThrottleStatReceiver)(nil), stats)
+	require.Implements(t, (*DeadLetterStatReceiver)(nil), stats)
+	require.Implements(t, (*DecompressionStatReceiver)(nil), stats)
+	require.Implements(t, (*RecoveryStatReceiver)(nil), stats)
+	require.Implements(t, (*DeduplicationStatReceiver)(nil), stats)
+	require.Implements(t, (*CheckpointFallbackStatReceiver)(nil), stats)
+	require.Implements(t, (*FailoverStatReceiver)(nil), stats)
+	require.Implements(t, (*BufferStatReceiver)(nil), stats)
+	require.Implements(t, (*CorruptRecordStatReceiver)(nil), stats)
+	require.Implements(t, (*ShardBufferStatReceiver)(nil), stats)
+
+	// The receivers written before them still build, and are only given the stats they take
+	config := NewConfig().WithStats(&checkpointStats{})
+	require.NoError(t, config.Validate())
+	k := &Kinsumer{config: config, health: &healthMonitor{}}
+	k.throttled("getRecords", "shard", time.Second)
+	k.checkBuffer(&stallDetector{}, time.Now())
+}
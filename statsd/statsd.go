@@ -54,3 +54,98 @@ func (s *Statsd) EventsFromKinesis(num int, shardID string, lag time.Duration) {
 	_ = s.client.TimingDuration(fmt.Sprintf("kinsumer.%s.lag", shardID), lag, 1.0)
 	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.retrieved", shardID), int64(num), 1.0)
 }
+
+// EventsForKey implementation that writes to statsd metrics about records that
+// were retrieved from kinesis for a single key
+func (s *Statsd) EventsForKey(num int, size int, key string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.key.%s.retrieved", key), int64(num), 1.0)
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.key.%s.bytes", key), int64(size), 1.0)
+}
+
+// BufferOccupancy implementation that writes to statsd gauges of how full the
+// buffer is
+func (s *Statsd) BufferOccupancy(buffered, capacity int) {
+	_ = s.client.Gauge("kinsumer.buffer.records", int64(buffered), 1.0)
+	_ = s.client.Gauge("kinsumer.buffer.capacity", int64(capacity), 1.0)
+}
+
+// TimeSinceDrained implementation that writes to statsd metrics about how long
+// ago the application took or finished a record
+func (s *Statsd) TimeSinceDrained(elapsed time.Duration) {
+	_ = s.client.TimingDuration("kinsumer.buffer.since_drained", elapsed, 1.0)
+}
+
+// ShardBufferOccupancy implementation that writes to statsd gauges of how full the
+// buffer of a shard is
+func (s *Statsd) ShardBufferOccupancy(shardID string, buffered, capacity int) {
+	_ = s.client.Gauge(fmt.Sprintf("kinsumer.%s.buffer.records", shardID), int64(buffered), 1.0)
+	_ = s.client.Gauge(fmt.Sprintf("kinsumer.%s.buffer.capacity", shardID), int64(capacity), 1.0)
+}
+
+// BufferBlocked implementation that writes to statsd metrics about how long the
+// shard workers waited for room in the buffer
+func (s *Statsd) BufferBlocked(shardID string, blocked time.Duration) {
+	_ = s.client.TimingDuration(fmt.Sprintf("kinsumer.%s.buffer_blocked", shardID), blocked, 1.0)
+}
+
+// EventsDropped implementation that writes to statsd metrics about records that
+// were dropped from the buffer
+func (s *Statsd) EventsDropped(num int, shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.dropped", shardID), int64(num), 1.0)
+}
+
+// IteratorExpired implementation that writes to statsd metrics about shard
+// iterators that expired before they were used
+func (s *Statsd) IteratorExpired(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.iterator_expired", shardID), 1, 1.0)
+}
+
+// CheckpointExpired implementation that writes to statsd metrics about shards
+// started at the fallback because their checkpoint was no longer in the stream
+func (s *Statsd) CheckpointExpired(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.checkpoint_expired", shardID), 1, 1.0)
+}
+
+// StreamFailedOver implementation that writes to statsd metrics about the clients
+// failing over to another copy of the stream
+func (s *Statsd) StreamFailedOver(streamName, region string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.stream_failover", streamName), 1, 1.0)
+}
+
+// Throttled implementation that writes to statsd metrics about requests that
+// were throttled and how long we backed off
+func (s *Statsd) Throttled(operation string, delay time.Duration) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.throttled.%s", operation), 1, 1.0)
+	_ = s.client.TimingDuration(fmt.Sprintf("kinsumer.throttled.%s.backoff", operation), delay, 1.0)
+}
+
+// DeadLettered implementation that writes to statsd metrics about records sent
+// to the dead-letter sink
+func (s *Statsd) DeadLettered(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.dead_lettered", shardID), 1, 1.0)
+}
+
+// DecompressionFailed implementation that writes to statsd metrics about records
+// whose data failed to decompress
+func (s *Statsd) DecompressionFailed(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.decompression_failed", shardID), 1, 1.0)
+}
+
+// CorruptRecord implementation that writes to statsd metrics about records failing
+// the record validator
+func (s *Statsd) CorruptRecord(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.corrupt_record", shardID), 1, 1.0)
+}
+
+// ShardRecovered implementation that writes to statsd metrics about how far behind a
+// shard was when it was captured
+func (s *Statsd) ShardRecovered(shardID string, checkpointAge, backlog time.Duration) {
+	_ = s.client.TimingDuration(fmt.Sprintf("kinsumer.%s.recovered.checkpoint_age", shardID), checkpointAge, 1.0)
+	_ = s.client.TimingDuration(fmt.Sprintf("kinsumer.%s.recovered.backlog", shardID), backlog, 1.0)
+}
+
+// Deduplicated implementation that writes to statsd metrics about records
+// skipped because they were already returned
+func (s *Statsd) Deduplicated(shardID string) {
+	_ = s.client.Inc(fmt.Sprintf("kinsumer.%s.deduplicated", shardID), 1, 1.0)
+}
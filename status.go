@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ClientStatus is a client of the application registered in the clients table
+type ClientStatus struct {
+	ID   string
+	Name string
+	// Last heartbeat of the client
+	LastUpdate time.Time
+	// Metadata the client registered, see WithAvailabilityZone and WithClientMetadata
+	Zone     string
+	Hostname string
+	Version  string
+	Labels   map[string]string
+	// Shards the client owns the checkpoints of
+	Shards []string
+}
+
+// Status is the state of all the clients of the application, as registered in the tables
+type Status struct {
+	Clients []ClientStatus
+	// Unfinished shards owned by none of the clients, until a client captures them
+	UnownedShards []string
+}
+
+// Status returns the clients of the application that heartbeated recently along with their
+// metadata and the shards they own, whether this Kinsumer is running or not
+func (k *Kinsumer) Status() (*Status, error) {
+	clients, err := getClients(k.dynamodb, k.clientName, k.clientsTableName, k.maxAgeForClientRecord)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints, err := loadCheckpoints(k.dynamodb, k.checkpointTableName)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{Clients: make([]ClientStatus, len(clients))}
+	byID := make(map[string]*ClientStatus, len(clients))
+	for i, c := range clients {
+		status.Clients[i] = ClientStatus{
+			ID:         c.ID,
+			Name:       c.Name,
+			LastUpdate: time.Unix(0, c.LastUpdate),
+			Zone:       c.Zone,
+			Hostname:   c.Hostname,
+			Version:    c.Version,
+			Labels:     c.Labels,
+		}
+		byID[c.ID] = &status.Clients[i]
+	}
+	for shardID, checkpoint := range checkpoints {
+		if checkpoint.Finished != nil {
+			continue
+		}
+		if owner, ok := byID[aws.StringValue(checkpoint.OwnerID)]; ok {
+			owner.Shards = append(owner.Shards, shardID)
+		} else {
+			status.UnownedShards = append(status.UnownedShards, shardID)
+		}
+	}
+	for _, c := range status.Clients {
+		sort.Strings(c.Shards)
+	}
+	sort.Strings(status.UnownedShards)
+	return status, nil
+}
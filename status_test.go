@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	db := mocks.NewMockDynamo([]string{"app_clients", "app_checkpoints"})
+	config := NewConfig().WithAvailabilityZone("us-west-2a").WithClientMetadata(ClientMetadata{
+		Version: "1.2.3",
+		Labels:  map[string]string{"cluster": "blue"},
+	})
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+	require.NotEmpty(t, k.config.clientMetadata.Hostname, "the hostname of the machine by default")
+
+	_, err = registerWithClientsTable(db, k.clientRecord(), k.clientsTableName, k.maxAgeForClientRecord)
+	require.NoError(t, err)
+	_, err = registerWithClientsTable(db, clientRecord{ID: "other", Name: "other"}, k.clientsTableName, k.maxAgeForClientRecord)
+	require.NoError(t, err)
+	// A client gone for longer than the expiry isn't listed, nor are the shards it owned
+	gone, err := dynamodbattribute.MarshalMap(clientRecord{ID: "gone", LastUpdate: time.Now().Add(-time.Hour).UnixNano()})
+	require.NoError(t, err)
+	_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(k.clientsTableName), Item: gone})
+	require.NoError(t, err)
+
+	finished := time.Now().UnixNano()
+	for _, checkpoint := range []checkpointRecord{
+		{Shard: "shard2", OwnerID: aws.String(k.clientID())},
+		{Shard: "shard0", OwnerID: aws.String(k.clientID())},
+		{Shard: "shard1", OwnerID: aws.String("other")},
+		{Shard: "shard3", OwnerID: aws.String("gone")},
+		{Shard: "shard4"},
+		{Shard: "shard5", OwnerID: aws.String("other"), Finished: &finished},
+	} {
+		item, err := dynamodbattribute.MarshalMap(checkpoint)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(k.checkpointTableName), Item: item})
+		require.NoError(t, err)
+	}
+
+	status, err := k.Status()
+	require.NoError(t, err)
+	require.Len(t, status.Clients, 2)
+	var ours, other ClientStatus
+	for _, c := range status.Clients {
+		if c.ID == k.clientID() {
+			ours = c
+		} else {
+			other = c
+		}
+	}
+	require.Equal(t, "client", ours.Name)
+	require.Equal(t, "us-west-2a", ours.Zone)
+	require.Equal(t, k.config.clientMetadata.Hostname, ours.Hostname)
+	require.Equal(t, "1.2.3", ours.Version)
+	require.Equal(t, map[string]string{"cluster": "blue"}, ours.Labels)
+	require.WithinDuration(t, time.Now(), ours.LastUpdate, time.Minute)
+	require.Equal(t, []string{"shard0", "shard2"}, ours.Shards)
+
+	require.Equal(t, "other", other.ID)
+	require.Empty(t, other.Hostname)
+	require.Nil(t, other.Labels)
+	require.Equal(t, []string{"shard1"}, other.Shards)
+	require.Equal(t, []string{"shard3", "shard4"}, status.UnownedShards)
+}
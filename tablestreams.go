@@ -0,0 +1,199 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+// tableWatcher follows the dynamodb stream of one of our tables, looking for changes that
+// should make the clients refresh their shards immediately.
+type tableWatcher struct {
+	streams   dynamodbstreamsiface.DynamoDBStreamsAPI
+	streamArn string
+	iterators map[string]string // shard iterators by dynamodb stream shard ID
+	seen      map[string]bool   // stream shards we already have, or had, an iterator for
+	refresh   bool              // whether the list of stream shards must be refreshed
+	relevant  func(record *dynamodbstreams.Record) bool
+}
+
+// newTableWatcher returns a watcher of the stream of the given table, which must have streams enabled
+func newTableWatcher(
+	db dynamodbiface.DynamoDBAPI,
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI,
+	tableName string,
+	relevant func(record *dynamodbstreams.Record) bool,
+) (*tableWatcher, error) {
+	out, err := db.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing table %s: %v", tableName, err)
+	}
+	streamArn := aws.StringValue(out.Table.LatestStreamArn)
+	if streamArn == "" {
+		return nil, fmt.Errorf("table %s does not have streams enabled", tableName)
+	}
+
+	return &tableWatcher{
+		streams:   streams,
+		streamArn: streamArn,
+		iterators: make(map[string]string),
+		seen:      make(map[string]bool),
+		refresh:   true,
+		relevant:  relevant,
+	}, nil
+}
+
+// refreshShards gets an iterator for every open stream shard we don't follow yet. The first time
+// we start from the latest record, afterwards new shards are read from the start so that no changes
+// are missed when the stream rotates its shards.
+func (w *tableWatcher) refreshShards() error {
+	iteratorType := dynamodbstreams.ShardIteratorTypeTrimHorizon
+	if len(w.seen) == 0 {
+		iteratorType = dynamodbstreams.ShardIteratorTypeLatest
+	}
+
+	current := make(map[string]bool)
+	var startShardID *string
+	for {
+		out, err := w.streams.DescribeStream(&dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(w.streamArn),
+			ExclusiveStartShardId: startShardID,
+		})
+		if err != nil {
+			return fmt.Errorf("error describing table stream: %v", err)
+		}
+
+		for _, shard := range out.StreamDescription.Shards {
+			shardID := aws.StringValue(shard.ShardId)
+			current[shardID] = true
+			open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+			if w.seen[shardID] || !open {
+				continue
+			}
+			it, err := w.streams.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         aws.String(w.streamArn),
+				ShardId:           aws.String(shardID),
+				ShardIteratorType: aws.String(iteratorType),
+			})
+			if err != nil {
+				return fmt.Errorf("error getting table stream shard iterator: %v", err)
+			}
+			w.iterators[shardID] = aws.StringValue(it.ShardIterator)
+			w.seen[shardID] = true
+		}
+
+		startShardID = out.StreamDescription.LastEvaluatedShardId
+		if startShardID == nil {
+			break
+		}
+	}
+
+	// Forget about shards that have been trimmed from the stream
+	for shardID := range w.seen {
+		if !current[shardID] {
+			delete(w.seen, shardID)
+		}
+	}
+	w.refresh = false
+	return nil
+}
+
+// poll reads the new records of every stream shard we follow, returning whether any of them was relevant
+func (w *tableWatcher) poll() (bool, error) {
+	if w.refresh {
+		if err := w.refreshShards(); err != nil {
+			return false, err
+		}
+	}
+
+	changed := false
+	for shardID, iterator := range w.iterators {
+		out, err := w.streams.GetRecords(&dynamodbstreams.GetRecordsInput{
+			ShardIterator: aws.String(iterator),
+		})
+		if err != nil {
+			// Start over from the latest records, the periodic shard check covers anything we miss
+			w.iterators = make(map[string]string)
+			w.seen = make(map[string]bool)
+			w.refresh = true
+			return changed, fmt.Errorf("error getting table stream records: %v", err)
+		}
+
+		for _, record := range out.Records {
+			if w.relevant(record) {
+				changed = true
+			}
+		}
+
+		if out.NextShardIterator == nil {
+			// The shard was closed, and its children need to be picked up
+			delete(w.iterators, shardID)
+			w.refresh = true
+		} else {
+			w.iterators[shardID] = aws.StringValue(out.NextShardIterator)
+		}
+	}
+	return changed, nil
+}
+
+// clientsTableChange returns whether a clients table change record is a client joining or leaving,
+// as opposed to a client refreshing its registration.
+func clientsTableChange(record *dynamodbstreams.Record) bool {
+	eventName := aws.StringValue(record.EventName)
+	return eventName == dynamodbstreams.OperationTypeInsert || eventName == dynamodbstreams.OperationTypeRemove
+}
+
+// metadataTableChange returns whether a metadata table change record is an update of the shard cache
+func metadataTableChange(record *dynamodbstreams.Record) bool {
+	if record.Dynamodb == nil {
+		return false
+	}
+	key, ok := record.Dynamodb.Keys["Key"]
+	return ok && aws.StringValue(key.S) == shardCacheKey
+}
+
+// watchTables follows the streams of the clients and metadata tables until stop is closed,
+// requesting a refresh whenever the clients or the shard cache changed.
+func (k *Kinsumer) watchTables(stop <-chan struct{}) {
+	defer k.recoverPanic("watchTables", "")
+	clients, err := newTableWatcher(k.dynamodb, k.config.dynamoStreams, k.clientsTableName, clientsTableChange)
+	if err != nil {
+		k.reportError("watchTables", "", fmt.Errorf("error watching clients table: %v", err))
+		return
+	}
+	metadata, err := newTableWatcher(k.dynamodb, k.config.dynamoStreams, k.metadataTableName, metadataTableChange)
+	if err != nil {
+		k.reportError("watchTables", "", fmt.Errorf("error watching metadata table: %v", err))
+		return
+	}
+
+	ticker := time.NewTicker(k.config.tableStreamsPollFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, w := range []*tableWatcher{clients, metadata} {
+			changed, err := w.poll()
+			if err != nil {
+				k.logf(LevelWarn, "watchTables", "", "Error watching table stream: %s", err)
+			}
+			if changed {
+				k.requestRefresh()
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableChanges(t *testing.T) {
+	event := func(name, key string) *dynamodbstreams.Record {
+		return &dynamodbstreams.Record{
+			EventName: aws.String(name),
+			Dynamodb: &dynamodbstreams.StreamRecord{
+				Keys: map[string]*dynamodb.AttributeValue{
+					"Key": {S: aws.String(key)},
+				},
+			},
+		}
+	}
+
+	require.True(t, clientsTableChange(event(dynamodbstreams.OperationTypeInsert, "")))
+	require.True(t, clientsTableChange(event(dynamodbstreams.OperationTypeRemove, "")))
+	require.False(t, clientsTableChange(event(dynamodbstreams.OperationTypeModify, "")))
+
+	require.True(t, metadataTableChange(event(dynamodbstreams.OperationTypeModify, shardCacheKey)))
+	require.False(t, metadataTableChange(event(dynamodbstreams.OperationTypeModify, leaderKey)))
+	require.False(t, metadataTableChange(&dynamodbstreams.Record{}))
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// deliveryTrace follows a sampled record through kinsumer, from the moment it is fetched from
+// kinesis to the moment a checkpoint covering it is written to dynamo
+type deliveryTrace struct {
+	id             uint64
+	shardID        string
+	sequenceNumber string
+	fetchedAt      time.Time
+}
+
+// newDeliveryTrace returns a trace for one record of every Config.WithDeliveryTracing records
+// fetched, or nil if the record isn't sampled
+func (k *Kinsumer) newDeliveryTrace(shardID string, record *kinesis.Record, fetchedAt time.Time) *deliveryTrace {
+	if k.config.deliveryTracing == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&k.deliveries, 1)
+	if n%uint64(k.config.deliveryTracing) != 0 {
+		return nil
+	}
+	t := &deliveryTrace{
+		id:             n,
+		shardID:        shardID,
+		sequenceNumber: aws.StringValue(record.SequenceNumber),
+		fetchedAt:      fetchedAt,
+	}
+	t.log(k.config.logger, "fetched", fetchedAt)
+	return t
+}
+
+// log logs that the traced record reached the given stage of its delivery
+func (t *deliveryTrace) log(logger Logger, stage string, at time.Time) {
+	if t == nil {
+		return
+	}
+	logf(logger, LevelDebug, []interface{}{"op", "trace", "shard", t.shardID},
+		"Delivery %d (shard %s, sequence number %s) %s at %s, %s after being fetched",
+		t.id, t.shardID, t.sequenceNumber, stage, at.UTC().Format(time.RFC3339Nano), at.Sub(t.fetchedAt))
+}
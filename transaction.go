@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CommitTransaction writes the given items and the checkpoint of the record's shard, at the record,
+// in a single dynamo transaction, so the output of processing a record is written if and only if
+// the record is checkpointed. It is meant to be used with Config.WithTransactionalCheckpoints, so
+// the checkpoints only move with the transactions, giving effectively-once processing to pipelines
+// writing to dynamo. Returns ErrShardNotOwned if this client doesn't own the shard anymore, and
+// ErrCheckpointOwnershipLost if another client captured it before the transaction, in which case
+// none of the items are written, and ErrUnknownRecord for a record that wasn't returned by NextRecord.
+func (k *Kinsumer) CommitTransaction(record *Record, items []*dynamodb.TransactWriteItem) error {
+	if record == nil || record.consumed == nil {
+		return ErrUnknownRecord
+	}
+	cp := record.consumed.checkpointer
+	if !cp.isCaptured() {
+		return ErrShardNotOwned
+	}
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	// Put the checkpointer back as it was if the transaction fails, the items weren't written
+	sequenceNumber, dirty, skipAfter, skipTo := cp.sequenceNumber, cp.dirty, cp.skipAfter, cp.skipTo
+	if sequenceNumberLess(cp.sequenceNumber, record.SequenceNumber) {
+		cp.setSequenceNumber(record.SequenceNumber)
+	}
+	_, err := cp.write(func(put *dynamodb.PutItemInput) error {
+		return k.transactWithCheckpoint(items, put)
+	})
+	if err != nil {
+		cp.sequenceNumber, cp.dirty, cp.skipAfter, cp.skipTo = sequenceNumber, dirty, skipAfter, skipTo
+		return err
+	}
+	return nil
+}
+
+// transactWithCheckpoint writes the items and the conditional put of a checkpoint in a transaction.
+// The transaction failing the checkpoint's condition fails like the put alone would.
+func (k *Kinsumer) transactWithCheckpoint(items []*dynamodb.TransactWriteItem, put *dynamodb.PutItemInput) error {
+	transactItems := make([]*dynamodb.TransactWriteItem, 0, len(items)+1)
+	transactItems = append(transactItems, items...)
+	transactItems = append(transactItems, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+		TableName:                 put.TableName,
+		Item:                      put.Item,
+		ConditionExpression:       put.ConditionExpression,
+		ExpressionAttributeValues: put.ExpressionAttributeValues,
+	}})
+
+	_, err := k.dynamodb.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) == len(transactItems) &&
+		aws.StringValue(canceled.CancellationReasons[len(items)].Code) == "ConditionalCheckFailed" {
+		return awserr.New(conditionalFail, canceled.Message(), err)
+	}
+	return err
+}
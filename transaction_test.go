@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// transactDynamo records the transactions written, failing them with the given cancellation reasons
+type transactDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	transactions [][]*dynamodb.TransactWriteItem
+	reasons      []string
+}
+
+func (d *transactDynamo) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if d.reasons != nil {
+		canceled := &dynamodb.TransactionCanceledException{Message_: aws.String("canceled")}
+		for _, code := range d.reasons {
+			canceled.CancellationReasons = append(canceled.CancellationReasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return nil, canceled
+	}
+	d.transactions = append(d.transactions, in.TransactItems)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestCommitTransaction(t *testing.T) {
+	db := &transactDynamo{DynamoDBAPI: mocks.NewMockDynamo([]string{"app_checkpoints"})}
+	config := NewConfig().WithTransactionalCheckpoints()
+	k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), db, "stream", "app", "client", config)
+	require.NoError(t, err)
+
+	cp, err := capture("shard", k.checkpointTableName, k.dynamodb, "client", k.clientID(), time.Minute, 0, k.config.stats)
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	record := func(sequenceNumber string) *Record {
+		return &Record{
+			ShardID:        "shard",
+			SequenceNumber: sequenceNumber,
+			consumed: &consumedRecord{
+				record:       &kinesis.Record{SequenceNumber: aws.String(sequenceNumber)},
+				checkpointer: cp,
+			},
+		}
+	}
+	output := &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+		TableName: aws.String("output"),
+		Item:      map[string]*dynamodb.AttributeValue{"ID": {S: aws.String("1")}},
+	}}
+
+	require.NoError(t, k.CommitTransaction(record("1"), []*dynamodb.TransactWriteItem{output}))
+	require.Len(t, db.transactions, 1)
+	items := db.transactions[0]
+	require.Len(t, items, 2)
+	require.Equal(t, output, items[0])
+	require.Equal(t, "app_checkpoints", aws.StringValue(items[1].Put.TableName))
+	require.Equal(t, "1", aws.StringValue(items[1].Put.Item["SequenceNumber"].S))
+	require.Equal(t, "OwnerID = :ownerID AND LeaseToken = :leaseToken", aws.StringValue(items[1].Put.ConditionExpression))
+	require.Equal(t, "1", cp.currentSequenceNumber())
+
+	// A transaction failing the checkpoint's condition means another client owns the shard
+	db.reasons = []string{"None", "ConditionalCheckFailed"}
+	err = k.CommitTransaction(record("2"), []*dynamodb.TransactWriteItem{output})
+	require.Equal(t, ErrCheckpointOwnershipLost, err)
+	require.Equal(t, "1", cp.currentSequenceNumber(), "the checkpoint didn't move")
+
+	// Failing the application's conditions is returned as is
+	db.reasons = []string{"ConditionalCheckFailed", "None"}
+	err = k.CommitTransaction(record("2"), []*dynamodb.TransactWriteItem{output})
+	require.Error(t, err)
+	require.NotEqual(t, ErrCheckpointOwnershipLost, err)
+
+	// Records that weren't returned by NextRecord have no checkpoint to commit
+	require.Equal(t, ErrUnknownRecord, k.CommitTransaction(nil, []*dynamodb.TransactWriteItem{output}))
+	require.Equal(t, ErrUnknownRecord, k.CommitTransaction(&Record{ShardID: "shard", SequenceNumber: "3"}, nil))
+	require.Len(t, db.transactions, 1)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// A RecordValidator checks a record in the shard worker before it is buffered, such as its checksum,
+// schema or size, returning an error if it is corrupt. It must not modify the record, and is called
+// from multiple go routines.
+type RecordValidator func(record *Record) error
+
+// corruptRecordPolicy is what the shard consumers do with the records failing the record validator
+// or to decompress
+type corruptRecordPolicy int
+
+const (
+	// corruptRecordHalt stops consuming the shard at the corrupt record, keeping it captured
+	corruptRecordHalt corruptRecordPolicy = iota
+	// corruptRecordSkip checkpoints past the corrupt record without returning it
+	corruptRecordSkip
+	// corruptRecordDeadLetter sends the corrupt record to the dead-letter sink, then skips it
+	corruptRecordDeadLetter
+)
+
+// validateRecord runs the record validator on a record, recovering its panics, and applies the
+// corrupt record policy if it fails. Returns whether the record should be buffered, and false for
+// ok if the consumer should stop.
+func (k *Kinsumer) validateRecord(cp *checkpointer, lastBuffered string, record *kinesis.Record,
+	commitTicker *time.Ticker, commitBackoff *backoff) (valid, ok bool) {
+	r := newRecord(cp.shardID, record)
+	err := runValidator(k.config.recordValidator, r)
+	if err == nil {
+		return true, true
+	}
+	return false, k.corruptRecord(cp, lastBuffered, r, err, commitTicker, commitBackoff)
+}
+
+// corruptRecord applies the corrupt record policy to a record that failed the record validator or
+// to decompress. Returns false if the consumer should stop.
+func (k *Kinsumer) corruptRecord(cp *checkpointer, lastBuffered string, r *Record, err error,
+	commitTicker *time.Ticker, commitBackoff *backoff) bool {
+	err = k.redactError(err)
+	if stats, ok := k.config.stats.(CorruptRecordStatReceiver); ok {
+		stats.CorruptRecord(cp.shardID)
+	}
+	switch k.config.corruptRecordPolicy {
+	case corruptRecordSkip:
+		k.logf(LevelWarn, "validateRecord", cp.shardID, "Skipping corrupt record %s of shard %s: %s",
+			r.SequenceNumber, cp.shardID, err)
+	case corruptRecordDeadLetter:
+		if !k.deadLetterCorruptRecord(cp, r, err, commitTicker, commitBackoff) {
+			return false
+		}
+	default:
+		k.logf(LevelError, "validateRecord", cp.shardID, "Halting shard %s at corrupt record %s: %s",
+			cp.shardID, r.SequenceNumber, err)
+		k.shardErrors <- shardConsumerError{shardID: cp.shardID, action: "validateRecord",
+			err: fmt.Errorf("%w at record %s: %v", ErrCorruptRecord, r.SequenceNumber, err)}
+		k.waitHalted(cp, commitTicker, commitBackoff)
+		return false
+	}
+	// Checkpoint past it once the records buffered before it are acked
+	cp.skip(lastBuffered, r.SequenceNumber)
+	return true
+}
+
+// runValidator calls the validator, turning its panics into errors so a record crashing it can't
+// crash the consumer
+func runValidator(validator RecordValidator, record *Record) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("record validator panicked: %v", r)
+		}
+	}()
+	return validator(record)
+}
+
+// deadLetterCorruptRecord sends a corrupt record to the dead-letter sink, trying it again every
+// throttle delay until it succeeds, committing the checkpoint while it waits. Returns false if the
+// consumer should stop.
+func (k *Kinsumer) deadLetterCorruptRecord(cp *checkpointer, record *Record, cause error,
+	commitTicker *time.Ticker, commitBackoff *backoff) bool {
+	for {
+		err := k.config.deadLetterSink.SendDeadLetter(record, cause)
+		if err == nil {
+			if stats, ok := k.config.stats.(DeadLetterStatReceiver); ok {
+				stats.DeadLettered(cp.shardID)
+			}
+			k.logf(LevelWarn, "deadLetter", cp.shardID, "Sent corrupt record %s of shard %s to the dead-letter sink: %s",
+				record.SequenceNumber, cp.shardID, cause)
+			return true
+		}
+		k.logf(LevelError, "deadLetter", cp.shardID, "Error sending corrupt record %s of shard %s to the dead-letter sink, trying it again: %s",
+			record.SequenceNumber, cp.shardID, err)
+		if !k.waitForShardRateLimit(cp, k.config.throttleDelay, commitTicker, commitBackoff) {
+			return false
+		}
+	}
+}
+
+// waitHalted keeps a halted shard captured, committing the checkpoint of the records buffered
+// before the corrupt one, until the consumer stops or the commit fails
+func (k *Kinsumer) waitHalted(cp *checkpointer, commitTicker *time.Ticker, commitBackoff *backoff) {
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-commitTicker.C:
+			finishCommitted, err := k.commitCheckpoint(cp, commitBackoff)
+			if err != nil {
+				k.shardErrors <- shardConsumerError{shardID: cp.shardID, action: "checkpointer.commit", err: err}
+				return
+			}
+			if finishCommitted {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package kinsumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/brenol/kinsumer/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordValidator(t *testing.T) {
+	validator := func(record *Record) error {
+		switch string(record.Data) {
+		case "corrupt":
+			return errors.New("bad checksum")
+		case "crash":
+			panic("unexpected schema")
+		}
+		return nil
+	}
+	var dead []*Record
+	sink := DeadLetterFunc(func(record *Record, cause error) error {
+		dead = append(dead, record)
+		return nil
+	})
+	newConsumer := func(config Config) *Kinsumer {
+		k, err := NewWithInterfaces(mocks.NewMockKinesis("stream", nil), mocks.NewMockDynamo(nil), "stream", "app", "client",
+			config.WithLogger(&recordingLogger{}).WithRecordValidator(validator).WithDeadLetterSink(sink, 1))
+		require.NoError(t, err)
+		k.stop = make(chan struct{})
+		return k
+	}
+	record := func(seq, data string) *kinesis.Record {
+		return &kinesis.Record{SequenceNumber: aws.String(seq), Data: []byte(data)}
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	// Valid records are buffered
+	k := newConsumer(NewConfig().WithCorruptRecordSkip())
+	commitBackoff := &backoff{policy: k.config.throttleBackoff}
+	cp := &checkpointer{shardID: "shard", captured: true}
+	valid, ok := k.validateRecord(cp, "", record("1", "good"), ticker, commitBackoff)
+	require.True(t, valid)
+	require.True(t, ok)
+
+	// Corrupt records are checkpointed past, even when the validator panics
+	for _, data := range []string{"corrupt", "crash"} {
+		valid, ok = k.validateRecord(cp, "", record("2", data), ticker, commitBackoff)
+		require.False(t, valid)
+		require.True(t, ok)
+		require.Equal(t, "2", cp.checkpointedSequenceNumber())
+	}
+
+	// Or sent to the dead-letter sink first
+	k = newConsumer(NewConfig().WithCorruptRecordDeadLetter())
+	valid, ok = k.validateRecord(cp, "", record("3", "corrupt"), ticker, commitBackoff)
+	require.False(t, valid)
+	require.True(t, ok)
+	require.Len(t, dead, 1)
+	require.Equal(t, "3", dead[0].SequenceNumber)
+	require.Equal(t, "3", cp.checkpointedSequenceNumber())
+
+	// Or halt the shard, without moving the checkpoint, until the consumer stops
+	k = newConsumer(NewConfig())
+	close(k.stop)
+	valid, ok = k.validateRecord(cp, "", record("4", "corrupt"), ticker, commitBackoff)
+	require.False(t, valid)
+	require.False(t, ok)
+	require.Equal(t, "3", cp.checkpointedSequenceNumber())
+	se := <-k.shardErrors
+	require.True(t, errors.Is(se.err, ErrCorruptRecord))
+
+	config := NewConfig().WithCorruptRecordDeadLetter()
+	require.True(t, errors.Is(validateConfig(&config), ErrConfigInvalidCorruptRecordPolicy))
+}
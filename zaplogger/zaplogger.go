@@ -0,0 +1,39 @@
+// Copyright (c) 2016 Twitch Interactive
+
+package zaplogger
+
+import (
+	"fmt"
+
+	"github.com/brenol/kinsumer"
+	"go.uber.org/zap"
+)
+
+// Logger is a kinsumer.StructuredLogger that writes to a zap logger
+type Logger struct {
+	logger *zap.SugaredLogger
+}
+
+// New creates a new Logger writing to the given zap logger
+func New(logger *zap.Logger) *Logger {
+	return &Logger{logger: logger.Sugar()}
+}
+
+// Log implementation, logging at the info level
+func (l *Logger) Log(format string, v ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
+
+// LogFields implementation
+func (l *Logger) LogFields(level kinsumer.Level, msg string, keysAndValues ...interface{}) {
+	switch level {
+	case kinsumer.LevelDebug:
+		l.logger.Debugw(msg, keysAndValues...)
+	case kinsumer.LevelWarn:
+		l.logger.Warnw(msg, keysAndValues...)
+	case kinsumer.LevelError:
+		l.logger.Errorw(msg, keysAndValues...)
+	default:
+		l.logger.Infow(msg, keysAndValues...)
+	}
+}